@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	runNote   string
+	runLabels []string
+)
+
+// addAnnotationFlags adds the run annotation flags to a command that collects
+func addAnnotationFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&runNote, "note", "", "Save this note with the collection, e.g. the deployment it verifies; shown in reports and history")
+	cmd.Flags().StringArrayVar(&runLabels, "label", nil, "Save this key=value label with the collection; repeatable")
+}
+
+// applyAnnotation checks --label and sets the annotation of the next collection
+func applyAnnotation() error {
+	labels, err := config.ParseLabels(runLabels)
+	if err != nil {
+		return err
+	}
+	collect.Annotation = config.RunAnnotation{Note: runNote, Labels: labels}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/ack"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newAckCmd() *cobra.Command {
+	ackCmd := &cobra.Command{
+		Use:   "ack",
+		Short: "Acknowledge known, accepted differences so analyses list them apart instead of as drift",
+	}
+
+	var servers []string
+	var note string
+	addCmd := &cobra.Command{
+		Use:   "add <file>...",
+		Short: "Acknowledge the differences of files, given as paths or glob patterns (e.g. /etc/ssh/ssh_host_*)",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := ack.Load(outputDir)
+			if err != nil {
+				return err
+			}
+			for _, p := range args {
+				replaced, err := store.Add(ack.Entry{Path: p, Servers: servers, Note: note})
+				if err != nil {
+					return err
+				}
+				if replaced {
+					log.Infof("Updated the acknowledgement of %s", ack.CleanPath(p))
+				} else {
+					log.Infof("Acknowledged %s", ack.CleanPath(p))
+				}
+			}
+			return store.Save()
+		},
+	}
+	addCmd.Flags().StringSliceVar(&servers, "servers", nil, "Only acknowledge differences of these servers' copies (comma-separated); others still count as drift")
+	addCmd.Flags().StringVar(&note, "note", "", "Why the difference is expected")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the acknowledged differences",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := ack.Load(outputDir)
+			if err != nil {
+				return err
+			}
+			if len(store.Acks) == 0 {
+				fmt.Printf("No acknowledged differences in %s\n", store.Path())
+				return nil
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "PATH\tSERVERS\tEXACT\tADDED\tNOTE")
+			for _, e := range store.Acks {
+				exact := "no"
+				if e.Fingerprint != "" {
+					exact = "yes"
+				}
+				servers := "any"
+				if len(e.Servers) > 0 {
+					servers = strings.Join(e.Servers, ",")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Path, servers, exact, e.Added.Format("2006-01-02 15:04"), orDash(e.Note))
+			}
+			return tw.Flush()
+		},
+	}
+
+	removeCmd := &cobra.Command{
+		Use:   "remove <file>...",
+		Short: "Withdraw the acknowledgements of files, given as they were added",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := ack.Load(outputDir)
+			if err != nil {
+				return err
+			}
+			for _, p := range args {
+				if store.Remove(p) == 0 {
+					return fmt.Errorf("%s is not acknowledged in %s", ack.CleanPath(p), store.Path())
+				}
+				log.Infof("Withdrew the acknowledgement of %s", ack.CleanPath(p))
+			}
+			return store.Save()
+		},
+	}
+
+	ackCmd.AddCommand(addCmd, listCmd, removeCmd)
+	return ackCmd
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/bundle"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bundleRedact         bool
+	bundleRedactPatterns []string
+	bundleRunID          string
+	bundleForce          bool
+)
+
+func newExportBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export-bundle [run-<id>.tar.zst]",
+		Short: "Package config, manifest, collected files and saved diffs into one archive",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := bundleRunID
+			if id == "" {
+				id = bundle.NewRunID()
+			}
+			bundlePath := bundle.DefaultBundleName(id)
+			if len(args) == 1 {
+				bundlePath = args[0]
+			}
+			meta, err := bundle.Export(outputDir, bundlePath, bundle.ExportOptions{
+				ID:             id,
+				DiffDir:        diffDir,
+				Redact:         bundleRedact,
+				RedactPatterns: bundleRedactPatterns,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Exported run %s to %s\n", meta.ID, bundlePath)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&bundleRunID, "run-id", "", "Run ID to record in the bundle (default: current timestamp)")
+	cmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory of saved diffs to include as reports")
+	cmd.Flags().BoolVar(&bundleRedact, "redact", false, "Redact secrets (password/token/key values, private keys) from collected files")
+	cmd.Flags().StringSliceVar(&bundleRedactPatterns, "redact-pattern", nil, "Additional regex whose matches mark a line for redaction (implies nothing without --redact)")
+	return cmd
+}
+
+func newImportBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import-bundle <bundle>",
+		Short: "Load an exported bundle into the output directory for offline analysis",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			meta, err := bundle.Import(args[0], outputDir, bundleForce)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Imported run %s (%d servers, created %s, redacted=%v) into %s\n",
+				meta.ID, len(meta.Servers), meta.CreatedAt.Format("2006-01-02 15:04:05"), meta.Redacted, outputDir)
+			fmt.Println("Run 'analyze' with the same --output-dir to compare the imported files.")
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&bundleForce, "force", false, "Replace collected files and a differing configuration already present in the output directory")
+	return cmd
+}
+
+func newCompareBundlesCmd() *cobra.Command {
+	var keepWorkDir bool
+	cmd := &cobra.Command{
+		Use:   "compare-bundles <a.tar.zst> <b.tar.zst>",
+		Short: "Compare two exported bundles offline (each server against its own earlier/later copy)",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !report.ValidFormat(outputFormat) {
+				return fmt.Errorf("unknown output format %q", outputFormat)
+			}
+			workDir, err := os.MkdirTemp("", "remote-diff-bundles-*")
+			if err != nil {
+				return errors.Wrap(err, "failed to create working directory")
+			}
+			if keepWorkDir {
+				log.Infof("Keeping extracted bundles in %s", workDir)
+			} else {
+				defer os.RemoveAll(workDir)
+			}
+
+			rep, err := bundle.Compare(args[0], args[1], workDir, analysisOptions())
+			if rep == nil {
+				return err
+			}
+			if writeErr := report.Write(os.Stdout, rep, outputFormat); writeErr != nil {
+				return writeErr
+			}
+			if err != nil {
+				return err
+			}
+			setExitStatus(rep)
+			if rep.HasDifferences() {
+				log.Warn("Bundle comparison finished: Differences found.")
+			} else {
+				log.Info("Bundle comparison finished: No differences found.")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&saveDiffs, "save-diffs", false, "Save diff outputs to files")
+	cmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory to store diff files")
+	cmd.Flags().IntVar(&maxInlineLines, "max-inline-diff-lines", defaultMaxInlineLines, "Write diffs longer than this many lines to --diff-dir and only point to them (0 prints every diff)")
+	cmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	cmd.Flags().StringVar(&outputFormat, "format", report.FormatText, "Output format for comparison results (text, json, yaml, junit, sarif, matrix, html)")
+	addExitCodeFlags(cmd)
+	addComparisonFlags(cmd)
+	cmd.Flags().BoolVar(&keepWorkDir, "keep", false, "Keep the extracted bundles instead of deleting them afterwards")
+	return cmd
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newCleanCmd() *cobra.Command {
+	var remote, dryRun bool
+	var logAge, remoteAge time.Duration
+	cmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Remove collected files, saved diffs and old logs, and with --remote what failed collections left on the servers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if logAge < 0 || remoteAge < 0 {
+				return fmt.Errorf("--logs-older-than and --remote-older-than can't be negative")
+			}
+			verb := "Removed"
+			if dryRun {
+				verb = "Would remove"
+			}
+
+			paths := []string{
+				filepath.Join(outputDir, config.CollectedFilesBaseDir),
+				filepath.Join(outputDir, collect.RemoteCompareDir),
+				diffDir,
+			}
+			logs, err := oldLogs(logAge)
+			if err != nil {
+				return err
+			}
+			for _, p := range append(paths, logs...) {
+				if _, err := os.Lstat(p); os.IsNotExist(err) {
+					continue
+				}
+				if !dryRun {
+					if err := os.RemoveAll(p); err != nil {
+						return errors.Wrapf(err, "failed to remove %s", p)
+					}
+				}
+				log.Infof("%s %s", verb, p)
+				fmt.Printf("%s %s\n", verb, p)
+			}
+
+			if !remote {
+				return nil
+			}
+			cfg, cleanup, err := loadCollectionConfig(false)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			failed := 0
+			for _, result := range collect.CleanRemote(cfg, maxConcurrency, remoteAge, dryRun) {
+				for _, p := range result.Removed {
+					fmt.Printf("%s %s:%s\n", verb, result.Server, p)
+				}
+				if result.Err != nil {
+					log.Errorf("[%s] Cleanup failed: %v", result.Server, result.Err)
+					fmt.Fprintf(os.Stderr, "%s: %v\n", result.Server, result.Err)
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("remote cleanup failed on %d of %d server(s)", failed, len(cfg.Servers))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&remote, "remote", false, "Also connect to the servers and remove the copies, tarballs and temporary files of failed collections")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only list what would be removed")
+	cmd.Flags().DurationVar(&logAge, "logs-older-than", 7*24*time.Hour, "Remove the log files in logs/ last written more than this long ago (0 = all but this run's)")
+	cmd.Flags().DurationVar(&remoteAge, "remote-older-than", time.Hour, "Only remove remote leftovers last changed more than this long ago, so running collections aren't disturbed")
+	cmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory of saved diffs to remove")
+	cmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Comma-separated list of server hostnames to clean with --remote (default: those of config.json)")
+	return cmd
+}
+
+// oldLogs returns the default log files last written before age ago,
+// except the one of this run
+func oldLogs(age time.Duration) ([]string, error) {
+	entries, err := os.ReadDir("logs")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to list the log files")
+	}
+	cutoff := time.Now().Add(-age)
+	var logs []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "remote_diff_") || !strings.HasSuffix(e.Name(), ".log") {
+			continue
+		}
+		p := filepath.Join("logs", e.Name())
+		info, err := e.Info()
+		if err != nil || p == currentLogFile || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		logs = append(logs, p)
+	}
+	return logs, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/events"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	eventsURL     string
+	eventsSubject string
+)
+
+// addEventFlags adds the event publishing flags to a command that collects or analyzes
+func addEventFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&eventsURL, "events", "", "Publish collection, analysis and finding events to this broker: nats://[user:pass@]host[:4222] or kafka+http(s)://rest-proxy:8082")
+	cmd.Flags().StringVar(&eventsSubject, "events-subject", events.DefaultSubject, "Subject prefix (NATS) or topic (Kafka) of the events")
+}
+
+// eventTarget returns the broker to publish to, or nil if none is set
+func eventTarget() (*events.Target, error) {
+	if eventsURL == "" {
+		return nil, nil
+	}
+	t, err := events.ParseTarget(eventsURL, eventsSubject)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// publishCollection publishes the completion of a collection into dir
+func publishCollection(cfg *config.Config, dir string, success bool) error {
+	t, err := eventTarget()
+	if t == nil {
+		return err
+	}
+	manifest, err := config.LoadManifest(dir)
+	if err != nil {
+		log.Warnf("Publishing the collection without file counts: %v", err)
+		manifest = nil
+	}
+	return events.Publish(*t, []events.Event{events.CollectionEvent(dir, cfg.Servers, success, manifest)})
+}
+
+// publishAnalysis publishes the findings and completion of an analysis of dir
+func publishAnalysis(rep *report.Report, dir string) error {
+	t, err := eventTarget()
+	if t == nil {
+		return err
+	}
+	return events.Publish(*t, events.AnalysisEvents(dir, rep))
+}
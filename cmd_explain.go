@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/ack"
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/ignore"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/snapshot"
+	"github.com/brndnsvr/remote-diff-tool/internal/timeline"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func newExplainCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "explain <path>",
+		Short: "Show everything known about one file: each server's copy, its history in the snapshots, the rules that apply to it and its diffs",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfigForAnalysis(outputDir)
+			if err != nil {
+				return err
+			}
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				return err
+			}
+			p := ack.CleanPath(args[0])
+			servers := manifestServers(manifest)
+			found := false
+			for _, server := range servers {
+				if _, ok := manifest.FilesByServer[server][p]; ok {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s is not in the manifest (see 'show files')", args[0])
+			}
+
+			fmt.Printf("File: %s\n", p)
+			fmt.Println("\n=== Copies ===")
+			if err := writeFileTable(os.Stdout, manifest, servers, p); err != nil {
+				return err
+			}
+
+			fmt.Println("\n=== History ===")
+			if err := explainHistory(p, manifest); err != nil {
+				return err
+			}
+
+			fmt.Println("\n=== Rules ===")
+			if err := explainRules(cfg, p); err != nil {
+				return err
+			}
+
+			fmt.Println("\n=== Comparison ===")
+			opts := analysisOptions()
+			opts.Paths = []string{p}
+			opts.IgnoreAcks = true // Looked up below, to say which entry covers it
+			opts.MaxInlineLines = 0
+			opts.SaveDiffs = false
+			rep, err := analyze.Analyze(cfg, outputDir, opts)
+			if rep == nil {
+				return fmt.Errorf("analysis failed: %w", err)
+			}
+			return explainResults(rep, p)
+		},
+	}
+	addComparisonFlags(cmd)
+	return cmd
+}
+
+// explainHistory lists the snapshots in which a server's copy of p changed,
+// with the timeline events since the snapshot before
+func explainHistory(p string, current *config.Manifest) error {
+	ids, err := snapshot.List(outputDir)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fmt.Println("No snapshots (collect with --snapshot to keep the history of each file)")
+		return nil
+	}
+	events, err := timeline.List(outputDir)
+	if err != nil {
+		return err
+	}
+
+	var prev map[string]string
+	var prevTime time.Time
+	changes := 0
+	show := func(label string, manifest *config.Manifest, at time.Time) {
+		states := copyStates(p, manifest)
+		if prev == nil {
+			fmt.Printf("%-16s first snapshot: %s\n", label, describeStates(states))
+			prev, prevTime = states, at
+			return
+		}
+		var changed []string
+		for _, server := range sortedKeys(unionKeys(prev, states)) {
+			if prev[server] != states[server] {
+				changed = append(changed, fmt.Sprintf("%s %s -> %s", server, orDash(prev[server]), orDash(states[server])))
+			}
+		}
+		if len(changed) > 0 {
+			changes++
+			fmt.Printf("%-16s %s\n", label, strings.Join(changed, ", "))
+			if !at.IsZero() {
+				for _, e := range timeline.Between(events, prevTime, at, nil) {
+					fmt.Printf("%-16s   after %s\n", "", e)
+				}
+			}
+		}
+		prev = states
+		if !at.IsZero() {
+			prevTime = at
+		}
+	}
+	for _, id := range ids {
+		manifest, err := config.LoadManifest(snapshot.Path(outputDir, id))
+		if err != nil {
+			return errors.Wrapf(err, "failed to load snapshot %s", id)
+		}
+		at, err := snapshot.Time(id)
+		if err != nil {
+			return err
+		}
+		show(id, manifest, at)
+	}
+	show("current", current, time.Time{})
+	if changes == 0 {
+		fmt.Printf("Unchanged in %d snapshot(s) and the current collection\n", len(ids))
+	}
+	return nil
+}
+
+// copyStates describes each server's copy of p in a manifest: its short
+// checksum, "missing" or "error"
+func copyStates(p string, manifest *config.Manifest) map[string]string {
+	states := make(map[string]string)
+	for server, files := range manifest.FilesByServer {
+		info, ok := files[p]
+		switch {
+		case !ok:
+		case info.Error == config.MissingOnRemote:
+			states[server] = "missing"
+		case info.Error != "":
+			states[server] = "error"
+		default:
+			states[server] = truncate(info.Checksum, shortChecksum)
+		}
+	}
+	return states
+}
+
+// describeStates lists the servers by copy, e.g. "1a2b3c4d5e6f on web1, web2"
+func describeStates(states map[string]string) string {
+	byState := make(map[string][]string)
+	for _, server := range sortedKeys(states) {
+		byState[states[server]] = append(byState[states[server]], server)
+	}
+	var parts []string
+	for _, state := range sortedKeys(byState) {
+		parts = append(parts, fmt.Sprintf("%s on %s", state, strings.Join(byState[state], ", ")))
+	}
+	if len(parts) == 0 {
+		return "not collected"
+	}
+	return strings.Join(parts, "; ")
+}
+
+func unionKeys(a, b map[string]string) map[string]bool {
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// explainRules lists the collection patterns, ignore rules and
+// normalizations that apply to p
+func explainRules(cfg *config.Config, p string) error {
+	logical := "/" + p
+	if config.IsHomePath(p) {
+		logical = p
+	}
+	filter, err := cfg.PathFilter()
+	if err != nil {
+		return errors.Wrap(err, "invalid exclude/include patterns")
+	}
+	if !filter.Keep(logical) {
+		fmt.Println("Excluded by the exclude/include patterns of the config, so not compared")
+	}
+
+	rules, err := ignore.Load(outputDir)
+	if err != nil {
+		return err
+	}
+	printed := 0
+	if matched := rules.PathRules(p); len(matched) > 0 {
+		verdict := "ignored"
+		if !rules.IgnoresPath(p) {
+			verdict = "re-included"
+		}
+		fmt.Printf("%s: %s by %s\n", ignore.FileName, verdict, strings.Join(matched, ", "))
+		printed++
+	}
+	for _, re := range rules.LineRules() {
+		fmt.Printf("%s: lines matching %s are ignored\n", ignore.FileName, re)
+		printed++
+	}
+	for _, re := range cfg.IgnoreLines {
+		fmt.Printf("ignore_lines: lines matching %s are ignored\n", re)
+		printed++
+	}
+	for _, entry := range pathEntries(cfg.PathIgnoreLines, logical) {
+		fmt.Printf("path_ignore_lines[%s]: lines matching %s are ignored\n", entry[0], entry[1])
+		printed++
+	}
+	normalize, err := cfg.PathNormalizeRules()
+	if err != nil {
+		return err
+	}
+	for _, entry := range pathEntries(normalize, logical) {
+		fmt.Printf("normalize[%s]: %s\n", entry[0], entry[1])
+		printed++
+	}
+	unique, err := cfg.UniquePatterns()
+	if err != nil {
+		return err
+	}
+	if m := analyze.UniqueMatch(unique, p); m != nil {
+		fmt.Printf("unique[%s]: expected to differ between servers, so differences aren't drift\n", m)
+		printed++
+	}
+	if printed == 0 && filter.Keep(logical) {
+		fmt.Println("No ignore or normalization rules apply")
+	}
+	return nil
+}
+
+// pathEntries returns the rules of the configured paths logical is at or
+// below, as (configured path, rule) pairs
+func pathEntries(byPath map[string][]string, logical string) [][2]string {
+	var entries [][2]string
+	for _, configured := range sortedKeys(byPath) {
+		if logical == configured || strings.HasPrefix(logical, strings.TrimSuffix(configured, "/")+"/") {
+			for _, rule := range byPath[configured] {
+				entries = append(entries, [2]string{configured, rule})
+			}
+		}
+	}
+	return entries
+}
+
+// explainResults prints the comparison of p: which servers are out of line,
+// whether it's acknowledged, and its diffs
+func explainResults(rep *report.Report, p string) error {
+	var results []report.FileResult
+	for _, f := range rep.Files {
+		if f.Path == p {
+			results = append(results, f)
+		}
+	}
+	if len(results) == 0 {
+		fmt.Println("Not compared (see Rules)")
+		return nil
+	}
+	acks, err := ack.Load(outputDir)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Server < results[j].Server })
+	for _, f := range results {
+		fmt.Printf("Status: %s", f.Status)
+		if c := f.Category(); c != "" {
+			fmt.Printf(" (%s)", c)
+		}
+		fmt.Println()
+		if f.Expected {
+			fmt.Println("Expected to differ (unique in the config)")
+		}
+		if drifted := f.DriftedServers(rep.Servers); len(drifted) > 0 {
+			fmt.Printf("Out of line: %s (severity %d)\n", strings.Join(drifted, ", "), f.Severity())
+		}
+		if f.Drifting() {
+			if e := acks.Covering(f, rep.Servers); e != nil {
+				fmt.Printf("Acknowledged in %s by %s", ack.FileName, e.Path)
+				if e.Note != "" {
+					fmt.Printf(" (%s)", e.Note)
+				}
+				fmt.Println()
+			}
+		}
+		fmt.Println(report.FileText(f))
+	}
+	for _, e := range rep.Errors {
+		fmt.Printf("Error: %s\n", e)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/metrics"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/syslogsink"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	metricsFile string
+	pushGateway string
+	pushJob     string
+	csvExport   string
+	syslogAddr  string
+	syslogFac   string
+)
+
+// addExportFlags adds the metrics and CSV export flags to a command that analyzes a collection
+func addExportFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&metricsFile, "metrics-file", "", "Also write Prometheus metrics of the result to this file (e.g. for node_exporter's textfile collector)")
+	cmd.Flags().StringVar(&pushGateway, "push-gateway", "", "Also push Prometheus metrics of the result to this Pushgateway URL")
+	cmd.Flags().StringVar(&pushJob, "push-job", metrics.DefaultJob, "Job name to push the metrics under")
+	cmd.Flags().StringVar(&syslogAddr, "syslog", "", "Also send a syslog message (RFC 5424) per drifting file to this server: udp://host[:514] or tcp://host[:601]")
+	cmd.Flags().StringVar(&syslogFac, "syslog-facility", "local0", "Facility of the syslog messages")
+	cmd.Flags().StringVar(&csvExport, "export-csv", "", "Also append a row per file of the result to this CSV file, creating it with a header if needed")
+}
+
+// exportResult appends an analysis of dir to the CSV export, sends it to
+// syslog, publishes its events and writes and pushes its metrics, if asked
+// to. The report may be partial; nil exports nothing.
+func exportResult(rep *report.Report, dir string) error {
+	if rep == nil {
+		return nil
+	}
+	if csvExport != "" {
+		if err := report.AppendCSV(csvExport, rep); err != nil {
+			return err
+		}
+		log.Infof("Appended %d row(s) to %s", len(rep.Files)+len(rep.Errors), csvExport)
+	}
+	if syslogAddr != "" {
+		target, err := syslogsink.ParseTarget(syslogAddr, syslogFac)
+		if err != nil {
+			return err
+		}
+		if err := syslogsink.Send(target, rep); err != nil {
+			return err
+		}
+	}
+	if err := publishAnalysis(rep, dir); err != nil {
+		return err
+	}
+	if metricsFile == "" && pushGateway == "" {
+		return nil
+	}
+	manifest, err := config.LoadManifest(dir)
+	if err != nil {
+		log.Warnf("Exporting metrics without collection errors: %v", err)
+		manifest = nil
+	}
+	if metricsFile != "" {
+		if err := metrics.WriteFile(metricsFile, rep, manifest); err != nil {
+			return err
+		}
+	}
+	if pushGateway != "" {
+		if err := metrics.Push(pushGateway, pushJob, rep, manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExportFlags validates the export settings, so a typo fails before collecting
+func checkExportFlags() error {
+	if syslogAddr != "" {
+		if _, err := syslogsink.ParseTarget(syslogAddr, syslogFac); err != nil {
+			return err
+		}
+	}
+	_, err := eventTarget()
+	return err
+}
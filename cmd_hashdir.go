@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newHashDirCmd() *cobra.Command {
+	var name, into, outputFile string
+	cmd := &cobra.Command{
+		Use:   "hash-dir <path>",
+		Short: "Checksum a local directory into a manifest, to compare a golden source with collected servers",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := args[0]
+			st, err := os.Stat(dir)
+			if err != nil {
+				return errors.Wrapf(err, "failed to stat %s", dir)
+			}
+			if !st.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			if name == "" {
+				abs, err := filepath.Abs(dir)
+				if err != nil {
+					return errors.Wrapf(err, "failed to resolve %s", dir)
+				}
+				name = filepath.Base(abs)
+			}
+			if strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+				return fmt.Errorf("invalid --name %q", name)
+			}
+			if err := collect.ValidateChunks(collect.ChunkThreshold, collect.ChunkSize); err != nil {
+				return err
+			}
+
+			if into == "" {
+				manifest := config.NewManifest()
+				n, err := collect.HashDir(dir, name, manifest)
+				if err != nil {
+					return err
+				}
+				return writeManifest(manifest, outputFile, n)
+			}
+
+			// Added to the collection in into like a collected server, replacing an earlier one of the same name
+			manifest, err := config.LoadManifest(into)
+			if err != nil {
+				return err
+			}
+			delete(manifest.FilesByServer, name)
+			delete(manifest.Methods, name)
+			delete(manifest.Unprivileged, name)
+			n, err := collect.HashDir(dir, name, manifest)
+			if err != nil {
+				return err
+			}
+			filesDir := filepath.Join(into, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", name))
+			if err := os.RemoveAll(filesDir); err != nil {
+				return errors.Wrapf(err, "failed to remove %s", filesDir)
+			}
+			if err := util.CopyTree(dir, filesDir, true); err != nil {
+				return errors.Wrapf(err, "failed to copy %s to %s", dir, filesDir)
+			}
+			if err := manifest.Save(into); err != nil {
+				return err
+			}
+			log.Infof("Added %d file(s) of %s to the collection in %s as %s", n, dir, into, name)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "Server name the directory's files are recorded under (default: the directory's name)")
+	cmd.Flags().StringVar(&outputFile, "manifest", "", "Write the manifest to this file instead of the standard output")
+	cmd.Flags().StringVar(&into, "into", "", "Add the directory to the collection in this output directory, with copies of its files, instead of writing a manifest")
+	addChunkFlags(cmd)
+	return cmd
+}
+
+// writeManifest writes a manifest as JSON to path, or to the standard output
+// if path is empty
+func writeManifest(manifest *config.Manifest, path string, files int) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	if err := config.ManifestSchema().Validate(data); err != nil {
+		return errors.Wrap(err, "manifest")
+	}
+	data = append(data, '\n')
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write manifest file %s", path)
+	}
+	log.Infof("Wrote the checksums of %d file(s) to %s", files, path)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/snapshot"
+	"github.com/brndnsvr/remote-diff-tool/internal/timeline"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	takeSnapshots bool
+	keepSnapshots int
+)
+
+// addSnapshotFlags adds the snapshot flags to a command that collects
+func addSnapshotFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&takeSnapshots, "snapshot", false, "Keep a timestamped copy of the collection under snapshots/ for the history command")
+	cmd.Flags().IntVar(&keepSnapshots, "keep-snapshots", 0, "With --snapshot, delete all but this many of the newest snapshots (0 keeps all)")
+}
+
+// snapshotCollection saves the collection just made, if --snapshot was given
+func snapshotCollection() error {
+	if !takeSnapshots {
+		return nil
+	}
+	if _, err := snapshot.Take(outputDir); err != nil {
+		return errors.Wrap(err, "failed to save snapshot")
+	}
+	if keepSnapshots > 0 {
+		if _, err := snapshot.Prune(outputDir, keepSnapshots); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newHistoryCmd() *cobra.Command {
+	var from, to string
+	var servers, labelPairs []string
+	var list, keepWorkDir bool
+	cmd := &cobra.Command{
+		Use:     "history",
+		Aliases: []string{"diff-history"},
+		Short:   "Compare each server with its own earlier snapshot (by default the two newest)",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			labels, err := config.ParseLabels(labelPairs)
+			if err != nil {
+				return err
+			}
+			ids, err := snapshot.List(outputDir)
+			if err != nil {
+				return err
+			}
+			annotations := make(map[string]*config.RunAnnotation, len(ids))
+			kept := ids[:0]
+			for _, id := range ids {
+				a, err := snapshot.Annotation(outputDir, id)
+				if err != nil {
+					return err
+				}
+				if a.HasLabels(labels) {
+					annotations[id] = a
+					kept = append(kept, id)
+				}
+			}
+			ids = kept
+			events, err := timeline.List(outputDir)
+			if err != nil {
+				return err
+			}
+			if list {
+				if len(ids) == 0 && len(labels) > 0 {
+					fmt.Println("No snapshots with these labels.")
+				} else if len(ids) == 0 {
+					fmt.Println("No snapshots. Collect with --snapshot to take one.")
+				}
+				// Registered events are shown once, where they started between the snapshots
+				next := 0
+				for _, id := range ids {
+					if at, err := snapshot.Time(id); err == nil {
+						for ; next < len(events) && !events[next].Start.After(at); next++ {
+							fmt.Printf("  * %s\n", events[next])
+						}
+					}
+					if a := annotations[id]; a != nil {
+						fmt.Printf("%s  %s\n", id, a)
+					} else {
+						fmt.Println(id)
+					}
+				}
+				if len(ids) > 0 {
+					for _, e := range events[next:] {
+						fmt.Printf("  * %s\n", e)
+					}
+				}
+				return nil
+			}
+			if !report.ValidFormat(outputFormat) {
+				return fmt.Errorf("unknown output format %q", outputFormat)
+			}
+
+			fromID, toID, err := historyRange(ids, from, to)
+			if err != nil {
+				return err
+			}
+			workDir, err := os.MkdirTemp("", "remote-diff-history-*")
+			if err != nil {
+				return errors.Wrap(err, "failed to create working directory")
+			}
+			if keepWorkDir {
+				log.Infof("Keeping the merged snapshots in %s", workDir)
+			} else {
+				defer os.RemoveAll(workDir)
+			}
+
+			log.Infof("Comparing snapshot %s with %s", fromID, toID)
+			rep, err := analyze.CompareRuns(
+				analyze.Run{Dir: snapshot.Path(outputDir, fromID), Label: fromID},
+				analyze.Run{Dir: snapshot.Path(outputDir, toID), Label: toID},
+				servers, workDir, analysisOptions())
+			if rep == nil {
+				return err
+			}
+			rep.Events = eventsBetween(events, fromID, toID, servers)
+			if writeErr := report.Write(os.Stdout, rep, outputFormat); writeErr != nil {
+				return writeErr
+			}
+			if err != nil {
+				return err
+			}
+			setExitStatus(rep)
+			if rep.HasDifferences() {
+				log.Warn("History comparison finished: Files changed.")
+			} else {
+				log.Info("History comparison finished: No changes.")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "Earlier snapshot ID (default: the one before --to)")
+	cmd.Flags().StringVar(&to, "to", "", "Later snapshot ID (default: the newest)")
+	cmd.Flags().StringSliceVar(&servers, "server", nil, "Only compare these servers (comma-separated or repeated)")
+	cmd.Flags().BoolVar(&list, "list", false, "List the snapshot IDs with their notes and labels, oldest first, instead of comparing")
+	cmd.Flags().StringArrayVar(&labelPairs, "label", nil, "Only list and pick from the snapshots with this key=value label; repeatable")
+	cmd.Flags().BoolVar(&keepWorkDir, "keep", false, "Keep the merged snapshots instead of deleting them afterwards")
+	cmd.Flags().BoolVar(&saveDiffs, "save-diffs", false, "Save diff outputs to files")
+	cmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory to store diff files")
+	cmd.Flags().IntVar(&maxInlineLines, "max-inline-diff-lines", defaultMaxInlineLines, "Write diffs longer than this many lines to --diff-dir and only point to them (0 prints every diff)")
+	cmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	cmd.Flags().StringVar(&outputFormat, "format", report.FormatText, "Output format for comparison results (text, json, yaml, junit, sarif, matrix, html)")
+	addExitCodeFlags(cmd)
+	addComparisonFlags(cmd)
+	return cmd
+}
+
+// eventsBetween returns the registered events that happened between two
+// snapshots and concern the compared servers, for the report
+func eventsBetween(events []timeline.Event, fromID, toID string, servers []string) []report.Event {
+	from, err := snapshot.Time(fromID)
+	if err != nil {
+		return nil
+	}
+	to, err := snapshot.Time(toID)
+	if err != nil {
+		return nil
+	}
+	var out []report.Event
+	for _, e := range timeline.Between(events, from, to, servers) {
+		out = append(out, report.Event{Kind: e.Kind, Title: e.Title, Start: e.Start, End: e.End, Servers: e.Servers})
+	}
+	return out
+}
+
+// historyRange picks the snapshots to compare: to defaults to the newest and
+// from to the one before it
+func historyRange(ids []string, from, to string) (string, string, error) {
+	index := func(id string) (int, error) {
+		for i, candidate := range ids {
+			if candidate == id {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("no snapshot %s (see 'history --list')", id)
+	}
+	if len(ids) == 0 {
+		return "", "", fmt.Errorf("no snapshots yet; collect with --snapshot at least twice")
+	}
+
+	toIndex := len(ids) - 1
+	if to != "" {
+		i, err := index(to)
+		if err != nil {
+			return "", "", err
+		}
+		toIndex = i
+	}
+	fromIndex := toIndex - 1
+	if from != "" {
+		i, err := index(from)
+		if err != nil {
+			return "", "", err
+		}
+		fromIndex = i
+	}
+	if fromIndex < 0 {
+		return "", "", fmt.Errorf("no snapshot before %s to compare with (have: %s)", ids[toIndex], strings.Join(ids, ", "))
+	}
+	if fromIndex == toIndex {
+		return "", "", fmt.Errorf("--from and --to are the same snapshot")
+	}
+	return ids[fromIndex], ids[toIndex], nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/notify"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// notifyQueueDir keeps the notifications that couldn't be delivered, in the output directory
+const notifyQueueDir = "notify-queue"
+
+var (
+	notifyURLs   []string
+	notifyStyle  string
+	notifyOn     string
+	notifyAttach bool
+	notifyTitle  string
+	notifyQueue  bool
+	notifyMaxAge time.Duration
+)
+
+// addNotifyFlags adds the webhook notification flags to a command that analyzes a collection
+func addNotifyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&notifyURLs, "notify-webhook", nil, "Post a summary of the result to this webhook (Slack, Teams or any URL accepting JSON); repeatable (default: $"+notify.URLEnvVar+")")
+	cmd.Flags().StringVar(&notifyStyle, "notify-style", "", "Payload of --notify-webhook: slack, teams or generic (default: guessed from the URL, else generic)")
+	cmd.Flags().StringVar(&notifyOn, "notify-on", notify.OnDrift, "When to notify: drift (files differ, can't be compared or the run had errors) or always")
+	cmd.Flags().BoolVar(&notifyAttach, "notify-attach-report", false, "Include the full JSON report in generic webhook payloads")
+	cmd.Flags().StringVar(&notifyTitle, "notify-title", "", "Start notifications with this instead of remote-diff-tool, e.g. the environment's name")
+	cmd.Flags().BoolVar(&notifyQueue, "notify-queue", true, "Keep notifications that can't be delivered in notify-queue/ of the output directory and retry them on later runs")
+	cmd.Flags().DurationVar(&notifyMaxAge, "notify-max-age", notify.DefaultMaxAge, "Drop queued notifications not delivered within this time (0 keeps retrying)")
+}
+
+// webhooks returns the webhooks to notify, checked so a typo fails before collecting
+func webhooks() ([]notify.Webhook, error) {
+	urls := notifyURLs
+	if len(urls) == 0 {
+		if u := os.Getenv(notify.URLEnvVar); u != "" {
+			urls = []string{u}
+		}
+	}
+	var hooks []notify.Webhook
+	for _, u := range urls {
+		h := notify.Webhook{URL: u, Style: notifyStyle, On: notifyOn, AttachReport: notifyAttach, Title: notifyTitle}
+		if notifyQueue {
+			h.QueueDir = filepath.Join(outputDir, notifyQueueDir)
+		}
+		if err := h.Validate(); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// notifyResult sends the summary of an analysis to every webhook, returning
+// the first failure after trying them all. The report may be partial; nil
+// sends nothing.
+func notifyResult(rep *report.Report) error {
+	if rep == nil {
+		return nil
+	}
+	hooks, err := webhooks()
+	if err != nil {
+		return err
+	}
+	flushNotifications()
+	var firstErr error
+	for _, h := range hooks {
+		if err := notify.Send(h, rep); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// publishResult exports an analysis of dir and notifies the webhooks
+func publishResult(rep *report.Report, dir string) error {
+	exportErr := exportResult(rep, dir)
+	if err := notifyResult(rep); err != nil {
+		return err
+	}
+	return exportErr
+}
+
+// flushNotifications retries the notifications queued by earlier runs
+func flushNotifications() {
+	if !notifyQueue {
+		return
+	}
+	dir := filepath.Join(outputDir, notifyQueueDir)
+	delivered, left, err := notify.Flush(dir, notifyMaxAge)
+	if err != nil {
+		log.Errorf("Failed to retry queued notifications: %v", err)
+	}
+	if delivered > 0 || left > 0 {
+		log.Infof("Queued notifications: %d delivered, %d still waiting in %s", delivered, left, dir)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/preset"
+
+	"github.com/spf13/cobra"
+)
+
+func newPresetCmd() *cobra.Command {
+	presetCmd := &cobra.Command{
+		Use:   "preset",
+		Short: "List and inspect the built-in and user-defined presets",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the presets with their source and description",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			all, err := preset.List()
+			if err != nil {
+				return err
+			}
+			dir, err := preset.Dir()
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tSOURCE\tFILES\tDIRS\tDESCRIPTION")
+			for _, p := range all {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", p.Name, p.Source, len(p.Files), len(p.Dirs), orDash(p.Description))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			fmt.Printf("\nUser presets are read from %s/<name>.json\n", dir)
+			return nil
+		},
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show <name>",
+		Short: "Print a preset in the preset file format, e.g. as a starting point for your own",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := preset.Get(args[0])
+			if err != nil {
+				return err
+			}
+			data, err := p.Marshal()
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		},
+	}
+
+	presetCmd.AddCommand(listCmd, showCmd)
+	return presetCmd
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/spf13/cobra"
+)
+
+func newReportCmd() *cobra.Command {
+	reportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "Work with saved analysis reports (written with --format json or yaml)",
+	}
+
+	var format string
+	diffCmd := &cobra.Command{
+		Use:   "diff OLD NEW",
+		Short: "Summarize what changed between two reports: new drift, resolved drift and changed diffs",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !report.ValidDeltaFormat(format) {
+				return fmt.Errorf("unknown output format %q", format)
+			}
+			oldRep, err := report.Load(args[0])
+			if err != nil {
+				return err
+			}
+			newRep, err := report.Load(args[1])
+			if err != nil {
+				return err
+			}
+			delta := report.Compare(oldRep, newRep)
+			if err := report.WriteDelta(os.Stdout, delta, format); err != nil {
+				return err
+			}
+			if exitCodes && !delta.Empty() {
+				exitStatus = exitDifferences
+			}
+			return nil
+		},
+	}
+	diffCmd.Flags().StringVar(&format, "format", report.FormatText, "Output format (text, json, yaml)")
+	diffCmd.Flags().BoolVar(&exitCodes, "exit-code", false, "Exit with 1 if anything drifts differently than before, and 2 on errors")
+
+	reportCmd.AddCommand(diffCmd)
+	return reportCmd
+}
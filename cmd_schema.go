@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/ack"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/timeline"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// jsonSchemas are the published schemas, by the name schema print takes
+var jsonSchemas = []struct {
+	name   string
+	schema func() *jsonschema.Schema
+}{
+	{"config", config.ConfigSchema},
+	{"manifest", config.ManifestSchema},
+	{"report", report.Schema},
+	{"summary", report.SummarySchema},
+	{"delta", report.DeltaSchema},
+	{"ack", ack.Schema},
+	{"timeline", timeline.Schema},
+}
+
+func lookupSchema(name string) (*jsonschema.Schema, error) {
+	for _, s := range jsonSchemas {
+		if s.name == name {
+			return s.schema(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown schema %q (see 'schema list')", name)
+}
+
+func newSchemaCmd() *cobra.Command {
+	schemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schemas of the config, manifest, reports and other JSON files, or check files against them",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the JSON Schemas",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tDESCRIPTION")
+			for _, s := range jsonSchemas {
+				fmt.Fprintf(tw, "%s\t%s\n", s.name, s.schema().Description)
+			}
+			return tw.Flush()
+		},
+	}
+
+	printCmd := &cobra.Command{
+		Use:   "print <name>",
+		Short: "Print a JSON Schema (draft 2020-12), e.g. to generate bindings or validate outputs in other tools",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := lookupSchema(args[0])
+			if err != nil {
+				return err
+			}
+			data, err := json.MarshalIndent(schema, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to encode the schema")
+			}
+			fmt.Println(string(data))
+			return nil
+		},
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate <name> <file>...",
+		Short: "Check JSON files against a schema, e.g. a report before handing it to another tool",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := lookupSchema(args[0])
+			if err != nil {
+				return err
+			}
+			invalid := 0
+			for _, file := range args[1:] {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return errors.Wrapf(err, "failed to read %s", file)
+				}
+				if err := schema.Validate(data); err != nil {
+					fmt.Printf("%s: %v\n", file, err)
+					invalid++
+					continue
+				}
+				fmt.Printf("%s: valid %s\n", file, args[0])
+			}
+			if invalid > 0 {
+				return fmt.Errorf("%d of %d file(s) don't match the %s schema", invalid, len(args)-1, args[0])
+			}
+			return nil
+		},
+	}
+
+	schemaCmd.AddCommand(listCmd, printCmd, validateCmd)
+	return schemaCmd
+}
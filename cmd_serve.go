@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/server"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	var listen, token, dataDir string
+	var keepJobs, maxQueued int
+	var shutdownWait time.Duration
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve a REST API to start collections and analyses and fetch their reports and diffs",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if token == "" {
+				token = os.Getenv(server.TokenEnvVar)
+			}
+			if token == "" && !isLoopback(listen) {
+				return fmt.Errorf("refusing to serve on %s without a token: anyone who can connect could start collections (set --token or $%s, or listen on a loopback address)", listen, server.TokenEnvVar)
+			}
+			if shutdownWait < 0 {
+				return fmt.Errorf("--shutdown-wait can't be negative")
+			}
+			if _, err := webhooks(); err != nil {
+				return err
+			}
+			if err := checkExportFlags(); err != nil {
+				return err
+			}
+			// Jobs can't prompt for the sudo password or key passphrase, so they are read before serving
+			if err := applyBecome(&config.Config{SSHConfig: config.SSHCredentials{Username: os.Getenv("SSHUSER")}}); err != nil {
+				return err
+			}
+			if err := applyKeyPassphrase(&config.Config{}); err != nil {
+				return err
+			}
+			baseDir := outputDir
+			hostKeyDir = baseDir // Pinned for all jobs, not per job
+			if dataDir == "" {
+				dataDir = filepath.Join(baseDir, "jobs")
+			}
+			srv, err := server.New(dataDir, baseDir, token, keepJobs, maxQueued, serveJob(baseDir))
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			worked := make(chan struct{})
+			go func() {
+				srv.Work(ctx)
+				close(worked)
+			}()
+
+			httpSrv := &http.Server{Addr: listen, Handler: srv.Handler(), ReadHeaderTimeout: 10 * time.Second}
+			errc := make(chan error, 1)
+			go func() { errc <- httpSrv.ListenAndServe() }()
+			log.Infof("Serving the API on http://%s%s, keeping jobs in %s", listen, server.APIPrefix, dataDir)
+			select {
+			case err := <-errc:
+				return errors.Wrapf(err, "failed to serve on %s", listen)
+			case <-ctx.Done():
+			}
+			log.Info("Shutting down; the running job is canceled")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+			defer cancel()
+			err = httpSrv.Shutdown(shutdownCtx)
+			// Servers already being collected finish, so they don't keep the copies and tarballs
+			select {
+			case <-worked:
+			case <-shutdownCtx.Done():
+				log.Warnf("The running job didn't stop within --shutdown-wait %s; its servers may keep leftovers for 'clean --remote'", shutdownWait)
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:8080", "Address to serve the API on")
+	cmd.Flags().StringVar(&token, "token", "", "Bearer token clients must send (default: $"+server.TokenEnvVar+")")
+	cmd.Flags().StringVar(&dataDir, "data-dir", "", "Directory holding one output directory per job (default: jobs/ in --output-dir)")
+	cmd.Flags().IntVar(&keepJobs, "keep-jobs", 50, "Forget all but this many of the newest finished jobs and delete their directories (0 keeps all)")
+	cmd.Flags().IntVar(&maxQueued, "max-queued", 20, "Refuse new jobs while this many are waiting to run")
+	cmd.Flags().DurationVar(&shutdownWait, "shutdown-wait", time.Minute, "On SIGINT or SIGTERM, how long to wait for the running job to finish the servers it is collecting")
+	cmd.Flags().StringVar(&collect.Method, "method", collect.MethodScript, "How files are fetched: script (sudo copy and tarball on the remote) , sftp (stream each file, no sudo, nothing written remotely) or auto (script, or sftp on servers without shell access)")
+	addChunkFlags(cmd)
+	cmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	addComparisonFlags(cmd)
+	addExportFlags(cmd)
+	addEventFlags(cmd)
+	addNotifyFlags(cmd)
+	return cmd
+}
+
+// isLoopback reports whether a listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveJob returns how the server runs a job: like all, in the job's own
+// directory, starting from the config file of baseDir. The request's paths
+// and annotation only go into the job's config and collection options; the
+// flag variables are left as serve was started with.
+func serveJob(baseDir string) server.RunFunc {
+	return func(ctx context.Context, dir string, req server.Request) (*report.Report, error) {
+		if _, err := config.CopyConfig(baseDir, dir); err != nil {
+			return nil, err
+		}
+		pairs := make([]string, 0, len(req.Labels))
+		for k, v := range req.Labels {
+			pairs = append(pairs, k+"="+v)
+		}
+		labels, err := config.ParseLabels(pairs)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, cleanup, err := loadCollectionConfigIn(dir, config.Overrides{
+			Servers: strings.Join(req.Servers, ","),
+			Files:   strings.Join(req.Files, ","),
+			Dirs:    strings.Join(req.Dirs, ","),
+			Exclude: req.Exclude,
+			Include: req.Include,
+			Presets: req.Presets,
+		}, true)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		opts := collect.CurrentOptions()
+		opts.Annotation = config.RunAnnotation{Note: req.Note, Labels: labels}
+		collectErr := collect.Run(ctx, cfg, dir, maxConcurrency, opts)
+		if err := publishCollection(cfg, dir, collectErr == nil); err != nil {
+			log.Errorf("Failed to publish the collection: %v", err)
+		}
+		if collectErr != nil {
+			return nil, fmt.Errorf("collection failed: %w", collectErr)
+		}
+
+		analysisCfg, err := config.LoadConfigForAnalysis(dir)
+		if err != nil {
+			return nil, err
+		}
+		rep, err := analyze.AnalyzeContext(ctx, analysisCfg, dir, analysisOptions())
+		publishErr := publishResult(rep, dir)
+		if err != nil {
+			return rep, fmt.Errorf("analysis failed: %w", err)
+		}
+		return rep, publishErr
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+var showServer string
+
+// shortChecksum is how many checksum characters the listings show
+const shortChecksum = 12
+
+func newShowCmd() *cobra.Command {
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Browse the manifest of the last collection",
+	}
+
+	serversCmd := &cobra.Command{
+		Use:   "servers",
+		Short: "List the collected servers with their file and error counts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "SERVER\tFILES\tMISSING\tERRORS\tUNSTABLE\tVOLATILE")
+			for _, server := range manifestServers(manifest) {
+				var files, missing, errs, unstable, volatile int
+				for _, info := range manifest.FilesByServer[server] {
+					switch {
+					case info.Error == config.MissingOnRemote:
+						missing++
+					case info.Error != "":
+						errs++
+					default:
+						files++
+					}
+					if info.Unstable {
+						unstable++
+					}
+					if info.Volatile {
+						volatile++
+					}
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", server, files, missing, errs, unstable, volatile)
+			}
+			return tw.Flush()
+		},
+	}
+
+	filesCmd := &cobra.Command{
+		Use:   "files",
+		Short: "List collected files, on all servers or with --server on one",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			if showServer != "" {
+				files, ok := manifest.FilesByServer[showServer]
+				if !ok {
+					return fmt.Errorf("server %s is not in the manifest (have: %s)", showServer, strings.Join(manifestServers(manifest), ", "))
+				}
+				fmt.Fprintln(tw, "PATH\tCHECKSUM\tMODE\tOWNER\tSTATUS")
+				for _, p := range sortedKeys(files) {
+					info := files[p]
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p, orDash(truncate(info.Checksum, shortChecksum)), orDash(info.Mode), ownerString(info.FileMetadata), fileStatus(info))
+				}
+				return tw.Flush()
+			}
+
+			servers := manifestServers(manifest)
+			paths := make(map[string]bool)
+			for _, files := range manifest.FilesByServer {
+				for p := range files {
+					paths[p] = true
+				}
+			}
+			fmt.Fprintln(tw, "PATH\tCOLLECTED\tMISSING\tERRORS\tCHECKSUMS")
+			for _, p := range sortedKeys(paths) {
+				collected, missing, errs := 0, 0, 0
+				distinct := make(map[string]bool)
+				for _, server := range servers {
+					info, ok := manifest.FilesByServer[server][p]
+					switch {
+					case !ok:
+					case info.Error == config.MissingOnRemote:
+						missing++
+					case info.Error != "":
+						errs++
+					default:
+						collected++
+						if info.Checksum != "" {
+							distinct[info.Checksum] = true
+						}
+					}
+				}
+				fmt.Fprintf(tw, "%s\t%d/%d\t%d\t%d\t%s\n", p, collected, len(servers), missing, errs, checksumSummary(len(distinct)))
+			}
+			return tw.Flush()
+		},
+	}
+	filesCmd.Flags().StringVar(&showServer, "server", "", "Only list the files of this server, with checksums, modes and owners")
+
+	fileCmd := &cobra.Command{
+		Use:   "file <path>",
+		Short: "Show one file's checksum, mode, owner and errors on every server",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				return err
+			}
+			// Manifest paths are relative to /, but absolute ones are what users type
+			p := strings.TrimPrefix(args[0], "/")
+			servers := manifestServers(manifest)
+			found := false
+			for _, server := range servers {
+				if _, ok := manifest.FilesByServer[server][p]; ok {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s is not in the manifest (see 'show files')", args[0])
+			}
+
+			fmt.Printf("File: %s\n", p)
+			return writeFileTable(os.Stdout, manifest, servers, p)
+		},
+	}
+
+	showCmd.AddCommand(serversCmd, filesCmd, fileCmd)
+	return showCmd
+}
+
+// manifestServers returns the manifest's servers in alphabetical order
+func manifestServers(manifest *config.Manifest) []string {
+	return sortedKeys(manifest.FilesByServer)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeFileTable lists a file's checksum, mode, owner and status on each
+// server, and how many distinct copies there are
+func writeFileTable(w io.Writer, manifest *config.Manifest, servers []string, p string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tCHECKSUM\tMODE\tOWNER\tSTATUS")
+	distinct := make(map[string]bool)
+	for _, server := range servers {
+		info, ok := manifest.FilesByServer[server][p]
+		if !ok {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\tnot collected\n", server)
+			continue
+		}
+		if info.Error == "" && info.Checksum != "" {
+			distinct[info.Checksum] = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", server, orDash(info.Checksum), orDash(info.Mode), ownerString(info.FileMetadata), fileStatus(info))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Checksums: %s\n", checksumSummary(len(distinct)))
+	return err
+}
+
+// fileStatus summarizes a manifest entry: "ok", "missing", the error, or
+// what made the copy unreliable
+func fileStatus(info config.FileInfo) string {
+	switch {
+	case info.Error == config.MissingOnRemote:
+		return "missing"
+	case info.Error != "":
+		return "error: " + info.Error
+	case info.Volatile && info.Checksum == "":
+		return "skipped (open for writing)"
+	}
+	var flags []string
+	if info.Unstable {
+		flags = append(flags, "unstable")
+	}
+	if info.Volatile {
+		flags = append(flags, "volatile")
+	}
+	if len(flags) == 0 {
+		return "ok"
+	}
+	return strings.Join(flags, ", ")
+}
+
+// checksumSummary describes how many different contents the servers have
+func checksumSummary(distinct int) string {
+	switch distinct {
+	case 0:
+		return "none"
+	case 1:
+		return "identical"
+	default:
+		return fmt.Sprintf("%d distinct", distinct)
+	}
+}
+
+func ownerString(md config.FileMetadata) string {
+	if md.Owner == "" && md.Group == "" {
+		return "-"
+	}
+	return md.Owner + ":" + md.Group
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/spf13/cobra"
+)
+
+// divergence counts how often a server's copies disagree with the others
+type divergence struct {
+	server    string
+	divergent int // Files whose copy isn't the one most servers have
+	alone     int // Files whose copy no other server has
+	missing   int // Files missing or with an error, while others have them
+}
+
+func newSummaryCmd() *cobra.Command {
+	var differing bool
+	cmd := &cobra.Command{
+		Use:   "summary",
+		Short: "Show which servers agree on each collected file, and rank the most divergent servers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				return err
+			}
+			servers := manifestServers(manifest)
+			paths := make(map[string]bool)
+			for _, files := range manifest.FilesByServer {
+				for p := range files {
+					paths[p] = true
+				}
+			}
+
+			ranking := make(map[string]*divergence, len(servers))
+			for _, server := range servers {
+				ranking[server] = &divergence{server: server}
+			}
+			identical := 0
+			for _, p := range sortedKeys(paths) {
+				checksums := make(map[string]string)
+				var missing []string
+				for _, server := range servers {
+					info, ok := manifest.FilesByServer[server][p]
+					switch {
+					case ok && info.Error == "" && info.Checksum != "":
+						checksums[server] = info.Checksum
+					case ok && info.Volatile && info.Error == "":
+						// Skipped as open for writing: neither agrees nor diverges
+					default:
+						missing = append(missing, server)
+					}
+				}
+				groups := report.GroupContents(servers, checksums)
+				if len(groups) <= 1 && len(missing) == 0 {
+					identical++
+					if !differing {
+						fmt.Printf("%s: identical on %d server(s)\n", p, len(checksums))
+					}
+					continue
+				}
+
+				fmt.Printf("%s: %s on %d of %d server(s)\n", p, checksumSummary(len(groups)), len(checksums), len(servers))
+				majority := majorityGroup(groups)
+				for i, g := range groups {
+					fmt.Printf("  %s  %s  %s\n", g.Name, truncate(g.Checksum, shortChecksum), strings.Join(g.Servers, ", "))
+					for _, server := range g.Servers {
+						if i != majority {
+							ranking[server].divergent++
+						}
+						if len(g.Servers) == 1 && len(checksums) > 1 {
+							ranking[server].alone++
+						}
+					}
+				}
+				if len(missing) > 0 {
+					fmt.Printf("  missing or failed: %s\n", strings.Join(missing, ", "))
+				}
+				if len(checksums) > 0 {
+					for _, server := range missing {
+						ranking[server].missing++
+					}
+				}
+			}
+			fmt.Printf("\n%d of %d file(s) identical on every server\n", identical, len(paths))
+
+			ranked := make([]*divergence, 0, len(ranking))
+			for _, d := range ranking {
+				ranked = append(ranked, d)
+			}
+			sort.Slice(ranked, func(i, j int) bool {
+				a, b := ranked[i], ranked[j]
+				if a.divergent+a.missing != b.divergent+b.missing {
+					return a.divergent+a.missing > b.divergent+b.missing
+				}
+				if a.alone != b.alone {
+					return a.alone > b.alone
+				}
+				return a.server < b.server
+			})
+			fmt.Println("\nMost divergent servers:")
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "SERVER\tDIVERGENT\tALONE\tMISSING")
+			for _, d := range ranked {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", d.server, d.divergent, d.alone, d.missing)
+			}
+			return tw.Flush()
+		},
+	}
+	cmd.Flags().BoolVar(&differing, "differing", false, "Only list the files the servers don't agree on")
+	return cmd
+}
+
+// majorityGroup returns the index of the group most servers are in, or -1
+// if no group is larger than all others
+func majorityGroup(groups []report.ContentGroup) int {
+	majority, size, tie := -1, 0, false
+	for i, g := range groups {
+		switch {
+		case len(g.Servers) > size:
+			majority, size, tie = i, len(g.Servers), false
+		case len(g.Servers) == size:
+			tie = true
+		}
+	}
+	if tie {
+		return -1
+	}
+	return majority
+}
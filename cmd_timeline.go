@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/timeline"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newTimelineCmd() *cobra.Command {
+	timelineCmd := &cobra.Command{
+		Use:   "timeline",
+		Short: "Register deploys, patching windows and other external events, shown by history next to the drift",
+	}
+
+	var kind, at, end, servers string
+	var duration time.Duration
+	var labelPairs []string
+	addCmd := &cobra.Command{
+		Use:   "add <title>",
+		Short: "Register an event in the output directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			e := timeline.Event{Kind: kind, Title: args[0], Start: time.Now()}
+			var err error
+			if at != "" {
+				if e.Start, err = timeline.ParseTime(at); err != nil {
+					return err
+				}
+			}
+			switch {
+			case end != "" && duration != 0:
+				return fmt.Errorf("--end and --duration can't be combined")
+			case end != "":
+				t, err := timeline.ParseTime(end)
+				if err != nil {
+					return err
+				}
+				e.End = &t
+			case duration < 0:
+				return fmt.Errorf("--duration can't be negative")
+			case duration > 0:
+				t := e.Start.Add(duration)
+				e.End = &t
+			}
+			if servers != "" {
+				e.Servers = strings.Split(servers, ",")
+			}
+			if e.Labels, err = config.ParseLabels(labelPairs); err != nil {
+				return err
+			}
+			e, err = timeline.Add(outputDir, e)
+			if err != nil {
+				return err
+			}
+			log.Infof("Registered event %s", e.ID)
+			fmt.Println(e.ID)
+			return nil
+		},
+	}
+	addCmd.Flags().StringVar(&kind, "kind", timeline.DefaultKind, "Kind of event, e.g. deploy, patching or maintenance")
+	addCmd.Flags().StringVar(&at, "at", "", "When it happened or started: RFC 3339, local \"2006-01-02 15:04\", a date, or e.g. -2h (default: now)")
+	addCmd.Flags().StringVar(&end, "end", "", "When a window ended, in the same formats as --at")
+	addCmd.Flags().DurationVar(&duration, "duration", 0, "How long a window lasted, instead of --end")
+	addCmd.Flags().StringVarP(&servers, "servers", "s", "", "Comma-separated servers it concerns (default: all)")
+	addCmd.Flags().StringArrayVar(&labelPairs, "label", nil, "Attach this key=value label, e.g. version=2.3.1; repeatable")
+
+	var since, until, format string
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the registered events, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != report.FormatText && format != report.FormatJSON {
+				return fmt.Errorf("unknown output format %q", format)
+			}
+			events, err := timeline.List(outputDir)
+			if err != nil {
+				return err
+			}
+			if since != "" || until != "" {
+				from, to := time.Time{}, time.Now()
+				if since != "" {
+					if from, err = timeline.ParseTime(since); err != nil {
+						return err
+					}
+				}
+				if until != "" {
+					if to, err = timeline.ParseTime(until); err != nil {
+						return err
+					}
+				}
+				events = timeline.Between(events, from, to, nil)
+			}
+			if format == report.FormatJSON {
+				if events == nil {
+					events = []timeline.Event{}
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(events)
+			}
+			if len(events) == 0 {
+				fmt.Println("No events. Register one with 'timeline add'.")
+				return nil
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tSTART\tEND\tKIND\tSERVERS\tTITLE")
+			for _, e := range events {
+				endStr := "-"
+				if e.End != nil {
+					endStr = e.End.Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Start.Format(time.RFC3339), endStr, e.Kind, orDash(strings.Join(e.Servers, ",")), e.Title)
+			}
+			return tw.Flush()
+		},
+	}
+	listCmd.Flags().StringVar(&since, "since", "", "Only list events that happened after this time (same formats as add --at)")
+	listCmd.Flags().StringVar(&until, "until", "", "Only list events that happened up to this time")
+	listCmd.Flags().StringVar(&format, "format", report.FormatText, "Output format (text, json)")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove <id>",
+		Short: "Delete a registered event",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := timeline.Remove(outputDir, args[0]); err != nil {
+				return err
+			}
+			log.Infof("Removed event %s", args[0])
+			return nil
+		},
+	}
+
+	timelineCmd.AddCommand(addCmd, listCmd, removeCmd)
+	return timelineCmd
+}
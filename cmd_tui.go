@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/ack"
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/tui"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func newTUICmd() *cobra.Command {
+	var reportFile, acksFile string
+	var opts tui.Options
+	cmd := &cobra.Command{
+		Use:   "tui",
+		Short: "Browse the analysis in the terminal: filter files by server, page through their diffs and acknowledge them",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !term.IsTerminal(int(os.Stdout.Fd())) || !term.IsTerminal(int(os.Stdin.Fd())) {
+				return fmt.Errorf("tui needs a terminal; use analyze for output to a file or pipe")
+			}
+			rep, err := tuiReport(reportFile)
+			if err != nil {
+				return err
+			}
+			if acksFile == "" {
+				acksFile = filepath.Join(outputDir, ack.FileName)
+			}
+			if opts.Acks, err = ack.LoadFile(acksFile); err != nil {
+				return err
+			}
+			return tui.Run(rep, opts)
+		},
+	}
+	cmd.Flags().StringVar(&reportFile, "report", "", "Browse this saved report (written with --format json or yaml) instead of analyzing the collection in --output-dir")
+	cmd.Flags().StringVar(&acksFile, "acks", "", "File acknowledged differences are kept in (default: ack.json in --output-dir)")
+	cmd.Flags().StringVar(&opts.Server, "server", "", "Start with only the files where this server's copy is out of line")
+	cmd.Flags().BoolVar(&opts.ShowIdentical, "identical", false, "Also list identical files")
+	cmd.Flags().BoolVar(&opts.HideAcked, "hide-acknowledged", false, "Start without the acknowledged files, or those the config expects to differ")
+	addComparisonFlags(cmd)
+	return cmd
+}
+
+// tuiReport loads the report to browse, or analyzes the collection in the
+// output directory without printing it
+func tuiReport(reportFile string) (*report.Report, error) {
+	if reportFile != "" {
+		return report.Load(reportFile)
+	}
+	cfg, err := config.LoadConfigForAnalysis(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	opts := analysisOptions()
+	opts.MaxInlineLines = 0 // Every diff is paged in full
+	rep, err := analyze.Analyze(cfg, outputDir, opts)
+	if rep == nil {
+		return nil, fmt.Errorf("analysis failed: %w", err)
+	}
+	if err != nil {
+		rep.Errors = append(rep.Errors, err.Error())
+	}
+	return rep, nil
+}
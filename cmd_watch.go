@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/notify"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/schedule"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// watchStateFile keeps the last report of watch in the output directory, so
+// a restarted watcher only reports what changed since it stopped
+const watchStateFile = "watch-report.json"
+
+// defaultWatchSnapshots bounds the snapshots a long-running watcher keeps
+const defaultWatchSnapshots = 30
+
+func newWatchCmd() *cobra.Command {
+	var interval, shutdownWait time.Duration
+	var cronSpec, onChange string
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Collect and analyze on a schedule, reporting only when drift appears, changes or resolves",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sched schedule.Schedule
+			switch {
+			case cronSpec != "" && cmd.Flags().Changed("interval"):
+				return fmt.Errorf("use either --interval or --cron")
+			case cronSpec != "":
+				c, err := schedule.ParseCron(cronSpec)
+				if err != nil {
+					return err
+				}
+				if c.Next(time.Now()).IsZero() {
+					return fmt.Errorf("cron spec %q never matches", cronSpec)
+				}
+				sched = c
+			case interval <= 0:
+				return fmt.Errorf("--interval must be positive")
+			case shutdownWait < 0:
+				return fmt.Errorf("--shutdown-wait can't be negative")
+			default:
+				sched = schedule.Every(interval)
+			}
+			if !report.ValidDeltaFormat(outputFormat) {
+				return fmt.Errorf("unknown output format %q", outputFormat)
+			}
+
+			cfg, cleanup, err := loadCollectionConfig(true)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+
+			statePath := filepath.Join(outputDir, watchStateFile)
+			var last *report.Report
+			if _, err := os.Stat(statePath); err == nil {
+				if last, err = report.Load(statePath); err != nil {
+					log.Warnf("Ignoring the state of the previous watch: %v", err)
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			for {
+				started := time.Now()
+				// A signal cancels the run: servers not yet started are skipped
+				// and the analysis stops, but those being collected finish
+				done := make(chan *report.Report, 1)
+				go func() { done <- watchRun(ctx, cfg) }()
+				var rep *report.Report
+				select {
+				case rep = <-done:
+				case <-ctx.Done():
+					log.Infof("Stopping watch; waiting up to %s for the servers being collected", shutdownWait)
+					select {
+					case <-done:
+					case <-time.After(shutdownWait):
+						log.Warnf("The run didn't stop within --shutdown-wait %s; its servers may keep leftovers for 'clean --remote'", shutdownWait)
+					}
+					return nil
+				}
+				if rep != nil {
+					reportWatchChanges(last, rep, onChange)
+					if err := saveWatchState(statePath, rep); err != nil {
+						log.Error(err)
+					}
+					last = rep
+				}
+
+				next := sched.Next(started)
+				if now := time.Now(); next.Before(now) {
+					// The run took longer than the interval
+					next = sched.Next(now)
+				}
+				log.Infof("Next run at %s", next.Format(time.RFC3339))
+				select {
+				case <-ctx.Done():
+					log.Info("Stopping watch")
+					return nil
+				case <-time.After(time.Until(next)):
+				}
+			}
+		},
+	}
+	cmd.Flags().DurationVar(&interval, "interval", time.Hour, "Time between the starts of two runs")
+	cmd.Flags().StringVar(&cronSpec, "cron", "", "Run when the local time matches this cron spec instead (e.g. \"*/30 * * * *\" or @daily)")
+	cmd.Flags().DurationVar(&shutdownWait, "shutdown-wait", time.Minute, "On SIGINT or SIGTERM, how long to wait for the run to finish the servers it is collecting")
+	cmd.Flags().StringVar(&onChange, "on-change", "", "Run this shell command when drift appears, changes or resolves; it gets the changes as JSON on stdin")
+	cmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Comma-separated list of server hostnames (required if no config.json)")
+	cmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths (or ~/ paths in the SSH user's home)")
+	cmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths (or ~/ paths in the SSH user's home)")
+	cmd.Flags().StringArrayVar(&presetNames, "preset", nil, presetHelp)
+	cmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Skip files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	cmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Only keep files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	cmd.Flags().StringVar(&collect.Method, "method", collect.MethodScript, "How files are fetched: script (sudo copy and tarball on the remote) , sftp (stream each file, no sudo, nothing written remotely) or auto (script, or sftp on servers without shell access)")
+	addChunkFlags(cmd)
+	cmd.Flags().BoolVar(&takeSnapshots, "snapshot", true, "Keep a timestamped copy of each collection under snapshots/ for the history command")
+	cmd.Flags().IntVar(&keepSnapshots, "keep-snapshots", defaultWatchSnapshots, "Delete all but this many of the newest snapshots (0 keeps all)")
+	addAnnotationFlags(cmd)
+	cmd.Flags().BoolVar(&saveDiffs, "save-diffs", false, "Save diff outputs to files")
+	cmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory to store diff files")
+	cmd.Flags().IntVar(&maxInlineLines, "max-inline-diff-lines", defaultMaxInlineLines, "Write diffs longer than this many lines to --diff-dir and only point to them (0 prints every diff)")
+	cmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	cmd.Flags().StringVar(&outputFormat, "format", report.FormatText, "Output format of the changes printed after a run (text, json, yaml)")
+	addComparisonFlags(cmd)
+	addExportFlags(cmd)
+	addEventFlags(cmd)
+	addNotifyFlags(cmd)
+	return cmd
+}
+
+// watchRun collects and analyzes once, returning nil if the run failed or
+// ctx was done before it finished
+func watchRun(ctx context.Context, cfg *config.Config) *report.Report {
+	log.Infof("Starting scheduled collection with concurrency %d", maxConcurrency)
+	success := collect.RunCollectionContext(ctx, cfg, outputDir, maxConcurrency) == nil
+	if ctx.Err() != nil {
+		log.Warn("Collection canceled")
+		return nil
+	}
+	if err := publishCollection(cfg, outputDir, success); err != nil {
+		log.Errorf("Failed to publish the collection: %v", err)
+	}
+	if !success {
+		log.Error("Collection failed; trying again at the next run")
+		return nil
+	}
+	if err := snapshotCollection(); err != nil {
+		log.Errorf("Snapshot failed: %v", err)
+	}
+	analysisCfg, err := config.LoadConfigForAnalysis(outputDir)
+	if err != nil {
+		log.Errorf("Failed to load config for analysis: %v", err)
+		return nil
+	}
+	rep, err := analyze.AnalyzeContext(ctx, analysisCfg, outputDir, analysisOptions())
+	if ctx.Err() != nil {
+		log.Warn("Analysis canceled")
+		return nil
+	}
+	if err != nil {
+		log.Errorf("Analysis failed: %v", err)
+		if rep == nil {
+			return nil
+		}
+	}
+	if err := exportResult(rep, outputDir); err != nil {
+		log.Errorf("Export failed: %v", err)
+	}
+	return rep
+}
+
+// reportWatchChanges prints, notifies and runs the hook when the drift of rep
+// differs from that of the previous run. Without a previous run, existing
+// drift counts as new.
+func reportWatchChanges(last, rep *report.Report, onChange string) {
+	if last == nil {
+		last = &report.Report{GeneratedAt: rep.GeneratedAt}
+	}
+	delta := report.Compare(last, rep)
+	hooks, err := webhooks()
+	if err != nil {
+		log.Error(err) // Checked at startup
+	}
+	flushNotifications()
+	if delta.Empty() {
+		log.Infof("No change in drift (%d file(s) drifting)", delta.Unchanged)
+		if notifyOn == notify.OnAlways {
+			for _, h := range hooks {
+				if err := notify.Send(h, rep); err != nil {
+					log.Errorf("Notification failed: %v", err)
+				}
+			}
+		}
+		return
+	}
+
+	log.Warnf("Drift changed: %d new, %d resolved, %d changed", len(delta.NewDrift), len(delta.Resolved), len(delta.Changed))
+	if err := report.WriteDelta(os.Stdout, delta, outputFormat); err != nil {
+		log.Errorf("Failed to print the changes: %v", err)
+	}
+	for _, h := range hooks {
+		h.On = notify.OnAlways // Resolved drift is news too
+		if err := notify.Send(h, rep); err != nil {
+			log.Errorf("Notification failed: %v", err)
+		}
+	}
+	if onChange != "" {
+		if err := runChangeHook(onChange, delta, rep); err != nil {
+			log.Errorf("--on-change command failed: %v", err)
+		}
+	}
+}
+
+// runChangeHook runs the --on-change command with the delta on stdin and
+// its counts in the environment
+func runChangeHook(command string, delta *report.Delta, rep *report.Report) error {
+	input, err := json.Marshal(delta)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the changes")
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("REMOTE_DIFF_NEW_DRIFT=%d", len(delta.NewDrift)),
+		fmt.Sprintf("REMOTE_DIFF_RESOLVED=%d", len(delta.Resolved)),
+		fmt.Sprintf("REMOTE_DIFF_CHANGED=%d", len(delta.Changed)),
+		fmt.Sprintf("REMOTE_DIFF_DRIFTING=%d", rep.Summary.Different+rep.Summary.Errors),
+		"REMOTE_DIFF_OUTPUT_DIR="+outputDir,
+	)
+	return cmd.Run()
+}
+
+// saveWatchState keeps rep as the report the next run is compared with. The
+// file is replaced in one step, so a watcher killed while saving leaves the
+// previous state rather than a truncated one.
+func saveWatchState(path string, rep *report.Report) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to save watch state to %s", path)
+	}
+	defer os.Remove(f.Name()) // No-op once renamed
+	defer f.Close()
+	if err := report.Write(f, rep, report.FormatJSON); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to save watch state to %s", path)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to save watch state to %s", path)
+	}
+	return errors.Wrapf(os.Rename(f.Name(), path), "failed to save watch state to %s", path)
+}
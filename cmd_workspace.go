@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/workspace"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var workspacePath string
+
+// resolveWorkspaceOutputDir points outputDir at the active workspace unless
+// -o/--output-dir was given explicitly
+func resolveWorkspaceOutputDir(cmd *cobra.Command) {
+	if cmd.Flags().Changed("output-dir") {
+		return
+	}
+	reg, err := workspace.Load()
+	if err != nil {
+		log.Warnf("Ignoring workspace registry: %v", err)
+		return
+	}
+	if ws, ok := reg.ActiveWorkspace(); ok {
+		outputDir = ws.Path
+		log.Infof("Using workspace %q (%s)", ws.Name, ws.Path)
+	}
+}
+
+func newWorkspaceCmd() *cobra.Command {
+	workspaceCmd := &cobra.Command{
+		Use:   "workspace",
+		Short: "Manage named output directories (e.g. one per environment)",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List workspaces (the active one is marked with *)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reg, err := workspace.Load()
+			if err != nil {
+				return err
+			}
+			list := reg.List()
+			if len(list) == 0 {
+				fmt.Println("No workspaces defined. Create one with 'workspace create <name>'.")
+				return nil
+			}
+			for _, ws := range list {
+				marker := " "
+				if ws.Name == reg.Active {
+					marker = "*"
+				}
+				fmt.Printf("%s %-20s %s\n", marker, ws.Name, ws.Path)
+			}
+			return nil
+		},
+	}
+
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a workspace and its output directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reg, err := workspace.Load()
+			if err != nil {
+				return err
+			}
+			dir := workspacePath
+			if dir == "" {
+				dir = filepath.Join("workspaces", args[0])
+			}
+			ws, err := reg.Create(args[0], dir)
+			if err != nil {
+				return err
+			}
+			if err := reg.Save(); err != nil {
+				return err
+			}
+			fmt.Printf("Created workspace %q at %s\n", ws.Name, ws.Path)
+			if reg.Active == ws.Name {
+				fmt.Printf("Workspace %q is now active\n", ws.Name)
+			}
+			return nil
+		},
+	}
+	createCmd.Flags().StringVar(&workspacePath, "path", "", "Output directory for the workspace (default ./workspaces/<name>)")
+
+	switchCmd := &cobra.Command{
+		Use:   "switch <name>",
+		Short: "Make a workspace the active one",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reg, err := workspace.Load()
+			if err != nil {
+				return err
+			}
+			ws, err := reg.Switch(args[0])
+			if err != nil {
+				return err
+			}
+			if err := reg.Save(); err != nil {
+				return err
+			}
+			fmt.Printf("Switched to workspace %q (%s)\n", ws.Name, ws.Path)
+			return nil
+		},
+	}
+
+	workspaceCmd.AddCommand(listCmd, createCmd, switchCmd)
+	return workspaceCmd
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Collections estimated above either threshold need confirmation
+const (
+	defaultConfirmBytes int64 = 1 << 30
+	defaultConfirmFiles       = 10000
+)
+
+var (
+	confirmBytes int64
+	confirmFiles int
+	assumeYes    bool
+)
+
+// addConfirmFlags adds the large collection safeguard flags to a command that collects
+func addConfirmFlags(cmd *cobra.Command) {
+	cmd.Flags().Int64Var(&confirmBytes, "confirm-bytes", defaultConfirmBytes, "Ask before collecting more than this many bytes in total, estimated with a plan first (0 = no limit)")
+	cmd.Flags().IntVar(&confirmFiles, "confirm-files", defaultConfirmFiles, "Ask before collecting more than this many files in total, estimated with a plan first (0 = no limit)")
+	cmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Collect without asking, however large the estimate")
+}
+
+// confirmCollection estimates the collection with a plan and, if it exceeds
+// --confirm-bytes or --confirm-files, asks on the terminal whether to go on.
+// Without a terminal the collection is refused unless --yes was given.
+func confirmCollection(cfg *config.Config) error {
+	// A replay copies nothing, and keeping the estimate out of recordings lets
+	// them replay the same with or without --yes
+	if assumeYes || replayDir != "" || recordDir != "" || (confirmBytes <= 0 && confirmFiles <= 0) {
+		return nil
+	}
+
+	log.Info("Estimating the collection size (skip with --yes)...")
+	plans, err := collect.RunPlan(cfg, maxConcurrency)
+	if err != nil {
+		return err
+	}
+	var files int
+	var bytes, largestBytes int64
+	largest := ""
+	for _, plan := range plans {
+		if plan.Err != nil {
+			// The collection reports the server's failure itself
+			log.Warnf("[%s] Not included in the estimate: %v", plan.Server, plan.Err)
+			continue
+		}
+		files += len(plan.Files)
+		size := plan.TotalSize()
+		bytes += size
+		if largest == "" || size > largestBytes {
+			largest, largestBytes = plan.Server, size
+		}
+	}
+	estimate := fmt.Sprintf("%d file(s), %s from %d server(s)", files, util.FormatBytes(bytes), len(plans))
+	if (confirmBytes <= 0 || bytes <= confirmBytes) && (confirmFiles <= 0 || files <= confirmFiles) {
+		log.Infof("Estimated collection: %s", estimate)
+		return nil
+	}
+
+	var exceeded []string
+	if confirmBytes > 0 && bytes > confirmBytes {
+		exceeded = append(exceeded, fmt.Sprintf("--confirm-bytes %d (%s)", confirmBytes, util.FormatBytes(confirmBytes)))
+	}
+	if confirmFiles > 0 && files > confirmFiles {
+		exceeded = append(exceeded, fmt.Sprintf("--confirm-files %d", confirmFiles))
+	}
+	message := fmt.Sprintf("The collection would copy %s, the most from %s (%s), above %s",
+		estimate, largest, util.FormatBytes(largestBytes), strings.Join(exceeded, " and "))
+
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("%s; rerun with --yes to collect anyway, or narrow it down (see 'plan')", message)
+	}
+	fmt.Fprintf(os.Stderr, "%s.\nContinue? [y/N] ", message)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("collection cancelled")
+}
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
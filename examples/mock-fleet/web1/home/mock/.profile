@@ -0,0 +1,3 @@
+# ~/.profile: executed by the login shell
+export EDITOR=vim
+export PATH="$HOME/bin:$PATH"
@@ -0,0 +1,3 @@
+# ~/.profile: executed by the login shell
+export EDITOR=nano
+export PATH="$HOME/bin:$PATH"
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	forgetHostKeys []string // Servers or host names whose pinned key is dropped before connecting
+	hostKeyDir     string   // Where host keys are pinned; the output directory when empty
+)
+
+// applyHostKeys pins the host keys of the servers in the output directory,
+// first forgetting those given with --forget-hostkey. The keys are only
+// forgotten once, not on every run of watch or serve.
+func applyHostKeys(cfg *config.Config) error {
+	dir := hostKeyDir
+	if dir == "" {
+		dir = outputDir
+	}
+	pins, err := sshutil.LoadHostKeyPins(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range forgetHostKeys {
+		hosts := []string{name}
+		if host := cfg.ServerSettings(name).Hostname; host != "" && host != name {
+			hosts = append(hosts, host)
+		}
+		var forgotten []string
+		for _, host := range hosts {
+			addresses, err := pins.Forget(host)
+			if err != nil {
+				return err
+			}
+			forgotten = append(forgotten, addresses...)
+		}
+		if len(forgotten) == 0 {
+			log.Warnf("No host key pinned for %s", name)
+		}
+		for _, address := range forgotten {
+			log.Warnf("Forgot the pinned host key of %s; the key it presents next is trusted", address)
+		}
+	}
+	forgetHostKeys = nil
+	collect.HostKeys = pins
+	return nil
+}
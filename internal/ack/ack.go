@@ -0,0 +1,212 @@
+// Package ack keeps the known, accepted differences of an output directory
+// in ack.json, such as a hostname file that is meant to differ on every
+// server. An analysis marks the files they cover as acknowledged: listed
+// apart, and not counted as files with diffs.
+package ack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+)
+
+// FileName is the acknowledgements file looked up in the output directory
+const FileName = "ack.json"
+
+// Entry acknowledges the differences of a file, or of the files matching a
+// pattern
+type Entry struct {
+	Path string `json:"path"` // Manifest path (etc/hostname) or glob pattern (etc/ssh/ssh_host_*)
+	// Only covers files where no other servers' copies are out of line; empty covers any
+	Servers []string `json:"servers,omitempty"`
+	// Only covers the file while it differs exactly this way (see Fingerprint)
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	Added       time.Time `json:"added"`
+}
+
+var schema = jsonschema.For(Store{}, jsonschema.Options{
+	Name:        "ack",
+	Title:       "Acknowledged differences",
+	Description: "ack.json: differences that analyses list apart instead of as drift",
+})
+
+// Schema returns the JSON Schema of ack.json
+func Schema() *jsonschema.Schema {
+	return schema
+}
+
+// Store is the acknowledgements file of an output directory
+type Store struct {
+	path string
+	Acks []Entry `json:"acks"`
+}
+
+// Load reads outputDir/ack.json. A missing file holds no acknowledgements.
+func Load(outputDir string) (*Store, error) {
+	return LoadFile(filepath.Join(outputDir, FileName))
+}
+
+// LoadFile reads the acknowledgements kept in p; a missing file holds none
+func LoadFile(p string) (*Store, error) {
+	s := &Store{path: p}
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read acknowledgements %s", p)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse acknowledgements %s", p)
+	}
+	if err := schema.Validate(data); err != nil {
+		return nil, errors.Wrapf(err, "acknowledgements %s", p)
+	}
+	for _, e := range s.Acks {
+		if _, err := path.Match(e.Path, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid path pattern %q", p, e.Path)
+		}
+	}
+	return s, nil
+}
+
+// Save writes the acknowledgements back to the file they were loaded from
+func (s *Store) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal acknowledgements")
+	}
+	if err := schema.Validate(data); err != nil {
+		return errors.Wrap(err, "acknowledgements")
+	}
+	if err := os.WriteFile(s.path, append(data, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write acknowledgements %s", s.path)
+	}
+	return nil
+}
+
+// Path returns the file the acknowledgements are kept in
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Add acknowledges the files of e.Path, replacing an entry of the same path
+// and fingerprint. It reports whether an entry was replaced.
+func (s *Store) Add(e Entry) (bool, error) {
+	e.Path = CleanPath(e.Path)
+	if e.Path == "" {
+		return false, fmt.Errorf("missing path")
+	}
+	if _, err := path.Match(e.Path, ""); err != nil {
+		return false, fmt.Errorf("invalid path pattern %q", e.Path)
+	}
+	if e.Added.IsZero() {
+		e.Added = time.Now().UTC()
+	}
+	for i, old := range s.Acks {
+		if old.Path == e.Path && old.Fingerprint == e.Fingerprint {
+			s.Acks[i] = e
+			return true, nil
+		}
+	}
+	s.Acks = append(s.Acks, e)
+	return false, nil
+}
+
+// Remove withdraws the acknowledgements of p and returns how many there were
+func (s *Store) Remove(p string) int {
+	p = CleanPath(p)
+	kept := s.Acks[:0]
+	for _, e := range s.Acks {
+		if e.Path != p {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(s.Acks) - len(kept)
+	s.Acks = kept
+	return removed
+}
+
+// Covering returns the first entry that acknowledges f in a report of
+// servers, or nil if none does
+func (s *Store) Covering(f report.FileResult, servers []string) *Entry {
+	f.Acknowledged = false // Judged by how it drifts
+	for i, e := range s.Acks {
+		if e.covers(f, servers) {
+			return &s.Acks[i]
+		}
+	}
+	return nil
+}
+
+// Apply marks the files of r that are acknowledged and returns how many
+// there are. Call Finalize afterwards to count them apart.
+func (s *Store) Apply(r *report.Report) int {
+	n := 0
+	for i, f := range r.Files {
+		if f.Drifting() && s.Covering(f, r.Servers) != nil {
+			r.Files[i].Acknowledged = true
+			n++
+		}
+	}
+	return n
+}
+
+func (e Entry) covers(f report.FileResult, servers []string) bool {
+	if ok, _ := path.Match(e.Path, f.Path); !ok {
+		return false
+	}
+	if e.Fingerprint != "" && e.Fingerprint != Fingerprint(f) {
+		return false
+	}
+	if len(e.Servers) == 0 {
+		return true
+	}
+	for _, server := range f.DriftedServers(servers) {
+		if !contains(e.Servers, server) {
+			return false
+		}
+	}
+	return true
+}
+
+// CleanPath turns a path as given on the command line (/etc/hostname) into
+// a manifest path (etc/hostname)
+func CleanPath(p string) string {
+	return strings.TrimPrefix(filepath.ToSlash(strings.TrimSpace(p)), "/")
+}
+
+// Fingerprint identifies how a file differs: its status and each server's
+// checksum, mode and ownership, and path. It changes once any copy does.
+func Fingerprint(f report.FileResult) string {
+	lines := []string{"status " + f.Status}
+	for kind, values := range map[string]map[string]string{"checksum": f.Checksums, "metadata": f.Metadata, "location": f.Locations} {
+		for server, v := range values {
+			lines = append(lines, kind+" "+server+" "+v)
+		}
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
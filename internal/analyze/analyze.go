@@ -4,25 +4,95 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/brndnsvr/remote-diff-tool/internal/ack"
 	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/diffengine"
+	"github.com/brndnsvr/remote-diff-tool/internal/ignore"
+	"github.com/brndnsvr/remote-diff-tool/internal/normalize"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/structdiff"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 )
 
+// Diff engine names accepted by Options.DiffEngine
+const (
+	DiffEngineNative   = "native"   // Built-in Myers implementation (no external dependencies)
+	DiffEngineExternal = "external" // Shell out to the system `diff -u`
+)
+
+// Options controls how RunAnalysis compares the collected files
+type Options struct {
+	DiffDir        string
+	SaveDiffs      bool
+	MaxConcurrency int
+	DiffEngine     string
+	Format         string // Report format written to Output (text, json, yaml)
+	Output         io.Writer
+	ChecksumOnly   bool // Report checksum mismatches without content diffs (local copies may not exist)
+	TextOnly       bool // Diff JSON, YAML, TOML and INI files as text only, without comparing their parsed content
+	// Diffs longer than this many lines are written to DiffDir even without
+	// SaveDiffs, and the text report only points to them. 0 prints every diff.
+	MaxInlineLines int
+	// Files with content diffs are only reported if their similarity (that
+	// of their least similar pair, in percent) is within this range. A
+	// MaxSimilarity of 0 sets no upper bound.
+	MinSimilarity float64
+	MaxSimilarity float64
+	SortBy        string   // Order of the report's files (report.SortPath, ...); "" sorts by path
+	GroupBy       string   // Grouping of the report's files (report.GroupOwner, ...); "" doesn't group
+	IgnoreAcks    bool     // Report the differences acknowledged in ack.json like any other
+	Paths         []string // Only compare these manifest paths (e.g. "etc/hosts"); empty compares all
+	Files         []string // Only compare the files at exactly these remote paths (e.g. "/etc/hosts"), and those of Within
+	Within        []string // Only compare files at or below these remote paths (e.g. "/etc/nginx", "~/.bashrc"), and those of Files; both empty compare all
+	UnicodePaths  string   // How paths in different Unicode forms match (UnicodePathsExact, ...); "" is exact
+
+	onDisk map[string]map[string]string // server -> path -> collected path, for paths matched in NFC
+}
+
+// similarityFilter reports whether Options restrict the similarity of reported files
+func (o Options) similarityFilter() bool {
+	return o.MinSimilarity > 0 || (o.MaxSimilarity > 0 && o.MaxSimilarity < 100)
+}
+
 type fileComparisonResult struct {
-	FilePath string
-	IsDiff   bool
-	Diffs    map[string]string // map[comparisonPair]diffOutput, e.g., "server1_vs_server2" -> "diff..."
-	Errors   []string          // Errors encountered during comparison
+	FilePath  string
+	IsDiff    bool
+	Checksums map[string]string // server -> checksum, for servers where the file was valid
+	Diffs     []report.PairDiff // One entry per differing server pair, in server order
+	Errors    []string          // Errors encountered during comparison
+	// Set when the copies differ only in lines matched by ignore patterns
+	IgnoredOnly bool
+	// Set when some copies only differ in the formatting or key order of a structured file
+	Equivalent bool
+	// Set when some copies are the same after applying the normalization rules
+	Normalized bool
+	Formats    []report.FormatDiff // Pairs holding the same text in different formats
+	// Set when every differing pair only differs in format
+	FormatOnly bool
+	Unstable   []string // Servers where the file changed while it was collected
+	Volatile   []string // Servers where the file was open for writing; set only if it wasn't compared
+	// Set when a copy holds binary content, which is compared by size and checksum only
+	Binary bool
+	Sizes  map[string]int64 // server -> size of the local copy, for binary and large files
+	// Set instead of Diffs for large files hashed in chunks
+	Chunks []report.ChunkDiff
+	// Servers with identical copies, set when more than two copies differ
+	ContentGroups []report.ContentGroup
 }
 
 // compareSingleFile performs checksum and content diff for one file path across servers
@@ -31,8 +101,9 @@ func compareSingleFile(
 	servers []string,
 	manifest *config.Manifest,
 	baseOutputDir string, // This is the main output dir (e.g., ".")
-	saveDiffs bool,
-	diffDir string,
+	opts Options,
+	ignoreLine func(line string) bool, // nil unless line ignore patterns are set
+	normalizeRules []string, // Applied to both copies before diffing; nil for none
 	resultChan chan<- fileComparisonResult,
 ) {
 	log.Debugf("Comparing file: %s", filePath)
@@ -43,10 +114,18 @@ func compareSingleFile(
 	foundOnAll := true
 	var firstChecksum string
 	allMatch := true
+	var volatile []string
 
 	// 1. Gather checksums and check existence from manifest
 	for i, server := range servers {
 		info, exists := manifest.GetFileInfo(server, filePath)
+		if exists && info.Volatile {
+			volatile = append(volatile, server)
+			if info.Checksum == "" && info.Error == "" {
+				allMatch = false // Skipped, so there is nothing to compare
+				continue
+			}
+		}
 		if !exists || info.Error != "" || info.Checksum == "" {
 			msg := fmt.Sprintf("File %s not found or has error on server %s", filePath, server)
 			if exists && info.Error != "" {
@@ -61,10 +140,17 @@ func compareSingleFile(
 
 		// Store checksum
 		checksums[server] = info.Checksum
+		if info.Unstable {
+			result.Unstable = append(result.Unstable, server)
+		}
 
 		// --- PATH UPDATED TO INCLUDE CollectedFilesBaseDir ---
 		// Construct the full path to the local file within the collected-files structure
-		filePaths[server] = filepath.Join(baseOutputDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server), filepath.FromSlash(filePath)) // Use local path separator
+		localPath := filePath
+		if p, ok := opts.onDisk[server][filePath]; ok {
+			localPath = p // Collected under another Unicode spelling
+		}
+		filePaths[server] = filepath.Join(baseOutputDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server), filepath.FromSlash(localPath)) // Use local path separator
 		// --- END OF PATH UPDATE ---
 
 		// Compare checksum with the first one found
@@ -76,6 +162,7 @@ func compareSingleFile(
 	}
 
 	result.Errors = errorsFound
+	result.Checksums = checksums
 
 	// If not found on all servers, cannot compare
 	if !foundOnAll {
@@ -85,6 +172,21 @@ func compareSingleFile(
 		return
 	}
 
+	// Files open for writing are expected to drift; only identical copies are reported as such
+	if len(volatile) > 0 && !allMatch {
+		log.Infof("Not comparing %s: it was open for writing on %s.", filePath, strings.Join(volatile, ", "))
+		result.Volatile = volatile
+		resultChan <- result
+		return
+	}
+
+	// A copy made while the file changed may be torn, so diffing it means nothing
+	if len(result.Unstable) > 0 {
+		log.Warnf("Not comparing %s: it changed during collection on %s.", filePath, strings.Join(result.Unstable, ", "))
+		resultChan <- result
+		return
+	}
+
 	// 2. Compare checksums
 	if allMatch {
 		log.Infof("Checksums match for %s across all servers.", filePath)
@@ -94,15 +196,53 @@ func compareSingleFile(
 	}
 
 	// 3. Checksums differ, perform content diff
-	log.Infof("Checksums differ for %s. Performing content diff...", filePath)
 	result.IsDiff = true // Mark as different
-	result.Diffs = make(map[string]string)
+	if opts.ChecksumOnly {
+		log.Infof("Checksums differ for %s (content diff skipped).", filePath)
+		resultChan <- result
+		return
+	}
+
+	// Servers with the same copy are compared once, through their group's first server
+	groups := report.GroupContents(servers, checksums)
+	reps := representatives(groups)
+	if len(checksums) > 2 {
+		result.ContentGroups = groups
+	}
 
-	// Pairwise comparison using external `diff` command
-	for i := 0; i < len(servers); i++ {
-		for j := i + 1; j < len(servers); j++ {
-			server1 := servers[i]
-			server2 := servers[j]
+	// Large files are compared by the chunk hashes taken during collection rather than loaded for a diff
+	if chunks, sizes, ok, err := chunkDiffs(filePath, servers, reps, manifest, filePaths); ok {
+		if err != nil {
+			msg := fmt.Sprintf("Error comparing chunks of %s: %v", filePath, err)
+			log.Error(msg)
+			result.Errors = append(result.Errors, msg)
+		} else {
+			log.Infof("Checksums differ for large file %s (compared by chunk).", filePath)
+			result.Chunks, result.Sizes = chunks, sizes
+		}
+		resultChan <- result
+		return
+	}
+
+	// A line diff of binary content is meaningless and can take as much memory as the files
+	if binary, sizes := binaryCopies(servers, filePaths); binary {
+		log.Infof("Checksums differ for binary file %s (content diff skipped).", filePath)
+		result.Binary, result.Sizes = true, sizes
+		resultChan <- result
+		return
+	}
+	log.Infof("Checksums differ for %s. Performing content diff...", filePath)
+	anyDiff := false
+	structured := ""
+	if !opts.TextOnly {
+		structured = structdiff.Detect(filePath)
+	}
+
+	// Pairwise comparison of the groups' representatives
+	for i := 0; i < len(reps); i++ {
+		for j := i + 1; j < len(reps); j++ {
+			server1 := reps[i]
+			server2 := reps[j]
 			path1 := filePaths[server1]
 			path2 := filePaths[server2]
 
@@ -120,53 +260,416 @@ func compareSingleFile(
 				continue
 			}
 
-			cmd := exec.Command("diff", "-u", path1, path2) // -u for unified diff format
-			var out bytes.Buffer
-			cmd.Stdout = &out
-			err := cmd.Run()
+			// Structured files are compared by their parsed content first; ones that
+			// don't parse are diffed as text
+			var changes []structdiff.Change
+			if structured != "" {
+				var err error
+				changes, err = structdiff.CompareFiles(structured, path1, path2)
+				if err != nil {
+					log.Debugf("Diffing %s between %s and %s as text: %v", filePath, server1, server2, err)
+				} else if len(changes) == 0 {
+					log.Infof("%s is equivalent on %s and %s: it only differs in formatting or key order", filePath, server1, server2)
+					result.Equivalent = true
+					continue
+				}
+			}
 
-			diffOutput := out.String()
+			// A diff of copies that differ only in line endings, a trailing newline
+			// or a byte order mark is either noise on every line or empty
+			if kinds := formatDifferences(path1, path2); len(kinds) > 0 {
+				log.Infof("%s differs between %s and %s only in format: %s", filePath, server1, server2, strings.Join(kinds, "; "))
+				result.Formats = append(result.Formats, report.FormatDiff{From: server1, To: server2, Differences: kinds})
+				continue
+			}
 
+			var diffOutput string
+			var differ bool
+			var err error
+			var lineCounts [2]int // Of the normalized copies, for the similarity
+			if len(normalizeRules) > 0 {
+				diffOutput, lineCounts, err = normalizedDiff(path1, path2, normalizeRules)
+				differ = diffOutput != ""
+				if err == nil && !differ {
+					log.Infof("%s is the same on %s and %s after normalization (%s)", filePath, server1, server2, strings.Join(normalizeRules, ", "))
+					result.Normalized = true
+					continue
+				}
+			} else {
+				diffOutput, differ, err = runDiff(opts.DiffEngine, path1, path2)
+			}
 			if err != nil {
-				// `diff` exits with status 1 if files differ, 0 if same, >1 on error
-				if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-					// This is expected when files differ
-					log.Infof("Differences found between %s:%s and %s:%s", server1, filePath, server2, filePath)
-					comparisonKey := fmt.Sprintf("%s_vs_%s", server1, server2)
-					result.Diffs[comparisonKey] = diffOutput
-
-					// Save diff if requested
-					if saveDiffs && diffDir != "" {
-						diffFileName := fmt.Sprintf("%s__%s_vs_%s.diff", strings.ReplaceAll(filePath, "/", "_"), server1, server2)
-						diffFilePath := filepath.Join(diffDir, diffFileName)
-						if err := os.MkdirAll(filepath.Dir(diffFilePath), 0755); err != nil {
-							log.Errorf("Failed to create diff output directory %s: %v", filepath.Dir(diffFilePath), err)
-						} else {
-							if err := os.WriteFile(diffFilePath, []byte(diffOutput), 0644); err != nil {
-								log.Errorf("Failed to write diff file %s: %v", diffFilePath, err)
-							} else {
-								log.Debugf("Diff saved to %s", diffFilePath)
-							}
-						}
+				msg := fmt.Sprintf("Error running diff for %s vs %s: %v", path1, path2, err)
+				log.Errorf(msg)
+				result.Errors = append(result.Errors, msg)
+				continue
+			}
+
+			var hunks []diffengine.Hunk
+			parsed := false
+			if differ {
+				var parseErr error
+				hunks, parseErr = diffengine.ParseUnified(diffOutput)
+				parsed = parseErr == nil
+				if parseErr != nil {
+					log.Warnf("Failed to parse diff output for %s (%s vs %s): %v", filePath, server1, server2, parseErr)
+				} else if ignoreLine != nil {
+					if kept := diffengine.FilterHunks(hunks, ignoreLine); len(kept) < len(hunks) {
+						from, to := diffengine.HeaderLabels(diffOutput)
+						hunks, diffOutput = kept, diffengine.FormatUnified(from, to, kept)
+						differ = len(kept) > 0
 					}
+				}
+			}
 
-				} else {
-					// Actual error running diff command
-					msg := fmt.Sprintf("Error running diff for %s vs %s: %v", path1, path2, err)
-					log.Errorf(msg)
-					result.Errors = append(result.Errors, msg)
+			if differ {
+				anyDiff = true
+				log.Infof("Differences found between %s:%s and %s:%s", server1, filePath, server2, filePath)
+				pair := report.PairDiff{
+					From:    server1,
+					To:      server2,
+					Hunks:   report.HunksFromEngine(hunks),
+					Unified: diffOutput,
 				}
+				for _, c := range changes {
+					pair.KeyChanges = append(pair.KeyChanges, report.KeyChange{Path: c.Path, Kind: c.Kind, Old: c.Old, New: c.New})
+				}
+				if parsed && len(normalizeRules) > 0 {
+					sim := similarityOf(lineCounts[0], lineCounts[1], pair)
+					pair.Similarity = &sim
+					pair.Category = categorize(pair)
+				} else if parsed {
+					if sim, err := similarity(path1, path2, pair); err != nil {
+						log.Warnf("Failed to compute the similarity of %s (%s vs %s): %v", filePath, server1, server2, err)
+					} else {
+						pair.Similarity = &sim
+					}
+					pair.Category = categorize(pair)
+				}
+
+				// Save diff if requested, or if it is too long to print
+				tooLong := opts.MaxInlineLines > 0 && strings.Count(diffOutput, "\n") > opts.MaxInlineLines
+				if (opts.SaveDiffs || tooLong) && opts.DiffDir != "" {
+					diffFileName := fmt.Sprintf("%s__%s_vs_%s.diff", strings.ReplaceAll(filePath, "/", "_"), server1, server2)
+					if diffFilePath, err := saveDiff(opts.DiffDir, diffFileName, diffOutput); err != nil {
+						log.Errorf("Failed to save diff of %s (%s vs %s): %v", filePath, server1, server2, err)
+					} else {
+						log.Debugf("Diff saved to %s", diffFilePath)
+						pair.SavedTo = diffFilePath
+						pair.Collapsed = tooLong // Printed in full if it couldn't be saved
+					}
+				}
+				result.Diffs = append(result.Diffs, pair)
+			} else if ignoreLine != nil {
+				log.Debugf("%s differs between %s and %s only in ignored lines", filePath, server1, server2)
 			} else {
-				// Diff exit code 0 means files are identical, contradicting checksum diff. Log warning.
+				// No differences contradicts the checksum mismatch. Log warning.
 				log.Warnf("Checksums differed but 'diff' command reported no differences for %s between %s and %s. Check file contents.", filePath, server1, server2)
-				// Could still store an empty diff if needed: result.Diffs[comparisonKey] = ""
+				// Could still store an empty diff if needed
 			}
 		}
 	}
 
+	if !anyDiff && len(result.Formats) > 0 && len(result.Errors) == 0 {
+		result.FormatOnly = true
+	} else if !anyDiff && result.Equivalent && len(result.Errors) == 0 {
+		log.Infof("%s differs only in formatting or key order.", filePath)
+		result.IsDiff = false
+	} else if !anyDiff && result.Normalized && len(result.Errors) == 0 {
+		log.Infof("%s is the same on all servers after normalization.", filePath)
+		result.IsDiff = false
+	} else if !anyDiff && ignoreLine != nil && len(result.Errors) == 0 {
+		log.Infof("%s differs only in lines matched by ignore patterns.", filePath)
+		result.IsDiff = false
+		result.IgnoredOnly = true
+	}
 	resultChan <- result
 }
 
+// similarity returns how alike two copies are, in percent, from the sizes of
+// the files and their diff: twice the unchanged lines over all lines of both
+func similarity(path1, path2 string, d report.PairDiff) (float64, error) {
+	lines1, err := countLines(path1)
+	if err != nil {
+		return 0, err
+	}
+	lines2, err := countLines(path2)
+	if err != nil {
+		return 0, err
+	}
+	return similarityOf(lines1, lines2, d), nil
+}
+
+// similarityOf computes the similarity of a diff between contents of lines1 and lines2 lines
+func similarityOf(lines1, lines2 int, d report.PairDiff) float64 {
+	if lines1+lines2 == 0 {
+		return 100
+	}
+	_, removed := d.Changes()
+	unchanged := lines1 - removed
+	if unchanged < 0 {
+		unchanged = 0
+	}
+	return math.Round(2*float64(unchanged)/float64(lines1+lines2)*1000) / 10
+}
+
+// normalizedDiff diffs two files after applying normalization rules to both,
+// with the built-in engine. It returns "" if the normalized contents are the
+// same, and the number of lines of each normalized copy.
+func normalizedDiff(path1, path2 string, rules []string) (string, [2]int, error) {
+	var contents [2]string
+	var counts [2]int
+	for i, p := range []string{path1, path2} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return "", counts, errors.Wrapf(err, "failed to read %s", p)
+		}
+		contents[i] = normalize.Apply(string(data), rules)
+		counts[i] = strings.Count(contents[i], "\n")
+	}
+	return diffengine.UnifiedStrings(path1+" (normalized)", path2+" (normalized)", contents[0], contents[1]), counts, nil
+}
+
+// categorize sorts a diff into one of report.Categories. Key changes of a
+// structured file take precedence over its lines, which a reordering may
+// have shuffled.
+func categorize(d report.PairDiff) string {
+	if len(d.KeyChanges) > 0 {
+		kinds := make(map[string]bool)
+		for _, c := range d.KeyChanges {
+			kinds[c.Kind] = true
+		}
+		switch {
+		case len(kinds) > 1 || kinds[structdiff.Changed]:
+			return report.CategoryValueChange
+		case kinds[structdiff.Added]:
+			return report.CategoryAppendOnly
+		default:
+			return report.CategoryRemoveOnly
+		}
+	}
+
+	added, removed := d.Changes()
+	switch {
+	case removed == 0:
+		return report.CategoryAppendOnly
+	case added == 0:
+		return report.CategoryRemoveOnly
+	case sameLines(d.Hunks):
+		return report.CategoryReorderOnly
+	case d.Similarity != nil && *d.Similarity < report.RewriteSimilarity:
+		return report.CategoryRewrite
+	}
+	return report.CategoryValueChange
+}
+
+// sameLines reports whether the removed lines of a diff are the added ones, in another order
+func sameLines(hunks []report.Hunk) bool {
+	balance := make(map[string]int)
+	for _, h := range hunks {
+		for _, line := range h.Lines {
+			switch {
+			case strings.HasPrefix(line, "-"):
+				balance[line[1:]]++
+			case strings.HasPrefix(line, "+"):
+				balance[line[1:]]--
+			}
+		}
+	}
+	for _, n := range balance {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// countLines counts the lines of a file, including a last one without a newline
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+	buf := make([]byte, 64*1024)
+	lines, last := 0, byte('\n')
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to read %s", path)
+		}
+	}
+	if last != '\n' {
+		lines++
+	}
+	return lines, nil
+}
+
+// saveDiff writes a diff file below diffDir and returns its path
+func saveDiff(diffDir, name, diffOutput string) (string, error) {
+	diffFilePath := filepath.Join(diffDir, name)
+	if err := os.MkdirAll(filepath.Dir(diffFilePath), 0755); err != nil {
+		return "", errors.Wrapf(err, "failed to create diff output directory %s", filepath.Dir(diffFilePath))
+	}
+	if err := os.WriteFile(diffFilePath, []byte(diffOutput), 0644); err != nil {
+		return "", errors.Wrapf(err, "failed to write diff file %s", diffFilePath)
+	}
+	return diffFilePath, nil
+}
+
+// binaryCopies reports whether any server's local copy of a file is binary,
+// with the size of each copy. Copies that can't be read are left to the diff
+// to report.
+func binaryCopies(servers []string, filePaths map[string]string) (bool, map[string]int64) {
+	binary := false
+	sizes := make(map[string]int64)
+	for _, server := range servers {
+		p := filePaths[server]
+		st, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		sizes[server] = st.Size()
+		if !binary {
+			isBinary, err := diffengine.IsBinaryFile(p)
+			if err != nil {
+				log.Debugf("Could not check whether %s is binary: %v", p, err)
+			}
+			binary = isBinary
+		}
+	}
+	return binary, sizes
+}
+
+// formatDifferences compares two local copies with diffengine.FormatDifferences.
+// Files that can't be read are left to the diff to report.
+func formatDifferences(path1, path2 string) []string {
+	a, err := os.ReadFile(path1)
+	if err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(path2)
+	if err != nil {
+		return nil
+	}
+	return diffengine.FormatDifferences(a, b)
+}
+
+// runDiff produces a unified diff of two local files with the selected engine.
+// The bool result reports whether the files differ.
+func runDiff(engine, path1, path2 string) (string, bool, error) {
+	switch engine {
+	case DiffEngineExternal:
+		cmd := exec.Command("diff", "-u", path1, path2) // -u for unified diff format
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		err := cmd.Run()
+		if err != nil {
+			// `diff` exits with status 1 if files differ, 0 if same, >1 on error
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+				return out.String(), true, nil
+			}
+			return "", false, err
+		}
+		return out.String(), false, nil
+	case DiffEngineNative, "":
+		return diffengine.UnifiedFiles(path1, path2)
+	default:
+		return "", false, fmt.Errorf("unknown diff engine %q", engine)
+	}
+}
+
+// markExpected marks the files that differ as the config's unique patterns
+// expect and returns how many there are. Errors, such as a missing copy,
+// still count as drift.
+func markExpected(rep *report.Report, unique []*pathfilter.Pattern) int {
+	n := 0
+	for i, f := range rep.Files {
+		if f.Differs() && UniqueMatch(unique, f.Path) != nil {
+			rep.Files[i].Expected = true
+			n++
+		}
+	}
+	return n
+}
+
+// UniqueMatch returns the first of the unique patterns that a manifest path
+// matches, or nil
+func UniqueMatch(unique []*pathfilter.Pattern, filePath string) *pathfilter.Pattern {
+	logical := "/" + filePath
+	if config.IsHomePath(filePath) {
+		logical = filePath
+	}
+	for _, p := range unique {
+		if p.Match(logical) {
+			return p
+		}
+	}
+	return nil
+}
+
+// pathRules resolves rules keyed by configured path for a manifest path: the
+// rules of every configured path it is at or below
+func pathRules(byPath map[string][]string) func(filePath string) []string {
+	return func(filePath string) []string {
+		logical := "/" + filePath
+		if config.IsHomePath(filePath) {
+			logical = filePath
+		}
+		var rules []string
+		for p, r := range byPath {
+			if logical == p || strings.HasPrefix(logical, p+"/") {
+				rules = append(rules, r...)
+			}
+		}
+		return rules
+	}
+}
+
+// lineIgnorer combines the config's ignore_lines with the line: rules of the
+// ignore file and the path_ignore_lines of the configured path a file is at or
+// below. For a manifest path, it returns nil when none of them apply.
+func lineIgnorer(cfg *config.Config, rules *ignore.Rules) (func(filePath string) func(string) bool, error) {
+	patterns, err := cfg.LinePatterns()
+	if err != nil {
+		return nil, err
+	}
+	byPath, err := cfg.PathLinePatterns()
+	if err != nil {
+		return nil, err
+	}
+	return func(filePath string) func(string) bool {
+		logical := "/" + filePath
+		if config.IsHomePath(filePath) {
+			logical = filePath
+		}
+		own := patterns
+		for p, res := range byPath {
+			if logical == p || strings.HasPrefix(logical, p+"/") {
+				own = append(own[:len(own):len(own)], res...)
+			}
+		}
+		if len(own) == 0 && !rules.HasLineRules() {
+			return nil
+		}
+		return func(line string) bool {
+			for _, re := range own {
+				if re.MatchString(line) {
+					return true
+				}
+			}
+			return rules.IgnoresLine(line)
+		}
+	}, nil
+}
+
 // getFilesToCompare finds the intersection of files present in the manifest for all servers
 func getFilesToCompare(servers []string, manifest *config.Manifest) []string {
 	if len(servers) == 0 {
@@ -226,46 +729,349 @@ func getFilesToCompare(servers []string, manifest *config.Manifest) []string {
 	return commonFiles
 }
 
-// RunAnalysis orchestrates the file comparison process
-func RunAnalysis(cfg *config.Config, outputDir, diffDir string, saveDiffs bool, maxConcurrency int) (bool, error) {
+// within reports whether a remote path is one of roots or below one of them
+func within(p string, roots []string) bool {
+	for _, root := range roots {
+		if p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// movedFiles finds files that are on every server but not at the same path:
+// paths present on only some servers whose copies all have the same checksum,
+// and that together cover each server exactly once. Each is returned as a
+// StatusMoved result listing the path on every server, under the first path.
+func movedFiles(servers []string, manifest *config.Manifest) []report.FileResult {
+	if len(servers) < 2 {
+		return nil
+	}
+	manifest.Mu.RLock()
+	defer manifest.Mu.RUnlock()
+
+	// path -> server -> checksum, for paths whose valid copies are all the same
+	type copies map[string]string
+	partial := make(map[string]copies)
+	mixed := make(map[string]bool)
+	for _, server := range servers {
+		for filePath, info := range manifest.FilesByServer[server] {
+			if info.Error != "" || info.Checksum == "" || info.Unstable || mixed[filePath] {
+				continue
+			}
+			c := partial[filePath]
+			if c == nil {
+				c = make(copies)
+				partial[filePath] = c
+			}
+			for _, sum := range c {
+				if sum != info.Checksum {
+					mixed[filePath] = true
+				}
+				break
+			}
+			c[server] = info.Checksum
+		}
+	}
+
+	byChecksum := make(map[string][]string) // checksum -> paths on some but not all servers
+	for filePath, c := range partial {
+		if mixed[filePath] || len(c) == len(servers) {
+			continue
+		}
+		for _, sum := range c {
+			byChecksum[sum] = append(byChecksum[sum], filePath)
+			break
+		}
+	}
+
+	var moved []report.FileResult
+	for sum, paths := range byChecksum {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		locations := make(map[string]string)
+		disjoint := true
+		for _, p := range paths {
+			for server := range partial[p] {
+				if _, seen := locations[server]; seen {
+					disjoint = false
+				}
+				locations[server] = p
+			}
+		}
+		if !disjoint || len(locations) != len(servers) {
+			continue // Copies, or still missing somewhere: leave them to the missing-file warnings
+		}
+		checksums := make(map[string]string, len(servers))
+		for _, server := range servers {
+			checksums[server] = sum
+		}
+		log.Infof("%s has the same content on every server, but at different paths: %s", paths[0], strings.Join(paths, ", "))
+		moved = append(moved, report.FileResult{
+			Path:      paths[0],
+			Status:    report.StatusMoved,
+			Checksums: checksums,
+			Locations: locations,
+		})
+	}
+	return moved
+}
+
+// metadataDiff returns each server's recorded mode and ownership of a file if
+// they are not the same everywhere, or nil. Only the values recorded in the
+// manifest are compared; servers without any (e.g. older collections) are left out.
+func metadataDiff(filePath string, servers []string, manifest *config.Manifest) map[string]string {
+	recorded := make(map[string]string)
+	distinct := make(map[config.FileMetadata]bool)
+	for _, server := range servers {
+		info, ok := manifest.GetFileInfo(server, filePath)
+		if !ok || info.Mode == "" {
+			continue
+		}
+		recorded[server] = info.FileMetadata.String()
+		distinct[info.FileMetadata] = true
+	}
+	if len(distinct) < 2 {
+		return nil
+	}
+	return recorded
+}
+
+// RunAnalysis orchestrates the file comparison process and writes the report to opts.Output.
+// The report is returned even with an error if the comparison got far enough to produce one.
+func RunAnalysis(cfg *config.Config, outputDir string, opts Options) (*report.Report, error) {
+	if !report.ValidFormat(opts.Format) {
+		return nil, fmt.Errorf("unknown output format %q (expected %s, %s, %s, %s, %s, %s or %s)", opts.Format, report.FormatText, report.FormatJSON, report.FormatYAML, report.FormatJUnit, report.FormatSARIF, report.FormatMatrix, report.FormatHTML)
+	}
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+
+	rep, err := Analyze(cfg, outputDir, opts)
+	if rep == nil {
+		return nil, err
+	}
+	// Nothing compared: keep the text output quiet, but machine consumers still expect a (empty) document
+	if len(rep.Files) > 0 || (opts.Format != report.FormatText && opts.Format != "") {
+		if writeErr := report.Write(out, rep, opts.Format); writeErr != nil {
+			return rep, errors.Wrap(writeErr, "failed to write analysis report")
+		}
+	}
+	if err != nil {
+		return rep, err
+	}
+
+	log.Info("Analysis finished.")
+	return rep, nil
+}
+
+// Analyze compares the collected files of cfg.Servers in outputDir and returns the report.
+// If some comparisons failed, both the (partial) report and an error are returned.
+func Analyze(cfg *config.Config, outputDir string, opts Options) (*report.Report, error) {
+	return AnalyzeContext(context.Background(), cfg, outputDir, opts)
+}
+
+// AnalyzeContext is Analyze with a context. Once ctx is done, files not yet
+// compared are skipped and reported as analysis errors.
+func AnalyzeContext(ctx context.Context, cfg *config.Config, outputDir string, opts Options) (*report.Report, error) {
 	log.Info("Starting analysis...")
+	diffDir, saveDiffs, maxConcurrency := opts.DiffDir, opts.SaveDiffs, opts.MaxConcurrency
+
+	switch opts.DiffEngine {
+	case DiffEngineNative, DiffEngineExternal, "":
+	default:
+		return nil, fmt.Errorf("unknown diff engine %q (expected %s or %s)", opts.DiffEngine, DiffEngineNative, DiffEngineExternal)
+	}
+	if opts.MinSimilarity < 0 || opts.MinSimilarity > 100 || opts.MaxSimilarity < 0 || opts.MaxSimilarity > 100 {
+		return nil, fmt.Errorf("--min-similarity and --max-similarity must be between 0 and 100")
+	}
+	if opts.MaxSimilarity > 0 && opts.MinSimilarity > opts.MaxSimilarity {
+		return nil, fmt.Errorf("--min-similarity is above --max-similarity")
+	}
+	if !report.ValidSort(opts.SortBy) {
+		return nil, fmt.Errorf("unknown sort order %q (expected %s, %s, %s or %s)", opts.SortBy, report.SortPath, report.SortSeverity, report.SortSimilarity, report.SortHosts)
+	}
+	switch opts.UnicodePaths {
+	case UnicodePathsExact, UnicodePathsNFC, "":
+	default:
+		return nil, fmt.Errorf("unknown Unicode path matching %q (expected %s or %s)", opts.UnicodePaths, UnicodePathsExact, UnicodePathsNFC)
+	}
+
+	rules, err := ignore.Load(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	unique, err := cfg.UniquePatterns()
+	if err != nil {
+		return nil, err
+	}
+	var acks *ack.Store
+	if !opts.IgnoreAcks {
+		if acks, err = ack.Load(outputDir); err != nil {
+			return nil, err
+		}
+	}
+	servers := cfg.Servers
+	if rules != nil {
+		servers = nil
+		for _, s := range cfg.Servers {
+			if rules.IgnoresServer(s) {
+				log.Infof("Leaving %s out of the analysis (%s)", s, ignore.FileName)
+				continue
+			}
+			servers = append(servers, s)
+		}
+		if len(servers) < 2 {
+			log.Warnf("Only %d server(s) left to compare after applying %s", len(servers), ignore.FileName)
+		}
+	}
+
+	ignoreLines, err := lineIgnorer(cfg, rules)
+	if err != nil {
+		return nil, err
+	}
+	normalizeByPath, err := cfg.PathNormalizeRules()
+	if err != nil {
+		return nil, err
+	}
+	normalizeRules := pathRules(normalizeByPath)
 
 	// 1. Load Manifest (Uses updated path via LoadManifest internally)
 	manifest, err := config.LoadManifest(outputDir)
 	if err != nil {
-		return false, errors.Wrap(err, "failed to load manifest for analysis")
+		return nil, errors.Wrap(err, "failed to load manifest for analysis")
+	}
+	// Servers whose collection failed (saved with --allow-partial) have nothing to compare
+	var excluded []string
+	if len(manifest.Failed) > 0 {
+		var collected []string
+		for _, s := range servers {
+			if reason, failed := manifest.Failed[s]; failed {
+				log.Warnf("Leaving %s out of the analysis: its collection failed: %s", s, reason)
+				excluded = append(excluded, s)
+				continue
+			}
+			collected = append(collected, s)
+		}
+		if len(excluded) > 0 && len(collected) < 2 {
+			log.Warnf("Only %d server(s) left to compare without those whose collection failed", len(collected))
+		}
+		servers = collected
 	}
+	opts.onDisk = matchUnicodePaths(opts.UnicodePaths, servers, manifest)
 
 	// --- PATH UPDATED FOR DIRECTORY CHECK ---
 	// Verify collection directories exist for all servers in config
 	log.Debugf("Verifying existence of collection directories in %s/%s/files-*", outputDir, config.CollectedFilesBaseDir)
-	for _, server := range cfg.Servers {
+	for _, server := range servers {
 		serverDir := filepath.Join(outputDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server))
 		if _, err := os.Stat(serverDir); os.IsNotExist(err) {
-			return false, fmt.Errorf("collection directory %s not found. Run 'collect' first", serverDir)
+			return nil, fmt.Errorf("collection directory %s not found. Run 'collect' first", serverDir)
 		} else if err != nil {
-			return false, errors.Wrapf(err, "failed to stat collection directory %s", serverDir)
+			return nil, errors.Wrapf(err, "failed to stat collection directory %s", serverDir)
 		}
 	}
 	// --- END OF PATH UPDATE ---
 
+	rep := &report.Report{
+		GeneratedAt: time.Now().UTC(),
+		Servers:     servers,
+		Files:       []report.FileResult{},
+	}
+	if a := manifest.Annotation; a != nil {
+		rep.Annotations = []report.Annotation{{Note: a.Note, Labels: a.Labels}}
+	}
+	for _, s := range excluded {
+		if rep.Excluded == nil {
+			rep.Excluded = make(map[string]string)
+		}
+		rep.Excluded[s] = "collection failed: " + manifest.Failed[s]
+		rep.Errors = append(rep.Errors, fmt.Sprintf("%s was not compared: its collection failed: %s", s, manifest.Failed[s]))
+	}
+
 	// 2. Determine Files to Compare (Intersection based on manifest)
-	filesToCompare := getFilesToCompare(cfg.Servers, manifest)
+	filesToCompare := getFilesToCompare(servers, manifest)
+	// Apply the current patterns too, so an existing collection can be re-analyzed with narrower ones
+	filter, err := cfg.PathFilter()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid exclude/include patterns")
+	}
+	filterPath := func(fp string) string {
+		if config.IsHomePath(fp) {
+			return fp // Matches the ~/ entry it was configured as
+		}
+		return "/" + fp
+	}
+	groupOf, err := grouper(opts.GroupBy, cfg, servers, manifest)
+	if err != nil {
+		return nil, err
+	}
+	var only map[string]bool
+	if len(opts.Paths) > 0 {
+		only = make(map[string]bool, len(opts.Paths))
+		for _, p := range opts.Paths {
+			only[p] = true
+		}
+	}
+	scoped := len(opts.Files) > 0 || len(opts.Within) > 0
+	exact := make(map[string]bool, len(opts.Files))
+	for _, p := range opts.Files {
+		exact[p] = true
+	}
+	inScope := func(fp string) bool {
+		if only != nil && !only[fp] {
+			return false
+		}
+		return !scoped || exact[filterPath(fp)] || within(filterPath(fp), opts.Within)
+	}
+	// Files found at different paths are reported once as moved instead of as missing on some servers
+	for _, moved := range movedFiles(servers, manifest) {
+		if filter.Keep(filterPath(moved.Path)) && !rules.IgnoresPath(moved.Path) && inScope(moved.Path) {
+			rep.Files = append(rep.Files, moved)
+		}
+	}
+	if !filter.Empty() || rules != nil || only != nil || scoped {
+		kept := filesToCompare[:0]
+		ignored, unasked := 0, 0
+		for _, fp := range filesToCompare {
+			switch {
+			case !inScope(fp):
+				unasked++
+			case !filter.Keep(filterPath(fp)):
+			case rules.IgnoresPath(fp):
+				ignored++
+			default:
+				kept = append(kept, fp)
+			}
+		}
+		if skipped := len(filesToCompare) - len(kept) - ignored - unasked; skipped > 0 {
+			log.Infof("Skipping %d file(s) excluded by filter patterns.", skipped)
+		}
+		if ignored > 0 {
+			log.Infof("Skipping %d file(s) matched by %s.", ignored, ignore.FileName)
+		}
+		filesToCompare = kept
+	}
 	if len(filesToCompare) == 0 {
 		log.Warn("No common files found across all servers based on the manifest. Analysis finished.")
-		return false, nil // No diffs found as no files compared
+		finish(rep, groupOf, opts.SortBy)
+		return rep, nil // No diffs found as no files compared
 	}
 	log.Infof("Found %d common files to compare.", len(filesToCompare))
 
 	// Prepare diff directory if saving
 	if saveDiffs {
 		if err := os.MkdirAll(diffDir, 0755); err != nil {
-			return false, errors.Wrapf(err, "failed to create diff output directory %s", diffDir)
+			return nil, errors.Wrapf(err, "failed to create diff output directory %s", diffDir)
 		}
 		log.Infof("Saving diffs to %s", diffDir)
 	}
 
 	// 3. Parallel Comparison
+	compareStart := time.Now()
 	var wg sync.WaitGroup
 	sem := semaphore.NewWeighted(int64(maxConcurrency)) // Limit concurrent diff processes
 	resultChan := make(chan fileComparisonResult, len(filesToCompare))
@@ -276,7 +1082,7 @@ func RunAnalysis(cfg *config.Config, outputDir, diffDir string, saveDiffs bool,
 		wg.Add(1)
 		go func(fp string) {
 			defer wg.Done()
-			if err := sem.Acquire(context.Background(), 1); err != nil {
+			if err := sem.Acquire(ctx, 1); err != nil {
 				log.Errorf("Failed to acquire semaphore for %s: %v", fp, err)
 				errMu.Lock()
 				analysisErrors = append(analysisErrors, errors.Wrapf(err, "semaphore error for %s", fp))
@@ -286,7 +1092,7 @@ func RunAnalysis(cfg *config.Config, outputDir, diffDir string, saveDiffs bool,
 			}
 			defer sem.Release(1)
 
-			compareSingleFile(fp, cfg.Servers, manifest, outputDir, saveDiffs, diffDir, resultChan) // Pass baseOutputDir
+			compareSingleFile(fp, servers, manifest, outputDir, opts, ignoreLines(fp), normalizeRules(fp), resultChan) // Pass baseOutputDir
 
 		}(filePath)
 	}
@@ -298,57 +1104,94 @@ func RunAnalysis(cfg *config.Config, outputDir, diffDir string, saveDiffs bool,
 	}()
 
 	// 4. Collect Results and Summarize
-	totalCompared := 0
-	totalDifferent := 0
-	totalIdentical := 0
-	anyDiffFound := false
-
-	fmt.Println("\n===== Analysis Results =====") // Print separator before results start streaming
-
 	for result := range resultChan {
-		totalCompared++
 		// Log errors encountered for this file path
 		for _, errMsg := range result.Errors {
 			log.Errorf("Error comparing %s: %s", result.FilePath, errMsg)
 		}
 
+		fileResult := report.FileResult{
+			Path:          result.FilePath,
+			Status:        report.StatusIdentical,
+			Checksums:     result.Checksums,
+			Diffs:         result.Diffs,
+			Errors:        result.Errors,
+			Metadata:      metadataDiff(result.FilePath, servers, manifest),
+			Binary:        result.Binary,
+			Sizes:         result.Sizes,
+			Chunks:        result.Chunks,
+			ContentGroups: result.ContentGroups,
+		}
+		if result.IgnoredOnly {
+			fileResult.Status = report.StatusIdenticalIgnoring
+		}
+		if result.Normalized && !result.IsDiff {
+			fileResult.Status = report.StatusIdenticalNormalized
+		}
+		if result.Equivalent && !result.IsDiff {
+			fileResult.Status = report.StatusEquivalent
+		}
+		if fileResult.Metadata != nil {
+			// Content drift below keeps its own status and lists the metadata as a detail
+			fileResult.Status = report.StatusMetadataOnly
+		}
+		if result.Unstable != nil {
+			fileResult.Status = report.StatusUnstable
+			fileResult.Unstable = result.Unstable
+		}
+		if result.Volatile != nil {
+			fileResult.Status = report.StatusVolatile
+			fileResult.Volatile = result.Volatile
+		}
+		fileResult.Formats = result.Formats
 		if result.IsDiff {
-			anyDiffFound = true
-			totalDifferent++
-			fmt.Printf("\n--- Differences found in: %s ---\n", result.FilePath)
-			// Print collected diffs to stdout
-			// Sort keys for consistent output order
-			keys := make([]string, 0, len(result.Diffs))
-			for k := range result.Diffs {
-				keys = append(keys, k)
+			fileResult.Status = report.StatusDifferent
+			if result.FormatOnly {
+				fileResult.Status = report.StatusFormatOnly
+			} else if len(result.Diffs) == 0 && len(result.Errors) > 0 {
+				fileResult.Status = report.StatusError
 			}
-			sort.Strings(keys)
-			for _, k := range keys {
-				fmt.Printf("--- Diff %s ---\n%s\n", k, result.Diffs[k])
-			}
-		} else {
-			totalIdentical++
-			fmt.Printf("--- Identical: %s ---\n", result.FilePath)
 		}
+		rep.Files = append(rep.Files, fileResult)
 	}
 
-	fmt.Println("\n===== Analysis Summary =====")
-	fmt.Printf("Total files compared: %d\n", totalCompared)
-	fmt.Printf("Identical files:      %d\n", totalIdentical)
-	fmt.Printf("Files with diffs:   %d\n", totalDifferent)
+	timing.Since(timing.AnalysisRow, timing.Diff, compareStart)
+
+	if opts.similarityFilter() {
+		kept := rep.Files[:0]
+		for _, f := range rep.Files {
+			if sim, ok := f.Similarity(); ok && (sim < opts.MinSimilarity || (opts.MaxSimilarity > 0 && sim > opts.MaxSimilarity)) {
+				log.Infof("Leaving %s out of the report: %.1f%% similar", f.Path, sim)
+				continue
+			}
+			kept = append(kept, f)
+		}
+		rep.Files = kept
+	}
 
 	// Report any general analysis errors
 	errMu.Lock()
 	finalError := analysisErrors // Copy slice under lock
 	errMu.Unlock()
+	for _, e := range finalError {
+		rep.Errors = append(rep.Errors, e.Error())
+	}
+	if n := markExpected(rep, unique); n > 0 {
+		log.Infof("%d file(s) differ as expected (unique in the config)", n)
+	}
+	if acks != nil {
+		if n := acks.Apply(rep); n > 0 {
+			log.Infof("%d file(s) differ as acknowledged in %s", n, ack.FileName)
+		}
+	}
+	finish(rep, groupOf, opts.SortBy)
+
 	if len(finalError) > 0 {
 		log.Errorf("%d errors occurred during analysis phase:", len(finalError))
 		for _, e := range finalError {
 			log.Error(e)
 		}
-		return anyDiffFound, fmt.Errorf("analysis completed with %d errors", len(finalError))
+		return rep, fmt.Errorf("analysis completed with %d errors", len(finalError))
 	}
-
-	log.Info("Analysis finished.")
-	return anyDiffFound, nil
+	return rep, nil
 }
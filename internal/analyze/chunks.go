@@ -0,0 +1,84 @@
+package analyze
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chunkDiffs compares a file block by block if any server's copy was hashed
+// in chunks during collection, and returns the differing byte ranges of each
+// pair of reps, the servers holding distinct copies, with each copy's size. Copies
+// without matching chunk hashes (e.g. just below the threshold) are hashed
+// now. The bool result is false if no copy has chunk hashes.
+func chunkDiffs(filePath string, servers, reps []string, manifest *config.Manifest, filePaths map[string]string) ([]report.ChunkDiff, map[string]int64, bool, error) {
+	var chunkSize int64
+	for _, server := range servers {
+		if info, _ := manifest.GetFileInfo(server, filePath); info.Chunks != nil {
+			chunkSize = info.Chunks.ChunkSize
+			break
+		}
+	}
+	if chunkSize == 0 {
+		return nil, nil, false, nil
+	}
+
+	chunks := make(map[string]*config.ChunkHashes)
+	sizes := make(map[string]int64)
+	for _, server := range servers {
+		info, _ := manifest.GetFileInfo(server, filePath)
+		c := info.Chunks
+		if c == nil || c.ChunkSize != chunkSize {
+			log.Debugf("Hashing %s of %s in chunks of %d bytes", filePath, server, chunkSize)
+			_, hashes, size, err := util.CalculateChunkedSHA256(filePaths[server], chunkSize)
+			if err != nil {
+				return nil, nil, true, err
+			}
+			c = &config.ChunkHashes{Size: size, ChunkSize: chunkSize, Hashes: hashes}
+		}
+		chunks[server] = c
+		sizes[server] = c.Size
+	}
+
+	var diffs []report.ChunkDiff
+	for i := 0; i < len(reps); i++ {
+		for j := i + 1; j < len(reps); j++ {
+			a, b := reps[i], reps[j]
+			diffs = append(diffs, compareChunks(a, b, chunks[a], chunks[b]))
+		}
+	}
+	return diffs, sizes, true, nil
+}
+
+// compareChunks lists the byte ranges where two copies' blocks differ, merging
+// adjacent blocks. Blocks past the end of the shorter copy differ too.
+func compareChunks(from, to string, a, b *config.ChunkHashes) report.ChunkDiff {
+	d := report.ChunkDiff{From: from, To: to, ChunkSize: a.ChunkSize}
+	n, size := len(a.Hashes), a.Size
+	if len(b.Hashes) > n {
+		n = len(b.Hashes)
+	}
+	if b.Size > size {
+		size = b.Size
+	}
+	d.Chunks = n
+	for k := 0; k < n; k++ {
+		if k < len(a.Hashes) && k < len(b.Hashes) && a.Hashes[k] == b.Hashes[k] {
+			continue
+		}
+		d.Differing++
+		start := int64(k) * a.ChunkSize
+		end := start + a.ChunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		if last := len(d.Ranges) - 1; last >= 0 && d.Ranges[last].End+1 == start {
+			d.Ranges[last].End = end
+			continue
+		}
+		d.Ranges = append(d.Ranges, report.ByteRange{Start: start, End: end})
+	}
+	return d
+}
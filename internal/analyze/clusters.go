@@ -0,0 +1,16 @@
+package analyze
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+)
+
+// representatives returns the first server of each content group. Only it
+// needs to be compared with the other groups: copies are diffed once per
+// pair of distinct contents instead of once per pair of servers.
+func representatives(groups []report.ContentGroup) []string {
+	reps := make([]string, len(groups))
+	for i, g := range groups {
+		reps[i] = g.Servers[0]
+	}
+	return reps
+}
@@ -0,0 +1,85 @@
+package analyze
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+)
+
+// grouper returns the function that names the group of a result under
+// Options.GroupBy, or nil when results aren't grouped
+func grouper(by string, cfg *config.Config, servers []string, manifest *config.Manifest) (func(f report.FileResult) string, error) {
+	switch by {
+	case report.GroupNone, "":
+		return nil, nil
+	case report.GroupStatus:
+		return func(f report.FileResult) string { return f.Status }, nil
+	case report.GroupCategory:
+		return func(f report.FileResult) string {
+			if c := f.Category(); c != "" {
+				return c
+			}
+			return "(none)"
+		}, nil
+	case report.GroupOwner:
+		return func(f report.FileResult) string { return commonOwner(f.Path, servers, manifest) }, nil
+	case report.GroupPath:
+		configured := append(append([]string{}, cfg.Files...), cfg.Dirs...)
+		for i, p := range configured {
+			configured[i] = path.Clean(p)
+		}
+		// Longest first, so a file is grouped under the most specific entry
+		sort.Slice(configured, func(i, j int) bool { return len(configured[i]) > len(configured[j]) })
+		return func(f report.FileResult) string {
+			logical := "/" + f.Path
+			if config.IsHomePath(f.Path) {
+				logical = f.Path
+			}
+			for _, p := range configured {
+				if logical == p || strings.HasPrefix(logical, p+"/") {
+					return p
+				}
+			}
+			return path.Dir(logical)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown grouping %q (expected %s, %s, %s, %s or %s)", by,
+		report.GroupNone, report.GroupStatus, report.GroupCategory, report.GroupOwner, report.GroupPath)
+}
+
+// commonOwner returns the owner most servers' copies of a file have, or
+// "(unknown)" when the manifest has none
+func commonOwner(filePath string, servers []string, manifest *config.Manifest) string {
+	counts := make(map[string]int)
+	owner := ""
+	for _, server := range servers {
+		info, ok := manifest.FilesByServer[server][filePath]
+		if !ok || info.Owner == "" {
+			continue
+		}
+		counts[info.Owner]++
+		if c := counts[info.Owner]; c > counts[owner] || (c == counts[owner] && info.Owner < owner) {
+			owner = info.Owner
+		}
+	}
+	if owner == "" {
+		return "(unknown)"
+	}
+	return owner
+}
+
+// finish groups the results of rep with groupOf (if set), fills in the
+// summary and puts the files in the order asked for
+func finish(rep *report.Report, groupOf func(f report.FileResult) string, sortBy string) {
+	if groupOf != nil {
+		for i := range rep.Files {
+			rep.Files[i].Group = groupOf(rep.Files[i])
+		}
+	}
+	rep.Finalize()
+	rep.Sort(sortBy) // Validated by Analyze
+}
@@ -0,0 +1,280 @@
+package analyze
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Run is one collection compared by CompareRuns: an output directory holding
+// its manifest and collected files, and the label its servers are shown with
+type Run struct {
+	Dir   string
+	Label string
+}
+
+// CompareRuns compares each server present in both runs with its own copy
+// from the other run, e.g. an earlier snapshot or bundle. servers limits the
+// comparison; nil compares every server. Servers in only one run are reported
+// as run-level errors. workDir receives a merged copy of both runs (with files
+// hard-linked where possible) and is left for the caller to clean up.
+func CompareRuns(a, b Run, servers []string, workDir string, opts Options) (*report.Report, error) {
+	manifestA, err := config.LoadManifest(a.Dir)
+	if err != nil {
+		return nil, err
+	}
+	manifestB, err := config.LoadManifest(b.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	labelA, labelB := a.Label, b.Label
+	if labelA == labelB {
+		labelA, labelB = "a", "b"
+	}
+	wanted := wantedServers(servers)
+
+	// Build one merged output dir where every server appears twice: <server>@<labelA> and <server>@<labelB>
+	mergedDir := filepath.Join(workDir, "merged")
+	merged := config.NewManifest()
+	if err := stageRun(mergedDir, merged, a.Dir, manifestA, labelA, wanted); err != nil {
+		return nil, err
+	}
+	if err := stageRun(mergedDir, merged, b.Dir, manifestB, labelB, wanted); err != nil {
+		return nil, err
+	}
+	if err := merged.Save(mergedDir); err != nil {
+		return nil, err
+	}
+
+	combined := &report.Report{GeneratedAt: time.Now().UTC(), Files: []report.FileResult{}}
+	for _, side := range []struct {
+		label    string
+		manifest *config.Manifest
+	}{{labelA, manifestA}, {labelB, manifestB}} {
+		if a := side.manifest.Annotation; a != nil {
+			combined.Annotations = append(combined.Annotations, report.Annotation{Run: side.label, Note: a.Note, Labels: a.Labels})
+		}
+	}
+	var common []string
+	for server := range manifestA.FilesByServer {
+		if !wanted(server) {
+			continue
+		}
+		if _, ok := manifestB.FilesByServer[server]; ok {
+			common = append(common, server)
+		} else {
+			combined.Errors = append(combined.Errors, fmt.Sprintf("server %s only present in %s", server, labelA))
+		}
+	}
+	for server := range manifestB.FilesByServer {
+		if _, ok := manifestA.FilesByServer[server]; !ok && wanted(server) {
+			combined.Errors = append(combined.Errors, fmt.Sprintf("server %s only present in %s", server, labelB))
+		}
+	}
+	for _, server := range servers {
+		_, inA := manifestA.FilesByServer[server]
+		_, inB := manifestB.FilesByServer[server]
+		if !inA && !inB {
+			combined.Errors = append(combined.Errors, fmt.Sprintf("server %s is in neither %s nor %s", server, labelA, labelB))
+		}
+	}
+	sort.Strings(common)
+	sort.Strings(combined.Errors)
+
+	var firstErr error
+	for _, server := range common {
+		pair := []string{server + "@" + labelA, server + "@" + labelB}
+		combined.Servers = append(combined.Servers, pair...)
+		log.Infof("Comparing %s across runs (%s vs %s)", server, labelA, labelB)
+
+		rep, err := Analyze(&config.Config{Servers: pair}, mergedDir, opts)
+		if err != nil {
+			combined.Errors = append(combined.Errors, fmt.Sprintf("%s: %v", server, err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if rep == nil {
+			continue
+		}
+		for _, f := range rep.Files {
+			f.Server = server
+			combined.Files = append(combined.Files, f)
+		}
+	}
+	combined.Finalize()
+	combined.Sort(opts.SortBy) // Validated by Analyze
+
+	if firstErr != nil {
+		return combined, errors.Wrap(firstErr, "run comparison completed with errors")
+	}
+	return combined, nil
+}
+
+// CompareRoots compares the servers of several collections with each other,
+// as if they had been collected together, e.g. today's and last week's
+// collection, or those of two teams. Every server appears as
+// <server>@<label>, so the same server can be compared with its copy in
+// another collection as well as with the other servers. cfg gives the
+// comparison settings (patterns, normalization, ignored lines); its servers
+// are replaced. servers limits the comparison; nil compares every server.
+// workDir receives the merged collections and is left for the caller to
+// clean up.
+func CompareRoots(cfg *config.Config, runs []Run, servers []string, workDir string, opts Options) (*report.Report, error) {
+	if len(runs) < 2 {
+		return nil, fmt.Errorf("need at least 2 collections to compare, got %d", len(runs))
+	}
+	manifests := make([]*config.Manifest, len(runs))
+	labels := make(map[string]string)
+	for i, run := range runs {
+		if run.Label == "" || strings.ContainsAny(run.Label, "/\\") {
+			return nil, fmt.Errorf("invalid label %q for %s", run.Label, run.Dir)
+		}
+		if dir, ok := labels[run.Label]; ok {
+			return nil, fmt.Errorf("%s and %s are both labeled %q", dir, run.Dir, run.Label)
+		}
+		labels[run.Label] = run.Dir
+		manifest, err := config.LoadManifest(run.Dir)
+		if err != nil {
+			return nil, err
+		}
+		manifests[i] = manifest
+	}
+
+	wanted := wantedServers(servers)
+	mergedDir := filepath.Join(workDir, "merged")
+	merged := config.NewManifest()
+	var names, unknown []string
+	for i, run := range runs {
+		if err := stageRun(mergedDir, merged, run.Dir, manifests[i], run.Label, wanted); err != nil {
+			return nil, err
+		}
+		var runServers []string
+		for server := range manifests[i].FilesByServer {
+			if wanted(server) {
+				runServers = append(runServers, server+"@"+run.Label)
+			}
+		}
+		for server := range manifests[i].Failed {
+			if wanted(server) {
+				runServers = append(runServers, server+"@"+run.Label) // Left out by the analysis, which says why
+			}
+		}
+		sort.Strings(runServers)
+		names = append(names, runServers...)
+	}
+	for _, server := range servers {
+		found := false
+		for _, manifest := range manifests {
+			if _, ok := manifest.FilesByServer[server]; ok {
+				found = true
+			}
+			if _, ok := manifest.Failed[server]; ok {
+				found = true
+			}
+		}
+		if !found {
+			unknown = append(unknown, server)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("server(s) %s in none of the collections", strings.Join(unknown, ", "))
+	}
+	if len(names) < 2 {
+		return nil, fmt.Errorf("only %d server(s) to compare across the collections", len(names))
+	}
+	if err := merged.Save(mergedDir); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Comparing %d server(s) across %d collections", len(names), len(runs))
+	mergedCfg := *cfg
+	mergedCfg.Servers = names
+	rep, err := Analyze(&mergedCfg, mergedDir, opts)
+	if rep == nil {
+		return nil, err
+	}
+	rep.Annotations = nil
+	for i, run := range runs {
+		if a := manifests[i].Annotation; a != nil {
+			rep.Annotations = append(rep.Annotations, report.Annotation{Run: run.Label, Note: a.Note, Labels: a.Labels})
+		}
+	}
+	return rep, err
+}
+
+// wantedServers returns whether a server is one of servers, or any server if
+// servers is nil
+func wantedServers(servers []string) func(string) bool {
+	return func(server string) bool {
+		if servers == nil {
+			return true
+		}
+		for _, s := range servers {
+			if s == server {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// stageRun adds the wanted servers of a collection in dir to the merged
+// output dir and its manifest as <server>@<label>, hard-linking their
+// collected files where possible
+func stageRun(mergedDir string, merged *config.Manifest, dir string, manifest *config.Manifest, label string, wanted func(string) bool) error {
+	if err := os.MkdirAll(filepath.Join(mergedDir, config.CollectedFilesBaseDir), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create merged directory %s", mergedDir)
+	}
+	for server, files := range manifest.FilesByServer {
+		if !wanted(server) {
+			continue
+		}
+		mergedName := server + "@" + label
+		if manifest.Unprivileged[server] {
+			merged.SetUnprivileged(mergedName)
+		}
+		if method := manifest.Methods[server]; method != "" {
+			merged.SetMethod(mergedName, method)
+		}
+		src := filepath.Join(dir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server))
+		dst := filepath.Join(mergedDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", mergedName))
+		if _, err := os.Stat(src); err == nil {
+			if err := util.CopyTree(src, dst, true); err != nil {
+				return errors.Wrapf(err, "failed to stage files of %s from %s", server, label)
+			}
+		} else if err := os.MkdirAll(dst, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create %s", dst)
+		}
+		for rel, info := range files {
+			merged.AddFile(mergedName, rel, info.Checksum, info.Error)
+			merged.SetMetadata(mergedName, rel, info.FileMetadata)
+			if info.Chunks != nil {
+				merged.SetChunks(mergedName, rel, info.Chunks)
+			}
+			if info.Unstable {
+				merged.MarkUnstable(mergedName, rel)
+			}
+			if info.Volatile {
+				merged.MarkVolatile(mergedName, rel)
+			}
+		}
+	}
+	for server, reason := range manifest.Failed {
+		if wanted(server) {
+			merged.SetFailed(server+"@"+label, reason)
+		}
+	}
+	return nil
+}
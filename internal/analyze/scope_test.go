@@ -0,0 +1,59 @@
+package analyze
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+)
+
+func TestAnalyzeScope(t *testing.T) {
+	collected := []string{"etc/hosts", "etc/hosts.allow", "etc/nginx/nginx.conf", "etc/nginx/sites/default", "etc/nginxfoo"}
+	tests := []struct {
+		name   string
+		files  []string
+		within []string
+		want   []string
+	}{
+		{name: "everything", want: collected},
+		{name: "exact file", files: []string{"/etc/hosts"}, want: []string{"etc/hosts"}},
+		{name: "file is not a prefix", files: []string{"/etc/nginx"}},
+		{name: "directory", within: []string{"/etc/nginx"}, want: []string{"etc/nginx/nginx.conf", "etc/nginx/sites/default"}},
+		{name: "files and directories", files: []string{"/etc/hosts"}, within: []string{"/etc/nginx/sites"}, want: []string{"etc/hosts", "etc/nginx/sites/default"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest := config.NewManifest()
+			for _, server := range []string{"web1", "web2"} {
+				// Identical checksums: the copies themselves are never read
+				if err := os.MkdirAll(filepath.Join(dir, config.CollectedFilesBaseDir, "files-"+server), 0755); err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range collected {
+					manifest.AddFile(server, p, "sum-of-"+p, "")
+				}
+			}
+			if err := manifest.Save(dir); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.Config{Servers: []string{"web1", "web2"}}
+			rep, err := AnalyzeContext(context.Background(), cfg, dir, Options{MaxConcurrency: 2, Files: tt.files, Within: tt.within})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range rep.Files {
+				got = append(got, f.Path)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compared %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
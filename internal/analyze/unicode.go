@@ -0,0 +1,120 @@
+package analyze
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode path matching modes accepted by Options.UnicodePaths
+const (
+	UnicodePathsExact = "exact" // Paths match byte for byte, as the file systems see them
+	UnicodePathsNFC   = "nfc"   // Paths match once both are in Unicode NFC, e.g. "café" typed on macOS and on Linux
+)
+
+// unicodeVariants finds paths that are spelled differently on some servers
+// but are the same in NFC: for each NFC path, the server -> path spellings
+// of the servers that have it. A server holding several spellings of one
+// path (two distinct files to its file system) is left out of that path.
+func unicodeVariants(servers []string, manifest *config.Manifest) map[string]map[string]string {
+	manifest.Mu.RLock()
+	defer manifest.Mu.RUnlock()
+
+	spellings := make(map[string]map[string]string) // NFC path -> server -> path
+	clashes := make(map[string]map[string]bool)     // NFC path -> servers with several spellings
+	for _, server := range servers {
+		for filePath := range manifest.FilesByServer[server] {
+			nfc := norm.NFC.String(filePath)
+			s := spellings[nfc]
+			if s == nil {
+				s = make(map[string]string)
+				spellings[nfc] = s
+			}
+			if _, seen := s[server]; seen {
+				if clashes[nfc] == nil {
+					clashes[nfc] = make(map[string]bool)
+				}
+				clashes[nfc][server] = true
+			}
+			s[server] = filePath
+		}
+	}
+
+	variants := make(map[string]map[string]string)
+	for nfc, s := range spellings {
+		for server := range clashes[nfc] {
+			log.Warnf("%s holds several files named %q in different Unicode forms; comparing each by its exact name", server, nfc)
+			delete(s, server)
+		}
+		distinct := make(map[string]bool)
+		for _, p := range s {
+			distinct[p] = true
+		}
+		if len(distinct) > 1 {
+			variants[nfc] = s
+		}
+	}
+	return variants
+}
+
+// describeSpellings lists a path's spellings with their servers, quoted so
+// that the ones that look alike can be told apart
+func describeSpellings(spellings map[string]string) string {
+	servers := make([]string, 0, len(spellings))
+	for server := range spellings {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	parts := make([]string, 0, len(servers))
+	for _, server := range servers {
+		parts = append(parts, fmt.Sprintf("%s %+q", server, spellings[server]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matchUnicodePaths reports paths spelled in different Unicode forms across
+// servers. Under UnicodePathsNFC it also renames them in the (in-memory)
+// manifest to their NFC form, so they are compared as one file, and returns
+// server -> NFC path -> collected path for reading the local copies.
+func matchUnicodePaths(mode string, servers []string, manifest *config.Manifest) map[string]map[string]string {
+	variants := unicodeVariants(servers, manifest)
+	if len(variants) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(variants))
+	for nfc := range variants {
+		paths = append(paths, nfc)
+	}
+	sort.Strings(paths)
+	if mode != UnicodePathsNFC {
+		for _, nfc := range paths {
+			log.Warnf("%s is spelled in different Unicode forms (%s), so its copies are compared as different files; use --unicode-paths %s to match them", nfc, describeSpellings(variants[nfc]), UnicodePathsNFC)
+		}
+		return nil
+	}
+
+	manifest.Mu.Lock()
+	defer manifest.Mu.Unlock()
+	onDisk := make(map[string]map[string]string)
+	for _, nfc := range paths {
+		log.Infof("Comparing %s as one file across its Unicode spellings: %s", nfc, describeSpellings(variants[nfc]))
+		for server, filePath := range variants[nfc] {
+			if filePath == nfc {
+				continue
+			}
+			files := manifest.FilesByServer[server]
+			files[nfc] = files[filePath]
+			delete(files, filePath)
+			if onDisk[server] == nil {
+				onDisk[server] = make(map[string]string)
+			}
+			onDisk[server][nfc] = filePath
+		}
+	}
+	return onDisk
+}
@@ -0,0 +1,88 @@
+package analyze
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+)
+
+const (
+	cafeNFC = "/etc/i18n/caf\u00e9.conf"  // As typed on Linux
+	cafeNFD = "/etc/i18n/cafe\u0301.conf" // As written by macOS
+)
+
+func TestMatchUnicodePaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		files  map[string][]string          // server -> collected paths
+		keys   map[string][]string          // server -> manifest paths afterwards
+		onDisk map[string]map[string]string // What matchUnicodePaths returns
+	}{
+		{
+			name:  "exact leaves spellings apart",
+			mode:  UnicodePathsExact,
+			files: map[string][]string{"web1": {cafeNFC}, "web2": {cafeNFD}},
+			keys:  map[string][]string{"web1": {cafeNFC}, "web2": {cafeNFD}},
+		},
+		{
+			name:   "nfc matches a decomposed name to its twin",
+			mode:   UnicodePathsNFC,
+			files:  map[string][]string{"web1": {cafeNFC, "/etc/hosts"}, "web2": {cafeNFD, "/etc/hosts"}},
+			keys:   map[string][]string{"web1": {cafeNFC, "/etc/hosts"}, "web2": {cafeNFC, "/etc/hosts"}},
+			onDisk: map[string]map[string]string{"web2": {cafeNFC: cafeNFD}},
+		},
+		{
+			name:   "nfc with every server decomposed",
+			mode:   UnicodePathsNFC,
+			files:  map[string][]string{"web1": {cafeNFD}, "web2": {cafeNFD}},
+			keys:   map[string][]string{"web1": {cafeNFD}, "web2": {cafeNFD}},
+			onDisk: nil, // Spelled alike, so compared as is
+		},
+		{
+			name:  "nfc leaves a server with both spellings alone",
+			mode:  UnicodePathsNFC,
+			files: map[string][]string{"web1": {cafeNFC, cafeNFD}, "web2": {cafeNFC}},
+			keys:  map[string][]string{"web1": {cafeNFC, cafeNFD}, "web2": {cafeNFC}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := config.NewManifest()
+			servers := make([]string, 0, len(tt.files))
+			for server, paths := range tt.files {
+				servers = append(servers, server)
+				for _, p := range paths {
+					manifest.AddFile(server, p, "sum-of-"+p, "")
+				}
+			}
+			sort.Strings(servers)
+
+			onDisk := matchUnicodePaths(tt.mode, servers, manifest)
+			if !reflect.DeepEqual(onDisk, tt.onDisk) {
+				t.Errorf("onDisk = %+q, want %+q", onDisk, tt.onDisk)
+			}
+			for server, want := range tt.keys {
+				var got []string
+				for p := range manifest.FilesByServer[server] {
+					got = append(got, p)
+				}
+				sort.Strings(got)
+				sort.Strings(want)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: manifest paths = %+q, want %+q", server, got, want)
+				}
+			}
+			// A renamed entry keeps the checksum of the file it was collected as
+			for server, renamed := range onDisk {
+				for nfc, collected := range renamed {
+					if info := manifest.FilesByServer[server][nfc]; info.Checksum != "sum-of-"+collected {
+						t.Errorf("%s: %+q has checksum %q, want that of %+q", server, nfc, info.Checksum, collected)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// MetadataFileName is stored at the root of every bundle
+const MetadataFileName = "bundle.json"
+
+// ReportsDir is where saved diffs/reports live inside a bundle (and an imported output dir)
+const ReportsDir = "reports"
+
+// DefaultRedactPatterns match "key = value" style secrets; everything after the
+// match is replaced on redacted lines
+var DefaultRedactPatterns = []string{
+	`(?i)(password|passwd|passphrase|secret|token|api[_-]?key|access[_-]?key|credentials?)["']?\s*[:=]`,
+}
+
+var pemBegin = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+var pemEnd = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+
+// Metadata describes a bundle's origin and contents
+type Metadata struct {
+	ID             string    `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	SourceDir      string    `json:"source_dir"`
+	Servers        []string  `json:"servers"`
+	Redacted       bool      `json:"redacted"`
+	RedactPatterns []string  `json:"redact_patterns,omitempty"`
+}
+
+// ExportOptions controls what goes into a bundle
+type ExportOptions struct {
+	ID             string   // Run ID recorded in the metadata (defaults to a timestamp)
+	DiffDir        string   // Saved diffs to include under reports/ (optional)
+	Redact         bool     // Redact secrets from collected file contents
+	RedactPatterns []string // Extra regexes on top of DefaultRedactPatterns
+}
+
+// NewRunID returns a timestamp-based run identifier
+func NewRunID() string {
+	return time.Now().Format("20060102-150405")
+}
+
+// DefaultBundleName returns the conventional file name for a bundle
+func DefaultBundleName(id string) string {
+	return fmt.Sprintf("run-%s.tar.zst", id)
+}
+
+// Export packages the config, manifest, collected files and saved diffs of
+// outputDir into a single compressed tar archive at bundlePath
+func Export(outputDir, bundlePath string, opts ExportOptions) (*Metadata, error) {
+	manifest, err := config.LoadManifest(outputDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load manifest for export")
+	}
+	collectedDir := filepath.Join(outputDir, config.CollectedFilesBaseDir)
+	if _, err := os.Stat(collectedDir); err != nil {
+		return nil, errors.Wrapf(err, "nothing to export: collection directory %s", collectedDir)
+	}
+
+	var redactors []*regexp.Regexp
+	meta := &Metadata{
+		ID:        opts.ID,
+		CreatedAt: time.Now().UTC(),
+		SourceDir: outputDir,
+		Redacted:  opts.Redact,
+	}
+	if meta.ID == "" {
+		meta.ID = NewRunID()
+	}
+	if abs, err := filepath.Abs(outputDir); err == nil {
+		meta.SourceDir = abs
+	}
+	for server := range manifest.FilesByServer {
+		meta.Servers = append(meta.Servers, server)
+	}
+	if opts.Redact {
+		meta.RedactPatterns = append(append([]string{}, DefaultRedactPatterns...), opts.RedactPatterns...)
+		for _, p := range meta.RedactPatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid redact pattern %q", p)
+			}
+			redactors = append(redactors, re)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(bundlePath), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory for bundle %s", bundlePath)
+	}
+	file, err := os.Create(bundlePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create bundle %s", bundlePath)
+	}
+	defer file.Close()
+
+	compressed, err := newCompressor(file, bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(compressed)
+
+	metaData, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal bundle metadata")
+	}
+	if err := writeTarFile(tw, MetadataFileName, metaData, 0644); err != nil {
+		return nil, err
+	}
+
+	// Config and collected files keep their output-dir layout so an imported
+	// bundle is directly usable as an output directory. The pinned host keys
+	// stay behind: they belong to the machine that connects.
+	if err := addTree(tw, filepath.Join(outputDir, config.ConfigDir), config.ConfigDir, func(rel string) bool {
+		return rel == sshutil.HostKeyFile
+	}, nil); err != nil {
+		return nil, err
+	}
+	if err := addTree(tw, collectedDir, config.CollectedFilesBaseDir, nil, func(rel string, data []byte) []byte {
+		if rel == config.ManifestFileName {
+			return data // Manifest keeps the original checksums
+		}
+		return redact(data, redactors)
+	}); err != nil {
+		return nil, err
+	}
+	if opts.DiffDir != "" {
+		if _, err := os.Stat(opts.DiffDir); err == nil {
+			// Diffs contain file contents too, so they go through the same redaction
+			if err := addTree(tw, opts.DiffDir, ReportsDir+"/diffs", nil, func(_ string, data []byte) []byte {
+				return redact(data, redactors)
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to finalize bundle tar stream")
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to finalize bundle compression")
+	}
+	log.Infof("Exported bundle %s (run %s, %d servers, redacted=%v)", bundlePath, meta.ID, len(meta.Servers), meta.Redacted)
+	return meta, nil
+}
+
+// Import extracts a bundle into outputDir, which must not already contain
+// collected files, or a conf/ that differs from the bundle's, unless force is
+// set. The bundle is unpacked and its manifest validated in a directory next
+// to outputDir first, so a broken or hostile bundle leaves outputDir as it was.
+// A bundle carrying files Export never writes is refused, even with force.
+func Import(bundlePath, outputDir string, force bool) (*Metadata, error) {
+	collectedDir := filepath.Join(outputDir, config.CollectedFilesBaseDir)
+	if _, err := os.Stat(collectedDir); err == nil && !force {
+		return nil, fmt.Errorf("%s already exists; import into an empty output directory or use --force", collectedDir)
+	}
+
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bundle %s", bundlePath)
+	}
+	defer file.Close()
+
+	compressed := &util.CountingReader{R: file}
+	stream, err := newDecompressor(compressed, bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	// Next to outputDir so the final renames stay on one file system
+	absOutput, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve output directory %s", outputDir)
+	}
+	if err := os.MkdirAll(absOutput, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create output directory %s", outputDir)
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(absOutput), "."+filepath.Base(absOutput)+"-import-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create staging directory for import")
+	}
+	defer os.RemoveAll(staging)
+
+	unpacked := filepath.Join(staging, "bundle")
+	if err := util.ExtractCompressedTar(stream, compressed, unpacked); err != nil {
+		return nil, errors.Wrapf(err, "failed to extract bundle %s", bundlePath)
+	}
+	meta, err := ReadMetadata(unpacked)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(unpacked, config.CollectedFilesBaseDir, config.ManifestFileName)); err != nil {
+		return nil, errors.Wrapf(err, "bundle %s has no manifest", bundlePath)
+	}
+	if _, err := config.LoadManifest(unpacked); err != nil {
+		return nil, errors.Wrapf(err, "bundle %s has an invalid manifest", bundlePath)
+	}
+	foreign, err := foreignFiles(unpacked)
+	if err != nil {
+		return nil, err
+	}
+	if len(foreign) > 0 {
+		return nil, fmt.Errorf("bundle %s carries files an export never writes (%s); refusing to import it",
+			bundlePath, strings.Join(foreign, ", "))
+	}
+	changed, err := changedFiles(filepath.Join(unpacked, config.ConfigDir), filepath.Join(outputDir, config.ConfigDir))
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) > 0 && !force {
+		return nil, fmt.Errorf("the bundle's configuration differs from the one in %s (%s); use --force to replace it",
+			outputDir, strings.Join(changed, ", "))
+	}
+
+	// The old collection is only moved aside (and dropped with the staging
+	// directory) once the new one is known to be good
+	if _, err := os.Stat(collectedDir); err == nil {
+		if err := os.Rename(collectedDir, filepath.Join(staging, "previous")); err != nil {
+			return nil, errors.Wrapf(err, "failed to move %s aside", collectedDir)
+		}
+	}
+	if err := os.Rename(filepath.Join(unpacked, config.CollectedFilesBaseDir), collectedDir); err != nil {
+		return nil, errors.Wrapf(err, "failed to move imported files into %s", collectedDir)
+	}
+	// Everything else is installed file by file, so files of outputDir the
+	// bundle doesn't carry (e.g. other saved reports) are kept
+	if err := installTree(unpacked, outputDir); err != nil {
+		return nil, err
+	}
+	log.Infof("Imported bundle %s (run %s) into %s", bundlePath, meta.ID, outputDir)
+	return meta, nil
+}
+
+// exported reports whether rel, a slash path relative to the bundle root,
+// is one Export writes. Nothing else is installed: a bundle must not pin host
+// keys or replace the acknowledgements and ignore rules of the output dir.
+func exported(rel string) bool {
+	switch {
+	case rel == MetadataFileName:
+		return true
+	case rel == config.ConfigDir+"/"+sshutil.HostKeyFile:
+		return false
+	}
+	for _, dir := range []string{config.ConfigDir, config.CollectedFilesBaseDir, ReportsDir} {
+		if strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// foreignFiles lists the files below dir, as slash paths, that exported rejects
+func foreignFiles(dir string) ([]string, error) {
+	var foreign []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %s", path)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compute relative path for %s", path)
+		}
+		if rel = filepath.ToSlash(rel); !exported(rel) {
+			foreign = append(foreign, rel)
+		}
+		return nil
+	})
+	return foreign, err
+}
+
+// changedFiles lists the files of srcDir whose copy in dstDir has different
+// content, as slash paths relative to srcDir
+func changedFiles(srcDir, dstDir string) ([]string, error) {
+	var changed []string
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == srcDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %s", path)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compute relative path for %s", path)
+		}
+		existing, err := os.ReadFile(filepath.Join(dstDir, rel))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", filepath.Join(dstDir, rel))
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", path)
+		}
+		if !bytes.Equal(data, existing) {
+			changed = append(changed, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// installTree moves every regular file under srcDir to the same place below
+// dstDir, replacing what is there
+func installTree(srcDir, dstDir string) error {
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %s", path)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compute relative path for %s", path)
+		}
+		target := filepath.Join(dstDir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.Wrapf(err, "failed to create directory for %s", target)
+		}
+		if err := os.Rename(path, target); err != nil {
+			return errors.Wrapf(err, "failed to install %s", target)
+		}
+		return nil
+	})
+}
+
+// ReadMetadata loads bundle.json from an imported bundle directory
+func ReadMetadata(dir string) (*Metadata, error) {
+	metaPath := filepath.Join(dir, MetadataFileName)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read bundle metadata %s", metaPath)
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse bundle metadata %s", metaPath)
+	}
+	return &meta, nil
+}
+
+// newCompressor picks the compression from the bundle's file extension
+func newCompressor(w io.Writer, name string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create zstd writer")
+		}
+		return enc, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle extension for %s (use .tar.zst or .tar.gz)", name)
+	}
+}
+
+func newDecompressor(r io.Reader, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create zstd reader")
+		}
+		return dec.IOReadCloser(), nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create gzip reader")
+		}
+		return gz, nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle extension for %s (use .tar.zst or .tar.gz)", name)
+	}
+}
+
+// addTree adds every regular file under srcDir to the archive below prefix.
+// skip (optional) leaves files out and transform (optional) may rewrite file
+// contents; both receive the slash path relative to srcDir.
+func addTree(tw *tar.Writer, srcDir, prefix string, skip func(rel string) bool, transform func(rel string, data []byte) []byte) error {
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+		log.Debugf("Skipping missing directory %s in bundle", srcDir)
+		return nil
+	}
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %s", path)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compute relative path for %s", path)
+		}
+		rel = filepath.ToSlash(rel)
+		if skip != nil && skip(rel) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", path)
+		}
+		if transform != nil {
+			data = transform(rel, data)
+		}
+		return writeTarFile(tw, prefix+"/"+rel, data, info.Mode().Perm())
+	})
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode fs.FileMode) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(mode),
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "failed to write tar header for %s", name)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to write %s to bundle", name)
+	}
+	return nil
+}
+
+// redact blanks out secrets: values after any matching pattern, and whole PEM
+// private key blocks. Binary content is dropped entirely since it can't be scanned.
+func redact(data []byte, redactors []*regexp.Regexp) []byte {
+	if len(redactors) == 0 {
+		return data
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return []byte("[REDACTED BINARY CONTENT]\n")
+	}
+
+	// Lines are split on \n by hand so their endings, \r\n or none at the
+	// end of the file, are kept byte for byte and no line is too long
+	var out bytes.Buffer
+	inPEM := false
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		text, ending := data[:end], ""
+		for _, e := range []string{"\r\n", "\n"} {
+			if bytes.HasSuffix(text, []byte(e)) {
+				text, ending = text[:len(text)-len(e)], e
+				break
+			}
+		}
+		data = data[end:]
+		line := string(text)
+		switch {
+		case inPEM:
+			if pemEnd.MatchString(line) {
+				inPEM = false
+				out.WriteString(line)
+			} else {
+				out.WriteString("[REDACTED]")
+			}
+		case pemBegin.MatchString(line):
+			inPEM = true
+			out.WriteString(line)
+		default:
+			for _, re := range redactors {
+				if loc := re.FindStringIndex(line); loc != nil {
+					line = line[:loc[1]] + " [REDACTED]"
+					break
+				}
+			}
+			out.WriteString(line)
+		}
+		out.WriteString(ending)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,28 @@
+package bundle
+
+import (
+	"path/filepath"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+)
+
+// Compare analyzes two exported bundles against each other entirely offline.
+// Each server present in both bundles is compared with its own copy from the
+// other bundle; servers in only one bundle are reported as run-level errors.
+// workDir receives the extracted bundles and is left for the caller to clean up.
+func Compare(bundleA, bundleB, workDir string, opts analyze.Options) (*report.Report, error) {
+	dirA := filepath.Join(workDir, "a")
+	dirB := filepath.Join(workDir, "b")
+	metaA, err := Import(bundleA, dirA, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to import bundle %s", bundleA)
+	}
+	metaB, err := Import(bundleB, dirB, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to import bundle %s", bundleB)
+	}
+	return analyze.CompareRuns(analyze.Run{Dir: dirA, Label: metaA.ID}, analyze.Run{Dir: dirB, Label: metaB.ID}, nil, workDir, opts)
+}
@@ -0,0 +1,95 @@
+package collect
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChunkThreshold is the size from which collected files are also hashed in
+// ChunkSize blocks, so analysis can report the byte ranges that differ
+// instead of diffing them. 0 disables chunk hashes.
+var ChunkThreshold int64 = 64 << 20
+
+// ChunkSize is the block size of chunk hashes
+var ChunkSize int64 = 4 << 20
+
+// ValidateChunks checks the chunk hash settings
+func ValidateChunks(threshold, size int64) error {
+	if threshold < 0 {
+		return fmt.Errorf("--chunk-threshold can't be negative")
+	}
+	if size <= 0 {
+		return fmt.Errorf("--chunk-size must be positive")
+	}
+	return nil
+}
+
+// hashLocalCopy checksums a collected file, counting it in stats. Files of
+// at least o.ChunkThreshold bytes also get their chunk hashes, which are nil
+// otherwise. With FastHash, the hashes of a copy with the same content are
+// reused.
+func (o *Options) hashLocalCopy(path string, stats *hashStats) (string, *config.ChunkHashes, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to stat %s", path)
+	}
+	stats.add(st.Size())
+	if cache := o.contents; cache != nil {
+		checksum, chunks, reused, err := cache.hash(path, st.Size(), o.hashContent)
+		if reused {
+			stats.reused.Add(1)
+		}
+		return checksum, chunks, err
+	}
+	return o.hashContent(path, st.Size())
+}
+
+// hashContent computes the SHA-256 of a file of the given size, and its
+// chunk hashes if it is large enough
+func (o *Options) hashContent(path string, size int64) (string, *config.ChunkHashes, error) {
+	if o.ChunkThreshold > 0 && size >= o.ChunkThreshold {
+		checksum, hashes, size, err := util.CalculateChunkedSHA256(path, o.ChunkSize)
+		if err != nil {
+			return "", nil, err
+		}
+		return checksum, &config.ChunkHashes{Size: size, ChunkSize: o.ChunkSize, Hashes: hashes}, nil
+	}
+	checksum, err := util.CalculateSHA256(path)
+	return checksum, nil, err
+}
+
+// hashStats counts the files and bytes a server's collection checksummed,
+// and the files whose SHA-256 was reused from an identical copy
+type hashStats struct {
+	files, bytes, reused atomic.Int64
+}
+
+func (s *hashStats) add(size int64) {
+	s.files.Add(1)
+	s.bytes.Add(size)
+}
+
+// report logs how much was checksummed in elapsed, and at what rate
+func (s *hashStats) report(server string, elapsed time.Duration) {
+	files, bytes := s.files.Load(), s.bytes.Load()
+	if files == 0 {
+		return
+	}
+	rate := "-"
+	if elapsed > 0 {
+		rate = util.FormatBytes(int64(float64(bytes)/elapsed.Seconds())) + "/s"
+	}
+	reused := ""
+	if n := s.reused.Load(); n > 0 {
+		reused = fmt.Sprintf(", SHA-256 of %d reused from identical copies", n)
+	}
+	log.Infof("[%s] Checksummed %d file(s), %s in %s (%s%s)", server, files, util.FormatBytes(bytes), elapsed.Round(time.Microsecond), rate, reused)
+}
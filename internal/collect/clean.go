@@ -0,0 +1,160 @@
+package collect
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+// Names of the temporary files collections upload to /tmp
+const (
+	scriptTempPrefix = "collect_files_"
+	sumsTempPrefix   = "collect_sums_"
+)
+
+// ServerCleanup is what CleanRemote found on one server
+type ServerCleanup struct {
+	Server  string
+	Removed []string // Remote paths removed, or that would be with a dry run
+	Err     error
+}
+
+// CleanRemote removes what failed collections left on each server: the
+// copy and tarball in the SSH user's home and the script and checksum
+// files the user uploaded to /tmp. Only leftovers older than minAge are
+// removed, so collections still running aren't disturbed. With dryRun,
+// they are only listed. Windows servers have none.
+func CleanRemote(cfg *config.Config, maxConcurrency int, minAge time.Duration, dryRun bool) []*ServerCleanup {
+	opts := CurrentOptions()
+	var wg sync.WaitGroup
+	sem := semaphore.NewWeighted(int64(maxConcurrency))
+	results := make([]*ServerCleanup, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		results[i] = &ServerCleanup{Server: server}
+		if cfg.ServerSettings(server).Windows() {
+			log.Infof("[%s] Skipping the Windows server: SFTP collections leave nothing behind", server)
+			continue
+		}
+		wg.Add(1)
+		go func(result *ServerCleanup) {
+			defer wg.Done()
+			if err := sem.Acquire(context.Background(), 1); err != nil {
+				result.Err = errors.Wrap(err, "semaphore acquisition failed")
+				return
+			}
+			defer sem.Release(1)
+			result.Removed, result.Err = cleanServer(result.Server, cfg, minAge, dryRun, &opts)
+		}(results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// cleanServer removes the leftovers of one server and returns their paths
+func cleanServer(server string, cfg *config.Config, minAge time.Duration, dryRun bool, opts *Options) ([]string, error) {
+	log.Infof("[%s] Looking for leftovers of failed collections...", server)
+	remote, err := opts.connect(cfg, server)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect")
+	}
+	defer remote.Close()
+	fsys, ok := remote.(RemoteFS)
+	if !ok {
+		return nil, errors.New("the connection can't list remote files")
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	old := func(info os.FileInfo) bool { return info.ModTime().Before(cutoff) }
+	home := "/home/" + cfg.ServerSettings(server).Username // Where collectFromServer puts the copy and tarball
+	homeInfo, err := fsys.Stat(home)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %s", home)
+	}
+
+	// The copy can be owned by root, the rest is the SSH user's
+	root := serverPrivileges(cfg, server, opts.Become)
+	if !cfg.NeedsPrivileges() {
+		root = privileges{Escalation: util.Escalation{Become: util.BecomeNone}}
+	}
+	var removed []string
+	remove := func(p string, info os.FileInfo, asRoot bool) error {
+		if !old(info) {
+			log.Infof("[%s] Keeping %s: changed %s ago, a collection may still be using it", server, p, time.Since(info.ModTime()).Round(time.Second))
+			return nil
+		}
+		removed = append(removed, p)
+		if dryRun {
+			return nil
+		}
+		command := "rm -f " + util.ShellQuote(p)
+		if info.IsDir() {
+			command = "rm -rf " + util.ShellQuote(p)
+		}
+		var stderr string
+		var err error
+		if asRoot {
+			_, stderr, err = root.run(remote, root.Prefix()+command)
+		} else {
+			_, stderr, err = remote.RunCommand(command, false)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove %s, stderr: %s", p, strings.TrimSpace(stderr))
+		}
+		log.Infof("[%s] Removed %s", server, p)
+		return nil
+	}
+
+	for _, name := range append([]string{"remote_backup"}, util.RemoteTarFilenames()...) {
+		p := path.Join(home, name)
+		info, err := fsys.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return removed, errors.Wrapf(err, "failed to stat %s", p)
+		}
+		if err := remove(p, info, name == "remote_backup"); err != nil {
+			return removed, err
+		}
+	}
+
+	entries, err := fsys.ReadDir("/tmp")
+	if errors.Is(err, os.ErrNotExist) {
+		return removed, nil
+	} else if err != nil {
+		return removed, errors.Wrap(err, "failed to list /tmp")
+	}
+	for _, info := range entries {
+		name := info.Name()
+		if !(strings.HasPrefix(name, scriptTempPrefix) && strings.HasSuffix(name, ".sh")) &&
+			!(strings.HasPrefix(name, sumsTempPrefix) && strings.HasSuffix(name, ".txt")) {
+			continue
+		}
+		// Other users' collections upload the same names; theirs are left alone
+		if !sameOwner(info, homeInfo) {
+			continue
+		}
+		if err := remove(path.Join("/tmp", name), info, false); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// sameOwner reports whether two remote files have the same owner, or
+// whether that can't be told
+func sameOwner(a, b os.FileInfo) bool {
+	sa, okA := a.Sys().(*sftp.FileStat)
+	sb, okB := b.Sys().(*sftp.FileStat)
+	return !okA || !okB || sa.UID == sb.UID
+}
@@ -12,32 +12,214 @@ import (
 
 	"github.com/brndnsvr/remote-diff-tool/internal/config"
 	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
 	"github.com/brndnsvr/remote-diff-tool/internal/util"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/sync/semaphore"
 )
 
 const remoteScriptPath = "tmp/collect_files_%d.sh" // Use /tmp, add timestamp
-const remoteTarFilename = "remote_backup.tar.gz"   // Relative to user home
+const tarballDownloadAttempts = 2                  // Re-download once if the checksum doesn't match
+
+// Remote is the part of an SSH connection the collectors use. *sshutil.Client implements it.
+type Remote interface {
+	RunCommand(command string, sudo bool) (string, string, error)
+	UploadFile(localPath, remotePath string) error
+	DownloadFile(remotePath, localPath string) error
+	CheckSudoAccess() bool
+	Close()
+}
+
+// InputRemote is implemented by remotes that can write to a command's
+// standard input, which is how commands get the sudo password.
+// *sshutil.Client implements it.
+type InputRemote interface {
+	RunCommandInput(command, input string, sudo bool) (string, string, error)
+}
+
+// Connector opens a connection to one configured server, with the settings
+// of the collection that asks for it
+type Connector func(cfg *config.Config, server string, opts *Options) (Remote, error)
+
+// Connect is used for every server connection. It can be replaced to collect
+// from something other than real hosts, such as the --mock servers.
+var Connect Connector = connectServer
+
+// Become is how servers without a become setting of their own run the
+// commands that read files as root: util.BecomeSudo, BecomeDoas or BecomeNone
+var Become = util.BecomeSudo
+
+// Annotation is saved in the manifest of every collection, e.g. to tie it to
+// the deployment it verifies
+var Annotation config.RunAnnotation
+
+// privileges is how the commands on one server gain root
+type privileges struct {
+	util.Escalation
+	password string // Piped to sudo -S when Escalation.PipesPassword
+}
+
+// serverPrivileges returns how commands on server gain root: its become
+// setting, or fallback
+func serverPrivileges(cfg *config.Config, server, fallback string) privileges {
+	become := cfg.ServerSettings(server).Become
+	if become == "" {
+		become = fallback
+	}
+	password := cfg.SSHConfig.SudoPassword
+	return privileges{Escalation: util.Escalation{Become: become, Password: password != ""}, password: password}
+}
+
+// ConfigureTarget sets how the commands run through target gain root on
+// server, and the host keys the connection checks
+func ConfigureTarget(cfg *config.Config, server string, opts *Options, target *sshutil.Target) {
+	p := serverPrivileges(cfg, server, opts.Become)
+	target.Become, target.SudoPassword = p.Become, p.password
+	target.HostKeys = opts.HostKeys
+}
+
+// run runs a command that escalates with Prefix by itself, writing the sudo
+// password to its standard input if sudo needs it
+func (p privileges) run(remote Remote, command string) (string, string, error) {
+	if !p.PipesPassword() {
+		return remote.RunCommand(command, false)
+	}
+	r, ok := remote.(InputRemote)
+	if !ok {
+		return "", "", fmt.Errorf("the connection can't pass the sudo password to remote commands")
+	}
+	return r.RunCommandInput(command, p.password+"\n", false)
+}
+
+// FileConcurrency is how many files of one server are checksummed, or
+// transferred with MethodSFTP, at the same time. It is separate from the
+// number of servers collected at once.
+var FileConcurrency = 4
 
-// collectFromServer handles the collection process for a single server
-func collectFromServer(server string, cfg *config.Config, outputDir string, manifest *config.Manifest) error {
+// forEachFile calls fn with every index below n, on up to
+// o.FileConcurrency goroutines, and returns once all calls are done
+func (o *Options) forEachFile(n int, fn func(i int)) {
+	forEachFileN(o.FileConcurrency, n, fn)
+}
+
+// forEachFileN is forEachFile with its own number of goroutines
+func forEachFileN(workers, n int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// connectServer opens an SSH connection using the server's effective settings
+func connectServer(cfg *config.Config, server string, opts *Options) (Remote, error) {
+	settings := cfg.ServerSettings(server)
+	jumps, err := cfg.JumpHosts(server)
+	if err != nil {
+		return nil, err
+	}
+	target := sshTarget(settings, cfg.SSHConfig.KeyPassphrase)
+	ConfigureTarget(cfg, server, opts, &target)
+	for _, j := range jumps {
+		target.JumpHosts = append(target.JumpHosts, sshTarget(j, cfg.SSHConfig.KeyPassphrase))
+	}
+	client, err := sshutil.Connect(target)
+	if err != nil {
+		return nil, err // Don't wrap a nil *sshutil.Client in a non-nil Remote
+	}
+	return client, nil
+}
+
+func sshTarget(settings config.ServerConfig, keyPassphrase string) sshutil.Target {
+	return sshutil.Target{
+		Hostname:      settings.Hostname,
+		Port:          settings.Port,
+		Username:      settings.Username,
+		KeyPath:       settings.KeyPath,
+		KeyPassphrase: keyPassphrase,
+	}
+}
+
+// collectFromServer handles the collection process for a single server. It
+// gives up slot once the tarball is downloaded, and waits for the local
+// stages to extract and checksum it.
+func collectFromServer(server string, cfg *config.Config, outputDir string, manifest *config.Manifest, slot *serverSlot, opts *Options) error {
 	log.Infof("[%s] Starting collection", server)
 
 	// 1. Connect
-	sshClient, err := sshutil.Connect(server, cfg.SSHConfig.Username, cfg.SSHConfig.KeyPath, cfg.SSHConfig.KeyPassphrase)
+	phaseStart := time.Now()
+	sshClient, err := opts.connect(cfg, server)
 	if err != nil {
+		timing.Since(server, timing.Connect, phaseStart)
 		return errors.Wrap(err, "failed to connect")
 	}
-	defer sshClient.Close()
+	var closeOnce sync.Once
+	disconnect := func() { closeOnce.Do(sshClient.Close) }
+	defer disconnect()
+
+	if opts.Method == MethodAuto {
+		shell, err := hasShell(server, sshClient)
+		if err != nil {
+			timing.Since(server, timing.Connect, phaseStart)
+			return errors.Wrap(err, "failed to check for shell access")
+		}
+		if !shell {
+			timing.Since(server, timing.Connect, phaseStart)
+			log.Warnf("[%s] The server refuses shell commands; collecting over SFTP instead, without privileges", server)
+			return collectOverSFTP(server, sshClient, cfg, outputDir, manifest, opts)
+		}
+	}
 
 	// Optional: Check sudo access early
+	root := serverPrivileges(cfg, server, opts.Become)
 	sshClient.CheckSudoAccess()
+	timing.Since(server, timing.Connect, phaseStart)
+
+	cfg, home, err := resolveHome(server, sshClient, cfg)
+	if err != nil {
+		return err
+	}
+
+	filter, err := cfg.PathFilter()
+	if err != nil {
+		return errors.Wrap(err, "invalid exclude/include patterns")
+	}
+	var unchanged map[string]bool
+	if opts.Incremental {
+		opts.throttle(server, sshClient, "the incremental checksums")
+		unchanged = unchangedFiles(server, sshClient, cfg, home, previousChecksums(server, outputDir, cfg, home, filter), opts.Priority)
+	}
 
 	// 2. Prepare and Upload Script
-	scriptContent := util.GenerateCollectionScript(cfg.Files, cfg.Dirs, cfg.SSHConfig.Username)
+	phaseStart = time.Now()
+	settings := cfg.ServerSettings(server)
+	username := settings.Username
+	scriptContent := util.GenerateCollectionScript(cfg.Files, cfg.Dirs, username, settings.Env, root.Escalation, util.ScriptOptions{Priority: opts.Priority, Compression: opts.Compression}, cfg.IsUnprivileged, func(dir string) string {
+		return filter.FindPredicates(dir, true)
+	}, unchangedRemotePaths(home, unchanged))
+	// Nothing root owns is left behind to clean up when no path escalates
+	cleanup := root
+	if !cfg.NeedsPrivileges() {
+		cleanup = privileges{Escalation: util.Escalation{Become: util.BecomeNone}}
+	}
 	localScript, err := os.CreateTemp("", "collect_script_*.sh")
 	if err != nil {
 		return errors.Wrap(err, "failed to create temporary script file")
@@ -53,7 +235,7 @@ func collectFromServer(server string, cfg *config.Config, outputDir string, mani
 
 	// Use unique remote script name to avoid conflicts if run concurrently by same user
 	// Script needs to be in a place the user can write to, like /tmp or $HOME
-	remoteHomeDir := fmt.Sprintf("/home/%s", cfg.SSHConfig.Username)
+	remoteHomeDir := fmt.Sprintf("/home/%s", username)
 	timestamp := time.Now().UnixNano()
 	remoteScript := fmt.Sprintf("/tmp/collect_files_%d.sh", timestamp)
 
@@ -69,38 +251,117 @@ func collectFromServer(server string, cfg *config.Config, outputDir string, mani
 		log.Warnf("[%s] Failed to chmod script (continuing anyway): %v", server, err)
 	}
 
+	timing.Since(server, timing.Script, phaseStart)
+
+	// lsof, the stable-reads checksums and the copy all read every configured file
+	opts.throttle(server, sshClient, "the collection script")
+
+	var openFiles map[string]bool
+	if opts.OpenFiles != OpenFilesIgnore {
+		openFiles = logicalKeys(home, remoteOpenFiles(server, sshClient, cfg, filter))
+	}
+	var before map[string]string
+	if opts.StableReads {
+		before = logicalKeys(home, remoteChecksumsNow(server, "before", sshClient, cfg, filter, opts.Priority))
+	}
+
 	// 4. Run Script
 	log.Infof("[%s] Running collection script...", server)
-	stdout, stderr, err := sshClient.RunCommand(remoteScript, false) // Script uses sudo internally where needed
+	phaseStart = time.Now()
+	stdout, stderr, err := root.run(sshClient, remoteScript) // Script uses sudo internally where needed
+	timing.Since(server, timing.Exec, phaseStart)
+	saveSession(outputDir, server, phaseStart, stdout, stderr, err)
 	log.Debugf("[%s] Script stdout:\n%s", server, stdout)
 	if err != nil {
-		log.Errorf("[%s] Collection script stderr:\n%s", server, stderr)
+		log.Errorf("[%s] Collection script stderr (all output is in %s):\n%s", server, SessionPath(outputDir, server), stderr)
 		// Attempt cleanup even if script failed
-		cleanupErr := cleanupRemoteFiles(sshClient, remoteScript, remoteHomeDir)
+		cleanupErr := cleanupRemoteFiles(sshClient, cleanup, opts.Compression, remoteScript, remoteHomeDir)
 		log.Warnf("[%s] Cleanup after script failure result: %v", server, cleanupErr)
 		return errors.Wrapf(err, "collection script execution failed")
 	}
 	log.Infof("[%s] Collection script finished successfully.", server)
 
-	// 5. Download Tarball
-	remoteTarPath := fmt.Sprintf("%s/%s", remoteHomeDir, remoteTarFilename)
-	localTarPath := filepath.Join(os.TempDir(), fmt.Sprintf("remote_backup_%s_%d.tar.gz", server, timestamp))
-	log.Infof("[%s] Downloading %s...", server, remoteTarPath)
-	err = sshClient.DownloadFile(remoteTarPath, localTarPath)
-	defer os.Remove(localTarPath) // Clean up local tarball
+	// Record the original modes and owners; the tarball only has loosened copies
+	phaseStart = time.Now()
+	metadata, err := remoteMetadata(server, sshClient, cfg, filter, opts.Priority)
+	timing.Since(server, timing.Exec, phaseStart)
 	if err != nil {
-		// Attempt cleanup even if download failed
-		cleanupErr := cleanupRemoteFiles(sshClient, remoteScript, remoteHomeDir)
-		log.Warnf("[%s] Cleanup after download failure result: %v", server, cleanupErr)
-		return errors.Wrapf(err, "failed to download tarball %s", remoteTarPath)
+		log.Warnf("[%s] Failed to list file modes and owners (continuing without them): %v", server, err)
+	}
+	metadata = logicalKeys(home, metadata)
+	var stability *stabilityCheck
+	if before != nil {
+		if after := logicalKeys(home, remoteChecksumsNow(server, "after", sshClient, cfg, filter, opts.Priority)); after != nil {
+			stability = &stabilityCheck{before: before, after: after}
+		}
 	}
-	log.Infof("[%s] Tarball downloaded to %s", server, localTarPath)
+
+	// 5. Download Tarball and verify it against the remote checksum
+	phaseStart = time.Now()
+	remoteTarPath := fmt.Sprintf("%s/%s", remoteHomeDir, opts.Compression.TarFilename())
+	localTarPath := filepath.Join(os.TempDir(), fmt.Sprintf("remote_backup_%s_%d%s", server, timestamp, opts.Compression.Extension()))
+	// Printed by the script; asked for separately if its output lacks it
+	remoteSum, ok := tarballChecksum(stdout, remoteTarPath)
+	if !ok {
+		if remoteSum, err = remoteSHA256(sshClient, remoteTarPath, opts.Priority); err != nil {
+			cleanupErr := cleanupRemoteFiles(sshClient, cleanup, opts.Compression, remoteScript, remoteHomeDir)
+			log.Warnf("[%s] Cleanup after checksum failure result: %v", server, cleanupErr)
+			return errors.Wrapf(err, "failed to checksum tarball %s on remote", remoteTarPath)
+		}
+	}
+	log.Debugf("[%s] Remote tarball sha256: %s", server, remoteSum)
+
+	defer os.Remove(localTarPath) // Clean up local tarball
+	for attempt := 1; ; attempt++ {
+		log.Infof("[%s] Downloading %s...", server, remoteTarPath)
+		err = sshClient.DownloadFile(remoteTarPath, localTarPath)
+		// Transfer errors were already retried if transient; only a bad checksum warrants another download
+		verifyFailed := false
+		if err == nil {
+			err = verifySHA256(localTarPath, remoteSum)
+			if err == nil {
+				break
+			}
+			verifyFailed = true
+			// A corrupted transfer would otherwise surface later as phantom diffs
+			log.Warnf("[%s] Tarball verification failed (attempt %d/%d): %v", server, attempt, tarballDownloadAttempts, err)
+		}
+		if !verifyFailed || attempt >= tarballDownloadAttempts {
+			// Attempt cleanup even if download failed
+			cleanupErr := cleanupRemoteFiles(sshClient, cleanup, opts.Compression, remoteScript, remoteHomeDir)
+			log.Warnf("[%s] Cleanup after download failure result: %v", server, cleanupErr)
+			return errors.Wrapf(err, "failed to download tarball %s", remoteTarPath)
+		}
+	}
+	timing.Since(server, timing.Download, phaseStart)
+	log.Infof("[%s] Tarball downloaded to %s and verified (sha256 %s)", server, localTarPath, remoteSum)
+
+	journals := fetchJournals(server, sshClient, cfg, manifest, true)
+
+	// Remote Cleanup: everything left to do is local, so the next server can connect
+	log.Infof("[%s] Cleaning up remote files...", server)
+	if err := cleanupRemoteFiles(sshClient, cleanup, opts.Compression, remoteScript, remoteHomeDir); err != nil {
+		log.Warnf("[%s] Remote cleanup failed: %v", server, err) // Log but don't fail the whole process
+	}
+	disconnect()
+	slot.release()
 
 	// 6. Extract Tarball Locally
+	leaveExtract := slot.enterExtract()
+	defer leaveExtract()
 	// --- PATH UPDATED TO INCLUDE CollectedFilesBaseDir ---
 	serverOutputDir := filepath.Join(outputDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server))
 	// --- END OF PATH UPDATE ---
 
+	previousDir := serverOutputDir + previousDirSuffix
+	if len(unchanged) > 0 {
+		// The tarball lacks the unchanged files; their copies are taken from here after extracting
+		os.RemoveAll(previousDir)
+		if err := os.Rename(serverOutputDir, previousDir); err != nil {
+			return errors.Wrapf(err, "failed to set aside the previous collection in %s", serverOutputDir)
+		}
+		defer os.RemoveAll(previousDir)
+	}
 	if err := os.RemoveAll(serverOutputDir); err != nil { // Clear previous contents
 		log.Warnf("[%s] Failed to clear previous output directory %s: %v", server, serverOutputDir, err)
 	}
@@ -110,18 +371,34 @@ func collectFromServer(server string, cfg *config.Config, outputDir string, mani
 	}
 
 	log.Infof("[%s] Extracting tarball to %s...", server, serverOutputDir)
+	phaseStart = time.Now()
 	tarFile, err := os.Open(localTarPath)
 	if err != nil {
 		return errors.Wrapf(err, "failed to open local tarball %s", localTarPath)
 	}
-	err = util.ExtractTarGz(tarFile, serverOutputDir) // Pass the correct nested path
-	tarFile.Close()                                   // Close file handle
+	err = opts.Compression.Extract(tarFile, serverOutputDir) // Pass the correct nested path
+	tarFile.Close()                                          // Close file handle
+	timing.Since(server, timing.Extract, phaseStart)
 	if err != nil {
 		return errors.Wrapf(err, "failed to extract tarball %s", localTarPath)
 	}
+	if err := home.relocate(serverOutputDir); err != nil {
+		return err
+	}
+	if len(unchanged) > 0 {
+		restored := restoreUnchanged(server, previousDir, serverOutputDir, unchanged, manifest)
+		log.Infof("[%s] Kept %d unchanged file(s) from the previous collection", server, restored)
+	}
+	leaveExtract()
 
 	// 7. Calculate Checksums and Update Manifest
+	leaveHash := slot.enterHash()
+	defer leaveHash()
 	log.Infof("[%s] Calculating checksums for files in %s...", server, serverOutputDir)
+	phaseStart = time.Now()
+	// The walk only lists the files; they are hashed FileConcurrency at a time below
+	type hashJob struct{ path, relativePath string }
+	var jobs []hashJob
 	// The filepath.WalkDir and filepath.Rel logic here should still work correctly
 	// as filepath.Rel calculates the path relative to the first argument (serverOutputDir)
 	err = filepath.WalkDir(serverOutputDir, func(path string, d fs.DirEntry, err error) error {
@@ -129,6 +406,12 @@ func collectFromServer(server string, cfg *config.Config, outputDir string, mani
 			log.Errorf("[%s] Error accessing path %s during walk: %v", server, path, err)
 			return err // Propagate walk error
 		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// Extracted symlinks stay inside the server dir; ones to directories have their contents walked already
+			if fi, statErr := os.Stat(path); statErr == nil && fi.IsDir() {
+				return nil
+			}
+		}
 		if !d.IsDir() {
 			relativePath, _ := filepath.Rel(serverOutputDir, path)
 			// Convert to forward slashes for consistency in manifest
@@ -136,45 +419,150 @@ func collectFromServer(server string, cfg *config.Config, outputDir string, mani
 
 			// Check if it's one of our MISSING marker files
 			if strings.HasSuffix(relativePath, ".MISSING") || strings.HasSuffix(relativePath, "DIRECTORY.MISSING") {
-				originalPath := strings.TrimSuffix(strings.TrimSuffix(relativePath, ".MISSING"), "DIRECTORY.MISSING")
+				originalPath := strings.TrimSuffix(strings.TrimSuffix(relativePath, "DIRECTORY.MISSING"), ".MISSING")
 				log.Warnf("[%s] Marked as missing on remote: %s", server, originalPath)
-				manifest.AddFile(server, originalPath, "", "Missing on remote")
+				manifest.AddFile(server, originalPath, "", config.MissingOnRemote)
 				return nil // Don't checksum marker files
 			}
 
-			checksum, csErr := util.CalculateSHA256(path)
-			if csErr != nil {
-				log.Errorf("[%s] Failed to calculate checksum for %s: %v", server, relativePath, csErr)
-				// Record error in manifest
-				manifest.AddFile(server, relativePath, "", csErr.Error())
-			} else {
-				log.Debugf("[%s] Checksum %s: %s", server, relativePath, checksum)
-				manifest.AddFile(server, relativePath, checksum, "")
+			// The remote find only prunes what it can express; the filter has the final say
+			if !filter.Keep(home.remote(relativePath)) {
+				log.Debugf("[%s] Excluded by filter: %s", server, relativePath)
+				if rmErr := os.Remove(path); rmErr != nil {
+					log.Warnf("[%s] Failed to remove excluded file %s: %v", server, path, rmErr)
+				}
+				return nil
 			}
+
+			if openFiles[relativePath] && opts.OpenFiles == OpenFilesSkip {
+				log.Infof("[%s] Skipping %s: it is open for writing", server, relativePath)
+				if rmErr := os.Remove(path); rmErr != nil {
+					log.Warnf("[%s] Failed to remove skipped file %s: %v", server, path, rmErr)
+				}
+				manifest.AddFile(server, relativePath, "", "")
+				manifest.MarkVolatile(server, relativePath)
+				if md, ok := metadata[relativePath]; ok {
+					manifest.SetMetadata(server, relativePath, md)
+				}
+				return nil
+			}
+			jobs = append(jobs, hashJob{path: path, relativePath: relativePath})
 		}
 		return nil // Continue walking
 	})
+	var stats hashStats
+	opts.forEachFile(len(jobs), func(i int) {
+		job := jobs[i]
+		checksum, chunks, csErr := opts.hashLocalCopy(job.path, &stats)
+		if csErr != nil {
+			log.Errorf("[%s] Failed to calculate checksum for %s: %v", server, job.relativePath, csErr)
+			// Record error in manifest
+			manifest.AddFile(server, job.relativePath, "", csErr.Error())
+			return
+		}
+		log.Debugf("[%s] Checksum %s: %s", server, job.relativePath, checksum)
+		manifest.AddFile(server, job.relativePath, checksum, "")
+		if chunks != nil {
+			manifest.SetChunks(server, job.relativePath, chunks)
+		}
+		if md, ok := metadata[job.relativePath]; ok {
+			manifest.SetMetadata(server, job.relativePath, md)
+		}
+		if openFiles[job.relativePath] {
+			manifest.MarkVolatile(server, job.relativePath)
+		}
+		if stability.changed(job.relativePath, checksum) {
+			log.Warnf("[%s] %s changed while it was collected; marking it unstable", server, job.relativePath)
+			manifest.MarkUnstable(server, job.relativePath)
+		}
+	})
+	timing.Since(server, timing.Hash, phaseStart)
+	stats.report(server, time.Since(phaseStart))
+	if root.Unprivileged() {
+		manifest.SetUnprivileged(server)
+		recordUnreadable(server, manifest, metadata, nil)
+	} else if len(cfg.Unprivileged) > 0 {
+		recordUnreadable(server, manifest, metadata, func(relativePath string) bool {
+			return cfg.IsUnprivileged(home.remote(relativePath))
+		})
+	}
+	recordCopyFailures(server, manifest, stdout, serverOutputDir, home, metadata)
 	if err != nil {
 		log.Errorf("[%s] Error walking directory %s for checksums: %v", server, serverOutputDir, err)
 		// Decide if this should be a fatal error for the server
 	}
 
-	// 8. Remote Cleanup
-	log.Infof("[%s] Cleaning up remote files...", server)
-	if err := cleanupRemoteFiles(sshClient, remoteScript, remoteHomeDir); err != nil {
-		log.Warnf("[%s] Remote cleanup failed: %v", server, err) // Log but don't fail the whole process
-	}
+	storeJournals(server, journals, serverOutputDir, manifest)
 
+	manifest.SetMethod(server, MethodScript)
 	log.Infof("[%s] Collection finished successfully", server)
 	return nil
 }
 
-func cleanupRemoteFiles(sshClient *sshutil.Client, remoteScriptPath, remoteHomeDir string) error {
+// tarballChecksum finds the sha256 the collection script printed for the
+// tarball in its output
+func tarballChecksum(stdout, remoteTarPath string) (string, bool) {
+	for _, line := range strings.Split(stdout, "\n") {
+		if sum, p, ok := parseChecksumLine(strings.TrimSpace(line)); ok && p == remoteTarPath {
+			return sum, true
+		}
+	}
+	return "", false
+}
+
+// remoteSHA256 computes a file's sha256 on the remote host
+func remoteSHA256(sshClient Remote, remotePath string, prio util.Priority) (string, error) {
+	stdout, stderr, err := sshClient.RunCommand(prio.Prefix()+"sha256sum "+util.ShellQuote(remotePath), false)
+	if err != nil {
+		return "", errors.Wrapf(err, "sha256sum failed, stderr: %s", stderr)
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("unexpected sha256sum output: %q", stdout)
+	}
+	return fields[0], nil
+}
+
+// verifySHA256 checks a local file against an expected sha256
+func verifySHA256(localPath, expected string) error {
+	actual, err := util.CalculateSHA256(localPath)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch for %s: remote %s, local %s", localPath, expected, actual)
+	}
+	return nil
+}
+
+// recordUnreadable records the files the remote listing has but the SSH user
+// couldn't copy, among those read without privileges (all when unprivileged
+// is nil)
+func recordUnreadable(server string, manifest *config.Manifest, listed map[string]config.FileMetadata, unprivileged func(relativePath string) bool) {
+	skipped := 0
+	for relativePath, md := range listed {
+		if unprivileged != nil && !unprivileged(relativePath) {
+			continue
+		}
+		if _, ok := manifest.GetFileInfo(server, relativePath); ok {
+			continue
+		}
+		log.Warnf("[%s] Skipped %s: not readable without privileges", server, relativePath)
+		manifest.AddFile(server, relativePath, "", config.UnreadableUnprivileged)
+		manifest.SetMetadata(server, relativePath, md)
+		skipped++
+	}
+	if skipped > 0 {
+		log.Warnf("[%s] %d file(s) could not be read without privileges", server, skipped)
+	}
+}
+
+func cleanupRemoteFiles(sshClient Remote, root privileges, compression util.Compression, remoteScriptPath, remoteHomeDir string) error {
 	remoteBackupDir := fmt.Sprintf("%s/remote_backup", remoteHomeDir)
-	remoteTarPath := fmt.Sprintf("%s/%s", remoteHomeDir, remoteTarFilename)
+	remoteTarPath := fmt.Sprintf("%s/%s", remoteHomeDir, compression.TarFilename())
 	// Use sudo for rm -rf because parts of remote_backup might be owned by root
-	command := fmt.Sprintf("rm -f %s && sudo rm -rf %s && rm -f %s", remoteScriptPath, remoteBackupDir, remoteTarPath)
-	_, stderr, err := sshClient.RunCommand(command, false) // Run as user, sudo is embedded
+	command := fmt.Sprintf("rm -f %s && %srm -rf %s && rm -f %s", remoteScriptPath, root.Prefix(), remoteBackupDir, remoteTarPath)
+	_, stderr, err := root.run(sshClient, command) // Run as user, sudo is embedded
 	if err != nil {
 		return errors.Wrapf(err, "remote cleanup command failed, stderr: %s", stderr)
 	}
@@ -183,32 +571,67 @@ func cleanupRemoteFiles(sshClient *sshutil.Client, remoteScriptPath, remoteHomeD
 
 // RunCollection orchestrates file collection from all servers concurrently
 func RunCollection(cfg *config.Config, outputDir string, maxConcurrency int) bool {
+	return RunCollectionContext(context.Background(), cfg, outputDir, maxConcurrency) == nil
+}
+
+// RunCollectionContext is RunCollection returning what went wrong. Once ctx
+// is done, servers that haven't started are skipped; those already being
+// collected finish.
+func RunCollectionContext(ctx context.Context, cfg *config.Config, outputDir string, maxConcurrency int) error {
+	return Run(ctx, cfg, outputDir, maxConcurrency, CurrentOptions())
+}
+
+// Run is RunCollectionContext with the settings of opts instead of the
+// package variables
+func Run(ctx context.Context, cfg *config.Config, outputDir string, maxConcurrency int, opts Options) error {
 	var wg sync.WaitGroup
-	// Use a semaphore to limit concurrency
-	sem := semaphore.NewWeighted(int64(maxConcurrency))
+	// maxConcurrency servers are connected at once; extraction and hashing have stages of their own
+	stages := newPipeline(ctx, maxConcurrency, &opts)
 	errChan := make(chan error, len(cfg.Servers)) // Buffered channel to collect errors
 	success := true                               // Track overall success
 
 	// Create a shared manifest
 	manifest := config.NewManifest()
+	if !opts.Annotation.Empty() {
+		annotation := opts.Annotation
+		manifest.Annotation = &annotation
+	}
 
-	log.Infof("Starting collection from %d servers...", len(cfg.Servers))
+	log.Infof("Starting collection from %d servers using the %s method...", len(cfg.Servers), opts.Method)
+	if opts.FastHash {
+		opts.contents = newContentCache()
+	}
 
 	for _, server := range cfg.Servers {
 		wg.Add(1)
 		go func(s string) {
 			defer wg.Done()
-			// Acquire semaphore, context for potential cancellation (optional)
-			if err := sem.Acquire(context.Background(), 1); err != nil {
+			// Acquire semaphore; fails once ctx is done
+			slot, err := stages.acquire()
+			if err != nil {
 				log.Errorf("[%s] Failed to acquire semaphore: %v", s, err)
+				if opts.AllowPartial {
+					manifest.SetFailed(s, "not collected: "+err.Error())
+				}
 				errChan <- errors.Wrapf(err, "[%s] semaphore acquisition failed", s)
 				return
 			}
-			defer sem.Release(1)
-
-			// Execute collection for this server
-			if err := collectFromServer(s, cfg, outputDir, manifest); err != nil {
+			defer slot.release()
+
+			// Execute collection for this server; SFTP downloads and hashes file by file, holding its slot
+			if opts.Method == MethodSFTP {
+				err = collectViaSFTP(s, cfg, outputDir, manifest, &opts)
+			} else if cfg.ServerSettings(s).Windows() {
+				log.Infof("[%s] Collecting the Windows server over SFTP", s)
+				err = collectViaSFTP(s, cfg, outputDir, manifest, &opts)
+			} else {
+				err = collectFromServer(s, cfg, outputDir, manifest, slot, &opts)
+			}
+			if err != nil {
 				log.Errorf("[%s] Collection failed: %v", s, err)
+				if opts.AllowPartial {
+					manifest.SetFailed(s, err.Error())
+				}
 				errChan <- errors.Wrapf(err, "[%s] collection error", s)
 			}
 		}(server)
@@ -219,22 +642,45 @@ func RunCollection(cfg *config.Config, outputDir string, maxConcurrency int) boo
 	close(errChan) // Close channel after all writers are done
 
 	// Check for errors
+	var firstErr error
+	failed := 0
 	for err := range errChan {
 		if err != nil {
 			log.Error(err) // Log each specific error
 			success = false
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
 
-	if success {
-		// Save the manifest only if all collections were successful (or adjust logic)
+	// With --allow-partial, the servers that succeeded are kept as long as there are any
+	partial := !success && opts.AllowPartial && failed < len(cfg.Servers)
+	if success || partial {
+		// Save the manifest only if all collections were successful, or those that were with --allow-partial
 		if err := manifest.Save(outputDir); err != nil {
 			log.Errorf("Failed to save manifest file: %v", err)
-			success = false // Mark as failure if manifest cannot be saved
+			return err
+		}
+		if partial {
+			log.Warnf("Collection failed on %d of %d server(s); the manifest was saved without them, and analyses leave them out", failed, len(cfg.Servers))
+		}
+		// The manifest is kept for inspection, but the data is incomplete
+		if errs, servers := fileErrors(manifest); opts.Strict && len(errs) > 0 {
+			log.Errorf("%d file(s) on %d server(s) failed to collect:", len(errs), servers)
+			for _, e := range errs {
+				log.Error("  " + e)
+			}
+			return fmt.Errorf("--strict: %d file(s) on %d server(s) failed to collect", len(errs), servers)
 		}
 	} else {
-		log.Warn("Manifest not saved due to collection errors.")
+		if opts.AllowPartial {
+			log.Warn("Manifest not saved: the collection failed on every server.")
+		} else {
+			log.Warn("Manifest not saved due to collection errors (--allow-partial keeps the servers that succeeded).")
+		}
+		return errors.Wrapf(firstErr, "collection failed on %d of %d server(s)", failed, len(cfg.Servers))
 	}
-
-	return success
+	return nil
 }
@@ -0,0 +1,317 @@
+package collect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshmock"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+)
+
+// fixtureFiles are written on every mock server; web2 has a different hosts file
+var fixtureFiles = map[string]string{
+	"etc/hosts":         "127.0.0.1 localhost\n",
+	"etc/app/app.conf":  "port = 8080\n",
+	"etc/app/conf.d/tz": "UTC\n",
+}
+
+// startFleet starts mock servers for servers, with the given --mock-fault specs
+func startFleet(t *testing.T, servers []string, faultSpecs ...string) *sshmock.Fleet {
+	t.Helper()
+	fixtures := t.TempDir()
+	for _, server := range servers {
+		for name, content := range fixtureFiles {
+			if server == "web2" && name == "etc/hosts" {
+				content += "10.0.0.2 web2\n"
+			}
+			p := filepath.Join(fixtures, server, name)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	faults, err := sshmock.ParseFaults(faultSpecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleet, err := sshmock.StartFleet(fixtures, servers, faults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fleet.Close)
+	return fleet
+}
+
+// fleetOptions returns the default options with connections to fleet.
+// Refused servers fail on the first dial.
+func fleetOptions(t *testing.T, fleet *sshmock.Fleet, method string) Options {
+	t.Helper()
+	dial := sshutil.DialRetry
+	t.Cleanup(func() { sshutil.DialRetry = dial })
+	sshutil.DialRetry.Attempts = 1
+	opts := DefaultOptions()
+	opts.Method = method
+	opts.Connect = func(cfg *config.Config, server string, opts *Options) (Remote, error) {
+		target, err := fleet.Target(server)
+		if err != nil {
+			return nil, err
+		}
+		ConfigureTarget(cfg, server, opts, &target)
+		return sshutil.Connect(target)
+	}
+	return opts
+}
+
+func loadConfig(t *testing.T, fleet *sshmock.Fleet, outputDir string, servers []string) *config.Config {
+	t.Helper()
+	creds := fleet.Credentials()
+	cfg, err := config.LoadOrInitializeConfig(outputDir, config.Overrides{
+		Servers: strings.Join(servers, ","),
+		Files:   "/etc/hosts",
+		Dirs:    "/etc/app",
+		SSH:     &creds,
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// listTree returns the slash paths of the files below root
+func listTree(t *testing.T, root string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRunCollection(t *testing.T) {
+	servers := []string{"web1", "web2"}
+	for _, method := range []string{MethodScript, MethodSFTP} {
+		t.Run(method, func(t *testing.T) {
+			fleet := startFleet(t, servers)
+			opts := fleetOptions(t, fleet, method)
+			before := make(map[string][]string)
+			for _, s := range servers {
+				before[s] = listTree(t, fleet.Root(s))
+			}
+
+			outputDir := t.TempDir()
+			cfg := loadConfig(t, fleet, outputDir, servers)
+			if err := Run(context.Background(), cfg, outputDir, 2, opts); err != nil {
+				t.Fatalf("collection failed: %v", err)
+			}
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, server := range servers {
+				files := manifest.FilesByServer[server]
+				if len(files) != len(fixtureFiles) {
+					t.Errorf("%s: manifest has %d files, want %d", server, len(files), len(fixtureFiles))
+				}
+				for name, content := range fixtureFiles {
+					if server == "web2" && name == "etc/hosts" {
+						content += "10.0.0.2 web2\n"
+					}
+					info, ok := files[name]
+					if !ok {
+						t.Errorf("%s: /%s missing from the manifest", server, name)
+						continue
+					}
+					if info.Error != "" || info.Checksum != sha256Hex(content) {
+						t.Errorf("%s: /%s has checksum %q (error %q), want %s", server, name, info.Checksum, info.Error, sha256Hex(content))
+					}
+					local, err := os.ReadFile(filepath.Join(outputDir, config.CollectedFilesBaseDir, "files-"+server, name))
+					if err != nil || string(local) != content {
+						t.Errorf("%s: collected copy of /%s = %q (%v), want %q", server, name, local, err, content)
+					}
+				}
+				// The script, tarball and staging copy are removed from the server
+				if after := listTree(t, fleet.Root(server)); strings.Join(after, "\n") != strings.Join(before[server], "\n") {
+					t.Errorf("%s: files left on the server:\n%v\nwant:\n%v", server, after, before[server])
+				}
+			}
+		})
+	}
+}
+
+func TestRunCollectionFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		refused   []string
+		partial   bool
+		wantErr   bool
+		collected []string // Servers in the saved manifest; nil if none is saved
+	}{
+		{name: "one server down", refused: []string{"web2"}, wantErr: true},
+		{name: "one server down, partial", refused: []string{"web2"}, partial: true, collected: []string{"web1", "web3"}},
+		{name: "every server down, partial", refused: []string{"web1", "web2", "web3"}, partial: true, wantErr: true},
+	}
+	servers := []string{"web1", "web2", "web3"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var specs []string
+			for _, s := range tt.refused {
+				specs = append(specs, s+"=refuse")
+			}
+			fleet := startFleet(t, servers, specs...)
+			opts := fleetOptions(t, fleet, MethodScript)
+			opts.AllowPartial = tt.partial
+
+			outputDir := t.TempDir()
+			cfg := loadConfig(t, fleet, outputDir, servers)
+			err := Run(context.Background(), cfg, outputDir, 3, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			_, statErr := os.Stat(filepath.Join(outputDir, config.CollectedFilesBaseDir, config.ManifestFileName))
+			if tt.collected == nil {
+				if statErr == nil {
+					t.Error("the manifest was saved")
+				}
+				return
+			}
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for s := range manifest.FilesByServer {
+				got = append(got, s)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.collected, ",") {
+				t.Errorf("manifest has servers %v, want %v", got, tt.collected)
+			}
+			for _, s := range tt.refused {
+				if manifest.Failed[s] == "" {
+					t.Errorf("%s is not recorded as failed", s)
+				}
+			}
+		})
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	// Collections with different settings share nothing but the servers
+	servers := []string{"web1", "web2"}
+	fleet := startFleet(t, servers)
+	methods := []string{MethodScript, MethodSFTP}
+	outputDirs := make([]string, len(methods))
+	errs := make([]error, len(methods))
+	var wg sync.WaitGroup
+	for i, method := range methods {
+		opts := fleetOptions(t, fleet, method)
+		opts.Annotation = config.RunAnnotation{Note: method}
+		opts.FastHash = i == 0
+		outputDirs[i] = t.TempDir()
+		cfg := loadConfig(t, fleet, outputDirs[i], servers)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = Run(context.Background(), cfg, outputDirs[i], 2, opts)
+		}(i)
+	}
+	wg.Wait()
+	for i, method := range methods {
+		if errs[i] != nil {
+			t.Fatalf("%s collection failed: %v", method, errs[i])
+		}
+		manifest, err := config.LoadManifest(outputDirs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Annotation == nil || manifest.Annotation.Note != method {
+			t.Errorf("%s collection saved annotation %+v", method, manifest.Annotation)
+		}
+		for _, server := range servers {
+			if got := manifest.Methods[server]; got != method {
+				t.Errorf("%s collection of %s used method %q", method, server, got)
+			}
+		}
+	}
+}
+
+func TestRunCollectionNames(t *testing.T) {
+	// Names that break line-based listings or look alike once normalized;
+	// the manifest must key them by their exact bytes
+	names := []string{
+		"etc/app/cafe\u0301.conf",
+		"etc/app/caf\u00e9.conf",
+		"etc/app/two\nlines.conf",
+		"etc/app/with  spaces.conf",
+		"etc/app/tab\there",
+	}
+	for _, method := range []string{MethodScript, MethodSFTP} {
+		t.Run(method, func(t *testing.T) {
+			fleet := startFleet(t, []string{"web1"})
+			for i, name := range names {
+				if err := os.WriteFile(filepath.Join(fleet.Root("web1"), name), []byte{byte('a' + i), '\n'}, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := fleetOptions(t, fleet, method)
+
+			outputDir := t.TempDir()
+			cfg := loadConfig(t, fleet, outputDir, []string{"web1"})
+			if err := Run(context.Background(), cfg, outputDir, 1, opts); err != nil {
+				t.Fatalf("collection failed: %v", err)
+			}
+			manifest, err := config.LoadManifest(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := manifest.FilesByServer["web1"]
+			for i, name := range names {
+				info, ok := files[name]
+				if !ok {
+					t.Errorf("%+q missing from the manifest", name)
+					continue
+				}
+				if want := sha256Hex(string([]byte{byte('a' + i), '\n'})); info.Checksum != want {
+					t.Errorf("%+q has checksum %s, want %s", name, info.Checksum, want)
+				}
+			}
+			if want := len(fixtureFiles) + len(names); len(files) != want {
+				var keys []string
+				for k := range files {
+					keys = append(keys, k)
+				}
+				t.Errorf("manifest has %d files, want %d: %+q", len(files), want, keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package collect
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// copyFailures reads the status lines of the collection script's output and
+// returns the remote paths it couldn't copy, with the reason. A directory
+// whose cpio failed without naming a file is reported as a whole.
+func copyFailures(stdout string) map[string]string {
+	failures := make(map[string]string)
+	dir, prev := "", ""
+	dirHasFailures := false
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if rest, ok := strings.CutPrefix(line, util.ScriptStatusPrefix+"\t"); ok {
+			status, p, _ := strings.Cut(rest, "\t")
+			switch status {
+			case util.StatusDir:
+				dir, dirHasFailures = p, false
+			case util.StatusDirFailed:
+				if !dirHasFailures {
+					failures[p] = "cpio failed"
+				}
+				dir = ""
+			case util.StatusCopyFailed:
+				reason := "cp failed"
+				if strings.HasPrefix(prev, "cp: ") {
+					reason = prev
+				}
+				failures[p] = reason
+			}
+			prev = line
+			continue
+		}
+		prev = line
+		// cpio: ./sub/file: Cannot open: Permission denied
+		msg, ok := strings.CutPrefix(line, "cpio: ")
+		if !ok || dir == "" {
+			continue
+		}
+		if name, reason, found := strings.Cut(msg, ": "); found && (strings.HasPrefix(name, "./") || strings.HasPrefix(name, "/")) {
+			p := name
+			if !strings.HasPrefix(name, "/") {
+				p = path.Join(dir, name)
+			}
+			failures[p] = "cpio: " + reason
+		} else {
+			failures[dir] = line
+		}
+		dirHasFailures = true
+	}
+	return failures
+}
+
+// recordCopyFailures records the files the collection script couldn't copy as
+// per-file errors, so they aren't mistaken for files missing on the server.
+// Files read without privileges are left to recordUnreadable.
+func recordCopyFailures(server string, manifest *config.Manifest, stdout, serverOutputDir string, home *homePaths, metadata map[string]config.FileMetadata) {
+	failures := copyFailures(stdout)
+	for remotePath, reason := range failures {
+		rel := home.logical(manifestPath(remotePath))
+		if info, ok := manifest.GetFileInfo(server, rel); ok && info.Error == config.UnreadableUnprivileged {
+			continue
+		}
+		log.Warnf("[%s] Could not copy %s on the remote: %s", server, remotePath, reason)
+		// cpio may leave a truncated copy behind
+		os.Remove(filepath.Join(serverOutputDir, filepath.FromSlash(rel)))
+		manifest.AddFile(server, rel, "", config.CopyFailed+": "+reason)
+		if md, ok := metadata[rel]; ok {
+			manifest.SetMetadata(server, rel, md)
+		}
+	}
+	if len(failures) > 0 {
+		log.Warnf("[%s] %d path(s) could not be copied on the remote; see the session log for the script output", server, len(failures))
+	}
+}
@@ -0,0 +1,74 @@
+package collect
+
+import (
+	"sync"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+)
+
+// FastHash makes a collection hash each collected file with xxHash64 first,
+// and compute the SHA-256 (and chunk hashes) only once per distinct content:
+// the copies with the same size and xxHash64, on other servers or at other
+// paths, reuse them. It saves most of the CPU time on large trees that are
+// mostly the same across the fleet, at the cost of trusting a
+// non-cryptographic hash to tell copies apart.
+var FastHash bool
+
+// contentKey identifies a file's content by its size and xxHash64. The size
+// also decides whether the content gets chunk hashes.
+type contentKey struct {
+	size int64
+	xxh  uint64
+}
+
+// contentHashes are the authoritative hashes of one content, computed once
+type contentHashes struct {
+	once     sync.Once
+	checksum string
+	chunks   *config.ChunkHashes
+	err      error
+}
+
+// contentCache groups the files of one collection by content
+type contentCache struct {
+	mu      sync.Mutex
+	entries map[contentKey]*contentHashes
+}
+
+func newContentCache() *contentCache {
+	return &contentCache{entries: make(map[contentKey]*contentHashes)}
+}
+
+// hash returns the hashes of the file at path, of the given size, computing
+// them with compute unless a file with the same content was hashed before.
+// reused tells whether they were. A copy that fails to hash isn't shared: the
+// other copies of its content are hashed on their own.
+func (c *contentCache) hash(path string, size int64, compute func(path string, size int64) (string, *config.ChunkHashes, error)) (checksum string, chunks *config.ChunkHashes, reused bool, err error) {
+	xxh, err := util.CalculateXXH64(path)
+	if err != nil {
+		return "", nil, false, err
+	}
+	key := contentKey{size: size, xxh: xxh}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &contentHashes{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	computed := false
+	entry.once.Do(func() {
+		computed = true
+		entry.checksum, entry.chunks, entry.err = compute(path, size)
+	})
+	if entry.err != nil {
+		if computed {
+			return "", nil, false, entry.err
+		}
+		checksum, chunks, err := compute(path, size)
+		return checksum, chunks, false, err
+	}
+	return entry.checksum, entry.chunks, !computed, nil
+}
@@ -0,0 +1,62 @@
+package collect
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// HashDir checksums the regular files below dir into manifest as the files
+// of server, keyed by their path relative to dir, the way a collection keys
+// a server's files by their path relative to /. A golden source laid out
+// like the servers' root can then be compared with them. Symlinks and other
+// special files are skipped, and no mode or ownership is recorded, since a
+// local tree's rarely match the servers'. It returns how many files were
+// hashed; files that fail to hash are recorded with the error.
+func HashDir(dir, server string, manifest *config.Manifest) (int, error) {
+	var paths, rels []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			if !d.IsDir() {
+				log.Debugf("[%s] Skipping %s: not a regular file", server, path)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		rels = append(rels, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to walk %s", dir)
+	}
+
+	opts := CurrentOptions()
+	start := time.Now()
+	var stats hashStats
+	opts.forEachFile(len(paths), func(i int) {
+		checksum, chunks, err := opts.hashLocalCopy(paths[i], &stats)
+		if err != nil {
+			log.Errorf("[%s] Failed to calculate checksum for %s: %v", server, rels[i], err)
+			manifest.AddFile(server, rels[i], "", err.Error())
+			return
+		}
+		manifest.AddFile(server, rels[i], checksum, "")
+		if chunks != nil {
+			manifest.SetChunks(server, rels[i], chunks)
+		}
+	})
+	stats.report(server, time.Since(start))
+	return len(paths), nil
+}
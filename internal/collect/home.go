@@ -0,0 +1,134 @@
+package collect
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// homePaths maps a server's "~/" entries between their resolved remote paths
+// and the logical names the manifest records them under. A nil homePaths
+// leaves every path as it is.
+type homePaths struct {
+	home    string   // The SSH user's home directory, e.g. "/home/alice"
+	entries []string // The configured "~/" files and dirs
+}
+
+// resolveHome looks up the SSH user's home directory if the config has "~/"
+// entries, and returns the config with them resolved
+func resolveHome(server string, remote Remote, cfg *config.Config) (*config.Config, *homePaths, error) {
+	if !cfg.HasHomePaths() {
+		return cfg, nil, nil
+	}
+	phaseStart := time.Now()
+	var home string
+	if cfg.ServerSettings(server).Windows() {
+		fsys, ok := remote.(WorkingDirFS)
+		if !ok {
+			return nil, nil, fmt.Errorf("the connection can't look up the home directory of a Windows server")
+		}
+		wd, err := fsys.Getwd()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to look up the home directory")
+		}
+		home = wd
+	} else {
+		stdout, stderr, err := remote.RunCommand(`echo "$HOME"`, false)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to look up the home directory, stderr: %s", strings.TrimSpace(stderr))
+		}
+		home = strings.TrimSpace(stdout)
+	}
+	timing.Since(server, timing.Exec, phaseStart)
+	if !strings.HasPrefix(home, "/") {
+		return nil, nil, fmt.Errorf("unexpected home directory %q", home)
+	}
+	home = path.Clean(home)
+	log.Infof("[%s] Resolving ~/ paths against %s", server, home)
+
+	resolved, err := cfg.WithHome(home)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &homePaths{home: home}
+	for _, p := range append(append([]string{}, cfg.Files...), cfg.Dirs...) {
+		if config.IsHomePath(p) {
+			h.entries = append(h.entries, p)
+		}
+	}
+	return resolved, h, nil
+}
+
+// resolved returns the manifest path an entry's remote copy would get, e.g.
+// "home/alice/.bashrc" for "~/.bashrc"
+func (h *homePaths) resolved(entry string) string {
+	return manifestPath(path.Join(h.home, strings.TrimPrefix(entry, config.HomePrefix)))
+}
+
+// logical turns a manifest path of a file below a "~/" entry into its logical
+// name, e.g. "home/alice/.bashrc" into "~/.bashrc"
+func (h *homePaths) logical(rel string) string {
+	if h == nil {
+		return rel
+	}
+	for _, entry := range h.entries {
+		if r := h.resolved(entry); rel == r || strings.HasPrefix(rel, r+"/") {
+			return entry + rel[len(r):]
+		}
+	}
+	return rel
+}
+
+// remote turns a manifest path, logical or not, into the absolute remote path
+func (h *homePaths) remote(rel string) string {
+	if h != nil && config.IsHomePath(rel) {
+		return path.Join(h.home, strings.TrimPrefix(rel, config.HomePrefix))
+	}
+	return "/" + rel
+}
+
+// relocate moves the copies of "~/" entries extracted below localRoot, along
+// with their missing markers, to their logical names
+func (h *homePaths) relocate(localRoot string) error {
+	if h == nil {
+		return nil
+	}
+	for _, entry := range h.entries {
+		r := h.resolved(entry)
+		for _, suffix := range []string{"", ".MISSING", "DIRECTORY.MISSING"} {
+			from := filepath.Join(localRoot, filepath.FromSlash(r+suffix))
+			if _, err := os.Lstat(from); os.IsNotExist(err) {
+				continue
+			}
+			to := filepath.Join(localRoot, filepath.FromSlash(entry+suffix))
+			if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+				return errors.Wrapf(err, "failed to create directory for %s", to)
+			}
+			if err := os.Rename(from, to); err != nil {
+				return errors.Wrapf(err, "failed to move %s to %s", from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// logicalKeys returns m with its manifest paths turned into logical names
+func logicalKeys[V any](h *homePaths, m map[string]V) map[string]V {
+	if h == nil || m == nil {
+		return m
+	}
+	out := make(map[string]V, len(m))
+	for rel, v := range m {
+		out[h.logical(rel)] = v
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package collect
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Incremental makes the collection script leave out the files whose remote
+// checksum still matches the previous collection in the output directory.
+// Their local copies are kept from that collection instead of being
+// transferred again. Servers collected over SFTP are always collected in full.
+var Incremental bool
+
+// previousDirSuffix is added to a server's directory of collected files
+// while the copies of its unchanged files are moved out of it
+const previousDirSuffix = ".previous"
+
+// previousChecksums returns the checksums of the files of server in the
+// previous collection in outputDir, keyed by manifest path. Files recorded
+// with an error, whose local copy is gone, or that are no longer configured
+// are left out, so they are transferred again.
+func previousChecksums(server, outputDir string, cfg *config.Config, home *homePaths, filter *pathfilter.Filter) map[string]string {
+	manifest, err := config.LoadManifest(outputDir)
+	if err != nil {
+		log.Infof("[%s] No previous collection to compare with (%v); collecting all files", server, err)
+		return nil
+	}
+	serverDir := filepath.Join(outputDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server))
+	sums := make(map[string]string)
+	for rel, info := range manifest.FilesByServer[server] {
+		if info.Checksum == "" || info.Error != "" {
+			continue
+		}
+		remotePath := home.remote(rel)
+		if !configured(cfg, remotePath) || !filter.Keep(remotePath) {
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(serverDir, filepath.FromSlash(rel))); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		sums[rel] = info.Checksum
+	}
+	return sums
+}
+
+// configured reports whether remotePath is one of the configured files or
+// below one of the configured dirs
+func configured(cfg *config.Config, remotePath string) bool {
+	for _, f := range cfg.Files {
+		if remotePath == f {
+			return true
+		}
+	}
+	for _, d := range cfg.Dirs {
+		if d = strings.TrimRight(d, "/"); strings.HasPrefix(remotePath, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unchangedFiles sends the previous checksums to the server and checks them
+// there with sha256sum -c. It returns the manifest paths of the files that
+// still match. A failure only makes the collection a full one.
+func unchangedFiles(server string, remote Remote, cfg *config.Config, home *homePaths, previous map[string]string, prio util.Priority) map[string]bool {
+	if len(previous) == 0 {
+		return nil
+	}
+	rels := make([]string, 0, len(previous))
+	for rel := range previous {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var list strings.Builder
+	byRemote := make(map[string]string, len(rels))
+	for _, rel := range rels {
+		remotePath := home.remote(rel)
+		if strings.ContainsAny(remotePath, "\\\n") {
+			continue // sha256sum would escape the name; such files are simply transferred
+		}
+		list.WriteString(previous[rel] + "  " + remotePath + "\n")
+		byRemote[remotePath] = rel
+	}
+
+	phaseStart := time.Now()
+	defer timing.Since(server, timing.Hash, phaseStart)
+	localList, err := os.CreateTemp("", "collect_sums_*.txt")
+	if err != nil {
+		log.Warnf("[%s] Failed to write the previous checksums (collecting all files): %v", server, err)
+		return nil
+	}
+	defer os.Remove(localList.Name())
+	_, err = localList.WriteString(list.String())
+	if closeErr := localList.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Warnf("[%s] Failed to write the previous checksums (collecting all files): %v", server, err)
+		return nil
+	}
+	remoteList := fmt.Sprintf("/tmp/collect_sums_%d.txt", time.Now().UnixNano())
+	if err := remote.UploadFile(localList.Name(), remoteList); err != nil {
+		log.Warnf("[%s] Failed to upload the previous checksums (collecting all files): %v", server, err)
+		return nil
+	}
+	defer func() {
+		if _, _, err := remote.RunCommand("rm -f "+util.ShellQuote(remoteList), false); err != nil {
+			log.Warnf("[%s] Failed to remove %s: %v", server, remoteList, err)
+		}
+	}()
+
+	log.Infof("[%s] Checking %d file(s) against the previous collection...", server, len(byRemote))
+	// sha256sum -c exits with an error as soon as one file changed
+	script := fmt.Sprintf("%ssha256sum -c %s 2>/dev/null || true", prio.Prefix(), util.ShellQuote(remoteList))
+	stdout, stderr, err := remote.RunCommand("sh -c "+util.ShellQuote(script), cfg.NeedsPrivileges())
+	if err != nil {
+		log.Warnf("[%s] Failed to check the previous checksums (collecting all files): %v, stderr: %s", server, err, stderr)
+		return nil
+	}
+	unchanged := make(map[string]bool)
+	for _, line := range strings.Split(stdout, "\n") {
+		if remotePath, ok := strings.CutSuffix(line, ": OK"); ok {
+			if rel, ok := byRemote[remotePath]; ok {
+				unchanged[rel] = true
+			}
+		}
+	}
+	log.Infof("[%s] %d of %d file(s) unchanged since the previous collection", server, len(unchanged), len(byRemote))
+	return unchanged
+}
+
+// restoreUnchanged moves the copies of the unchanged files from the previous
+// collection's directory into the server's new one. A file whose copy can't
+// be moved is recorded with the error. It returns how many were restored.
+func restoreUnchanged(server, previousDir, serverOutputDir string, unchanged map[string]bool, manifest *config.Manifest) int {
+	restored := 0
+	for rel := range unchanged {
+		from := filepath.Join(previousDir, filepath.FromSlash(rel))
+		to := filepath.Join(serverOutputDir, filepath.FromSlash(rel))
+		err := os.MkdirAll(filepath.Dir(to), 0755)
+		if err == nil {
+			err = os.Rename(from, to)
+		}
+		if err != nil {
+			log.Errorf("[%s] Failed to keep the previous copy of unchanged %s: %v", server, rel, err)
+			manifest.AddFile(server, rel, "", fmt.Sprintf("Failed to keep the previous copy: %v", err))
+			continue
+		}
+		restored++
+	}
+	return restored
+}
+
+// unchangedRemotePaths returns the remote paths of the unchanged files, sorted
+func unchangedRemotePaths(home *homePaths, unchanged map[string]bool) []string {
+	paths := make([]string, 0, len(unchanged))
+	for rel := range unchanged {
+		paths = append(paths, home.remote(rel))
+	}
+	sort.Strings(paths)
+	return paths
+}
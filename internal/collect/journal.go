@@ -0,0 +1,73 @@
+package collect
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/journal"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// collectJournals stores the server's normalized journal excerpts below
+// localRoot and adds them to the manifest like collected files. An excerpt
+// that can't be read is recorded as a per-file error.
+func collectJournals(server string, remote Remote, cfg *config.Config, localRoot string, manifest *config.Manifest, sudo bool) {
+	storeJournals(server, fetchJournals(server, remote, cfg, manifest, sudo), localRoot, manifest)
+}
+
+// journalExcerpt is the normalized output of journalctl for one excerpt
+type journalExcerpt struct {
+	rel, content string
+}
+
+// fetchJournals reads the server's journal excerpts, recording those that
+// can't be read as per-file errors
+func fetchJournals(server string, remote Remote, cfg *config.Config, manifest *config.Manifest, sudo bool) []journalExcerpt {
+	var excerpts []journalExcerpt
+	for _, j := range cfg.Journals {
+		rel := journal.Path(j)
+		log.Infof("[%s] Collecting journal excerpt %s", server, j)
+		phaseStart := time.Now()
+		stdout, stderr, err := remote.RunCommand(journal.Command(j), sudo)
+		timing.Since(server, timing.Exec, phaseStart)
+		if err != nil {
+			log.Errorf("[%s] Failed to read the journal of %s: %v", server, j.Unit, err)
+			manifest.AddFile(server, rel, "", fmt.Sprintf("journalctl failed: %v, stderr: %s", err, strings.TrimSpace(stderr)))
+			continue
+		}
+		excerpts = append(excerpts, journalExcerpt{rel: rel, content: journal.Normalize(stdout)})
+	}
+	return excerpts
+}
+
+// storeJournals writes fetched journal excerpts below localRoot and adds them
+// to the manifest
+func storeJournals(server string, excerpts []journalExcerpt, localRoot string, manifest *config.Manifest) {
+	for _, e := range excerpts {
+		localPath := filepath.Join(localRoot, filepath.FromSlash(e.rel))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			log.Errorf("[%s] Failed to create directory for %s: %v", server, localPath, err)
+			manifest.AddFile(server, e.rel, "", err.Error())
+			continue
+		}
+		if err := os.WriteFile(localPath, []byte(e.content), 0644); err != nil {
+			log.Errorf("[%s] Failed to write %s: %v", server, localPath, err)
+			manifest.AddFile(server, e.rel, "", err.Error())
+			continue
+		}
+		checksum, err := util.CalculateSHA256(localPath)
+		if err != nil {
+			log.Errorf("[%s] Failed to calculate checksum for %s: %v", server, e.rel, err)
+			manifest.AddFile(server, e.rel, "", err.Error())
+			continue
+		}
+		manifest.AddFile(server, e.rel, checksum, "")
+	}
+}
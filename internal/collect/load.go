@@ -0,0 +1,88 @@
+package collect
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxLoad is the 1-minute load average per CPU above which a server counts as
+// busy. Busy servers are waited for before heavy operations, and get one file
+// transfer at a time. 0 disables the check.
+var MaxLoad float64
+
+// LoadWait is how long to wait for a busy server before going ahead anyway
+var LoadWait = 5 * time.Minute
+
+// loadPollInterval is how often a busy server's load is checked again
+var loadPollInterval = 15 * time.Second
+
+// loadCommand prints the load averages and the number of CPUs
+const loadCommand = "cat /proc/loadavg && nproc"
+
+// parseLoad returns the 1-minute load average per CPU from loadCommand's output
+func parseLoad(output string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("unexpected load output %q", output)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid load average %q", fields[0])
+	}
+	cpus, err := strconv.Atoi(strings.TrimSpace(lines[1]))
+	if err != nil || cpus < 1 {
+		return 0, fmt.Errorf("invalid CPU count %q", lines[1])
+	}
+	return load / float64(cpus), nil
+}
+
+// remoteLoad returns the server's 1-minute load average per CPU
+func remoteLoad(remote Remote) (float64, error) {
+	stdout, stderr, err := remote.RunCommand(loadCommand, false)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr))
+	}
+	return parseLoad(stdout)
+}
+
+// throttle is called before a heavy operation on a server. If the server's
+// load is above o.MaxLoad, it waits until the load drops or o.LoadWait has
+// passed. It returns how many files of the server to transfer at once:
+// o.FileConcurrency, or 1 if the server is still busy. A failed load check
+// only logs a warning, so hosts without /proc/loadavg are collected as usual.
+func (o *Options) throttle(server string, remote Remote, what string) int {
+	if o.MaxLoad <= 0 {
+		return o.FileConcurrency
+	}
+	start := time.Now()
+	defer timing.Since(server, timing.Wait, start)
+
+	for {
+		load, err := remoteLoad(remote)
+		if err != nil {
+			log.Warnf("[%s] Failed to check the load, going ahead with %s: %v", server, what, err)
+			return o.FileConcurrency
+		}
+		if load <= o.MaxLoad {
+			log.Debugf("[%s] Load %.2f per CPU, going ahead with %s", server, load, what)
+			return o.FileConcurrency
+		}
+		waited := time.Since(start)
+		if waited+loadPollInterval > o.LoadWait {
+			log.Warnf("[%s] Load %.2f per CPU is still above --max-load %.2f after %s; going ahead with %s anyway", server, load, o.MaxLoad, waited.Round(time.Second), what)
+			return 1
+		}
+		log.Infof("[%s] Load %.2f per CPU is above --max-load %.2f; waiting %s before %s", server, load, o.MaxLoad, loadPollInterval, what)
+		time.Sleep(loadPollInterval)
+	}
+}
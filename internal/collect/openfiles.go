@@ -0,0 +1,100 @@
+package collect
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// What collections do with files a remote process has open for writing
+const (
+	OpenFilesIgnore = "ignore" // Collect and compare them like any other file
+	OpenFilesFlag   = "flag"   // Collect them, but mark them volatile in the manifest
+	OpenFilesSkip   = "skip"   // Mark them volatile and discard their copies
+)
+
+// OpenFiles selects how collections treat files open for writing on the remote
+var OpenFiles = OpenFilesIgnore
+
+// ValidateOpenFiles checks an --open-files value. The check runs lsof on the
+// remote host, so it needs the script method.
+func ValidateOpenFiles(mode, method string) error {
+	switch mode {
+	case OpenFilesIgnore:
+		return nil
+	case OpenFilesFlag, OpenFilesSkip:
+		if method == MethodSFTP {
+			return fmt.Errorf("--open-files %s runs lsof on the remote host and needs --method %s or %s", mode, MethodScript, MethodAuto)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown --open-files value %q (expected %s, %s or %s)", mode, OpenFilesIgnore, OpenFilesFlag, OpenFilesSkip)
+	}
+}
+
+// generateOpenFilesScript builds a shell snippet that runs lsof on every
+// configured file and dir that exists. lsof exits with 1 when nothing is
+// open, so only its (-w quieted) stderr tells a failure apart.
+func generateOpenFilesScript(filePaths, dirPaths []string) string {
+	var script strings.Builder
+	for _, p := range filePaths {
+		q := util.ShellQuote(p)
+		script.WriteString(fmt.Sprintf("if [ -f %s ]; then lsof -w -F an -- %s; fi\n", q, q))
+	}
+	for _, p := range dirPaths {
+		q := util.ShellQuote(p)
+		script.WriteString(fmt.Sprintf("if [ -d %s ]; then lsof -w -F an +D %s; fi\n", q, q))
+	}
+	return script.String()
+}
+
+// parseOpenFilesOutput returns the manifest paths of the files lsof -F an
+// lists as open for writing ("w") or reading and writing ("u")
+func parseOpenFilesOutput(output string, filter *pathfilter.Filter) map[string]bool {
+	open := make(map[string]bool)
+	access := ""
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		switch field, value := line[0], line[1:]; field {
+		case 'p', 'f':
+			access = "" // A new process or file descriptor starts
+		case 'a':
+			access = strings.TrimSpace(value)
+		case 'n':
+			if (access == "w" || access == "u") && strings.HasPrefix(value, "/") {
+				if filePath := path.Clean(value); filter.Keep(filePath) {
+					open[manifestPath(filePath)] = true
+				}
+			}
+		}
+	}
+	return open
+}
+
+// remoteOpenFiles lists the server's files that are open for writing, as root
+// sees them. A failure is logged and treated as no open files.
+func remoteOpenFiles(server string, remote Remote, cfg *config.Config, filter *pathfilter.Filter) map[string]bool {
+	phaseStart := time.Now()
+	stdout, stderr, err := remote.RunCommand("sh -c "+util.ShellQuote(generateOpenFilesScript(cfg.Files, cfg.Dirs)), true)
+	timing.Since(server, timing.Exec, phaseStart)
+	if err != nil && strings.TrimSpace(stderr) != "" {
+		log.Warnf("[%s] Failed to check for open files (collecting them normally): %v", server, errors.Wrapf(err, "stderr: %s", strings.TrimSpace(stderr)))
+		return nil
+	}
+	open := parseOpenFilesOutput(stdout, filter)
+	if len(open) > 0 {
+		log.Infof("[%s] %d file(s) are open for writing", server, len(open))
+	}
+	return open
+}
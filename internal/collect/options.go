@@ -0,0 +1,87 @@
+package collect
+
+import (
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+)
+
+// HostKeys, when set, pins the host keys of every connection the command
+// line makes; without it any host key is accepted
+var HostKeys *sshutil.HostKeyPins
+
+// Options are the settings of one collection. The package variables hold
+// the command line's, which CurrentOptions copies; Run reads none of them.
+// The process-wide settings of other packages, such as the SSH config file,
+// extraction limits, bandwidth limit and retry policies, apply to every
+// collection.
+type Options struct {
+	Method             string               // MethodScript, MethodSFTP or MethodAuto
+	Become             string               // How servers without a become setting of their own gain root
+	Annotation         config.RunAnnotation // Saved in the manifest
+	AllowPartial       bool                 // See the package variables of the same names
+	Strict             bool
+	Incremental        bool
+	FastHash           bool
+	StableReads        bool
+	OpenFiles          string
+	MaxLoad            float64
+	LoadWait           time.Duration
+	FileConcurrency    int
+	ExtractConcurrency int
+	HashConcurrency    int
+	ChunkThreshold     int64
+	ChunkSize          int64
+	Priority           util.Priority        // Of the remote commands that read the configured trees
+	Compression        util.Compression     // Of the remote tarball
+	HostKeys           *sshutil.HostKeyPins // Checked on every connection; nil accepts any host key
+	Connect            Connector            // Opens the connections; nil for SSH to the configured hosts
+
+	contents *contentCache // Cache of the running collection, set with FastHash
+}
+
+// CurrentOptions returns the settings of the package variables
+func CurrentOptions() Options {
+	return Options{
+		Method:             Method,
+		Become:             Become,
+		Annotation:         Annotation,
+		AllowPartial:       AllowPartial,
+		Strict:             Strict,
+		Incremental:        Incremental,
+		FastHash:           FastHash,
+		StableReads:        StableReads,
+		OpenFiles:          OpenFiles,
+		MaxLoad:            MaxLoad,
+		LoadWait:           LoadWait,
+		FileConcurrency:    FileConcurrency,
+		ExtractConcurrency: ExtractConcurrency,
+		HashConcurrency:    HashConcurrency,
+		ChunkThreshold:     ChunkThreshold,
+		ChunkSize:          ChunkSize,
+		Priority:           util.RemotePriority,
+		Compression:        util.RemoteCompression,
+		HostKeys:           HostKeys,
+		Connect:            Connect,
+	}
+}
+
+// defaultOptions are the package variables as initialized, before the
+// command line changes any
+var defaultOptions = CurrentOptions()
+
+// DefaultOptions returns the built-in settings, whatever the package
+// variables were changed to
+func DefaultOptions() Options {
+	return defaultOptions
+}
+
+// connect opens a connection to server with o.Connect, or over SSH
+func (o *Options) connect(cfg *config.Config, server string) (Remote, error) {
+	if o.Connect != nil {
+		return o.Connect(cfg, server, o)
+	}
+	return connectServer(cfg, server, o)
+}
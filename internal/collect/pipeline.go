@@ -0,0 +1,85 @@
+package collect
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ExtractConcurrency is how many servers' tarballs are extracted at the same
+// time, and HashConcurrency how many servers have their collected files
+// checksummed. Both are separate from the number of servers collected at
+// once: a server gives up its slot once its tarball is downloaded, so fast
+// servers go on to extract and hash while the slow transfers of others
+// continue, and the next server can connect.
+var (
+	ExtractConcurrency = 2
+	HashConcurrency    = 2
+)
+
+// pipeline bounds the stages of the servers of one collection: the remote
+// one, from connecting to downloading, and the local extraction and hashing
+type pipeline struct {
+	ctx                   context.Context
+	remote, extract, hash *semaphore.Weighted
+}
+
+func newPipeline(ctx context.Context, maxConcurrency int, opts *Options) *pipeline {
+	return &pipeline{
+		ctx:     ctx,
+		remote:  semaphore.NewWeighted(int64(maxConcurrency)),
+		extract: semaphore.NewWeighted(int64(opts.ExtractConcurrency)),
+		hash:    semaphore.NewWeighted(int64(opts.HashConcurrency)),
+	}
+}
+
+// serverSlot is a server's place in the remote stage of a pipeline
+type serverSlot struct {
+	p    *pipeline
+	once sync.Once
+}
+
+// acquire waits for a place in the remote stage; it fails once the
+// pipeline's context is done
+func (p *pipeline) acquire() (*serverSlot, error) {
+	if err := p.remote.Acquire(p.ctx, 1); err != nil {
+		return nil, err
+	}
+	return &serverSlot{p: p}, nil
+}
+
+// release gives up the server's place in the remote stage. It can be called
+// more than once, and on a nil slot, which holds nothing.
+func (s *serverSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { s.p.remote.Release(1) })
+}
+
+// enterExtract waits for a place in the extraction stage and returns the
+// function that leaves it, which can be called more than once
+func (s *serverSlot) enterExtract() func() {
+	if s == nil {
+		return func() {}
+	}
+	return enter(s.p.extract)
+}
+
+// enterHash waits for a place in the hashing stage and returns the function
+// that leaves it, which can be called more than once
+func (s *serverSlot) enterHash() func() {
+	if s == nil {
+		return func() {}
+	}
+	return enter(s.p.hash)
+}
+
+// enter takes a place of sem. Stages are entered even once the context is
+// done: the servers that got there are finished, like those being collected.
+func enter(sem *semaphore.Weighted) func() {
+	sem.Acquire(context.Background(), 1) // Can't fail without a deadline
+	var once sync.Once
+	return func() { once.Do(func() { sem.Release(1) }) }
+}
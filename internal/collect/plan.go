@@ -0,0 +1,312 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+// planFormat is the find -printf format of one listing record: symbolic
+// mode, octal mode, owner, group, size in bytes, path. Records end with a NUL,
+// since file names may hold newlines.
+const planFormat = `%M %m %u %g %s %p\0`
+
+// PlannedFile is a file a collection would copy
+type PlannedFile struct {
+	Path  string // Absolute remote path
+	Mode  string // Symbolic mode, as shown by ls -l
+	Perm  string // Octal mode, e.g. "0640"
+	Owner string
+	Group string
+	Size  int64
+}
+
+// Metadata returns the file's mode and ownership for the manifest
+func (f PlannedFile) Metadata() config.FileMetadata {
+	return config.FileMetadata{Mode: f.Perm, Owner: f.Owner, Group: f.Group}
+}
+
+// ServerPlan is what a collection would copy from one server
+type ServerPlan struct {
+	Server  string
+	Files   []PlannedFile
+	Missing []string // Configured files and dirs that don't exist
+	Errors  []string // Paths that couldn't be looked at, with the reason
+	Err     error    // Set if the server couldn't be inspected at all
+}
+
+// TotalSize is the number of bytes the server's files add up to
+func (p *ServerPlan) TotalSize() int64 {
+	var total int64
+	for _, f := range p.Files {
+		total += f.Size
+	}
+	return total
+}
+
+// generatePlanScript builds a shell snippet that lists every configured file
+// and every regular file below the configured dirs, like the collection
+// script would copy them
+func generatePlanScript(filePaths, dirPaths []string, filter *pathfilter.Filter, priority util.Priority) string {
+	format := util.ShellQuote(planFormat)
+	prio := priority.Prefix()
+	var script strings.Builder
+	for _, p := range filePaths {
+		q := util.ShellQuote(p)
+		script.WriteString(fmt.Sprintf("if [ -f %s ]; then %sfind -H %s -maxdepth 0 -printf %s; else printf '%%s\\0' %s; fi\n", q, prio, q, format, util.ShellQuote(missingFileMarker+p)))
+	}
+	for _, p := range dirPaths {
+		q := util.ShellQuote(p)
+		script.WriteString(fmt.Sprintf("if [ -d %s ]; then %sfind %s -mindepth 1 %s-type f -printf %s; else printf '%%s\\0' %s; fi\n", q, prio, q, filter.FindPredicates(p, false), format, util.ShellQuote(missingDirMarker+p)))
+	}
+	return script.String()
+}
+
+// parsePlanOutput adds the plan script's output to plan
+func parsePlanOutput(output string, filter *pathfilter.Filter, plan *ServerPlan) {
+	for _, line := range strings.Split(output, "\x00") {
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, missingFileMarker):
+			plan.Missing = append(plan.Missing, strings.TrimPrefix(line, missingFileMarker))
+			continue
+		case strings.HasPrefix(line, missingDirMarker):
+			plan.Missing = append(plan.Missing, strings.TrimPrefix(line, missingDirMarker))
+			continue
+		}
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) != 6 {
+			log.Warnf("[%s] Ignoring unexpected listing line: %q", plan.Server, line)
+			continue
+		}
+		perm, permErr := strconv.ParseUint(fields[1], 8, 32)
+		size, sizeErr := strconv.ParseInt(fields[4], 10, 64)
+		if permErr != nil || sizeErr != nil {
+			log.Warnf("[%s] Ignoring unexpected listing line: %q", plan.Server, line)
+			continue
+		}
+		filePath := path.Clean(fields[5])
+		if !filter.Keep(filePath) {
+			continue
+		}
+		plan.Files = append(plan.Files, PlannedFile{
+			Path:  filePath,
+			Mode:  fields[0],
+			Perm:  fmt.Sprintf("%04o", perm),
+			Owner: fields[2],
+			Group: fields[3],
+			Size:  size,
+		})
+	}
+}
+
+// planViaScript lists the server's files with a sudo find, as root sees
+// them, unless no path needs privileges. Without privileges find can't look
+// into some directories; it still lists the rest, and its complaints become
+// plan errors.
+func planViaScript(remote Remote, cfg *config.Config, filter *pathfilter.Filter, plan *ServerPlan, prio util.Priority) error {
+	script := generatePlanScript(cfg.Files, cfg.Dirs, filter, prio)
+	stdout, stderr, err := remote.RunCommand("sh -c "+util.ShellQuote(script), cfg.NeedsPrivileges())
+	if err != nil {
+		if stdout == "" {
+			return errors.Wrapf(err, "remote listing command failed, stderr: %s", stderr)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				plan.Errors = append(plan.Errors, line)
+			}
+		}
+	}
+	parsePlanOutput(stdout, filter, plan)
+	return nil
+}
+
+// planViaSFTP lists the server's files over SFTP, as the SSH user sees them
+func planViaSFTP(remote Remote, cfg *config.Config, filter *pathfilter.Filter, plan *ServerPlan) error {
+	fsys, ok := remote.(RemoteFS)
+	if !ok {
+		return fmt.Errorf("the connection does not support SFTP collection")
+	}
+	add := func(remotePath string, info os.FileInfo) {
+		if filter.Keep(remotePath) {
+			plan.Files = append(plan.Files, plannedFile(remotePath, info))
+		}
+	}
+	failed := func(remotePath string, err error) {
+		if errors.Is(err, os.ErrNotExist) {
+			plan.Missing = append(plan.Missing, remotePath)
+		} else {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s: %v", remotePath, err))
+		}
+	}
+	for _, filePath := range cfg.Files {
+		info, err := fsys.Stat(filePath)
+		switch {
+		case err != nil:
+			failed(filePath, err)
+		case !info.Mode().IsRegular():
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s: not a regular file", filePath))
+		default:
+			add(filePath, info)
+		}
+	}
+	for _, dirPath := range cfg.Dirs {
+		info, err := fsys.Stat(dirPath)
+		if err != nil {
+			failed(dirPath, err)
+			continue
+		}
+		if !info.IsDir() {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s: not a directory", dirPath))
+			continue
+		}
+		err = walkRemote(plan.Server, fsys, dirPath, func(remotePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				failed(remotePath, err)
+				return nil
+			}
+			add(remotePath, info)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func plannedFile(remotePath string, info os.FileInfo) PlannedFile {
+	f := PlannedFile{Path: remotePath, Mode: info.Mode().String(), Perm: util.OctalMode(info.Mode()), Owner: "-", Group: "-", Size: info.Size()}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		f.Owner = strconv.FormatUint(uint64(stat.UID), 10)
+		f.Group = strconv.FormatUint(uint64(stat.GID), 10)
+	}
+	return f
+}
+
+// remoteMetadata lists the mode and ownership of the files the collection
+// script copies, keyed by manifest path. The originals are listed because the
+// script loosens the modes of its copies to be able to tar them.
+func remoteMetadata(server string, remote Remote, cfg *config.Config, filter *pathfilter.Filter, prio util.Priority) (map[string]config.FileMetadata, error) {
+	plan := &ServerPlan{Server: server}
+	if err := planViaScript(remote, cfg, filter, plan, prio); err != nil {
+		return nil, err
+	}
+	for _, e := range plan.Errors {
+		log.Warnf("[%s] Listing incomplete: %s", server, e)
+	}
+	metadata := make(map[string]config.FileMetadata, len(plan.Files))
+	for _, f := range plan.Files {
+		metadata[manifestPath(f.Path)] = f.Metadata()
+	}
+	return metadata, nil
+}
+
+// RunPlan connects to every server and lists what a collection with the
+// current Method would copy, without copying anything. Plans are returned in
+// the configured server order.
+func RunPlan(cfg *config.Config, maxConcurrency int) ([]*ServerPlan, error) {
+	if _, err := cfg.PathFilter(); err != nil {
+		return nil, errors.Wrap(err, "invalid exclude/include patterns")
+	}
+
+	opts := CurrentOptions()
+	var wg sync.WaitGroup
+	sem := semaphore.NewWeighted(int64(maxConcurrency))
+	plans := make([]*ServerPlan, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		plans[i] = &ServerPlan{Server: server}
+		wg.Add(1)
+		go func(plan *ServerPlan) {
+			defer wg.Done()
+			if err := sem.Acquire(context.Background(), 1); err != nil {
+				plan.Err = errors.Wrap(err, "semaphore acquisition failed")
+				return
+			}
+			defer sem.Release(1)
+
+			log.Infof("[%s] Listing files...", plan.Server)
+			remote, err := opts.connect(cfg, plan.Server)
+			if err != nil {
+				plan.Err = errors.Wrap(err, "failed to connect")
+				return
+			}
+			defer remote.Close()
+			serverCfg, _, err := resolveHome(plan.Server, remote, cfg)
+			if err != nil {
+				plan.Err = err
+				return
+			}
+			filter, err := serverCfg.PathFilter()
+			if err != nil {
+				plan.Err = err
+				return
+			}
+			sftpOnly := opts.Method == MethodSFTP || cfg.ServerSettings(plan.Server).Windows()
+			if !sftpOnly && opts.Method == MethodAuto {
+				shell, err := hasShell(plan.Server, remote)
+				if err != nil {
+					plan.Err = errors.Wrap(err, "failed to check for shell access")
+					return
+				}
+				if !shell {
+					log.Infof("[%s] The server refuses shell commands; listing over SFTP", plan.Server)
+				}
+				sftpOnly = !shell
+			}
+			if sftpOnly {
+				plan.Err = planViaSFTP(remote, serverCfg, filter, plan)
+			} else {
+				plan.Err = planViaScript(remote, serverCfg, filter, plan, opts.Priority)
+			}
+			sort.Slice(plan.Files, func(a, b int) bool { return plan.Files[a].Path < plan.Files[b].Path })
+		}(plans[i])
+	}
+	wg.Wait()
+	return plans, nil
+}
+
+// WritePlan prints each server's files, followed by what is missing and a total
+func WritePlan(w io.Writer, plans []*ServerPlan) error {
+	for _, plan := range plans {
+		fmt.Fprintf(w, "===== %s =====\n", plan.Server)
+		if plan.Err != nil {
+			fmt.Fprintf(w, "Error: %v\n\n", plan.Err)
+			continue
+		}
+		if len(plan.Files) > 0 {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			for _, f := range plan.Files {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", f.Mode, f.Owner, f.Group, f.Size, f.Path)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+		for _, p := range plan.Missing {
+			fmt.Fprintf(w, "Missing: %s\n", p)
+		}
+		for _, e := range plan.Errors {
+			fmt.Fprintf(w, "Error: %s\n", e)
+		}
+		fmt.Fprintf(w, "Total: %d file(s), %d bytes, %d missing\n\n", len(plan.Files), plan.TotalSize(), len(plan.Missing))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package collect
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlanOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		files   []PlannedFile
+		missing []string
+	}{
+		{
+			name:   "plain names",
+			output: "-rw-r--r-- 644 root root 12 /etc/hosts\x00-rw-r----- 640 root app 5 /etc/app/app.conf\x00",
+			files: []PlannedFile{
+				{Path: "/etc/hosts", Mode: "-rw-r--r--", Perm: "0644", Owner: "root", Group: "root", Size: 12},
+				{Path: "/etc/app/app.conf", Mode: "-rw-r-----", Perm: "0640", Owner: "root", Group: "app", Size: 5},
+			},
+		},
+		{
+			name:   "newline and spaces in a name",
+			output: "-rw-r--r-- 644 root root 3 /etc/app/two\nlines.conf\x00-rw-r--r-- 644 root root 4 /etc/app/with  spaces.conf\x00",
+			files: []PlannedFile{
+				{Path: "/etc/app/two\nlines.conf", Mode: "-rw-r--r--", Perm: "0644", Owner: "root", Group: "root", Size: 3},
+				{Path: "/etc/app/with  spaces.conf", Mode: "-rw-r--r--", Perm: "0644", Owner: "root", Group: "root", Size: 4},
+			},
+		},
+		{
+			name:   "decomposed name kept byte for byte",
+			output: "-rw-r--r-- 644 root root 1 /etc/i18n/cafe\u0301.conf\x00",
+			files: []PlannedFile{
+				{Path: "/etc/i18n/cafe\u0301.conf", Mode: "-rw-r--r--", Perm: "0644", Owner: "root", Group: "root", Size: 1},
+			},
+		},
+		{
+			name:    "missing paths",
+			output:  missingFileMarker + "/etc/gone\nfile\x00" + missingDirMarker + "/srv/none\x00",
+			missing: []string{"/etc/gone\nfile", "/srv/none"},
+		},
+		{
+			name:   "garbage records are skipped",
+			output: "-rw-r--r-- 644 root root\x00-rw-r--r-- xyz root root 1 /etc/x\x00-rw-r--r-- 644 root root 1 /etc/ok\x00",
+			files: []PlannedFile{
+				{Path: "/etc/ok", Mode: "-rw-r--r--", Perm: "0644", Owner: "root", Group: "root", Size: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := &ServerPlan{Server: "web1"}
+			parsePlanOutput(tt.output, nil, plan)
+			if !reflect.DeepEqual(plan.Files, tt.files) {
+				t.Errorf("files = %+q\nwant %+q", plan.Files, tt.files)
+			}
+			if !reflect.DeepEqual(plan.Missing, tt.missing) {
+				t.Errorf("missing = %+q, want %+q", plan.Missing, tt.missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+// RemoteCompareDir is the output-dir subfolder used by remote-only comparisons.
+// It mirrors the collected-files layout so the analyzer can run on it unchanged.
+const RemoteCompareDir = "remote-compare"
+
+// Markers printed by the remote checksum script for absent targets
+const (
+	missingFileMarker = "MISSING-FILE "
+	missingDirMarker  = "MISSING-DIR "
+)
+
+// generateChecksumScript builds a shell snippet that prints `sha256sum` lines for
+// every configured file and every regular file below the configured dirs,
+// pruning what the filter's exclude patterns allow find to skip
+func generateChecksumScript(filePaths, dirPaths []string, filter *pathfilter.Filter, priority util.Priority) string {
+	var script strings.Builder
+	prio := priority.Prefix()
+	for _, p := range filePaths {
+		q := util.ShellQuote(p)
+		script.WriteString(fmt.Sprintf("if [ -f %s ]; then %ssha256sum %s; else echo %s; fi\n", q, prio, q, util.ShellQuote(missingFileMarker+p)))
+	}
+	for _, p := range dirPaths {
+		q := util.ShellQuote(p)
+		script.WriteString(fmt.Sprintf("if [ -d %s ]; then %sfind %s -mindepth 1 %s-type f -exec sha256sum {} +; else echo %s; fi\n", q, prio, q, filter.FindPredicates(p, false), util.ShellQuote(missingDirMarker+p)))
+	}
+	return script.String()
+}
+
+// parseChecksumOutput turns the checksum script output into manifest entries.
+// Paths are recorded relative to / (e.g. "etc/hosts"), or by their logical
+// "~/" name, like collected files. Files the filter rejects are left out.
+func parseChecksumOutput(server, output string, filter *pathfilter.Filter, home *homePaths, manifest *config.Manifest) {
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, missingFileMarker):
+			p := strings.TrimPrefix(line, missingFileMarker)
+			log.Warnf("[%s] Marked as missing on remote: %s", server, p)
+			manifest.AddFile(server, home.logical(manifestPath(p)), "", config.MissingOnRemote)
+			continue
+		case strings.HasPrefix(line, missingDirMarker):
+			p := strings.TrimPrefix(line, missingDirMarker)
+			log.Warnf("[%s] Directory missing on remote: %s", server, p)
+			manifest.AddFile(server, home.logical(manifestPath(p)), "", config.MissingOnRemote)
+			continue
+		}
+
+		sum, filePath, ok := parseChecksumLine(line)
+		if !ok {
+			log.Warnf("[%s] Ignoring unexpected checksum output line: %q", server, line)
+			continue
+		}
+		if !filter.Keep(filePath) {
+			log.Debugf("[%s] Excluded by filter: %s", server, filePath)
+			continue
+		}
+		manifest.AddFile(server, home.logical(manifestPath(filePath)), sum, "")
+	}
+}
+
+// parseChecksumLine splits one sha256sum output line into the checksum and the cleaned path
+func parseChecksumLine(line string) (string, string, bool) {
+	// sha256sum prefixes the line with a backslash when it had to escape the file name
+	escaped := strings.HasPrefix(line, "\\")
+	line = strings.TrimPrefix(line, "\\")
+	sum, filePath, ok := strings.Cut(line, "  ")
+	if !ok || len(sum) != 64 {
+		return "", "", false
+	}
+	if escaped {
+		filePath = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(filePath)
+	}
+	return sum, path.Clean(filePath), true
+}
+
+// remoteFileChecksums checksums the configured files on the remote host as
+// root (unless no path needs it), keyed by manifest path. Missing paths are
+// left out.
+func remoteFileChecksums(remote Remote, cfg *config.Config, filter *pathfilter.Filter, prio util.Priority) (map[string]string, error) {
+	script := generateChecksumScript(cfg.Files, cfg.Dirs, filter, prio)
+	stdout, stderr, err := remote.RunCommand("sh -c "+util.ShellQuote(script), cfg.NeedsPrivileges())
+	if err != nil {
+		return nil, errors.Wrapf(err, "remote checksum command failed, stderr: %s", stderr)
+	}
+	sums := make(map[string]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		if sum, filePath, ok := parseChecksumLine(line); ok && filter.Keep(filePath) {
+			sums[manifestPath(filePath)] = sum
+		}
+	}
+	return sums, nil
+}
+
+// remoteChecksums connects to every server and fills a manifest with remotely
+// computed checksums. The returned clients are still connected; the caller
+// closes them. Servers with "~/" entries also get their homePaths.
+func remoteChecksums(cfg *config.Config, maxConcurrency int, opts *Options) (*config.Manifest, map[string]Remote, map[string]*homePaths, []error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := semaphore.NewWeighted(int64(maxConcurrency))
+	manifest := config.NewManifest()
+	clients := make(map[string]Remote)
+	homes := make(map[string]*homePaths)
+	var errs []error
+
+	if _, err := cfg.PathFilter(); err != nil {
+		return nil, nil, nil, []error{errors.Wrap(err, "invalid exclude/include patterns")}
+	}
+	for _, server := range cfg.Servers {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			if err := sem.Acquire(context.Background(), 1); err != nil {
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "[%s] semaphore acquisition failed", s))
+				mu.Unlock()
+				return
+			}
+			defer sem.Release(1)
+			if cfg.ServerSettings(s).Windows() {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("[%s] remote checksums need a POSIX shell; collect Windows servers instead", s))
+				mu.Unlock()
+				return
+			}
+
+			phaseStart := time.Now()
+			sshClient, err := opts.connect(cfg, s)
+			timing.Since(s, timing.Connect, phaseStart)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "[%s] failed to connect", s))
+				mu.Unlock()
+				return
+			}
+
+			serverCfg, home, err := resolveHome(s, sshClient, cfg)
+			var filter *pathfilter.Filter
+			if err == nil {
+				// Built from the resolved entries, so configured ~/ files are kept
+				filter, err = serverCfg.PathFilter()
+			}
+			if err != nil {
+				sshClient.Close()
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "[%s] failed to resolve ~/ paths", s))
+				mu.Unlock()
+				return
+			}
+
+			opts.throttle(s, sshClient, "the remote checksums")
+			log.Infof("[%s] Computing remote checksums...", s)
+			phaseStart = time.Now()
+			script := generateChecksumScript(serverCfg.Files, serverCfg.Dirs, filter, opts.Priority)
+			stdout, stderr, err := sshClient.RunCommand("sh -c "+util.ShellQuote(script), serverCfg.NeedsPrivileges())
+			timing.Since(s, timing.Hash, phaseStart)
+			if err != nil {
+				sshClient.Close()
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "[%s] remote checksum command failed, stderr: %s", s, stderr))
+				mu.Unlock()
+				return
+			}
+			parseChecksumOutput(s, stdout, filter, home, manifest)
+
+			mu.Lock()
+			clients[s] = sshClient
+			homes[s] = home
+			mu.Unlock()
+		}(server)
+	}
+	wg.Wait()
+	return manifest, clients, homes, errs
+}
+
+// mismatchedFiles returns the paths whose checksums are not identical on every server
+func mismatchedFiles(servers []string, manifest *config.Manifest) []string {
+	manifest.Mu.RLock()
+	defer manifest.Mu.RUnlock()
+
+	var mismatched []string
+	for filePath, info := range manifest.FilesByServer[servers[0]] {
+		for _, server := range servers[1:] {
+			other, ok := manifest.FilesByServer[server][filePath]
+			if ok && other.Error == "" && info.Error == "" && other.Checksum != info.Checksum {
+				mismatched = append(mismatched, filePath)
+				break
+			}
+		}
+	}
+	return mismatched
+}
+
+// fetchFile downloads one remote file into localRoot over SFTP, which
+// streams it to disk. A file the SSH user can't read is copied with sudo
+// into a temporary file only the user can read, which is downloaded and
+// removed, unless it is below an unprivileged path. Downloads are retried as
+// sshutil.TransferRetry allows and commands as CommandRetry does.
+func fetchFile(sshClient Remote, cfg *config.Config, home *homePaths, relPath, localRoot string) error {
+	remotePath := home.remote(relPath)
+	localPath := filepath.Join(localRoot, filepath.FromSlash(relPath))
+	err := sshClient.DownloadFile(remotePath, localPath)
+	if !errors.Is(err, os.ErrPermission) || cfg.IsUnprivileged(remotePath) || cfg.IsUnprivileged(relPath) {
+		return err
+	}
+
+	stdout, stderr, err := sshClient.RunCommand("umask 077 && mktemp", false)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a temporary file for %s, stderr: %s", remotePath, stderr)
+	}
+	staged := strings.TrimSpace(stdout)
+	defer func() {
+		if _, stderr, err := sshClient.RunCommand("rm -f "+util.ShellQuote(staged), false); err != nil {
+			log.Warnf("Failed to remove %s: %v, stderr: %s", staged, err, stderr)
+		}
+	}()
+	// The redirection is the user's, so the copy keeps the mode mktemp gave it
+	if _, stderr, err := sshClient.RunCommand("cat "+util.ShellQuote(remotePath)+" > "+util.ShellQuote(staged), true); err != nil {
+		return errors.Wrapf(err, "failed to read %s, stderr: %s", remotePath, stderr)
+	}
+	return sshClient.DownloadFile(staged, localPath)
+}
+
+// RunRemoteCompare computes checksums on each server over SSH without
+// transferring file contents. If fetchMismatched is set, only files whose
+// checksums differ are downloaded so they can be content-diffed. It returns
+// the directory to run the analyzer on.
+func RunRemoteCompare(cfg *config.Config, outputDir string, maxConcurrency int, fetchMismatched bool) (string, error) {
+	compareDir := filepath.Join(outputDir, RemoteCompareDir)
+	if err := os.RemoveAll(compareDir); err != nil {
+		return "", errors.Wrapf(err, "failed to clear %s", compareDir)
+	}
+
+	opts := CurrentOptions()
+	manifest, clients, homes, errs := remoteChecksums(cfg, maxConcurrency, &opts)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		return "", fmt.Errorf("remote checksum collection failed on %d server(s)", len(errs))
+	}
+
+	// The analyzer expects a directory per server even when nothing is fetched
+	for _, server := range cfg.Servers {
+		serverDir := filepath.Join(compareDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server))
+		if err := os.MkdirAll(serverDir, 0755); err != nil {
+			return "", errors.Wrapf(err, "failed to create %s", serverDir)
+		}
+	}
+
+	if fetchMismatched {
+		mismatched := mismatchedFiles(cfg.Servers, manifest)
+		log.Infof("Fetching %d file(s) with mismatching checksums for content diff", len(mismatched))
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var fetchErrs int
+		for server, client := range clients {
+			wg.Add(1)
+			go func(s string, c Remote) {
+				defer wg.Done()
+				serverDir := filepath.Join(compareDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", s))
+				phaseStart := time.Now()
+				defer timing.Since(s, timing.Download, phaseStart)
+				for _, relPath := range mismatched {
+					err := fetchFile(c, cfg, homes[s], relPath, serverDir)
+					if err == nil {
+						continue
+					}
+					if !sshutil.IsTransient(err) {
+						// e.g. permission denied: the file is reported with an error instead of failing the comparison
+						log.Errorf("[%s] Permanent error fetching /%s: %v", s, relPath, err)
+						manifest.AddFile(s, relPath, "", err.Error()) // Takes the manifest's lock
+						continue
+					}
+					log.Errorf("[%s] %v", s, err)
+					mu.Lock()
+					fetchErrs++
+					mu.Unlock()
+				}
+			}(server, client)
+		}
+		wg.Wait()
+		if fetchErrs > 0 {
+			return "", fmt.Errorf("failed to fetch %d mismatching file(s)", fetchErrs)
+		}
+	}
+
+	if err := manifest.Save(compareDir); err != nil {
+		return "", err
+	}
+	return compareDir, nil
+}
@@ -0,0 +1,96 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+)
+
+// rootOnlyRemote serves files over "SFTP" except those in rootOnly, which
+// only a sudo cat can read, and records the commands it runs
+type rootOnlyRemote struct {
+	files    map[string]string // Remote path -> content
+	rootOnly map[string]bool
+	commands []string
+}
+
+func (r *rootOnlyRemote) RunCommand(command string, sudo bool) (string, string, error) {
+	if sudo {
+		command = "sudo " + command
+	}
+	r.commands = append(r.commands, command)
+	switch {
+	case command == "umask 077 && mktemp":
+		return "/tmp/tmp.x\n", "", nil
+	case strings.HasPrefix(command, "sudo cat '") && strings.HasSuffix(command, "' > '/tmp/tmp.x'"):
+		src := strings.TrimSuffix(strings.TrimPrefix(command, "sudo cat '"), "' > '/tmp/tmp.x'")
+		r.files["/tmp/tmp.x"] = r.files[src]
+		return "", "", nil
+	case command == "rm -f '/tmp/tmp.x'":
+		delete(r.files, "/tmp/tmp.x")
+		return "", "", nil
+	}
+	return "", "", fmt.Errorf("unexpected command %q", command)
+}
+
+func (r *rootOnlyRemote) DownloadFile(remotePath, localPath string) error {
+	if r.rootOnly[remotePath] {
+		return fmt.Errorf("open %s: %w", remotePath, os.ErrPermission)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, []byte(r.files[remotePath]), 0644)
+}
+
+func (r *rootOnlyRemote) UploadFile(localPath, remotePath string) error {
+	return errors.New("no uploads")
+}
+func (r *rootOnlyRemote) CheckSudoAccess() bool { return true }
+func (r *rootOnlyRemote) Close()                {}
+
+func TestFetchFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		wantErr  bool
+		commands []string
+	}{
+		{name: "readable", path: "etc/hosts"},
+		{name: "root only", path: "etc/shadow", commands: []string{"umask 077 && mktemp", "sudo cat '/etc/shadow' > '/tmp/tmp.x'", "rm -f '/tmp/tmp.x'"}},
+		{name: "root only below an unprivileged path", path: "srv/app/secret", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := &rootOnlyRemote{
+				files:    map[string]string{"/etc/hosts": "hosts\n", "/etc/shadow": "shadow\n", "/srv/app/secret": "secret\n"},
+				rootOnly: map[string]bool{"/etc/shadow": true, "/srv/app/secret": true},
+			}
+			cfg := &config.Config{Unprivileged: []string{"/srv/app"}}
+			localRoot := t.TempDir()
+			err := fetchFile(remote, cfg, nil, tt.path, localRoot)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(remote.commands, tt.commands) {
+				t.Errorf("ran %q, want %q", remote.commands, tt.commands)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.ReadFile(filepath.Join(localRoot, tt.path))
+			if want := remote.files["/"+tt.path]; err != nil || string(got) != want {
+				t.Errorf("fetched %q (%v), want %q", got, err, want)
+			}
+			if _, ok := remote.files["/tmp/tmp.x"]; ok {
+				t.Error("the temporary copy was left on the server")
+			}
+		})
+	}
+}
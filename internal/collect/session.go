@@ -0,0 +1,60 @@
+package collect
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionsDir is the directory below the output directory that keeps the
+// full output of each server's last collection script, so failures can be
+// looked into after the run
+const SessionsDir = "sessions"
+
+// SessionPath returns the file holding the script output of server
+func SessionPath(outputDir, server string) string {
+	return filepath.Join(outputDir, SessionsDir, server+".log")
+}
+
+// saveSession keeps the output of a collection script, replacing that of
+// the server's previous collection. Failing to save it is only logged.
+func saveSession(outputDir, server string, start time.Time, stdout, stderr string, runErr error) {
+	status := "ok"
+	if runErr != nil {
+		status = runErr.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "server: %s\nstarted: %s\nduration: %s\nstatus: %s\n", server, start.UTC().Format(time.RFC3339), time.Since(start).Round(time.Millisecond), status)
+	fmt.Fprintf(&b, "\n--- stdout ---\n%s", stdout)
+	if stdout != "" && !strings.HasSuffix(stdout, "\n") {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\n--- stderr ---\n%s", stderr)
+	if stderr != "" && !strings.HasSuffix(stderr, "\n") {
+		b.WriteString("\n")
+	}
+
+	path := SessionPath(outputDir, server)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(b.String()), 0644)
+	}
+	if err != nil {
+		log.Warnf("[%s] Failed to save the output of the collection script: %v", server, errors.Wrapf(err, "failed to write %s", path))
+		return
+	}
+	log.Debugf("[%s] Collection script output saved to %s", server, path)
+}
+
+// removeSession drops the script output of an earlier collection of a
+// server that is now collected without a script
+func removeSession(outputDir, server string) {
+	if err := os.Remove(SessionPath(outputDir, server)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("[%s] Failed to remove the output of an earlier collection script: %v", server, err)
+	}
+}
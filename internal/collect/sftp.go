@@ -0,0 +1,377 @@
+package collect
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Collection methods
+const (
+	MethodScript = "script" // Upload a script that copies the paths with sudo and tars them up
+	MethodSFTP   = "sftp"   // Walk and download the paths over SFTP; nothing is written on the remote
+	MethodAuto   = "auto"   // MethodScript, or MethodSFTP on servers that refuse shell commands
+)
+
+// Method selects how RunCollection fetches files from each server
+var Method = MethodScript
+
+// ValidateMethod checks a --method value
+func ValidateMethod(method string) error {
+	switch method {
+	case MethodScript, MethodSFTP, MethodAuto:
+		return nil
+	default:
+		return fmt.Errorf("unknown collection method %q (expected %s, %s or %s)", method, MethodScript, MethodSFTP, MethodAuto)
+	}
+}
+
+// RemoteFS is implemented by remotes that can inspect the remote filesystem
+// directly. *sshutil.Client implements it over SFTP.
+type RemoteFS interface {
+	Stat(remotePath string) (os.FileInfo, error)
+	ReadDir(remotePath string) ([]os.FileInfo, error)
+}
+
+// WorkingDirFS is implemented by connections that can tell the directory
+// SFTP sessions start in, the user's home on Windows servers, which have no
+// shell to ask for $HOME
+type WorkingDirFS interface {
+	Getwd() (string, error)
+}
+
+// collectViaSFTP collects a server's files by streaming each one over SFTP.
+// It runs no commands other than journalctl for configured journal excerpts,
+// so it works where the user can't write to /tmp or their home directory, but
+// it also can't use sudo: files the SSH user can't read are recorded as
+// per-file errors. Windows servers are always collected this way, and run no
+// commands at all.
+func collectViaSFTP(server string, cfg *config.Config, outputDir string, manifest *config.Manifest, opts *Options) error {
+	log.Infof("[%s] Starting SFTP collection", server)
+
+	phaseStart := time.Now()
+	remote, err := opts.connect(cfg, server)
+	timing.Since(server, timing.Connect, phaseStart)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect")
+	}
+	defer remote.Close()
+	return collectOverSFTP(server, remote, cfg, outputDir, manifest, opts)
+}
+
+// shellProbe is echoed to tell whether a server runs shell commands
+const shellProbe = "remote-diff-tool-shell-ok"
+
+// hasShell reports whether the server runs shell commands. Appliances that
+// only allow the SFTP subsystem (e.g. with ForceCommand internal-sftp)
+// refuse the command, or answer with a notice of their own instead of running
+// it. Only a connection that stayed down is an error.
+func hasShell(server string, remote Remote) (bool, error) {
+	stdout, stderr, err := remote.RunCommand("echo "+shellProbe, false)
+	if strings.Contains(stdout, shellProbe) {
+		return true, nil
+	}
+	if err != nil && sshutil.IsTransient(err) {
+		return false, err
+	}
+	log.Debugf("[%s] Shell probe failed: %v, stdout: %q, stderr: %q", server, err, stdout, stderr)
+	return false, nil
+}
+
+// collectOverSFTP is collectViaSFTP on an open connection
+func collectOverSFTP(server string, remote Remote, cfg *config.Config, outputDir string, manifest *config.Manifest, opts *Options) error {
+	fsys, ok := remote.(RemoteFS)
+	if !ok {
+		return fmt.Errorf("the connection does not support SFTP collection")
+	}
+	removeSession(outputDir, server)
+
+	cfg, home, err := resolveHome(server, remote, cfg)
+	if err != nil {
+		return err
+	}
+	filter, err := cfg.PathFilter()
+	if err != nil {
+		return errors.Wrap(err, "invalid exclude/include patterns")
+	}
+
+	serverOutputDir := filepath.Join(outputDir, config.CollectedFilesBaseDir, fmt.Sprintf("files-%s", server))
+	if err := os.RemoveAll(serverOutputDir); err != nil { // Clear previous contents
+		log.Warnf("[%s] Failed to clear previous output directory %s: %v", server, serverOutputDir, err)
+	}
+	if err := os.MkdirAll(serverOutputDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create server output directory %s", serverOutputDir)
+	}
+
+	c := &sftpCollector{server: server, fsys: fsys, remote: remote, filter: filter, home: home, localRoot: serverOutputDir, manifest: manifest, opts: opts}
+	for _, filePath := range cfg.Files {
+		info, err := fsys.Stat(filePath)
+		if err != nil {
+			if err := c.statFailed(filePath, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if info.IsDir() {
+			log.Warnf("[%s] %s is a directory; list it under dirs to collect it", server, filePath)
+			continue
+		}
+		c.queue(filePath, info)
+	}
+	for _, dirPath := range cfg.Dirs {
+		info, err := fsys.Stat(dirPath)
+		if err != nil {
+			if err := c.statFailed(dirPath, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.IsDir() {
+			log.Warnf("[%s] %s is not a directory; list it under files to collect it", server, dirPath)
+			continue
+		}
+		if err := c.walk(dirPath); err != nil {
+			return err
+		}
+	}
+	windows := cfg.ServerSettings(server).Windows()
+	if windows {
+		if opts.MaxLoad > 0 {
+			log.Infof("[%s] Not checking the load of a Windows server", server)
+		}
+		c.workers = opts.FileConcurrency
+	} else {
+		c.workers = opts.throttle(server, remote, "the downloads")
+	}
+	if c.workers < opts.FileConcurrency {
+		log.Infof("[%s] Downloading one file at a time while the server is busy", server)
+	}
+	if err := c.fetchQueued(); err != nil {
+		return err
+	}
+	if !windows {
+		collectJournals(server, remote, cfg, serverOutputDir, manifest, false)
+	} else if len(cfg.Journals) > 0 {
+		log.Warnf("[%s] Skipping the journal excerpts: Windows servers have no journald", server)
+	}
+	timing.Default.Add(server, timing.Download, c.downloadTime)
+	timing.Default.Add(server, timing.Hash, c.hashTime)
+	c.hashed.report(server, c.hashTime) // Summed over the concurrent downloads, so the rate is that of one worker
+
+	manifest.SetMethod(server, MethodSFTP)
+	log.Infof("[%s] SFTP collection finished: %d file(s) downloaded", server, c.fetched)
+	return nil
+}
+
+type sftpCollector struct {
+	server    string
+	fsys      RemoteFS
+	remote    Remote
+	filter    *pathfilter.Filter
+	home      *homePaths
+	localRoot string
+	manifest  *config.Manifest
+	opts      *Options
+	queued    []queuedFile
+	workers   int // Files downloaded at once
+
+	mu           sync.Mutex // Guards the fields below, updated by concurrent fetches
+	firstErr     error
+	fetched      int
+	downloadTime time.Duration
+	hashTime     time.Duration
+	hashed       hashStats
+}
+
+// statFailed records a configured path that couldn't be looked at. Only a
+// connection that stayed down fails the server.
+func (c *sftpCollector) statFailed(remotePath string, err error) error {
+	rel := c.home.logical(manifestPath(remotePath))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Warnf("[%s] Missing on remote: %s", c.server, remotePath)
+		c.manifest.AddFile(c.server, rel, "", config.MissingOnRemote)
+		return nil
+	case sshutil.IsTransient(err):
+		return errors.Wrapf(err, "failed to stat %s", remotePath)
+	default:
+		log.Errorf("[%s] Failed to stat %s: %v", c.server, remotePath, err)
+		c.manifest.AddFile(c.server, rel, "", err.Error())
+		return nil
+	}
+}
+
+// walkRemote calls visit for every regular file below dir, and with a
+// non-nil error for every directory that can't be listed. The walk stops at
+// the first error visit returns.
+// Symlinks to files are followed; symlinks to directories are not descended
+// into, which also keeps link loops from recursing forever.
+func walkRemote(server string, fsys RemoteFS, dir string, visit func(remotePath string, info os.FileInfo, err error) error) error {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return visit(dir, nil, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "" || name == "." || name == ".." || path.Base(name) != name {
+			log.Warnf("[%s] Skipping suspicious entry %q in %s", server, name, dir)
+			continue
+		}
+		remotePath := path.Join(dir, name)
+		info := entry
+		if entry.Mode()&os.ModeSymlink != 0 {
+			target, err := fsys.Stat(remotePath)
+			if err != nil {
+				log.Warnf("[%s] Skipping unresolvable symlink %s: %v", server, remotePath, err)
+				continue
+			}
+			if target.IsDir() {
+				log.Debugf("[%s] Not following symlinked directory %s", server, remotePath)
+				continue
+			}
+			info = target
+		}
+		switch {
+		case info.IsDir():
+			if err := walkRemote(server, fsys, remotePath, visit); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := visit(remotePath, info, nil); err != nil {
+				return err
+			}
+		default:
+			log.Debugf("[%s] Skipping special file %s", server, remotePath)
+		}
+	}
+	return nil
+}
+
+type queuedFile struct {
+	remotePath string
+	info       os.FileInfo
+}
+
+// queue adds a file to be downloaded by fetchQueued, unless the filter leaves it out
+func (c *sftpCollector) queue(remotePath string, info os.FileInfo) {
+	if !c.filter.Keep(remotePath) {
+		log.Debugf("[%s] Excluded by filter: %s", c.server, remotePath)
+		return
+	}
+	c.queued = append(c.queued, queuedFile{remotePath: remotePath, info: info})
+}
+
+// fetchQueued downloads the queued files, c.workers at a time. The first
+// error fails the server; files not started by then are skipped.
+func (c *sftpCollector) fetchQueued() error {
+	forEachFileN(c.workers, len(c.queued), func(i int) {
+		c.mu.Lock()
+		failed := c.firstErr != nil
+		c.mu.Unlock()
+		if failed {
+			return
+		}
+		if err := c.fetch(c.queued[i].remotePath, c.queued[i].info); err != nil {
+			c.mu.Lock()
+			if c.firstErr == nil {
+				c.firstErr = err
+			}
+			c.mu.Unlock()
+		}
+	})
+	return c.firstErr
+}
+
+// walk queues every regular file below dir
+func (c *sftpCollector) walk(dir string) error {
+	return walkRemote(c.server, c.fsys, dir, func(remotePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if sshutil.IsTransient(err) {
+				return errors.Wrapf(err, "failed to list %s", remotePath)
+			}
+			log.Errorf("[%s] Failed to list %s: %v", c.server, remotePath, err)
+			return nil
+		}
+		c.queue(remotePath, info)
+		return nil
+	})
+}
+
+// fetch downloads one file below the local root and adds its checksum and
+// remote metadata to the manifest. It is safe for concurrent use.
+func (c *sftpCollector) fetch(remotePath string, info os.FileInfo) error {
+	rel := c.home.logical(manifestPath(remotePath))
+	localPath := filepath.Join(c.localRoot, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %s", localPath)
+	}
+
+	start := time.Now()
+	err := c.remote.DownloadFile(remotePath, localPath)
+	c.addTime(&c.downloadTime, start)
+	if err != nil {
+		if sshutil.IsTransient(err) {
+			return errors.Wrapf(err, "failed to download %s", remotePath)
+		}
+		log.Errorf("[%s] Failed to download %s: %v", c.server, remotePath, err)
+		os.Remove(localPath)
+		c.manifest.AddFile(c.server, rel, "", err.Error())
+		return nil
+	}
+	c.mu.Lock()
+	c.fetched++
+	c.mu.Unlock()
+	if err := os.Chmod(localPath, util.LocalMode(info.Mode())); err != nil {
+		log.Warnf("[%s] Failed to set permissions on %s: %v", c.server, localPath, err)
+	}
+
+	start = time.Now()
+	checksum, chunks, err := c.opts.hashLocalCopy(localPath, &c.hashed)
+	c.addTime(&c.hashTime, start)
+	if err != nil {
+		log.Errorf("[%s] Failed to calculate checksum for %s: %v", c.server, rel, err)
+		c.manifest.AddFile(c.server, rel, "", err.Error())
+		return nil
+	}
+	log.Debugf("[%s] Checksum %s: %s", c.server, rel, checksum)
+	c.manifest.AddFile(c.server, rel, checksum, "")
+	if chunks != nil {
+		c.manifest.SetChunks(c.server, rel, chunks)
+	}
+	c.manifest.SetMetadata(c.server, rel, plannedFile(remotePath, info).Metadata())
+	if c.opts.StableReads {
+		// info was taken before the download, so a change in between shows up in a second stat
+		after, err := c.fsys.Stat(remotePath)
+		if err != nil || statChanged(info, after) {
+			log.Warnf("[%s] %s changed while it was collected; marking it unstable", c.server, remotePath)
+			c.manifest.MarkUnstable(c.server, rel)
+		}
+	}
+	return nil
+}
+
+// addTime adds the time since start to one of the phase totals. With
+// concurrent fetches the totals add up the time spent by every worker.
+func (c *sftpCollector) addTime(total *time.Duration, start time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*total += time.Since(start)
+}
+
+// manifestPath turns an absolute remote path into the relative form the manifest uses
+func manifestPath(remotePath string) string {
+	return path.Clean("/" + remotePath)[1:]
+}
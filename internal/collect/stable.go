@@ -0,0 +1,53 @@
+package collect
+
+import (
+	"os"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StableReads makes collections check that every file stayed the same while
+// it was copied. Files that changed, such as logs and counters, are marked
+// unstable in the manifest, and the analyzer doesn't diff their torn copies.
+var StableReads bool
+
+// stabilityCheck holds a server's remote checksums from before and after the
+// collection script copied its files
+type stabilityCheck struct {
+	before, after map[string]string
+}
+
+// remoteChecksumsNow checksums the server's files for a stabilityCheck. A
+// failure only disables the check.
+func remoteChecksumsNow(server, when string, remote Remote, cfg *config.Config, filter *pathfilter.Filter, prio util.Priority) map[string]string {
+	phaseStart := time.Now()
+	sums, err := remoteFileChecksums(remote, cfg, filter, prio)
+	timing.Since(server, timing.Exec, phaseStart)
+	if err != nil {
+		log.Warnf("[%s] Failed to checksum files %s copying them (not checking for unstable files): %v", server, when, err)
+		return nil
+	}
+	return sums
+}
+
+// changed reports whether a file changed while it was copied, or its copy
+// doesn't match what it was both before and after. A nil check reports nothing.
+func (s *stabilityCheck) changed(rel, checksum string) bool {
+	if s == nil {
+		return false
+	}
+	before, after := s.before[rel], s.after[rel]
+	return before != after || after != checksum
+}
+
+// statChanged reports whether a file's size or modification time differs
+// between two stats, which is all SFTP can tell about a file without reading it
+func statChanged(before, after os.FileInfo) bool {
+	return before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
+}
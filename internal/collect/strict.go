@@ -0,0 +1,41 @@
+package collect
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+)
+
+// Strict makes a collection fail if any file was recorded with an error,
+// such as a failed copy or checksum, or one the SSH user couldn't read.
+// Files missing on the remote are not errors: their absence is compared.
+var Strict bool
+
+// AllowPartial saves the manifest when some servers failed to collect, as
+// long as one succeeded: the failed ones are recorded with their error and
+// analyses compare the others. Without it, nothing is saved.
+var AllowPartial bool
+
+// fileErrors lists the files of the manifest recorded with an error, as
+// "[server] path: error", sorted, and counts the servers they are on
+func fileErrors(manifest *config.Manifest) ([]string, int) {
+	manifest.Mu.RLock()
+	defer manifest.Mu.RUnlock()
+
+	var errs []string
+	servers := 0
+	for server, files := range manifest.FilesByServer {
+		before := len(errs)
+		for rel, info := range files {
+			if info.Error != "" && info.Error != config.MissingOnRemote {
+				errs = append(errs, fmt.Sprintf("[%s] %s: %s", server, rel, info.Error))
+			}
+		}
+		if len(errs) > before {
+			servers++
+		}
+	}
+	sort.Strings(errs)
+	return errs, servers
+}
@@ -1,13 +1,25 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/brndnsvr/remote-diff-tool/internal/normalize"
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+	"github.com/brndnsvr/remote-diff-tool/internal/preset"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshconfig"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,40 +32,472 @@ const ManifestFileName = "manifest.json"
 
 // --- END OF UPDATED CONSTANTS ---
 
+// StrictDecoding makes config and manifest loading fail on keys that don't map
+// to a known field, so typos like "servres" surface instead of being ignored.
+var StrictDecoding = true
+
+// SSHConfigPath is the OpenSSH client config used to resolve server names
+// (HostName, User, Port, IdentityFile, ProxyJump). Empty disables the lookup.
+var SSHConfigPath = sshconfig.DefaultPath()
+
+// RequireSSHCredentials makes collection configs load SSH credentials from the
+// environment. It is turned off when connections don't need them (--mock).
+var RequireSSHCredentials = true
+
+// UnknownFieldError reports a key in a JSON file that has no matching field
+type UnknownFieldError struct {
+	File  string
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q in %s (check for typos, or disable strict decoding with --strict-config=false)", e.Field, e.File)
+}
+
+// decodeJSON unmarshals data into v, rejecting unknown keys when StrictDecoding is set.
+// file is only used to make error messages point at the offending file.
+func decodeJSON(file string, data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if StrictDecoding {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		// encoding/json doesn't export a typed error for this case, only the message
+		const prefix = "json: unknown field "
+		if msg := err.Error(); strings.HasPrefix(msg, prefix) {
+			return &UnknownFieldError{File: file, Field: strings.Trim(strings.TrimPrefix(msg, prefix), `"`)}
+		}
+		return err
+	}
+	return nil
+}
+
 // SSHCredentials holds the SSH authentication details
 type SSHCredentials struct {
 	Username      string
 	KeyPath       string
 	KeyPassphrase string
+	SudoPassword  string // Piped to sudo -S on every server that escalates with sudo
+}
+
+// DefaultSSHPort is used for servers without a port override
+const DefaultSSHPort = 22
+
+// ServerConfig overrides how one server is reached. Empty fields fall back to
+// the server name, DefaultSSHPort and the SSHUSER/SSHKEYPATH environment.
+type ServerConfig struct {
+	Hostname string            `json:"hostname,omitempty" yaml:"hostname" toml:"hostname"`
+	Port     int               `json:"port,omitempty" yaml:"port" toml:"port"`
+	Username string            `json:"username,omitempty" yaml:"username" toml:"username"`
+	KeyPath  string            `json:"key_path,omitempty" yaml:"key_path" toml:"key_path"`
+	JumpHost string            `json:"jump_host,omitempty" yaml:"jump_host" toml:"jump_host"` // ProxyJump syntax: [user@]host[:port][,...]
+	Env      map[string]string `json:"env,omitempty" yaml:"env" toml:"env"`                   // Variables exported at the top of the collection script
+	Become   string            `json:"become,omitempty" yaml:"become" toml:"become"`          // Privilege escalation: sudo, doas or none; empty uses --become
+	OS       string            `json:"os,omitempty" yaml:"os" toml:"os"`                      // OSLinux (the default) or OSWindows
+}
+
+// Operating systems of a server
+const (
+	OSLinux   = "linux"   // Linux or another Unix with a POSIX shell
+	OSWindows = "windows" // Windows with OpenSSH: collected over SFTP only, without running commands
+)
+
+// ValidateOS checks the os setting of a hosts entry; empty means OSLinux
+func ValidateOS(os string) error {
+	switch os {
+	case "", OSLinux, OSWindows:
+		return nil
+	}
+	return fmt.Errorf("invalid os %q (expected %s or %s)", os, OSLinux, OSWindows)
+}
+
+// Windows reports whether the server runs Windows
+func (s ServerConfig) Windows() bool {
+	return s.OS == OSWindows
 }
 
 // Config holds the application configuration
 type Config struct {
-	Servers   []string       `json:"servers"`
-	Files     []string       `json:"files"`
-	Dirs      []string       `json:"dirs"`
+	Servers     []string                `json:"servers"`
+	Hosts       map[string]ServerConfig `json:"hosts,omitempty"` // server name -> connection overrides
+	Files       []string                `json:"files"`
+	Dirs        []string                `json:"dirs"`
+	Exclude     []string                `json:"exclude,omitempty"`      // Patterns for files below Dirs to skip
+	Include     []string                `json:"include,omitempty"`      // If set, only files below Dirs matching one of these are kept
+	IgnoreLines []string                `json:"ignore_lines,omitempty"` // Regexes for lines whose changes don't count as differences
+	Journals    []JournalExcerpt        `json:"journals,omitempty"`     // journald excerpts collected alongside the files
+	Retry       []string                `json:"retry,omitempty"`        // Retry policy changes in the --retry syntax, applied before the flags
+	Presets     []string                `json:"presets,omitempty"`      // Presets whose paths and patterns are added when collecting
+	Groups      map[string][]string     `json:"groups,omitempty"`       // Named server lists, selected as @name in servers
+	// Extra ignore_lines patterns for one configured file or dir (and the files below it)
+	PathIgnoreLines map[string][]string `json:"path_ignore_lines,omitempty"`
+	// Normalization rules (see package normalize) applied to the copies of one
+	// configured file or dir (and the files below it) before they are compared
+	Normalize map[string][]string `json:"normalize,omitempty"`
+	// Configured files and dirs that are read as the SSH user, without
+	// privilege escalation, because they don't need it
+	Unprivileged []string `json:"unprivileged,omitempty"`
+	// Files expected to differ between servers, such as /etc/hostname, as
+	// exclude patterns: collected for the record, but never counted as drift
+	Unique    []string       `json:"unique,omitempty"`
 	SSHConfig SSHCredentials `json:"-"` // Loaded from ENV, not saved in config.json
+
+	aliases  *sshconfig.Config // Host aliases from SSHConfigPath, consulted after Hosts
+	defaults ServerConfig      // The config file's ssh settings, copied into Hosts for every server
+}
+
+// JournalExcerpt selects the journald entries of one unit within a time
+// window. Since and Until take anything journalctl accepts, e.g. "-1h",
+// "today" or "2024-05-01 10:00"; empty means unbounded.
+type JournalExcerpt struct {
+	Unit  string `json:"unit" yaml:"unit" toml:"unit"`
+	Since string `json:"since,omitempty" yaml:"since" toml:"since"`
+	Until string `json:"until,omitempty" yaml:"until" toml:"until"`
+}
+
+// ParseJournalExcerpt parses the --journal syntax: unit[@since[..until]]
+func ParseJournalExcerpt(s string) (JournalExcerpt, error) {
+	unit, window, _ := strings.Cut(s, "@")
+	since, until, _ := strings.Cut(window, "..")
+	j := JournalExcerpt{Unit: strings.TrimSpace(unit), Since: strings.TrimSpace(since), Until: strings.TrimSpace(until)}
+	return j, j.validate()
+}
+
+// String formats the excerpt in the --journal syntax
+func (j JournalExcerpt) String() string {
+	s := j.Unit
+	if j.Since != "" || j.Until != "" {
+		s += "@" + j.Since
+	}
+	if j.Until != "" {
+		s += ".." + j.Until
+	}
+	return s
+}
+
+func (j JournalExcerpt) validate() error {
+	switch {
+	case j.Unit == "":
+		return fmt.Errorf("journal excerpt %q has no unit", j.String())
+	case strings.ContainsAny(j.Unit, "/\x00\n") || strings.HasPrefix(j.Unit, "-") || strings.HasPrefix(j.Unit, "."):
+		return fmt.Errorf("invalid journal unit name %q", j.Unit)
+	case strings.ContainsAny(j.Since+j.Until, "\x00\n"):
+		return fmt.Errorf("journal excerpt %q has control characters in its time window", j.String())
+	}
+	return nil
+}
+
+// PathFilter returns the include/exclude filter for files below cfg.Dirs
+func (c *Config) PathFilter() (*pathfilter.Filter, error) {
+	return pathfilter.New(c.Files, c.Dirs, c.Exclude, c.Include)
+}
+
+// UniquePatterns compiles Unique
+func (c *Config) UniquePatterns() ([]*pathfilter.Pattern, error) {
+	patterns := make([]*pathfilter.Pattern, 0, len(c.Unique))
+	for _, raw := range c.Unique {
+		p, err := pathfilter.Compile(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid unique pattern")
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// LinePatterns compiles IgnoreLines
+func (c *Config) LinePatterns() ([]*regexp.Regexp, error) {
+	return compileLinePatterns(c.IgnoreLines)
+}
+
+// PathLinePatterns compiles PathIgnoreLines, keyed by the configured path
+func (c *Config) PathLinePatterns() (map[string][]*regexp.Regexp, error) {
+	compiled := make(map[string][]*regexp.Regexp, len(c.PathIgnoreLines))
+	for p, patterns := range c.PathIgnoreLines {
+		if !strings.HasPrefix(p, "/") && !IsHomePath(p) {
+			return nil, fmt.Errorf("path_ignore_lines path %q must be absolute or start with ~/", p)
+		}
+		res, err := compileLinePatterns(patterns)
+		if err != nil {
+			return nil, errors.Wrapf(err, "for %s", p)
+		}
+		compiled[path.Clean(p)] = res
+	}
+	return compiled, nil
+}
+
+// PathNormalizeRules validates Normalize and returns it keyed by the cleaned configured path
+func (c *Config) PathNormalizeRules() (map[string][]string, error) {
+	rules := make(map[string][]string, len(c.Normalize))
+	for p, r := range c.Normalize {
+		if !strings.HasPrefix(p, "/") && !IsHomePath(p) {
+			return nil, fmt.Errorf("normalize path %q must be absolute or start with ~/", p)
+		}
+		if err := normalize.Validate(r); err != nil {
+			return nil, errors.Wrapf(err, "for %s", p)
+		}
+		key := path.Clean(p)
+		rules[key] = appendMissing(rules[key], r)
+	}
+	return rules, nil
+}
+
+func compileLinePatterns(raw []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(raw))
+	for _, p := range raw {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ignore_lines pattern %q", p)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// hostEntry returns the overrides for name: its hosts entry, with gaps filled
+// from the matching ~/.ssh/config Host section
+func (c *Config) hostEntry(name string) ServerConfig {
+	entry := c.Hosts[name]
+	if c.aliases == nil {
+		return entry
+	}
+	alias := c.aliases.Lookup(name)
+	if entry.Hostname == "" {
+		entry.Hostname = alias.HostName
+	}
+	if entry.Port == 0 {
+		entry.Port = alias.Port
+	}
+	if entry.Username == "" {
+		entry.Username = alias.User
+	}
+	if entry.KeyPath == "" {
+		entry.KeyPath = alias.IdentityFile
+	}
+	if entry.JumpHost == "" {
+		entry.JumpHost = alias.ProxyJump
+	}
+	return entry
+}
+
+// ServerSettings returns the effective connection settings for server, with
+// every empty field filled in from the defaults
+func (c *Config) ServerSettings(server string) ServerConfig {
+	settings := c.hostEntry(server)
+	if settings.Hostname == "" {
+		settings.Hostname = server
+	}
+	if settings.Port == 0 {
+		settings.Port = DefaultSSHPort
+	}
+	if settings.Username == "" {
+		settings.Username = c.SSHConfig.Username
+	}
+	if settings.KeyPath == "" {
+		settings.KeyPath = c.SSHConfig.KeyPath
+	}
+	return settings
 }
 
 // FileInfo holds metadata about a collected file, including its checksum
 type FileInfo struct {
-	Path     string `json:"path"`            // Relative path within the server's collection dir
-	Checksum string `json:"checksum"`        // SHA-256 checksum
-	Error    string `json:"error,omitempty"` // Record if there was an error fetching/checksumming
+	Path     string       `json:"path"`               // Relative path within the server's collection dir
+	Checksum string       `json:"checksum"`           // SHA-256 checksum
+	Error    string       `json:"error,omitempty"`    // Record if there was an error fetching/checksumming
+	Unstable bool         `json:"unstable,omitempty"` // The file changed while it was collected, so the copy may be torn
+	Volatile bool         `json:"volatile,omitempty"` // A process had the file open for writing; Checksum is empty if it was skipped
+	Chunks   *ChunkHashes `json:"chunks,omitempty"`   // Set for files hashed in blocks because they are large
+	FileMetadata
+}
+
+// ChunkHashes are the sha256 checksums of each fixed-size block of a file, so
+// large copies can be compared by byte range instead of being diffed
+type ChunkHashes struct {
+	Size      int64    `json:"size"`       // File size in bytes
+	ChunkSize int64    `json:"chunk_size"` // Block size in bytes; the last block may be shorter
+	Hashes    []string `json:"hashes"`
+}
+
+// MissingOnRemote is the FileInfo.Error of a configured path that doesn't exist on the server
+const MissingOnRemote = "Missing on remote"
+
+// UnreadableUnprivileged is the FileInfo.Error of a file the SSH user couldn't
+// read on a server collected without privilege escalation
+const UnreadableUnprivileged = "Not readable without privileges"
+
+// CopyFailed starts the FileInfo.Error of a file the collection script found
+// but couldn't copy, followed by the reason cp or cpio gave
+const CopyFailed = "Copy failed on remote"
+
+// FileMetadata is a file's mode and ownership as found on the remote host.
+// Local copies are written with safe permissions instead, so these recorded
+// values are what metadata comparisons use.
+type FileMetadata struct {
+	Mode  string `json:"mode,omitempty"`  // Octal, e.g. "0640"
+	Owner string `json:"owner,omitempty"` // User name, or numeric ID when collected over SFTP
+	Group string `json:"group,omitempty"` // Group name, or numeric ID when collected over SFTP
+}
+
+// String formats the metadata like "0640 root:adm"
+func (md FileMetadata) String() string {
+	return fmt.Sprintf("%s %s:%s", md.Mode, md.Owner, md.Group)
 }
 
 // Manifest holds the checksums for all collected files from all servers
 type Manifest struct {
-	Mu            sync.RWMutex                   `json:"-"`               // Use exported field for cross-package access
-	FilesByServer map[string]map[string]FileInfo `json:"files_by_server"` // server -> relativePath -> FileInfo
+	Mu            sync.RWMutex                   `json:"-"`                        // Use exported field for cross-package access
+	SchemaVersion int                            `json:"schema_version,omitempty"` // ManifestVersion when written; absent before versioning
+	FilesByServer map[string]map[string]FileInfo `json:"files_by_server"`          // server -> relativePath -> FileInfo
+	// Servers whose files were read as the SSH user, skipping those it can't read
+	Unprivileged map[string]bool `json:"unprivileged,omitempty"`
+	Annotation   *RunAnnotation  `json:"annotation,omitempty"` // The note and labels the collection was made with
+	// server -> how its files were collected, script or sftp
+	Methods map[string]string `json:"methods,omitempty"`
+	// server -> why its collection failed, when saved with --allow-partial.
+	// These servers have no files and are left out of analyses.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// RunAnnotation ties a collection to something outside of it, such as the
+// deployment it verifies
+type RunAnnotation struct {
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Empty reports whether the annotation has neither a note nor labels
+func (a RunAnnotation) Empty() bool {
+	return a.Note == "" && len(a.Labels) == 0
+}
+
+// HasLabels reports whether the annotation has all the given labels
+func (a *RunAnnotation) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if a == nil || a.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the annotation like `post-deploy check [env=prod version=2.3.1]`
+func (a RunAnnotation) String() string {
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + a.Labels[k]
+	}
+	switch {
+	case len(pairs) == 0:
+		return a.Note
+	case a.Note == "":
+		return "[" + strings.Join(pairs, " ") + "]"
+	}
+	return a.Note + " [" + strings.Join(pairs, " ") + "]"
+}
+
+// ParseLabels turns key=value pairs into labels. Keys may not be empty or
+// contain spaces; a later pair replaces an earlier one with the same key.
+func ParseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("invalid label %q (expected key=value)", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// ManifestVersion is the SchemaVersion of the manifests this version writes.
+// Older manifests are migrated when they are loaded; newer ones are refused.
+const ManifestVersion = 1
+
+// manifestMigrations upgrade the JSON document of a manifest from the
+// version of their index to the next one, before it is decoded
+var manifestMigrations = []func(doc map[string]json.RawMessage) error{
+	// 0, before schema_version: the same layout, but nothing kept a server's
+	// files or the whole map from being written as null
+	func(doc map[string]json.RawMessage) error {
+		var files map[string]json.RawMessage
+		if raw := doc["files_by_server"]; len(raw) > 0 {
+			if err := json.Unmarshal(raw, &files); err != nil {
+				return err
+			}
+		}
+		if files == nil {
+			files = make(map[string]json.RawMessage)
+		}
+		for server, raw := range files {
+			if string(raw) == "null" {
+				files[server] = json.RawMessage("{}")
+			}
+		}
+		data, err := json.Marshal(files)
+		if err != nil {
+			return err
+		}
+		doc["files_by_server"] = data
+		return nil
+	},
 }
 
 func NewManifest() *Manifest {
 	return &Manifest{
+		SchemaVersion: ManifestVersion,
 		FilesByServer: make(map[string]map[string]FileInfo),
 	}
 }
 
+// migrateManifest brings the JSON document of a manifest up to
+// ManifestVersion. Only schema_version is looked at first, so a manifest of
+// a newer version is refused as such, not for the fields this version
+// doesn't know, and an older one is checked in its migrated form.
+func migrateManifest(manifestPath string, data []byte) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal manifest file %s", manifestPath)
+	}
+	version := 0 // Absent before versioning
+	if raw, ok := doc["schema_version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("manifest file %s has an invalid schema version %s", manifestPath, raw)
+		}
+	}
+	if version > ManifestVersion {
+		return nil, fmt.Errorf("manifest file %s has schema version %d, but this version of the tool only reads up to %d; upgrade it", manifestPath, version, ManifestVersion)
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("manifest file %s has an invalid schema version %d", manifestPath, version)
+	}
+	if version == ManifestVersion {
+		return data, nil
+	}
+	if doc == nil {
+		doc = make(map[string]json.RawMessage)
+	}
+	for v := version; v < ManifestVersion; v++ {
+		if err := manifestMigrations[v](doc); err != nil {
+			return nil, errors.Wrapf(err, "failed to migrate manifest file %s from schema version %d", manifestPath, v)
+		}
+	}
+	doc["schema_version"] = json.RawMessage(strconv.Itoa(ManifestVersion))
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to migrate manifest file %s", manifestPath)
+	}
+	log.Debugf("Migrated manifest %s from schema version %d to %d", manifestPath, version, ManifestVersion)
+	return migrated, nil
+}
+
 // AddFile adds or updates file info in the manifest safely.
 func (m *Manifest) AddFile(server, relativePath, checksum, fileError string) {
 	m.Mu.Lock()         // Use exported field Mu
@@ -69,6 +513,96 @@ func (m *Manifest) AddFile(server, relativePath, checksum, fileError string) {
 	}
 }
 
+// SetMetadata records the remote mode and ownership of a file already in the manifest.
+func (m *Manifest) SetMetadata(server, relativePath string, md FileMetadata) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	info, ok := m.FilesByServer[server][relativePath]
+	if !ok {
+		return
+	}
+	info.FileMetadata = md
+	m.FilesByServer[server][relativePath] = info
+}
+
+// MarkUnstable records that a file in the manifest changed while it was collected.
+func (m *Manifest) MarkUnstable(server, relativePath string) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	info, ok := m.FilesByServer[server][relativePath]
+	if !ok {
+		return
+	}
+	info.Unstable = true
+	m.FilesByServer[server][relativePath] = info
+}
+
+// SetChunks records the block checksums of a file already in the manifest.
+func (m *Manifest) SetChunks(server, relativePath string, chunks *ChunkHashes) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	info, ok := m.FilesByServer[server][relativePath]
+	if !ok {
+		return
+	}
+	info.Chunks = chunks
+	m.FilesByServer[server][relativePath] = info
+}
+
+// MarkVolatile records that a file in the manifest was open for writing on the remote.
+func (m *Manifest) MarkVolatile(server, relativePath string) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	info, ok := m.FilesByServer[server][relativePath]
+	if !ok {
+		return
+	}
+	info.Volatile = true
+	m.FilesByServer[server][relativePath] = info
+}
+
+// SetUnprivileged records that the files of server were read without
+// privilege escalation, so files the SSH user can't read are left out.
+func (m *Manifest) SetUnprivileged(server string) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	if m.Unprivileged == nil {
+		m.Unprivileged = make(map[string]bool)
+	}
+	m.Unprivileged[server] = true
+}
+
+// SetMethod records how the files of server were collected
+func (m *Manifest) SetMethod(server, method string) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	if m.Methods == nil {
+		m.Methods = make(map[string]string)
+	}
+	m.Methods[server] = method
+}
+
+// SetFailed records that the collection of server failed, dropping whatever
+// it had recorded, so the manifest can be saved with the other servers
+func (m *Manifest) SetFailed(server, reason string) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	if m.Failed == nil {
+		m.Failed = make(map[string]string)
+	}
+	m.Failed[server] = reason
+	delete(m.FilesByServer, server)
+	delete(m.Methods, server)
+	delete(m.Unprivileged, server)
+}
+
 // GetFileInfo retrieves file info safely.
 func (m *Manifest) GetFileInfo(server, relativePath string) (FileInfo, bool) {
 	m.Mu.RLock()         // Use exported field Mu
@@ -107,13 +641,43 @@ func (m *Manifest) Save(outputDir string) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal manifest")
 	}
-	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+	if err := manifestSchema.Validate(data); err != nil {
+		return errors.Wrap(err, "manifest")
+	}
+	if err := writeFileAtomic(manifestPath, data); err != nil {
 		return errors.Wrapf(err, "failed to write manifest file %s", manifestPath)
 	}
 	log.Infof("Manifest saved to %s", manifestPath)
 	return nil
 }
 
+// writeFileAtomic replaces path with data in one step: a crash leaves either
+// the old file or the new one, never a truncated one
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Flushed before the rename, or a power loss could still leave it empty
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // LoadManifest loads the manifest from disk from the correct subfolder.
 func LoadManifest(outputDir string) (*Manifest, error) {
 	manifestPath := getManifestPath(outputDir) // Use helper
@@ -126,16 +690,389 @@ func LoadManifest(outputDir string) (*Manifest, error) {
 		return nil, errors.Wrapf(err, "failed to read manifest file %s", manifestPath)
 	}
 
+	data, err = migrateManifest(manifestPath, data)
+	if err != nil {
+		return nil, err
+	}
 	var manifest Manifest
 	// Initialize map before unmarshaling into it
 	manifest.FilesByServer = make(map[string]map[string]FileInfo)
-	if err := json.Unmarshal(data, &manifest); err != nil {
+	if err := decodeJSON(manifestPath, data, &manifest); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal manifest file %s", manifestPath)
 	}
+	if err := manifestSchema.Validate(data); err != nil {
+		return nil, errors.Wrapf(err, "manifest file %s", manifestPath)
+	}
 	log.Infof("Manifest loaded from %s", manifestPath)
 	return &manifest, nil
 }
 
+// InvalidPath describes one rejected entry from the files/dirs lists
+type InvalidPath struct {
+	Kind   string // "file" or "dir"
+	Path   string
+	Reason string
+}
+
+// PathValidationError lists every invalid file/dir entry found in the config
+type PathValidationError struct {
+	Invalid []InvalidPath
+}
+
+func (e *PathValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d invalid path(s) in configuration:", len(e.Invalid)))
+	for _, p := range e.Invalid {
+		sb.WriteString(fmt.Sprintf("\n  - %s %q: %s", p.Kind, p.Path, p.Reason))
+	}
+	return sb.String()
+}
+
+// HomePrefix starts a remote path relative to the SSH user's home directory,
+// e.g. "~/.bashrc". Each server resolves it against its own user's home, and
+// the manifest records the file under this logical name, so dotfiles compare
+// across accounts. "$HOME/" and "${HOME}/" are accepted and stored as "~/".
+const HomePrefix = "~/"
+
+// IsHomePath reports whether a files/dirs entry is relative to the remote home
+func IsHomePath(p string) bool {
+	return strings.HasPrefix(p, HomePrefix)
+}
+
+// HasHomePaths reports whether any files/dirs entry is relative to the remote home
+func (c *Config) HasHomePaths() bool {
+	for _, p := range append(append([]string{}, c.Files...), c.Dirs...) {
+		if IsHomePath(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithHome returns a copy of the config whose "~/" entries are resolved
+// against home. The resolved entries are validated again, since one may now
+// duplicate or overlap an absolute entry.
+func (c *Config) WithHome(home string) (*Config, error) {
+	resolved := *c
+	resolve := func(entries []string) []string {
+		out := make([]string, len(entries))
+		for i, p := range entries {
+			if IsHomePath(p) {
+				p = path.Join(home, strings.TrimPrefix(p, HomePrefix))
+			}
+			out[i] = p
+		}
+		return out
+	}
+	resolved.Files = resolve(c.Files)
+	resolved.Dirs = resolve(c.Dirs)
+	resolved.Unprivileged = resolve(c.Unprivileged)
+	// Patterns written for a ~/ dir, e.g. from a paths entry
+	resolved.Exclude = resolve(c.Exclude)
+	resolved.Include = resolve(c.Include)
+	if err := normalizePaths(&resolved); err != nil {
+		return nil, errors.Wrapf(err, "with home directory %s", home)
+	}
+	return &resolved, nil
+}
+
+// A path on a Windows drive as given (C:\ProgramData or C:/ProgramData), and a drive's root once normalized (/C:)
+var (
+	windowsDrivePath = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+	windowsDriveRoot = regexp.MustCompile(`^/[A-Z]:$`)
+)
+
+// normalizePaths cleans cfg.Files and cfg.Dirs in place and checks that every
+// entry is absolute (or relative to the remote home) and that no entry is
+// duplicated or nested inside a listed directory. All problems are collected
+// into a single PathValidationError.
+func normalizePaths(cfg *Config) error {
+	var invalid []InvalidPath
+
+	// Remote paths are always POSIX, so use path rather than filepath here
+	clean := func(kind string, entries []string) []string {
+		cleaned := []string{}
+		for _, p := range entries {
+			trimmed := strings.TrimSpace(p)
+			for _, home := range []string{"$HOME/", "${HOME}/"} {
+				if strings.HasPrefix(trimmed, home) {
+					trimmed = HomePrefix + strings.TrimPrefix(trimmed, home)
+				}
+			}
+			if windowsDrivePath.MatchString(trimmed) {
+				// SFTP on Windows OpenSSH names C:\ProgramData as /C:/ProgramData
+				trimmed = "/" + strings.ToUpper(trimmed[:1]) + ":" + strings.ReplaceAll(trimmed[2:], `\`, "/")
+			}
+			switch {
+			case trimmed == "":
+				invalid = append(invalid, InvalidPath{Kind: kind, Path: p, Reason: "empty path"})
+				continue
+			case trimmed == "~" || trimmed == "$HOME" || trimmed == "${HOME}":
+				invalid = append(invalid, InvalidPath{Kind: kind, Path: p, Reason: "refusing to collect the whole home directory"})
+				continue
+			case !strings.HasPrefix(trimmed, "/") && !IsHomePath(trimmed):
+				invalid = append(invalid, InvalidPath{Kind: kind, Path: p, Reason: "path must be absolute or start with ~/"})
+				continue
+			case strings.ContainsAny(trimmed, "\x00\n"):
+				invalid = append(invalid, InvalidPath{Kind: kind, Path: p, Reason: "path contains control characters"})
+				continue
+			}
+			if IsHomePath(trimmed) {
+				// Cleaned as if the home were /, so ".." can't climb out of it
+				rest := path.Clean("/" + strings.TrimPrefix(trimmed, HomePrefix))
+				if rest == "/" {
+					invalid = append(invalid, InvalidPath{Kind: kind, Path: p, Reason: "refusing to collect the whole home directory"})
+					continue
+				}
+				cleaned = append(cleaned, "~"+rest)
+				continue
+			}
+			cleanedPath := path.Clean(trimmed)
+			if cleanedPath == "/" || windowsDriveRoot.MatchString(cleanedPath) {
+				invalid = append(invalid, InvalidPath{Kind: kind, Path: p, Reason: "refusing to collect the filesystem root"})
+				continue
+			}
+			cleaned = append(cleaned, cleanedPath)
+		}
+		return cleaned
+	}
+	files := clean("file", cfg.Files)
+	dirs := clean("dir", cfg.Dirs)
+
+	// Overlapping entries would be copied twice and show up twice in the manifest
+	seen := make(map[string]string) // path -> kind
+	for _, d := range dirs {
+		if kind, dup := seen[d]; dup {
+			invalid = append(invalid, InvalidPath{Kind: "dir", Path: d, Reason: fmt.Sprintf("duplicate of %s entry", kind)})
+			continue
+		}
+		seen[d] = "dir"
+	}
+	for _, f := range files {
+		if kind, dup := seen[f]; dup {
+			invalid = append(invalid, InvalidPath{Kind: "file", Path: f, Reason: fmt.Sprintf("duplicate of %s entry", kind)})
+			continue
+		}
+		seen[f] = "file"
+	}
+	for _, d := range dirs {
+		for _, other := range dirs {
+			if other != d && isWithin(d, other) {
+				invalid = append(invalid, InvalidPath{Kind: "dir", Path: d, Reason: fmt.Sprintf("nested inside dir %s", other)})
+				break
+			}
+		}
+	}
+	for _, f := range files {
+		for _, d := range dirs {
+			if isWithin(f, d) {
+				invalid = append(invalid, InvalidPath{Kind: "file", Path: f, Reason: fmt.Sprintf("already covered by dir %s", d)})
+				break
+			}
+		}
+	}
+
+	// Left over when --files or --dirs replace the saved paths
+	var unprivileged []string
+	for _, u := range clean("unprivileged", cfg.Unprivileged) {
+		if _, ok := seen[u]; !ok {
+			log.Warnf("Ignoring unprivileged entry %s: it is not a configured file or dir", u)
+			continue
+		}
+		unprivileged = appendMissing(unprivileged, []string{u})
+	}
+
+	if len(invalid) > 0 {
+		return &PathValidationError{Invalid: invalid}
+	}
+	cfg.Files = files
+	cfg.Dirs = dirs
+	cfg.Unprivileged = unprivileged
+	return nil
+}
+
+// IsUnprivileged reports whether the remote path p (absolute, or ~/ like
+// the entries) is read without privilege escalation: it is, or lies below, an
+// unprivileged entry
+func (c *Config) IsUnprivileged(p string) bool {
+	for _, u := range c.Unprivileged {
+		if p == u || isWithin(p, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsPrivileges reports whether any configured file or dir is read with
+// privilege escalation
+func (c *Config) NeedsPrivileges() bool {
+	for _, p := range append(append([]string{}, c.Files...), c.Dirs...) {
+		if !c.IsUnprivileged(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMissing appends the entries of add that list doesn't have yet
+func appendMissing(list, add []string) []string {
+	for _, a := range add {
+		found := false
+		for _, l := range list {
+			if l == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// isWithin reports whether p lies strictly below dir (both cleaned absolute or ~/ paths)
+func isWithin(p, dir string) bool {
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// JumpHosts resolves the jump_host chain of server, outermost first. A hop
+// naming a hosts entry or ~/.ssh/config alias (e.g. "bastion") uses its
+// settings; the username and key default to the server's own.
+func (c *Config) JumpHosts(server string) ([]ServerConfig, error) {
+	target := c.ServerSettings(server)
+	hops, err := ParseJumpHosts(target.JumpHost)
+	if err != nil {
+		return nil, err
+	}
+	for i, hop := range hops {
+		entry := c.hostEntry(hop.Hostname)
+		if entry.Hostname != "" {
+			hop.Hostname = entry.Hostname
+		}
+		if hop.Port == 0 {
+			hop.Port = entry.Port
+		}
+		if hop.Username == "" {
+			hop.Username = entry.Username
+		}
+		hop.KeyPath = entry.KeyPath
+		if hop.Port == 0 {
+			hop.Port = DefaultSSHPort
+		}
+		if hop.Username == "" {
+			hop.Username = target.Username
+		}
+		if hop.KeyPath == "" {
+			hop.KeyPath = target.KeyPath
+		}
+		hops[i] = hop
+	}
+	return hops, nil
+}
+
+// ParseJumpHosts splits a ProxyJump-style spec ("[user@]host[:port],...")
+// into hops. Only Hostname, Port and Username are set.
+func ParseJumpHosts(spec string) ([]ServerConfig, error) {
+	if strings.TrimSpace(spec) == "" || spec == "none" {
+		return nil, nil
+	}
+	var hops []ServerConfig
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		var hop ServerConfig
+		if user, rest, ok := strings.Cut(part, "@"); ok {
+			hop.Username, part = user, rest
+		}
+		hop.Hostname = part
+		if host, port, err := net.SplitHostPort(part); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid port %q in jump host %q", port, spec)
+			}
+			hop.Hostname, hop.Port = host, p
+		}
+		if hop.Hostname == "" {
+			return nil, fmt.Errorf("empty host in jump host %q", spec)
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// validateHosts checks the per-server overrides: every entry must name a
+// configured server or a jump host, use a valid port and have a parseable
+// jump_host. Key paths are kept as written; see ExpandHome.
+func validateHosts(cfg *Config) error {
+	known := make(map[string]bool, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		known[s] = true
+	}
+	var problems []string
+	for name, h := range cfg.Hosts {
+		hops, err := ParseJumpHosts(h.JumpHost)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("hosts entry %q: %v", name, err))
+		}
+		for _, hop := range hops {
+			known[hop.Hostname] = true
+		}
+	}
+	for name, h := range cfg.Hosts {
+		if !known[name] {
+			problems = append(problems, fmt.Sprintf("hosts entry %q does not match any server or jump host", name))
+		}
+		if h.Port < 0 || h.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("hosts entry %q has invalid port %d", name, h.Port))
+		}
+		if err := util.ValidateBecome(h.Become); err != nil {
+			problems = append(problems, fmt.Sprintf("hosts entry %q: %v", name, err))
+		}
+		if err := ValidateOS(h.OS); err != nil {
+			problems = append(problems, fmt.Sprintf("hosts entry %q: %v", name, err))
+		}
+		for key := range h.Env {
+			if !envNamePattern.MatchString(key) {
+				problems = append(problems, fmt.Sprintf("hosts entry %q has invalid environment variable name %q", name, key))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid hosts configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// envNamePattern matches names the shell accepts in an export statement
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// hostsProvideCredentials reports whether every server has its own username
+// and key path, in which case the SSH environment variables are optional
+func hostsProvideCredentials(cfg *Config) bool {
+	for _, s := range cfg.Servers {
+		h := cfg.hostEntry(s)
+		if h.Username == "" || h.KeyPath == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// ExpandHome replaces a leading ~ with the user's home directory. Key paths
+// keep their ~ in the config, so it stays usable by other users, and are
+// expanded when connecting.
+func ExpandHome(p string) (string, error) {
+	if !strings.HasPrefix(p, "~") {
+		return p, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return p, errors.Wrap(err, "failed to get user home directory to expand key path")
+	}
+	return filepath.Join(homeDir, p[1:]), nil
+}
+
 // GetSSHCredentialsFromEnv loads SSH details from environment variables
 func GetSSHCredentialsFromEnv() (SSHCredentials, error) {
 	creds := SSHCredentials{
@@ -159,11 +1096,11 @@ func GetSSHCredentialsFromEnv() (SSHCredentials, error) {
 
 	// Expand tilde ~ in key path
 	if strings.HasPrefix(creds.KeyPath, "~") {
-		homeDir, err := os.UserHomeDir()
+		expanded, err := ExpandHome(creds.KeyPath)
 		if err != nil {
-			return creds, errors.Wrap(err, "failed to get user home directory to expand key path")
+			return creds, err
 		}
-		creds.KeyPath = filepath.Join(homeDir, creds.KeyPath[1:])
+		creds.KeyPath = expanded
 	}
 
 	if _, err := os.Stat(creds.KeyPath); os.IsNotExist(err) {
@@ -173,67 +1110,203 @@ func GetSSHCredentialsFromEnv() (SSHCredentials, error) {
 	return creds, nil
 }
 
+// Overrides holds command line values that replace the saved config.
+// Servers, Files and Dirs are comma-separated; empty values keep the saved config.
+type Overrides struct {
+	Servers  string
+	Files    string
+	Dirs     string
+	Exclude  []string
+	Include  []string
+	Journals []string // In the --journal syntax
+	Presets  []string // Names of presets added to the config's presets
+	// Default SSH credentials used instead of SSHUSER, SSHKEYPATH and SSHKEYPIN
+	SSH *SSHCredentials
+}
+
 // LoadOrInitializeConfig loads config from file or initializes from args
-func LoadOrInitializeConfig(outputDir, serversStr, filesStr, dirsStr string, saveConfig bool) (*Config, error) {
+func LoadOrInitializeConfig(outputDir string, overrides Overrides, saveConfig bool) (*Config, error) {
+	return loadConfig(outputDir, overrides, saveConfig, true)
+}
+
+// LoadConfigForAnalysis loads an existing config without requiring SSH credentials,
+// since analysis only works on already collected (or imported) files
+func LoadConfigForAnalysis(outputDir string) (*Config, error) {
+	return loadConfig(outputDir, Overrides{}, false, false)
+}
+
+func loadConfig(outputDir string, overrides Overrides, saveConfig, needSSH bool) (*Config, error) {
 	configPath := getConfigPath(outputDir) // Use helper
 	cfg := &Config{}
 
-	if _, err := os.Stat(configPath); err == nil {
-		data, err := os.ReadFile(configPath)
+	sourcePath, err := findConfigFile(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	handWritten := sourcePath != "" && isHandWritten(sourcePath)
+	if sourcePath != "" {
+		data, err := os.ReadFile(sourcePath)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read existing config file %s", configPath)
+			return nil, errors.Wrapf(err, "failed to read existing config file %s", sourcePath)
 		}
-		if err := json.Unmarshal(data, cfg); err != nil {
-			log.Warnf("Failed to parse existing config file %s: %v. Proceeding with arguments.", configPath, err)
-			// Reset cfg to avoid partial data
-			cfg = &Config{}
-		} else {
-			log.Infof("Loaded existing configuration from %s", configPath)
+		decoded, err := decodeConfigFile(sourcePath, data)
+		var unknownErr *UnknownFieldError
+		switch {
+		case err == nil:
+			cfg = decoded
+			log.Infof("Loaded existing configuration from %s", sourcePath)
+		case errors.As(err, &unknownErr), handWritten:
+			// A misspelled key would otherwise silently drop part of the config
+			return nil, err
+		default:
+			log.Warnf("Failed to parse existing config file %s: %v. Proceeding with arguments.", sourcePath, err)
 		}
-	} else if !os.IsNotExist(err) {
-		return nil, errors.Wrapf(err, "failed to stat config file %s", configPath)
 	}
 
 	// Override or set from arguments if provided
-	if serversStr != "" {
-		cfg.Servers = strings.Split(serversStr, ",")
+	if overrides.Servers != "" {
+		cfg.Servers = strings.Split(overrides.Servers, ",")
+	}
+	if overrides.Files != "" {
+		cfg.Files = strings.Split(overrides.Files, ",")
+	}
+	if overrides.Dirs != "" {
+		cfg.Dirs = strings.Split(overrides.Dirs, ",")
+	}
+	if len(overrides.Exclude) > 0 {
+		cfg.Exclude = overrides.Exclude
 	}
-	if filesStr != "" {
-		cfg.Files = strings.Split(filesStr, ",")
+	if len(overrides.Include) > 0 {
+		cfg.Include = overrides.Include
+	}
+	if len(overrides.Journals) > 0 {
+		cfg.Journals = nil
+		for _, s := range overrides.Journals {
+			j, err := ParseJournalExcerpt(s)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Journals = append(cfg.Journals, j)
+		}
+	}
+
+	if err := expandGroups(cfg); err != nil {
+		return nil, err
 	}
-	if dirsStr != "" {
-		cfg.Dirs = strings.Split(dirsStr, ",")
+	applySSHDefaults(cfg)
+
+	cfg.Presets = appendMissing(cfg.Presets, overrides.Presets)
+	// The expanded presets are saved with the config, so analysis (possibly of
+	// an imported bundle, on a machine without the preset files) doesn't need
+	// them. A hand-written config is never saved, so it's expanded every time.
+	if needSSH || handWritten {
+		for _, name := range cfg.Presets {
+			p, err := preset.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			log.Infof("Adding preset %s (%s): %s", p.Name, p.Source, p.Description)
+			cfg.Files = appendMissing(cfg.Files, p.Files)
+			cfg.Dirs = appendMissing(cfg.Dirs, p.Dirs)
+			cfg.Exclude = appendMissing(cfg.Exclude, p.Exclude)
+			cfg.Include = appendMissing(cfg.Include, p.Include)
+			cfg.IgnoreLines = appendMissing(cfg.IgnoreLines, p.IgnoreLines)
+		}
 	}
 
 	// Basic validation
 	if len(cfg.Servers) == 0 {
 		return nil, fmt.Errorf("no servers specified (use --servers or ensure valid %s exists)", configPath)
 	}
-	if len(cfg.Files) == 0 && len(cfg.Dirs) == 0 {
-		return nil, fmt.Errorf("no files or directories specified (use --files/--dirs or ensure valid %s exists)", configPath)
+	if len(cfg.Files) == 0 && len(cfg.Dirs) == 0 && len(cfg.Journals) == 0 {
+		return nil, fmt.Errorf("no files, directories or journals specified (use --files/--dirs/--journal or ensure valid %s exists)", configPath)
+	}
+	seenUnits := make(map[string]bool)
+	for _, j := range cfg.Journals {
+		if err := j.validate(); err != nil {
+			return nil, err
+		}
+		if seenUnits[j.Unit] {
+			return nil, fmt.Errorf("journal unit %s is listed more than once", j.Unit)
+		}
+		seenUnits[j.Unit] = true
 	}
 
-	// Clean paths (remove trailing slashes from dirs for consistency)
-	cleanedDirs := []string{}
-	for _, d := range cfg.Dirs {
-		cleanedDirs = append(cleanedDirs, strings.TrimRight(d, "/"))
+	// Normalize paths and make sure the remote script gets something sensible
+	if err := normalizePaths(cfg); err != nil {
+		return nil, err
 	}
-	cfg.Dirs = cleanedDirs
 
-	// Load SSH creds (always from ENV)
-	sshConfig, err := GetSSHCredentialsFromEnv()
-	if err != nil {
+	if err := validateHosts(cfg); err != nil {
+		return nil, err
+	}
+	if err := pathfilter.Validate(cfg.Exclude); err != nil {
+		return nil, errors.Wrap(err, "invalid exclude pattern")
+	}
+	if err := pathfilter.Validate(cfg.Include); err != nil {
+		return nil, errors.Wrap(err, "invalid include pattern")
+	}
+	if _, err := cfg.UniquePatterns(); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.LinePatterns(); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.PathLinePatterns(); err != nil {
 		return nil, err
 	}
-	cfg.SSHConfig = sshConfig
+
+	// Load default SSH creds from ENV; they're optional when every server has its own
+	if needSSH && RequireSSHCredentials {
+		if SSHConfigPath != "" {
+			aliases, err := sshconfig.Load(SSHConfigPath)
+			if err != nil {
+				return nil, err
+			}
+			cfg.aliases = aliases
+		}
+		sshConfig, err := GetSSHCredentialsFromEnv()
+		if overrides.SSH != nil {
+			sshConfig, err = *overrides.SSH, nil
+		}
+		if err != nil {
+			if !hostsProvideCredentials(cfg) {
+				return nil, err
+			}
+			log.Debugf("Ignoring SSH environment (%v): every server has its own credentials", err)
+		}
+		cfg.SSHConfig = sshConfig
+	}
 
 	log.Infof("Using configuration:")
 	log.Infof("  Servers: %s", strings.Join(cfg.Servers, ", "))
+	for _, server := range cfg.Servers {
+		if h, ok := cfg.Hosts[server]; ok {
+			log.Debugf("  Host override for %s: %+v", server, h)
+		}
+	}
 	log.Infof("  Files: %s", strings.Join(cfg.Files, ", "))
 	log.Infof("  Directories: %s", strings.Join(cfg.Dirs, ", "))
+	if len(cfg.Exclude) > 0 {
+		log.Infof("  Exclude: %s", strings.Join(cfg.Exclude, ", "))
+	}
+	if len(cfg.Include) > 0 {
+		log.Infof("  Include: %s", strings.Join(cfg.Include, ", "))
+	}
+	for _, j := range cfg.Journals {
+		log.Infof("  Journal: %s", j)
+	}
+	if len(cfg.Retry) > 0 {
+		log.Infof("  Retry: %s", strings.Join(cfg.Retry, "; "))
+	}
+	if len(cfg.IgnoreLines) > 0 {
+		log.Infof("  Ignored line patterns: %s", strings.Join(cfg.IgnoreLines, ", "))
+	}
 
 	// Save the potentially updated config if requested (e.g., during collect/all)
-	if saveConfig {
+	if saveConfig && handWritten {
+		log.Infof("Not saving the configuration: %s is edited by hand, so command-line changes only apply to this run", sourcePath)
+	} else if saveConfig {
 		// Ensure the <outputDir>/conf directory exists before writing
 		configDir := filepath.Dir(configPath)
 		if err := os.MkdirAll(configDir, 0755); err != nil {
@@ -244,6 +1317,9 @@ func LoadOrInitializeConfig(outputDir, serversStr, filesStr, dirsStr string, sav
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to marshal config")
 		}
+		if err := configSchema.Validate(data); err != nil {
+			return nil, errors.Wrap(err, "config")
+		}
 		if err := os.WriteFile(configPath, data, 0644); err != nil {
 			return nil, errors.Wrapf(err, "failed to write config file %s", configPath)
 		}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadManifestVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string // Part of the error; empty if the manifest loads
+		servers int    // Servers with a non-nil file map once loaded
+	}{
+		{name: "current", data: `{"schema_version":1,"files_by_server":{"web1":{"etc/hosts":{"path":"etc/hosts","checksum":"x"}}}}`, servers: 1},
+		{name: "unversioned", data: `{"files_by_server":{"web1":{"etc/hosts":{"path":"etc/hosts","checksum":"x"}}}}`, servers: 1},
+		{name: "unversioned with null files", data: `{"files_by_server":{"web1":null,"web2":{}}}`, servers: 2},
+		{name: "unversioned with null map", data: `{"files_by_server":null}`},
+		{name: "unversioned without map", data: `{}`},
+		{name: "newer", data: `{"schema_version":2,"files_by_server":{}}`, wantErr: "upgrade it"},
+		{name: "newer with unknown fields", data: `{"schema_version":9,"files":[],"servers":{}}`, wantErr: "upgrade it"},
+		{name: "negative", data: `{"schema_version":-1,"files_by_server":{}}`, wantErr: "invalid schema version"},
+		{name: "not a number", data: `{"schema_version":"1","files_by_server":{}}`, wantErr: "invalid schema version"},
+		{name: "unknown field", data: `{"schema_version":1,"files_by_server":{},"extra":true}`, wantErr: "extra"},
+		{name: "unversioned with unknown field", data: `{"files_by_server":null,"extra":true}`, wantErr: "extra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := getManifestPath(dir)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m, err := LoadManifest(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadManifest() error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadManifest() error = %v", err)
+			}
+			if m.SchemaVersion != ManifestVersion {
+				t.Errorf("schema version %d, want %d", m.SchemaVersion, ManifestVersion)
+			}
+			if m.FilesByServer == nil {
+				t.Fatal("nil files_by_server")
+			}
+			servers := 0
+			for server, files := range m.FilesByServer {
+				if files == nil {
+					t.Errorf("%s has a nil file map", server)
+					continue
+				}
+				servers++
+			}
+			if servers != tt.servers {
+				t.Errorf("%d servers, want %d", servers, tt.servers)
+			}
+		})
+	}
+}
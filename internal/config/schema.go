@@ -0,0 +1,364 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Hand-written config files, looked up in <outputDir>/conf before
+// ConfigFileName. They are never overwritten.
+const (
+	YAMLConfigFileName = "config.yaml"
+	TOMLConfigFileName = "config.toml"
+)
+
+// configFileNames are the config files in the order they are looked for
+var configFileNames = []string{YAMLConfigFileName, "config.yml", TOMLConfigFileName, ConfigFileName}
+
+// GroupPrefix marks a servers entry as the name of a group
+const GroupPrefix = "@"
+
+// Path types of a paths entry
+const (
+	PathTypeFile = "file"
+	PathTypeDir  = "dir"
+)
+
+// fileConfig is the schema shared by config.yaml, config.toml and
+// config.json. It extends the Config that config.json is saved as with
+// settings that are resolved into plain Config fields when loading.
+type fileConfig struct {
+	Servers         []string                `json:"servers" yaml:"servers" toml:"servers"`
+	Groups          map[string][]string     `json:"groups" yaml:"groups" toml:"groups"`
+	SSH             ServerConfig            `json:"ssh" yaml:"ssh" toml:"ssh"` // Defaults for every server, below its hosts entry
+	Hosts           map[string]ServerConfig `json:"hosts" yaml:"hosts" toml:"hosts"`
+	Files           []string                `json:"files" yaml:"files" toml:"files"`
+	Dirs            []string                `json:"dirs" yaml:"dirs" toml:"dirs"`
+	Paths           []pathOptions           `json:"paths" yaml:"paths" toml:"paths"`
+	Exclude         []string                `json:"exclude" yaml:"exclude" toml:"exclude"`
+	Include         []string                `json:"include" yaml:"include" toml:"include"`
+	IgnoreLines     []string                `json:"ignore_lines" yaml:"ignore_lines" toml:"ignore_lines"`
+	Ignore          ignoreOptions           `json:"ignore" yaml:"ignore" toml:"ignore"`
+	PathIgnoreLines map[string][]string     `json:"path_ignore_lines" yaml:"path_ignore_lines" toml:"path_ignore_lines"`
+	Normalize       map[string][]string     `json:"normalize" yaml:"normalize" toml:"normalize"`
+	Journals        []JournalExcerpt        `json:"journals" yaml:"journals" toml:"journals"`
+	Retry           []string                `json:"retry" yaml:"retry" toml:"retry"`
+	Presets         []string                `json:"presets" yaml:"presets" toml:"presets"`
+	Unprivileged    []string                `json:"unprivileged" yaml:"unprivileged" toml:"unprivileged"`
+	Unique          []string                `json:"unique" yaml:"unique" toml:"unique"`
+}
+
+// pathOptions is a file or dir with settings that only apply to it
+type pathOptions struct {
+	Path        string   `json:"path" yaml:"path" toml:"path"`
+	Type        string   `json:"type" yaml:"type" toml:"type"`                         // PathTypeFile (the default) or PathTypeDir
+	Exclude     []string `json:"exclude" yaml:"exclude" toml:"exclude"`                // Globs relative to the dir
+	IgnoreLines []string `json:"ignore_lines" yaml:"ignore_lines" toml:"ignore_lines"` // Only applied to this path
+	Normalize   []string `json:"normalize" yaml:"normalize" toml:"normalize"`          // Normalization rules for this path
+	// Read as the SSH user: the path doesn't need sudo (or doas)
+	Unprivileged bool `json:"unprivileged" yaml:"unprivileged" toml:"unprivileged"`
+	// Expected to differ between servers: collected, but never counted as drift
+	Unique bool `json:"unique" yaml:"unique" toml:"unique"`
+}
+
+// ignoreOptions groups the noise rules; they add to exclude and ignore_lines
+type ignoreOptions struct {
+	Paths []string `json:"paths" yaml:"paths" toml:"paths"`
+	Lines []string `json:"lines" yaml:"lines" toml:"lines"`
+}
+
+// findConfigFile returns the config file of outputDir, or "" if there is none
+func findConfigFile(outputDir string) (string, error) {
+	found := ""
+	for _, name := range configFileNames {
+		p := filepath.Join(outputDir, ConfigDir, name)
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", errors.Wrapf(err, "failed to stat config file %s", p)
+		}
+		if found == "" {
+			found = p
+		} else if name != ConfigFileName {
+			// config.json next to a hand-written config is just the last saved state
+			log.Warnf("Ignoring %s: %s takes precedence", p, found)
+		}
+	}
+	return found, nil
+}
+
+// CopyConfig copies the config file of fromDir, if there is one, to toDir, so
+// a new output directory starts from the same settings. It reports whether a
+// file was copied.
+func CopyConfig(fromDir, toDir string) (bool, error) {
+	src, err := findConfigFile(fromDir)
+	if err != nil || src == "" {
+		return false, err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read config file %s", src)
+	}
+	dst := filepath.Join(toDir, ConfigDir, filepath.Base(src))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, errors.Wrapf(err, "failed to create config directory for %s", dst)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return false, errors.Wrapf(err, "failed to write config file %s", dst)
+	}
+	return true, nil
+}
+
+// isHandWritten reports whether a config file is YAML or TOML, which are
+// read but never saved
+func isHandWritten(configPath string) bool {
+	return filepath.Base(configPath) != ConfigFileName
+}
+
+// decodeConfigFile parses a config file in the format its extension names
+func decodeConfigFile(configPath string, data []byte) (*Config, error) {
+	var fc fileConfig
+	switch filepath.Ext(configPath) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(StrictDecoding)
+		if err := dec.Decode(&fc); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "failed to parse %s", configPath)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), &fc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", configPath)
+		}
+		if undecoded := md.Undecoded(); StrictDecoding && len(undecoded) > 0 {
+			return nil, &UnknownFieldError{File: configPath, Field: undecoded[0].String()}
+		}
+	default:
+		if err := decodeJSON(configPath, data, &fc); err != nil {
+			return nil, err
+		}
+		if err := configSchema.Validate(data); err != nil {
+			return nil, errors.Wrapf(err, "config file %s", configPath)
+		}
+	}
+	return fc.toConfig()
+}
+
+// toConfig resolves the schema's extras into plain Config fields: paths into
+// files, dirs, exclude and path_ignore_lines, and ignore into exclude and
+// ignore_lines
+func (fc *fileConfig) toConfig() (*Config, error) {
+	if fc.SSH.Hostname != "" {
+		// As a default it would send every server to the same host
+		return nil, fmt.Errorf("ssh can't set a hostname; set it per server under hosts")
+	}
+	if err := util.ValidateBecome(fc.SSH.Become); err != nil {
+		return nil, fmt.Errorf("ssh: %v", err)
+	}
+	if err := ValidateOS(fc.SSH.OS); err != nil {
+		return nil, fmt.Errorf("ssh: %v", err)
+	}
+	cfg := &Config{
+		Servers:         fc.Servers,
+		Groups:          fc.Groups,
+		Hosts:           fc.Hosts,
+		Files:           fc.Files,
+		Dirs:            fc.Dirs,
+		Exclude:         appendMissing(fc.Exclude, fc.Ignore.Paths),
+		Include:         fc.Include,
+		IgnoreLines:     appendMissing(fc.IgnoreLines, fc.Ignore.Lines),
+		PathIgnoreLines: fc.PathIgnoreLines,
+		Normalize:       fc.Normalize,
+		Journals:        fc.Journals,
+		Retry:           fc.Retry,
+		Presets:         fc.Presets,
+		Unprivileged:    fc.Unprivileged,
+		Unique:          fc.Unique,
+		defaults:        fc.SSH,
+	}
+	for _, p := range fc.Paths {
+		entry := strings.TrimSpace(p.Path)
+		if entry == "" {
+			return nil, fmt.Errorf("paths entry without a path")
+		}
+		switch p.Type {
+		case PathTypeFile, "":
+			if len(p.Exclude) > 0 {
+				return nil, fmt.Errorf("paths entry %s: exclude only applies to dirs (add type: %s)", entry, PathTypeDir)
+			}
+			cfg.Files = append(cfg.Files, entry)
+		case PathTypeDir:
+			cfg.Dirs = append(cfg.Dirs, entry)
+			for _, pattern := range p.Exclude {
+				anchored, err := anchorPattern(path.Clean(entry), pattern)
+				if err != nil {
+					return nil, errors.Wrapf(err, "paths entry %s", entry)
+				}
+				cfg.Exclude = appendMissing(cfg.Exclude, []string{anchored})
+			}
+		default:
+			return nil, fmt.Errorf("paths entry %s: unknown type %q (use %s or %s)", entry, p.Type, PathTypeFile, PathTypeDir)
+		}
+		if len(p.IgnoreLines) > 0 {
+			if cfg.PathIgnoreLines == nil {
+				cfg.PathIgnoreLines = make(map[string][]string)
+			}
+			key := path.Clean(entry)
+			cfg.PathIgnoreLines[key] = appendMissing(cfg.PathIgnoreLines[key], p.IgnoreLines)
+		}
+		if len(p.Normalize) > 0 {
+			if cfg.Normalize == nil {
+				cfg.Normalize = make(map[string][]string)
+			}
+			key := path.Clean(entry)
+			cfg.Normalize[key] = appendMissing(cfg.Normalize[key], p.Normalize)
+		}
+		if p.Unprivileged {
+			cfg.Unprivileged = appendMissing(cfg.Unprivileged, []string{entry})
+		}
+		if p.Unique {
+			cfg.Unique = appendMissing(cfg.Unique, []string{path.Clean(entry)})
+		}
+	}
+	return cfg, nil
+}
+
+// anchorPattern turns a glob relative to dir into an exclude pattern that
+// only matches below dir. A glob without a slash matches base names at any
+// depth, as it would in exclude.
+func anchorPattern(dir, pattern string) (string, error) {
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		return "", fmt.Errorf("exclude pattern %q: per-path patterns are globs; put regexes in the top-level exclude", pattern)
+	case strings.HasPrefix(pattern, "/"):
+		return "", fmt.Errorf("exclude pattern %q must be relative to the dir", pattern)
+	case strings.Contains(pattern, "/"):
+		return dir + "/" + pattern, nil
+	default:
+		return dir + "/**/" + pattern, nil
+	}
+}
+
+// expandGroups replaces @group entries of cfg.Servers with the group's
+// servers. Without servers, every server of every group is used.
+func expandGroups(cfg *Config) error {
+	for name, members := range cfg.Groups {
+		for _, m := range members {
+			if strings.HasPrefix(m, GroupPrefix) {
+				return fmt.Errorf("group %s: groups can't contain groups (%s)", name, m)
+			}
+		}
+	}
+	entries := cfg.Servers
+	if len(entries) == 0 {
+		names := make([]string, 0, len(cfg.Groups))
+		for name := range cfg.Groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entries = append(entries, GroupPrefix+name)
+		}
+	}
+
+	var servers []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.HasPrefix(entry, GroupPrefix) {
+			servers = appendMissing(servers, []string{entry})
+			continue
+		}
+		members, ok := cfg.Groups[strings.TrimPrefix(entry, GroupPrefix)]
+		if !ok {
+			return fmt.Errorf("unknown server group %s", entry)
+		}
+		servers = appendMissing(servers, members)
+	}
+	cfg.Servers = servers
+	return nil
+}
+
+// applySSHDefaults fills the empty connection settings of every server from
+// the config file's ssh section, so they are saved with the config
+func applySSHDefaults(cfg *Config) {
+	d := cfg.defaults
+	if d.Port == 0 && d.Username == "" && d.KeyPath == "" && d.JumpHost == "" && d.Become == "" && d.OS == "" && len(d.Env) == 0 {
+		return
+	}
+	if cfg.Hosts == nil {
+		cfg.Hosts = make(map[string]ServerConfig)
+	}
+	for _, server := range cfg.Servers {
+		h := cfg.Hosts[server]
+		if h.Port == 0 {
+			h.Port = d.Port
+		}
+		if h.Username == "" {
+			h.Username = d.Username
+		}
+		if h.KeyPath == "" {
+			h.KeyPath = d.KeyPath
+		}
+		if h.JumpHost == "" {
+			h.JumpHost = d.JumpHost
+		}
+		if h.Become == "" {
+			h.Become = d.Become
+		}
+		if h.OS == "" {
+			h.OS = d.OS
+		}
+		for k, v := range d.Env {
+			if _, ok := h.Env[k]; !ok {
+				if h.Env == nil {
+					h.Env = make(map[string]string)
+				}
+				h.Env[k] = v
+			}
+		}
+		cfg.Hosts[server] = h
+	}
+}
+
+var (
+	configSchema = jsonschema.For(fileConfig{}, jsonschema.Options{
+		Name:        "config",
+		Title:       "Configuration",
+		Description: "conf/config.json: the servers to collect from and the files, dirs and rules to compare (config.yaml and config.toml take the same keys)",
+		Enums: map[string][]string{
+			"ServerConfig.os":     {"", OSLinux, OSWindows},
+			"ServerConfig.become": {"", util.BecomeSudo, util.BecomeDoas, util.BecomeNone},
+			"pathOptions.type":    {"", PathTypeFile, PathTypeDir},
+		},
+		Optional: true, // Written by hand, too
+	})
+	manifestSchema = jsonschema.For(Manifest{}, jsonschema.Options{
+		Name:        "manifest",
+		Title:       "Collection manifest",
+		Description: "collected-files/manifest.json: each server's collected files with their checksums, metadata and errors",
+	})
+)
+
+// ConfigSchema returns the JSON Schema of config.json
+func ConfigSchema() *jsonschema.Schema {
+	return configSchema
+}
+
+// ManifestSchema returns the JSON Schema of manifest.json
+func ManifestSchema() *jsonschema.Schema {
+	return manifestSchema
+}
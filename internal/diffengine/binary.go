@@ -0,0 +1,38 @@
+package diffengine
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sniffLen is how much of a file IsBinaryFile looks at, as much as git does
+const sniffLen = 8000
+
+// IsBinary reports whether the start of a file holds binary content: a null
+// byte, or anything MIME sniffing doesn't take for text
+func IsBinary(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return true
+	}
+	return !strings.HasPrefix(http.DetectContentType(head), "text/")
+}
+
+// IsBinaryFile applies IsBinary to the start of a file
+func IsBinaryFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return IsBinary(head[:n]), nil
+}
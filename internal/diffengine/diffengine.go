@@ -0,0 +1,337 @@
+package diffengine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultContext matches the number of context lines used by `diff -u`
+const DefaultContext = 3
+
+// OpKind identifies what happened to a line between the two inputs
+type OpKind int
+
+const (
+	Equal OpKind = iota
+	Delete
+	Insert
+)
+
+// Line is a single line of a hunk. Text keeps its trailing newline (if any) so
+// that "foo" and "foo\n" compare as different lines, exactly like diff(1).
+type Line struct {
+	Kind OpKind
+	Text string
+}
+
+// Hunk is one "@@ -a,b +c,d @@" block of a unified diff.
+// Start values are 1-based; a zero-length side uses the line before the change.
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []Line
+}
+
+// Header renders the "@@ ... @@" line the same way GNU diff does
+func (h Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.OldStart, h.OldLines), hunkRange(h.NewStart, h.NewLines))
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// SplitLines splits content into lines, keeping the "\n" terminator on each line
+func SplitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1] // Content ended with a newline
+	}
+	return lines
+}
+
+// ComputeHunks diffs a and b line by line and groups the changes into hunks
+// with the given number of context lines. No hunks means the inputs are identical.
+func ComputeHunks(a, b []string, context int) []Hunk {
+	edits := diff(a, b)
+
+	// Locate change runs and merge the ones whose context would overlap
+	var hunks []Hunk
+	i := 0
+	for i < len(edits) {
+		if edits[i].kind == Equal {
+			i++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(edits) {
+			if edits[end].kind != Equal {
+				end++
+				continue
+			}
+			// Count the run of equal lines; stop if it's long enough to split hunks
+			run := 0
+			for end+run < len(edits) && edits[end+run].kind == Equal {
+				run++
+			}
+			if end+run == len(edits) || run > 2*context {
+				if run > context {
+					run = context
+				}
+				end += run
+				break
+			}
+			end += run
+		}
+
+		hunks = append(hunks, buildHunk(edits[start:end], a, b))
+		i = end
+	}
+	return hunks
+}
+
+func buildHunk(edits []edit, a, b []string) Hunk {
+	h := Hunk{}
+	oldStart, newStart := -1, -1
+	for _, e := range edits {
+		switch e.kind {
+		case Equal:
+			if oldStart < 0 {
+				oldStart = e.a
+			}
+			if newStart < 0 {
+				newStart = e.b
+			}
+			h.OldLines++
+			h.NewLines++
+			h.Lines = append(h.Lines, Line{Kind: Equal, Text: a[e.a]})
+		case Delete:
+			if oldStart < 0 {
+				oldStart = e.a
+			}
+			h.OldLines++
+			h.Lines = append(h.Lines, Line{Kind: Delete, Text: a[e.a]})
+		case Insert:
+			if newStart < 0 {
+				newStart = e.b
+			}
+			h.NewLines++
+			h.Lines = append(h.Lines, Line{Kind: Insert, Text: b[e.b]})
+		}
+	}
+
+	// An empty side points at the line preceding the change, like diff(1)
+	if h.OldLines == 0 {
+		h.OldStart = precedingLine(edits, true)
+	} else {
+		h.OldStart = oldStart + 1
+	}
+	if h.NewLines == 0 {
+		h.NewStart = precedingLine(edits, false)
+	} else {
+		h.NewStart = newStart + 1
+	}
+	return h
+}
+
+// precedingLine returns the 1-based line number just before the hunk on one side
+// (0 when the hunk is at the top of the file)
+func precedingLine(edits []edit, old bool) int {
+	for _, e := range edits {
+		if old && e.kind == Insert {
+			return e.a
+		}
+		if !old && e.kind == Delete {
+			return e.b
+		}
+	}
+	return 0
+}
+
+// FormatUnified renders hunks in unified format, including the file header lines.
+// Returns "" when there are no hunks.
+func FormatUnified(fromLabel, toLabel string, hunks []Hunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("--- " + fromLabel + "\n")
+	sb.WriteString("+++ " + toLabel + "\n")
+	for _, h := range hunks {
+		sb.WriteString(h.Header() + "\n")
+		for _, l := range h.Lines {
+			switch l.Kind {
+			case Equal:
+				sb.WriteByte(' ')
+			case Delete:
+				sb.WriteByte('-')
+			case Insert:
+				sb.WriteByte('+')
+			}
+			sb.WriteString(l.Text)
+			if !strings.HasSuffix(l.Text, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// fileLabel builds the "path<TAB>timestamp" label used in `diff -u` headers
+func fileLabel(path string, modTime time.Time) string {
+	return path + "\t" + modTime.Format("2006-01-02 15:04:05.000000000 -0700")
+}
+
+// UnifiedFiles diffs two local files and returns `diff -u` compatible output.
+// The bool result reports whether the files differ.
+func UnifiedFiles(path1, path2 string) (string, bool, error) {
+	content1, stat1, err := readFile(path1)
+	if err != nil {
+		return "", false, err
+	}
+	content2, stat2, err := readFile(path2)
+	if err != nil {
+		return "", false, err
+	}
+	if content1 == content2 {
+		return "", false, nil
+	}
+
+	hunks := ComputeHunks(SplitLines(content1), SplitLines(content2), DefaultContext)
+	out := FormatUnified(fileLabel(path1, stat1.ModTime()), fileLabel(path2, stat2.ModTime()), hunks)
+	return out, true, nil
+}
+
+// UnifiedStrings diffs two contents in memory, e.g. normalized copies of
+// files, and returns `diff -u` compatible output with the given labels, or ""
+// if they are the same.
+func UnifiedStrings(fromLabel, toLabel, a, b string) string {
+	if a == b {
+		return ""
+	}
+	return FormatUnified(fromLabel, toLabel, ComputeHunks(SplitLines(a), SplitLines(b), DefaultContext))
+}
+
+func readFile(path string) (string, os.FileInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to stat %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return string(data), stat, nil
+}
+
+// FilterHunks drops the hunks whose changed lines all satisfy ignore, so
+// changes made only of ignorable lines (e.g. "# Generated on ..." stamps) don't
+// count. A hunk that also changes other lines is kept whole. Line text is
+// passed to ignore without its trailing newline.
+func FilterHunks(hunks []Hunk, ignore func(line string) bool) []Hunk {
+	var kept []Hunk
+	for _, h := range hunks {
+		for _, l := range h.Lines {
+			if l.Kind != Equal && !ignore(strings.TrimSuffix(l.Text, "\n")) {
+				kept = append(kept, h)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// HeaderLabels returns the file labels from the "---" and "+++" lines of unified diff text
+func HeaderLabels(text string) (string, string) {
+	var from, to string
+	for _, raw := range SplitLines(text) {
+		line := strings.TrimSuffix(raw, "\n")
+		switch {
+		case strings.HasPrefix(line, "--- ") && from == "":
+			from = strings.TrimPrefix(line, "--- ")
+		case strings.HasPrefix(line, "+++ ") && to == "":
+			to = strings.TrimPrefix(line, "+++ ")
+		case strings.HasPrefix(line, "@@ "):
+			return from, to
+		}
+	}
+	return from, to
+}
+
+// ParseUnified parses `diff -u` output back into hunks. It is used to get
+// structured hunks out of the external diff engine; file header lines are skipped.
+func ParseUnified(text string) ([]Hunk, error) {
+	var hunks []Hunk
+	var current *Hunk
+	for _, raw := range SplitLines(text) {
+		switch {
+		case strings.HasPrefix(raw, "@@ "):
+			h := Hunk{}
+			if err := parseHunkHeader(strings.TrimRight(raw, "\n"), &h); err != nil {
+				return nil, err
+			}
+			hunks = append(hunks, h)
+			current = &hunks[len(hunks)-1]
+		case current == nil:
+			continue // "---"/"+++" header lines before the first hunk
+		case strings.HasPrefix(raw, "\\"):
+			// "\ No newline at end of file" applies to the previous line
+			if n := len(current.Lines); n > 0 {
+				current.Lines[n-1].Text = strings.TrimSuffix(current.Lines[n-1].Text, "\n")
+			}
+		case strings.HasPrefix(raw, " "):
+			current.Lines = append(current.Lines, Line{Kind: Equal, Text: raw[1:]})
+		case strings.HasPrefix(raw, "-"):
+			current.Lines = append(current.Lines, Line{Kind: Delete, Text: raw[1:]})
+		case strings.HasPrefix(raw, "+"):
+			current.Lines = append(current.Lines, Line{Kind: Insert, Text: raw[1:]})
+		}
+	}
+	return hunks, nil
+}
+
+func parseHunkHeader(header string, h *Hunk) error {
+	var oldRange, newRange string
+	if _, err := fmt.Sscanf(header, "@@ -%s +%s @@", &oldRange, &newRange); err != nil {
+		return errors.Wrapf(err, "malformed hunk header %q", header)
+	}
+	var err error
+	if h.OldStart, h.OldLines, err = parseRange(oldRange); err != nil {
+		return errors.Wrapf(err, "malformed hunk header %q", header)
+	}
+	if h.NewStart, h.NewLines, err = parseRange(newRange); err != nil {
+		return errors.Wrapf(err, "malformed hunk header %q", header)
+	}
+	return nil
+}
+
+func parseRange(r string) (int, int, error) {
+	start, count := 0, 1
+	if i := strings.IndexByte(r, ','); i >= 0 {
+		if _, err := fmt.Sscanf(r[i+1:], "%d", &count); err != nil {
+			return 0, 0, err
+		}
+		r = r[:i]
+	}
+	if _, err := fmt.Sscanf(r, "%d", &start); err != nil {
+		return 0, 0, err
+	}
+	return start, count, nil
+}
@@ -0,0 +1,62 @@
+package diffengine
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// FormatDifferences reports how a and b differ if they hold the same text
+// and only differ in line endings, a trailing newline or a UTF-8 byte order
+// mark. Each entry describes one kind, from a's side to b's, e.g.
+// "line endings: CRLF vs LF". It returns nil if the contents are identical or
+// also differ otherwise.
+func FormatDifferences(a, b []byte) []string {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	na, nb := normalizeFormat(a), normalizeFormat(b)
+	if !bytes.Equal(na, nb) {
+		return nil
+	}
+
+	var kinds []string
+	if hasA, hasB := bytes.HasPrefix(a, utf8BOM), bytes.HasPrefix(b, utf8BOM); hasA != hasB {
+		kinds = append(kinds, fmt.Sprintf("byte order mark: %s vs %s", presence(hasA), presence(hasB)))
+	}
+	if crlfA, crlfB := bytes.Contains(a, []byte("\r\n")), bytes.Contains(b, []byte("\r\n")); crlfA != crlfB {
+		kinds = append(kinds, fmt.Sprintf("line endings: %s vs %s", lineEnding(crlfA), lineEnding(crlfB)))
+	} else if crlfA && bytes.Count(a, []byte("\r\n")) != bytes.Count(b, []byte("\r\n")) {
+		kinds = append(kinds, "line endings: mixed CRLF and LF")
+	}
+	if nlA, nlB := endsWithNewline(a), endsWithNewline(b); nlA != nlB {
+		kinds = append(kinds, fmt.Sprintf("trailing newline: %s vs %s", presence(nlA), presence(nlB)))
+	}
+	return kinds
+}
+
+// normalizeFormat drops a leading byte order mark and a trailing newline, and turns CRLF into LF
+func normalizeFormat(content []byte) []byte {
+	content = bytes.TrimPrefix(content, utf8BOM)
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.TrimSuffix(content, []byte("\n"))
+}
+
+func endsWithNewline(content []byte) bool {
+	return bytes.HasSuffix(content, []byte("\n"))
+}
+
+func presence(present bool) string {
+	if present {
+		return "present"
+	}
+	return "missing"
+}
+
+func lineEnding(crlf bool) string {
+	if crlf {
+		return "CRLF"
+	}
+	return "LF"
+}
@@ -0,0 +1,456 @@
+package diffengine
+
+import "math"
+
+// edit is one step of the edit script
+type edit struct {
+	kind OpKind
+	a, b int // Position in a and b; for Insert/Delete the untouched side is the insertion point
+}
+
+// diff computes a shortest edit script between a and b. It follows GNU diff's
+// analyze.c closely (horizon lines, discarding confusing lines, middle-snake
+// search, boundary shifting) so that ties between equally short scripts are
+// broken the same way and the unified output matches `diff -u`; the tests
+// check this against diff itself. Unlike diff, it never settles for a longer
+// script to save time on large, very different inputs.
+func diff(a, b []string) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	// Like GNU diff (find_identical_ends), keep a few lines of the common ends
+	// in play ("horizon lines"): they take part in the line statistics used
+	// to discard confusing lines, and boundary shifting may move changes into
+	// them but no further. The suffix is searched after the horizon is taken
+	// off the prefix, so the two may overlap.
+	lo := prefix - DefaultContext
+	if lo < 0 {
+		lo = 0
+	}
+	suffix := 0
+	for suffix < len(a)-lo && suffix < len(b)-lo && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	hi := suffix - DefaultContext
+	if hi < 0 {
+		hi = 0
+	}
+
+	// Index 0 and len+1 of the lines in play are sentinels so boundary
+	// shifting never has to bounds-check; they are lines of the common ends,
+	// or past the ends, so never changed
+	changedA := make([]bool, len(a)+2)
+	changedB := make([]bool, len(b)+2)
+	endA, endB := len(a)-hi, len(b)-hi
+	markChanges(a[lo:endA], b[lo:endB], changedA[lo+1:], changedB[lo+1:])
+	shiftBoundaries(a[lo:endA], changedA[lo:endA+2], changedB[lo:endB+2])
+	shiftBoundaries(b[lo:endB], changedB[lo:endB+2], changedA[lo:endA+2])
+
+	// Rebuild the script; within a changed block deletions come first, like diff(1)
+	edits := make([]edit, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && changedA[i+1]:
+			edits = append(edits, edit{kind: Delete, a: i, b: j})
+			i++
+		case j < len(b) && changedB[j+1]:
+			edits = append(edits, edit{kind: Insert, a: i, b: j})
+			j++
+		default:
+			edits = append(edits, edit{kind: Equal, a: i, b: j})
+			i++
+			j++
+		}
+	}
+	return edits
+}
+
+// markChanges sets changedA[i]/changedB[j] for every line of a/b that is not part
+// of the longest common subsequence
+func markChanges(a, b []string, changedA, changedB []bool) {
+	// Compare integer equivalence classes instead of strings
+	ids := make(map[string]int)
+	classify := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	equivsA, equivsB := classify(a), classify(b)
+	countA := make([]int, len(ids))
+	countB := make([]int, len(ids))
+	for _, id := range equivsA {
+		countA[id]++
+	}
+	for _, id := range equivsB {
+		countB[id]++
+	}
+
+	// Lines that can't match anything in the other file are changed outright and
+	// kept out of the search, which both speeds it up and steers tie-breaking
+	keptA, realA := discardConfusingLines(equivsA, countB, changedA)
+	keptB, realB := discardConfusingLines(equivsB, countA, changedB)
+
+	s := &snakeSearch{a: keptA, b: keptB}
+	size := len(keptA) + len(keptB) + 3
+	s.fd = make([]int, size)
+	s.bd = make([]int, size)
+	s.off = len(keptB) + 1
+	s.compare(0, len(keptA), 0, len(keptB))
+
+	for _, i := range s.deleted {
+		changedA[realA[i]] = true
+	}
+	for _, j := range s.inserted {
+		changedB[realB[j]] = true
+	}
+}
+
+// discardConfusingLines is a port of the function of the same name in GNU
+// diffutils. Lines with no match in the other file are discarded; lines with
+// very many matches are discarded too when they sit inside a run of discards.
+// It marks discarded lines in changed and returns the remaining equivalence
+// classes along with their original indexes.
+func discardConfusingLines(equivs, otherCounts []int, changed []bool) ([]int, []int) {
+	const (
+		keep        = 0
+		discard     = 1
+		provisional = 2
+	)
+	end := len(equivs)
+	discards := make([]byte, end)
+
+	many := 5
+	for tem := (end / 64) >> 2; tem > 0; tem >>= 2 {
+		many *= 2
+	}
+	for i, id := range equivs {
+		nmatch := otherCounts[id]
+		if nmatch == 0 {
+			discards[i] = discard
+		} else if nmatch > many {
+			discards[i] = provisional
+		}
+	}
+
+	// Only really discard provisional lines inside a run of discards that
+	// starts and ends with a non-provisional one
+	for i := 0; i < end; i++ {
+		if discards[i] == provisional {
+			discards[i] = keep
+			continue
+		}
+		if discards[i] == keep {
+			continue
+		}
+
+		j := i
+		provisionals := 0
+		for ; j < end && discards[j] != keep; j++ {
+			if discards[j] == provisional {
+				provisionals++
+			}
+		}
+		for j > i && discards[j-1] == provisional {
+			j--
+			discards[j] = keep
+			provisionals--
+		}
+		length := j - i
+
+		if provisionals*4 > length {
+			for j > i {
+				j--
+				if discards[j] == provisional {
+					discards[j] = keep
+				}
+			}
+			continue
+		}
+
+		minimum := 1
+		for tem := length >> 2; ; {
+			tem >>= 2
+			if tem <= 0 {
+				break
+			}
+			minimum <<= 1
+		}
+		minimum++
+
+		// Cancel any subrun of minimum or more provisionals
+		consec := 0
+		for j = 0; j < length; j++ {
+			if discards[i+j] != provisional {
+				consec = 0
+			} else if consec++; consec == minimum {
+				j -= consec // Back up to the start of the subrun to cancel all of it
+			} else if consec > minimum {
+				discards[i+j] = keep
+			}
+		}
+
+		// Cancel provisionals near the start of the run, then near the end
+		consec = 0
+		for j = 0; j < length; j++ {
+			if j >= 8 && discards[i+j] == discard {
+				break
+			}
+			if discards[i+j] == provisional {
+				consec = 0
+				discards[i+j] = keep
+			} else if discards[i+j] == keep {
+				consec = 0
+			} else {
+				consec++
+			}
+			if consec == 3 {
+				break
+			}
+		}
+		i += length - 1
+		consec = 0
+		for j = 0; j < length; j++ {
+			if j >= 8 && discards[i-j] == discard {
+				break
+			}
+			if discards[i-j] == provisional {
+				consec = 0
+				discards[i-j] = keep
+			} else if discards[i-j] == keep {
+				consec = 0
+			} else {
+				consec++
+			}
+			if consec == 3 {
+				break
+			}
+		}
+	}
+
+	var kept, real []int
+	for i, id := range equivs {
+		if discards[i] == keep {
+			kept = append(kept, id)
+			real = append(real, i)
+		} else {
+			changed[i] = true
+		}
+	}
+	return kept, real
+}
+
+// snakeSearch holds the state for one run of the linear-space Myers algorithm.
+// fd/bd are the forward and backward furthest-reaching x per diagonal, indexed
+// by diagonal+off.
+type snakeSearch struct {
+	a, b     []int
+	fd, bd   []int
+	off      int
+	deleted  []int
+	inserted []int
+}
+
+func (s *snakeSearch) compare(xoff, xlim, yoff, ylim int) {
+	for xoff < xlim && yoff < ylim && s.a[xoff] == s.b[yoff] {
+		xoff++
+		yoff++
+	}
+	for xoff < xlim && yoff < ylim && s.a[xlim-1] == s.b[ylim-1] {
+		xlim--
+		ylim--
+	}
+
+	switch {
+	case xoff == xlim:
+		for ; yoff < ylim; yoff++ {
+			s.inserted = append(s.inserted, yoff)
+		}
+	case yoff == ylim:
+		for ; xoff < xlim; xoff++ {
+			s.deleted = append(s.deleted, xoff)
+		}
+	default:
+		xmid, ymid := s.middleSnake(xoff, xlim, yoff, ylim)
+		s.compare(xoff, xmid, yoff, ymid)
+		s.compare(xmid, xlim, ymid, ylim)
+	}
+}
+
+// middleSnake runs the forward and backward searches until they overlap and
+// returns the point where the edit script should be split
+func (s *snakeSearch) middleSnake(xoff, xlim, yoff, ylim int) (int, int) {
+	fd, bd, off := s.fd, s.bd, s.off
+	dmin := xoff - ylim
+	dmax := xlim - yoff
+	fmid := xoff - yoff
+	bmid := xlim - ylim
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+	odd := (fmid-bmid)&1 != 0
+
+	fd[off+fmid] = xoff
+	bd[off+bmid] = xlim
+
+	for {
+		// Extend the top-down search by one edit step on each diagonal
+		if fmin > dmin {
+			fmin--
+			fd[off+fmin-1] = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			fd[off+fmax+1] = -1
+		} else {
+			fmax--
+		}
+		for d := fmax; d >= fmin; d -= 2 {
+			tlo, thi := fd[off+d-1], fd[off+d+1]
+			x := tlo + 1
+			if tlo < thi {
+				x = thi
+			}
+			y := x - d
+			for x < xlim && y < ylim && s.a[x] == s.b[y] {
+				x++
+				y++
+			}
+			fd[off+d] = x
+			if odd && bmin <= d && d <= bmax && bd[off+d] <= x {
+				return x, y
+			}
+		}
+
+		// And the bottom-up search
+		if bmin > dmin {
+			bmin--
+			bd[off+bmin-1] = math.MaxInt
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			bd[off+bmax+1] = math.MaxInt
+		} else {
+			bmax--
+		}
+		for d := bmax; d >= bmin; d -= 2 {
+			tlo, thi := bd[off+d-1], bd[off+d+1]
+			x := thi - 1
+			if tlo < thi {
+				x = tlo
+			}
+			y := x - d
+			for xoff < x && yoff < y && s.a[x-1] == s.b[y-1] {
+				x--
+				y--
+			}
+			bd[off+d] = x
+			if !odd && fmin <= d && d <= fmax && x <= fd[off+d] {
+				return x, y
+			}
+		}
+	}
+}
+
+// shiftBoundaries slides runs of changed lines in lines (marked in changed) so
+// that adjacent runs merge and runs line up with changes in the other file.
+// It is a port of shift_boundaries from GNU diffutils' analyze.c; both bool
+// slices are offset by one for the sentinels.
+func shiftBoundaries(lines []string, changed, otherChanged []bool) {
+	n := len(lines)
+	eq := func(x, y int) bool { return lines[x-1] == lines[y-1] }
+
+	i, j := 1, 1
+	for {
+		// Scan forward to the start of the next run, tracking the matching point in the other file
+		for i <= n && !changed[i] {
+			for otherChanged[j] {
+				j++
+			}
+			j++
+			i++
+		}
+		if i > n {
+			break
+		}
+		start := i
+
+		// Find the end of this run
+		for changed[i] {
+			i++
+		}
+		for otherChanged[j] {
+			j++
+		}
+
+		var corresponding int
+		for {
+			runLength := i - start
+
+			// Move the run back while the previous unchanged line matches the last changed one
+			for start > 1 && eq(start-1, i-1) {
+				start--
+				changed[start] = true
+				i--
+				changed[i] = false
+				for changed[start-1] {
+					start--
+				}
+				j--
+				for otherChanged[j] {
+					j--
+				}
+			}
+
+			// Remember the last point where this run lines up with a run in the other file
+			corresponding = n + 1
+			if otherChanged[j-1] {
+				corresponding = i
+			}
+
+			// Move the run forward while the first changed line matches the next unchanged one
+			for i <= n && eq(start, i) {
+				changed[start] = false
+				start++
+				changed[i] = true
+				i++
+				for changed[i] {
+					i++
+				}
+				j++
+				for otherChanged[j] {
+					j++
+					corresponding = i
+				}
+			}
+
+			if runLength == i-start {
+				break
+			}
+		}
+
+		// Move the merged run back to line up with a change in the other file if possible
+		for corresponding < i {
+			start--
+			changed[start] = true
+			i--
+			changed[i] = false
+			j--
+			for otherChanged[j] {
+				j--
+			}
+		}
+	}
+}
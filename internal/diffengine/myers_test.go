@@ -0,0 +1,126 @@
+package diffengine
+
+import (
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string // Without the header lines; as printed by `diff -u`
+	}{
+		{name: "same", a: "a\nb\n", b: "a\nb\n"},
+		{name: "empty old", a: "", b: "a\nb\n", want: "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{name: "empty new", a: "a\nb\n", b: "", want: "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{name: "change", a: "a\nb\nc\n", b: "a\nB\nc\n", want: "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{name: "missing newline", a: "a\nb", b: "a\nb\n", want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		{name: "split hunks", a: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", b: "1\nX\n3\n4\n5\n6\n7\n8\n9\n10\nY\n12\n",
+			want: "@@ -1,5 +1,5 @@\n 1\n-2\n+X\n 3\n 4\n 5\n@@ -8,5 +8,5 @@\n 8\n 9\n 10\n-11\n+Y\n 12\n"},
+		{name: "merged hunks", a: "1\n2\n3\n4\n5\n6\n7\n8\n9\n", b: "1\nX\n3\n4\n5\n6\n7\nY\n9\n",
+			want: "@@ -1,9 +1,9 @@\n 1\n-2\n+X\n 3\n 4\n 5\n 6\n 7\n-8\n+Y\n 9\n"},
+		{name: "repeated block", a: "a\nb\na\nb\n", b: "a\nb\na\nb\na\nb\n", want: "@@ -2,3 +2,5 @@\n b\n a\n b\n+a\n+b\n"},
+		// A run of changes is slid no further than the horizon lines kept of
+		// the common suffix, not to the end of the repeated lines
+		{name: "horizon", a: "a\nd\nb\nc\nb\nb\na\na\na\na\na\na\nb\na\nc\n", b: "a\n\nd\nb\n\nc\nb\nb\na\na\na\na\nb\na\nc\n",
+			want: "@@ -1,14 +1,14 @@\n a\n+\n d\n b\n+\n c\n b\n b\n a\n a\n a\n-a\n-a\n a\n b\n a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := ""
+			if tt.want != "" {
+				want = "--- a\n+++ b\n" + tt.want
+			}
+			if got := UnifiedStrings("a", "b", tt.a, tt.b); got != want {
+				t.Errorf("UnifiedStrings() =\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// gnuDiff returns the output of `diff -u` for a and b, skipping the test
+// where diff isn't installed
+func gnuDiff(t testing.TB, a, b string) string {
+	t.Helper()
+	if _, err := exec.LookPath("diff"); err != nil {
+		t.Skip("diff is not installed")
+	}
+	dir := t.TempDir()
+	pathA, pathB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := os.WriteFile(pathA, []byte(a), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pathB, []byte(b), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("diff", "-u", "--label", "a", "--label", "b", pathA, pathB).Output()
+	if exit, ok := err.(*exec.ExitError); err != nil && !(ok && exit.ExitCode() == 1) {
+		t.Fatalf("diff failed: %v", err)
+	}
+	return string(out)
+}
+
+// randomText returns up to n lines drawn from a small alphabet, so lines
+// repeat and equally short edit scripts abound
+func randomText(r *rand.Rand, n int) string {
+	alphabet := []string{"a\n", "b\n", "c\n", "\n", "d\n"}
+	var sb strings.Builder
+	for i := r.Intn(n + 1); i > 0; i-- {
+		sb.WriteString(alphabet[r.Intn(1+r.Intn(len(alphabet)))])
+	}
+	return sb.String()
+}
+
+// edited returns s with a few lines deleted, inserted or replaced
+func edited(r *rand.Rand, s string) string {
+	lines := SplitLines(s)
+	for i := r.Intn(12); i > 0; i-- {
+		at := r.Intn(len(lines) + 1)
+		switch op := r.Intn(3); {
+		case op == 0 && at < len(lines):
+			lines = append(lines[:at], lines[at+1:]...)
+		case op == 1 && at < len(lines):
+			lines[at] = "e\n"
+		default:
+			lines = append(lines[:at], append([]string{"a\n"}, lines[at:]...)...)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func TestUnifiedMatchesDiff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		n := []int{10, 30, 200}[r.Intn(3)]
+		a := randomText(r, n)
+		b := edited(r, a)
+		if r.Intn(2) == 0 {
+			b = randomText(r, n)
+		}
+		if r.Intn(4) == 0 {
+			a = strings.TrimSuffix(a, "\n")
+		}
+		if want := gnuDiff(t, a, b); UnifiedStrings("a", "b", a, b) != want {
+			t.Fatalf("output differs from diff -u for\na = %q\nb = %q\nwant:\n%s\ngot:\n%s", a, b, want, UnifiedStrings("a", "b", a, b))
+		}
+	}
+}
+
+func FuzzUnified(f *testing.F) {
+	f.Add("a\nd\nb\nc\nb\nb\na\na\na\na\na\na\nb\na\nc\n", "a\n\nd\nb\n\nc\nb\nb\na\na\na\na\nb\na\nc\n")
+	f.Add("a\nb", "a\nb\n")
+	f.Add("", "a\n")
+	f.Fuzz(func(t *testing.T, a, b string) {
+		if strings.ContainsRune(a+b, 0) {
+			t.Skip("diff reports files with NUL bytes as binary")
+		}
+		if want := gnuDiff(t, a, b); UnifiedStrings("a", "b", a, b) != want {
+			t.Errorf("output differs from diff -u:\nwant:\n%s\ngot:\n%s", want, UnifiedStrings("a", "b", a, b))
+		}
+	})
+}
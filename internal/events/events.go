@@ -0,0 +1,338 @@
+// Package events publishes the completion of collections and analyses, and
+// each drifting file, as JSON messages on NATS or Kafka, so remediation bots
+// and dashboards can react to runs without polling the output directory.
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types
+const (
+	TypeCollection = "collection.completed"
+	TypeAnalysis   = "analysis.completed"
+	TypeFinding    = "finding"
+)
+
+// DefaultSubject prefixes the NATS subjects, and names the Kafka topic,
+// events are published to
+const DefaultSubject = "remote-diff"
+
+// Transports of a Target
+const (
+	TransportNATS  = "nats"  // NATS core protocol, one subject per event type
+	TransportKafka = "kafka" // Kafka through a Confluent REST Proxy (v2 API)
+)
+
+// timeout bounds connecting and publishing, so an unreachable broker doesn't hang a run
+const timeout = 30 * time.Second
+
+// Event is one message. Exactly one of Collection, Analysis and Finding is
+// set, matching Type.
+type Event struct {
+	Type       string      `json:"type"`
+	Time       time.Time   `json:"time"`
+	Host       string      `json:"host,omitempty"` // Where the tool ran
+	OutputDir  string      `json:"output_dir"`
+	Servers    []string    `json:"servers,omitempty"`
+	Collection *Collection `json:"collection,omitempty"`
+	Analysis   *Analysis   `json:"analysis,omitempty"`
+	Finding    *Finding    `json:"finding,omitempty"`
+}
+
+// Collection is the outcome of a collection
+type Collection struct {
+	Success bool           `json:"success"`
+	Files   map[string]int `json:"files,omitempty"`  // server -> files collected
+	Errors  map[string]int `json:"errors,omitempty"` // server -> files that could not be collected
+	// The note and labels the collection was made with
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Analysis is the outcome of an analysis
+type Analysis struct {
+	Drift   bool           `json:"drift"` // Files differ, can't be compared or the run had errors
+	Summary report.Summary `json:"summary"`
+	Errors  []string       `json:"errors,omitempty"`
+}
+
+// Finding is a file that drifts or could not be compared
+type Finding struct {
+	Path          string   `json:"path"`
+	Server        string   `json:"server,omitempty"` // Set for per-server reports
+	Status        string   `json:"status"`
+	Category      string   `json:"category,omitempty"`
+	Similarity    *float64 `json:"similarity,omitempty"`
+	AffectedHosts int      `json:"affected_hosts"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// Subject returns the NATS subject of the event under prefix, e.g.
+// "remote-diff.finding"
+func (e Event) Subject(prefix string) string {
+	return prefix + "." + e.Type
+}
+
+// Key returns the Kafka record key of the event, so the findings of one file
+// land in one partition in order
+func (e Event) Key() string {
+	if e.Finding == nil {
+		return e.Type
+	}
+	if e.Finding.Server != "" {
+		return e.Finding.Server + ":" + e.Finding.Path
+	}
+	return e.Finding.Path
+}
+
+// hostname is where the tool runs, or "" if unknown
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+// CollectionEvent describes a collection into dir. manifest, if not nil,
+// adds the files collected and failed per server.
+func CollectionEvent(dir string, servers []string, success bool, manifest *config.Manifest) Event {
+	c := &Collection{Success: success}
+	if manifest != nil {
+		if a := manifest.Annotation; a != nil {
+			c.Note, c.Labels = a.Note, a.Labels
+		}
+		c.Files, c.Errors = map[string]int{}, map[string]int{}
+		for server, files := range manifest.FilesByServer {
+			for _, info := range files {
+				if info.Error != "" {
+					c.Errors[server]++
+				} else {
+					c.Files[server]++
+				}
+			}
+		}
+	}
+	return Event{Type: TypeCollection, Time: time.Now().UTC(), Host: hostname(), OutputDir: dir, Servers: servers, Collection: c}
+}
+
+// AnalysisEvents describes an analysis of dir: a finding per drifting file,
+// then the completion of the analysis
+func AnalysisEvents(dir string, rep *report.Report) []Event {
+	base := Event{Time: rep.GeneratedAt.UTC(), Host: hostname(), OutputDir: dir, Servers: rep.Servers}
+	var evs []Event
+	for _, f := range rep.Files {
+		if !f.Drifting() {
+			continue
+		}
+		finding := &Finding{Path: f.Path, Server: f.Server, Status: f.Status, Category: f.Category(), AffectedHosts: f.AffectedHosts(), Errors: f.Errors}
+		if sim, ok := f.Similarity(); ok {
+			finding.Similarity = &sim
+		}
+		ev := base
+		ev.Type, ev.Finding = TypeFinding, finding
+		evs = append(evs, ev)
+	}
+	ev := base
+	ev.Type = TypeAnalysis
+	ev.Analysis = &Analysis{Drift: rep.HasDifferences() || len(rep.Errors) > 0, Summary: rep.Summary, Errors: rep.Errors}
+	return append(evs, ev)
+}
+
+// Target is a broker to publish to
+type Target struct {
+	Transport string   // TransportNATS or TransportKafka
+	URL       *url.URL // nats://, tls:// or the REST Proxy's http(s):// URL
+	Subject   string   // Subject prefix for NATS, topic for Kafka
+}
+
+// ParseTarget reads a broker as nats://[user:pass@]host[:4222] (tls:// for
+// NATS over TLS) or kafka+http(s)://rest-proxy[:8082], and the subject prefix
+// or topic to publish to
+func ParseTarget(raw, subject string) (Target, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return Target{}, fmt.Errorf("invalid event broker %q (expected nats://host:4222 or kafka+http://rest-proxy:8082)", raw)
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return Target{}, fmt.Errorf("invalid event subject %q", subject)
+	}
+	t := Target{URL: u, Subject: subject}
+	switch u.Scheme {
+	case "nats", "tls":
+		t.Transport = TransportNATS
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "4222")
+		}
+	case "kafka+http", "kafka+https":
+		t.Transport = TransportKafka
+		u.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+	default:
+		return Target{}, fmt.Errorf("unsupported event broker %q (use nats://, tls:// or kafka+http(s)://)", raw)
+	}
+	return t, nil
+}
+
+// Publish sends the events to the target, in order
+func Publish(t Target, evs []Event) error {
+	if len(evs) == 0 {
+		return nil
+	}
+	var err error
+	if t.Transport == TransportKafka {
+		err = publishKafka(t, evs)
+	} else {
+		err = publishNATS(t, evs)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Published %d event(s) to %s", len(evs), t.URL.Redacted())
+	return nil
+}
+
+// publishNATS speaks just enough of the NATS client protocol to publish:
+// INFO, CONNECT, PUB per event, then PING to learn whether the server
+// accepted them
+func publishNATS(t Target, evs []Event) error {
+	addr := t.URL.Redacted()
+	conn, err := net.DialTimeout("tcp", t.URL.Host, timeout)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to NATS server %s", addr)
+	}
+	defer func() { conn.Close() }()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("NATS server %s didn't greet with INFO", addr)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "INFO ")), &info); err != nil {
+		return errors.Wrapf(err, "failed to read INFO of NATS server %s", addr)
+	}
+	if info.TLSRequired || t.URL.Scheme == "tls" {
+		tc := tls.Client(conn, &tls.Config{ServerName: t.URL.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			return errors.Wrapf(err, "TLS handshake with NATS server %s failed", addr)
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "remote-diff-tool", "lang": "go"}
+	if u := t.URL.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			connect["user"], connect["pass"] = u.Username(), pass
+		} else {
+			connect["auth_token"] = u.Username()
+		}
+	}
+	var buf bytes.Buffer
+	opts, _ := json.Marshal(connect)
+	fmt.Fprintf(&buf, "CONNECT %s\r\n", opts)
+	for _, ev := range evs {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode event")
+		}
+		fmt.Fprintf(&buf, "PUB %s %d\r\n%s\r\n", ev.Subject(t.Subject), len(payload), payload)
+	}
+	buf.WriteString("PING\r\n")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return errors.Wrapf(err, "failed to publish to NATS server %s", addr)
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return errors.Wrapf(err, "no answer from NATS server %s", addr)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server %s refused the events: %s", addr, strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case line == "PING":
+			conn.Write([]byte("PONG\r\n"))
+		}
+	}
+}
+
+// publishKafka posts the events as one batch to the topic on a Kafka REST Proxy
+func publishKafka(t Target, evs []Event) error {
+	type record struct {
+		Key   string `json:"key"`
+		Value Event  `json:"value"`
+	}
+	body := struct {
+		Records []record `json:"records"`
+	}{}
+	for _, ev := range evs {
+		body.Records = append(body.Records, record{Key: ev.Key(), Value: ev})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode events")
+	}
+
+	u := *t.URL
+	u.User = nil // Sent as basic auth instead
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/topics/" + url.PathEscape(t.Subject)
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to build Kafka REST Proxy request")
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if user := t.URL.User; user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to publish to Kafka REST Proxy %s", u.Redacted())
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka REST Proxy %s answered %s: %s", u.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	// The proxy answers 200 even when single records fail
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.Unmarshal(msg, &result); err == nil {
+		var failed []string
+		for _, o := range result.Offsets {
+			if o.ErrorCode != nil {
+				failed = append(failed, o.Error)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("kafka REST Proxy %s rejected %d of %d event(s): %s", u.Redacted(), len(failed), len(evs), failed[0])
+		}
+	}
+	return nil
+}
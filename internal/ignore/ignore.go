@@ -0,0 +1,179 @@
+// Package ignore reads the .remotediffignore file from the output directory.
+// It holds gitignore-style rules that keep known noise out of analysis:
+//
+//	# Path patterns, as for --exclude; a leading ! re-includes
+//	*.bak
+//	etc/app/generated/
+//	!etc/app/generated/keep.conf
+//	# Lines matching the regex are dropped before comparing
+//	line:^# Generated at
+//	# Leave a server out of the comparison
+//	server:web3
+//
+// For path patterns the last matching rule wins, as in gitignore.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/pathfilter"
+
+	"github.com/pkg/errors"
+)
+
+// FileName is the ignore file looked up in the output directory
+const FileName = ".remotediffignore"
+
+// Rule prefixes for the non-path rule kinds
+const (
+	LinePrefix   = "line:"
+	ServerPrefix = "server:"
+)
+
+type pathRule struct {
+	raw     string // As written in the file
+	pattern *pathfilter.Pattern
+	negate  bool
+}
+
+// Rules is a parsed ignore file. A nil *Rules ignores nothing.
+type Rules struct {
+	paths   []pathRule
+	lines   []*regexp.Regexp
+	servers map[string]bool
+}
+
+// Load reads outputDir/.remotediffignore. A missing file yields no rules.
+func Load(outputDir string) (*Rules, error) {
+	p := filepath.Join(outputDir, FileName)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to open ignore file %s", p)
+	}
+	defer f.Close()
+
+	r := &Rules{servers: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if err := r.add(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", p, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read ignore file %s", p)
+	}
+	return r, nil
+}
+
+func (r *Rules) add(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(line, LinePrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(line, LinePrefix))
+		if err != nil {
+			return fmt.Errorf("invalid line regex: %v", err)
+		}
+		r.lines = append(r.lines, re)
+	case strings.HasPrefix(line, ServerPrefix):
+		server := strings.TrimSpace(strings.TrimPrefix(line, ServerPrefix))
+		if server == "" {
+			return fmt.Errorf("missing server name")
+		}
+		r.servers[server] = true
+	default:
+		rule := pathRule{raw: line}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if !strings.HasPrefix(line, pathfilter.RegexPrefix) {
+			// As in gitignore, a pattern with an inner slash is anchored at the root
+			line = strings.TrimSuffix(line, "/")
+			if strings.Contains(line, "/") && !strings.HasPrefix(line, "/") {
+				line = "/" + line
+			}
+		}
+		pattern, err := pathfilter.Compile(line)
+		if err != nil {
+			return err
+		}
+		rule.pattern = pattern
+		r.paths = append(r.paths, rule)
+	}
+	return nil
+}
+
+// IgnoresPath reports whether a manifest path (e.g. "etc/app/x.conf") is left out of analysis
+func (r *Rules) IgnoresPath(filePath string) bool {
+	if r == nil {
+		return false
+	}
+	ignored := false
+	for _, rule := range r.paths {
+		if rule.pattern.Match("/" + filePath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// PathRules returns the path rules that match a manifest path, as written in
+// the file; the last one decides whether it's ignored
+func (r *Rules) PathRules(filePath string) []string {
+	if r == nil {
+		return nil
+	}
+	var matched []string
+	for _, rule := range r.paths {
+		if rule.pattern.Match("/" + filePath) {
+			matched = append(matched, rule.raw)
+		}
+	}
+	return matched
+}
+
+// LineRules returns the regexes of the line: rules
+func (r *Rules) LineRules() []string {
+	if r == nil {
+		return nil
+	}
+	res := make([]string, len(r.lines))
+	for i, re := range r.lines {
+		res[i] = re.String()
+	}
+	return res
+}
+
+// IgnoresServer reports whether the server is left out of analysis
+func (r *Rules) IgnoresServer(server string) bool {
+	return r != nil && r.servers[server]
+}
+
+// HasLineRules reports whether any line: rules are set
+func (r *Rules) HasLineRules() bool {
+	return r != nil && len(r.lines) > 0
+}
+
+// IgnoresLine reports whether a file line matches a line: rule
+func (r *Rules) IgnoresLine(line string) bool {
+	if r == nil {
+		return false
+	}
+	line = strings.TrimSuffix(line, "\n")
+	for _, re := range r.lines {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
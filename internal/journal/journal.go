@@ -0,0 +1,67 @@
+// Package journal collects bounded journald excerpts, so the way services log
+// their startup configuration can be compared across servers like any file.
+//
+// Excerpts are normalized before they are stored: timestamps, the host name,
+// PIDs and boot IDs are dropped, since they differ on every server and every
+// run. What is left is "<identifier>: <message>" per entry.
+package journal
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+)
+
+// Dir is the top-level directory excerpts are stored under in each server's
+// collected files and in the manifest. Remote paths are absolute, so it can't
+// clash with a collected file.
+const Dir = "_journal"
+
+// Path returns the manifest path of a unit's excerpt, e.g. "_journal/nginx.service.log"
+func Path(j config.JournalExcerpt) string {
+	return path.Join(Dir, j.Unit+".log")
+}
+
+// Command builds the journalctl command printing the excerpt
+func Command(j config.JournalExcerpt) string {
+	args := []string{"journalctl", "--no-pager", "--quiet", "--output=short-iso", "--unit", util.ShellQuote(j.Unit)}
+	if j.Since != "" {
+		args = append(args, "--since", util.ShellQuote(j.Since))
+	}
+	if j.Until != "" {
+		args = append(args, "--until", util.ShellQuote(j.Until))
+	}
+	return strings.Join(args, " ")
+}
+
+// entryHeader matches the short-iso prefix of an entry: timestamp, host and
+// identifier with an optional [PID]
+var entryHeader = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\S+ \S+ ([^\s\[:]+)(?:\[\d+\])?: ?`)
+
+// bootMarker matches the separator journalctl prints between boots
+var bootMarker = regexp.MustCompile(`^-- Boot [0-9a-f]+ --$`)
+
+// Normalize drops the volatile fields of journalctl --output=short-iso lines.
+// Continuation lines of multi-line messages are kept as they are.
+func Normalize(output string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		switch {
+		case line == "":
+			continue
+		case bootMarker.MatchString(line):
+			line = "-- Boot --"
+		default:
+			if m := entryHeader.FindStringSubmatchIndex(line); m != nil {
+				line = fmt.Sprintf("%s: %s", line[m[2]:m[3]], line[m[1]:])
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
@@ -0,0 +1,339 @@
+// Package jsonschema describes the JSON files the tool reads and writes as
+// JSON Schemas (draft 2020-12), generated from the Go types they are encoded
+// from, and checks documents against them. Only the keywords the generated
+// schemas use are validated.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Draft is the JSON Schema dialect of the generated schemas
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// BaseID prefixes the $id of the generated schemas
+const BaseID = "https://github.com/brndnsvr/remote-diff-tool/schemas/"
+
+// Strict makes Validate reject unknown properties and missing required ones;
+// otherwise only types and values are checked. Set from --strict-config.
+var Strict = true
+
+// maxProblems caps the violations a ValidationError lists
+const maxProblems = 10
+
+// Schema is a JSON Schema, or one of its subschemas
+type Schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	ID          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Ref         string             `json:"$ref,omitempty"`
+	Type        Types              `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"` // Only date-time is checked
+	Enum        []string           `json:"enum,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	// false for structs, the schema of the values for maps
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+}
+
+// Types is the type keyword: one type, or several when null is allowed too
+type Types []string
+
+// MarshalJSON writes a single type as a string, like schemas usually do
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// Options describe a schema generated by For
+type Options struct {
+	Name        string // File name of the $id, e.g. "report"
+	Title       string
+	Description string
+	// Allowed values of string fields, keyed by Go type and JSON name (e.g. "FileResult.status")
+	Enums map[string][]string
+	// Fields without omitempty aren't required either, for files written by hand
+	Optional bool
+}
+
+// For generates the schema of the JSON encoding of v's type. Structs other
+// than the top-level one are kept in $defs and referred to by type name.
+func For(v interface{}, opts Options) *Schema {
+	g := &generator{opts: opts, defs: make(map[string]*Schema)}
+	t := reflect.TypeOf(v)
+	var s *Schema
+	if t.Kind() == reflect.Struct && t != timeType {
+		s = g.object(t)
+	} else {
+		s = g.schema(t)
+	}
+	s.Schema = Draft
+	if opts.Name != "" {
+		s.ID = BaseID + opts.Name + ".schema.json"
+	}
+	s.Title = opts.Title
+	s.Description = opts.Description
+	if len(g.defs) > 0 {
+		s.Defs = g.defs
+	}
+	return s
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type generator struct {
+	opts Options
+	defs map[string]*Schema
+}
+
+func (g *generator) schema(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: Types{"string"}, Format: "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return g.schema(t.Elem())
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: Types{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: Types{"integer"}}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: Types{"number"}}
+	case reflect.String:
+		return &Schema{Type: Types{"string"}}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: Types{"array"}, Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: Types{"object"}, AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := g.defs[name]; !ok {
+			g.defs[name] = nil // Reserved, for types that refer to themselves
+			g.defs[name] = g.object(t)
+		}
+		return &Schema{Ref: "#/$defs/" + name}
+	}
+	return &Schema{} // Anything, e.g. an interface{}
+}
+
+// object describes a struct as encoding/json writes it: embedded structs
+// flattened, json:"-" fields left out and nil slices, maps and pointers as
+// null unless they are omitted when empty
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: Types{"object"}, Properties: make(map[string]*Schema), AdditionalProperties: false}
+	g.fields(t, s)
+	sort.Strings(s.Required)
+	return s
+}
+
+func (g *generator) fields(t reflect.Type, s *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, omitEmpty := parseTag(tag)
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, s)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fs := g.schema(f.Type)
+		if values := g.opts.Enums[t.Name()+"."+name]; len(values) > 0 {
+			fs.Enum = values
+		}
+		if !omitEmpty {
+			switch f.Type.Kind() {
+			case reflect.Slice, reflect.Map, reflect.Ptr:
+				if fs.Ref == "" {
+					fs.Type = append(fs.Type, "null")
+				}
+			}
+			if !g.opts.Optional {
+				s.Required = append(s.Required, name)
+			}
+		}
+		s.Properties[name] = fs
+	}
+}
+
+func parseTag(tag string) (name string, omitEmpty bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty
+}
+
+// ValidationError lists how a document doesn't match its schema
+type ValidationError struct {
+	Problems []string // e.g. "files[3].status: \"changed\" is not one of identical, different, ..."
+	More     int      // Problems beyond maxProblems
+}
+
+func (e *ValidationError) Error() string {
+	msg := "does not match its schema: " + strings.Join(e.Problems, "; ")
+	if e.More > 0 {
+		msg += fmt.Sprintf(" (and %d more)", e.More)
+	}
+	return msg
+}
+
+// Validate checks a JSON document against the schema
+func (s *Schema) Validate(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return errors.Wrap(err, "invalid JSON")
+	}
+	v := &validator{root: s, err: &ValidationError{}}
+	v.check(s, doc, "")
+	if len(v.err.Problems) > 0 {
+		return v.err
+	}
+	return nil
+}
+
+type validator struct {
+	root *Schema
+	err  *ValidationError
+}
+
+func (v *validator) problem(at, format string, args ...interface{}) {
+	if len(v.err.Problems) >= maxProblems {
+		v.err.More++
+		return
+	}
+	if at == "" {
+		at = "(document)"
+	}
+	v.err.Problems = append(v.err.Problems, at+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) check(s *Schema, value interface{}, at string) {
+	if s.Ref != "" {
+		def := v.root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+		if def == nil {
+			v.problem(at, "unresolved reference %s", s.Ref)
+			return
+		}
+		s = def
+	}
+	if len(s.Type) > 0 && !hasType(s.Type, value) {
+		v.problem(at, "expected %s, got %s", strings.Join(s.Type, " or "), typeOf(value))
+		return
+	}
+	switch value := value.(type) {
+	case string:
+		if len(s.Enum) > 0 && !contains(s.Enum, value) {
+			v.problem(at, "%q is not one of %s", value, strings.Join(s.Enum, ", "))
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+				v.problem(at, "%q is not an RFC 3339 date-time", value)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				v.check(s.Items, item, fmt.Sprintf("%s[%d]", at, i))
+			}
+		}
+	case map[string]interface{}:
+		v.checkObject(s, value, at)
+	}
+}
+
+func (v *validator) checkObject(s *Schema, value map[string]interface{}, at string) {
+	if Strict {
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				v.problem(at, "missing required property %q", name)
+			}
+		}
+	}
+	keys := make([]string, 0, len(value))
+	for k := range value {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		child := k
+		if at != "" {
+			child = at + "." + k
+		}
+		if ps, ok := s.Properties[k]; ok {
+			v.check(ps, value[k], child)
+			continue
+		}
+		switch extra := s.AdditionalProperties.(type) {
+		case *Schema:
+			v.check(extra, value[k], child)
+		case bool:
+			if !extra && Strict {
+				v.problem(at, "unknown property %q", k)
+			}
+		}
+	}
+}
+
+func hasType(types Types, value interface{}) bool {
+	for _, t := range types {
+		if t == typeOf(value) || (t == "number" && typeOf(value) == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf names the JSON type of a value decoded with UseNumber
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
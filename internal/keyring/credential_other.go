@@ -0,0 +1,10 @@
+//go:build !windows
+
+package keyring
+
+import "fmt"
+
+// credential only exists on Windows
+func credential(target string) (string, error) {
+	return "", fmt.Errorf("the Credential Manager is only available on Windows")
+}
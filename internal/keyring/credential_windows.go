@@ -0,0 +1,59 @@
+package keyring
+
+import (
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+// credGeneric is CRED_TYPE_GENERIC, the type cmdkey /generic stores
+const credGeneric = 1
+
+// winCredential is the CREDENTIALW structure
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// credential reads the password of a generic credential, e.g. one stored
+// with cmdkey /generic:<target> /user:<anything> /pass
+func credential(target string) (string, error) {
+	name, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return "", err
+	}
+	var cred *winCredential
+	if ok, _, err := procCredRead.Call(uintptr(unsafe.Pointer(name)), credGeneric, 0, uintptr(unsafe.Pointer(&cred))); ok == 0 {
+		return "", errors.Wrapf(err, "no generic credential %s", target)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	// cmdkey and the Control Panel store UTF-16; other tools store UTF-8
+	if len(blob)%2 == 0 && len(blob) > 0 && blob[1] == 0 {
+		chars := make([]uint16, len(blob)/2)
+		for i := range chars {
+			chars[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+		}
+		return string(utf16.Decode(chars)), nil
+	}
+	return string(blob), nil
+}
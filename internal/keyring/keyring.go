@@ -0,0 +1,47 @@
+// Package keyring reads secrets, such as the SSH key passphrase and the sudo
+// password, from the keyring of the operating system, so they don't have to
+// be put in environment variables, which show up in process listings and
+// shell history.
+package keyring
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Service is the service every secret is stored under, with an account
+// naming the secret
+const Service = "remote-diff-tool"
+
+// Lookup reads the secret of account: from the keychain on macOS (the
+// generic password of Service and account), from the Credential Manager on
+// Windows (the generic credential Service:account) and with secret-tool
+// (libsecret, attributes service and user) elsewhere
+func Lookup(account string) (string, error) {
+	var secret string
+	switch runtime.GOOS {
+	case "windows":
+		var err error
+		if secret, err = credential(Service + ":" + account); err != nil {
+			return "", errors.Wrapf(err, "failed to read %s from the Credential Manager", account)
+		}
+	default:
+		cmd := exec.Command("secret-tool", "lookup", "service", Service, "user", account)
+		if runtime.GOOS == "darwin" {
+			cmd = exec.Command("security", "find-generic-password", "-s", Service, "-a", account, "-w")
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read %s from the keyring with %s", account, cmd.Args[0])
+		}
+		secret = strings.TrimRight(string(out), "\r\n")
+	}
+	if secret == "" {
+		return "", fmt.Errorf("the keyring holds no secret for %s", account)
+	}
+	return secret, nil
+}
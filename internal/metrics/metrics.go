@@ -0,0 +1,200 @@
+// Package metrics exports the outcome of an analysis as Prometheus metrics,
+// either as a file in the text exposition format (for node_exporter's
+// textfile collector) or pushed to a Pushgateway, so drift can be alerted on.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix is the common prefix of the exported metric names
+const Prefix = "remote_diff_"
+
+// DefaultJob is the Pushgateway job metrics are pushed under
+const DefaultJob = "remote_diff_tool"
+
+// contentType is the text exposition format, understood by both the
+// textfile collector and the Pushgateway
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// pushTimeout bounds a push, so an unreachable gateway doesn't hang a run
+const pushTimeout = 30 * time.Second
+
+// Write renders the metrics of rep. manifest, if not nil, adds the
+// collection errors of each server.
+func Write(w io.Writer, rep *report.Report, manifest *config.Manifest) error {
+	var b bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n# TYPE %s%s %s\n", Prefix, name, help, Prefix, name, typ)
+	}
+	sample := func(name string, value float64, labels ...string) {
+		b.WriteString(Prefix + name)
+		if len(labels) > 0 {
+			pairs := make([]string, 0, len(labels)/2)
+			for i := 0; i+1 < len(labels); i += 2 {
+				pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+			}
+			b.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		fmt.Fprintf(&b, " %v\n", value)
+	}
+
+	s := rep.Summary
+	metric("files_compared", "gauge", "Files compared in the last analysis.")
+	sample("files_compared", float64(s.TotalCompared))
+	metric("files", "gauge", "Files compared in the last analysis, by status.")
+	for _, st := range []struct {
+		status string
+		count  int
+	}{
+		{report.StatusIdentical, s.Identical - s.IdenticalIgnoring - s.Equivalent - s.IdenticalNormalized},
+		{report.StatusIdenticalIgnoring, s.IdenticalIgnoring},
+		{report.StatusIdenticalNormalized, s.IdenticalNormalized},
+		{report.StatusEquivalent, s.Equivalent},
+		{report.StatusDifferent, s.Different - s.FormatOnly - s.MetadataOnly - s.Moved},
+		{report.StatusFormatOnly, s.FormatOnly},
+		{report.StatusMetadataOnly, s.MetadataOnly},
+		{report.StatusMoved, s.Moved},
+		{report.StatusUnstable, s.Unstable},
+		{report.StatusVolatile, s.Volatile},
+		{report.StatusError, s.Errors},
+		{"acknowledged", s.Acknowledged},
+		{"expected", s.Expected},
+	} {
+		sample("files", float64(st.count), "status", st.status)
+	}
+
+	// One series per compared file, 0 while it matches, so alerts resolve once drift is fixed
+	metric("files_different", "gauge", "Whether a file differs between servers (1) or not (0).")
+	for _, f := range rep.Files {
+		value := 0.0
+		if f.Differs() && f.Drifting() {
+			value = 1
+		}
+		if f.Server != "" {
+			sample("files_different", value, "path", logicalPath(f.Path), "server", f.Server)
+		} else {
+			sample("files_different", value, "path", logicalPath(f.Path))
+		}
+	}
+	metric("file_errors", "gauge", "Whether a file could not be compared (1) or not (0).")
+	for _, f := range rep.Files {
+		value := 0.0
+		if f.Status == report.StatusError && f.Drifting() {
+			value = 1
+		}
+		if f.Server != "" {
+			sample("file_errors", value, "path", logicalPath(f.Path), "server", f.Server)
+		} else {
+			sample("file_errors", value, "path", logicalPath(f.Path))
+		}
+	}
+
+	if manifest != nil {
+		metric("collection_errors", "gauge", "Files that could not be collected from a server.")
+		servers := make([]string, 0, len(manifest.FilesByServer))
+		for server := range manifest.FilesByServer {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		for _, server := range servers {
+			n := 0
+			for _, info := range manifest.FilesByServer[server] {
+				if info.Error != "" {
+					n++
+				}
+			}
+			sample("collection_errors", float64(n), "server", server)
+		}
+	}
+	metric("analysis_errors", "gauge", "Errors of the last analysis not tied to one file.")
+	sample("analysis_errors", float64(len(rep.Errors)))
+	metric("last_run_timestamp_seconds", "gauge", "Unix time of the last analysis.")
+	sample("last_run_timestamp_seconds", float64(rep.GeneratedAt.Unix()))
+
+	_, err := w.Write(b.Bytes())
+	return errors.Wrap(err, "failed to write metrics")
+}
+
+// labelEscaper escapes label values as the exposition format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// logicalPath returns the path a file was configured as
+func logicalPath(filePath string) string {
+	if config.IsHomePath(filePath) {
+		return filePath
+	}
+	return "/" + filePath
+}
+
+// WriteFile writes the metrics of rep to path. The file is replaced in one
+// step, so a collector never reads it half-written.
+func WriteFile(path string, rep *report.Report, manifest *config.Manifest) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create metrics file for %s", path)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if err := Write(tmp, rep, manifest); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to set permissions of %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "failed to write metrics file %s", path)
+	}
+	log.Infof("Wrote metrics to %s", path)
+	return nil
+}
+
+// Push replaces the metrics of job on the Pushgateway at gateway with those
+// of rep
+func Push(gateway, job string, rep *report.Report, manifest *config.Manifest) error {
+	u, err := url.Parse(gateway)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid Pushgateway URL %q (expected e.g. http://pushgateway:9091)", gateway)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/metrics/job/" + url.PathEscape(job)
+
+	var body bytes.Buffer
+	if err := Write(&body, rep, manifest); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), &body)
+	if err != nil {
+		return errors.Wrap(err, "failed to build Pushgateway request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := (&http.Client{Timeout: pushTimeout}).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to push metrics to %s", u.Redacted())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pushgateway %s answered %s: %s", u.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	log.Infof("Pushed metrics to %s", u.Redacted())
+	return nil
+}
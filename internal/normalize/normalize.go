@@ -0,0 +1,83 @@
+// Package normalize rewrites file contents before they are compared, so
+// differences that don't matter for a file (comments, spacing, line order,
+// case, Unicode normalization form) don't count as drift.
+package normalize
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Rules, applied in this order whatever order they are configured in
+const (
+	UnicodeNFC         = "unicode-nfc"         // Compose characters, so "é" as e + U+0301 is the same as U+00E9
+	StripComments      = "strip-comments"      // Drop lines starting with # or ; and blank lines
+	CollapseWhitespace = "collapse-whitespace" // Trim lines, turn runs of spaces and tabs into one space, drop blank lines
+	Lowercase          = "lowercase"
+	SortLines          = "sort-lines"
+)
+
+// All lists the rules in the order they are applied
+var All = []string{UnicodeNFC, StripComments, CollapseWhitespace, Lowercase, SortLines}
+
+// Validate checks that every rule is known
+func Validate(rules []string) error {
+	for _, r := range rules {
+		if !known(r) {
+			return fmt.Errorf("unknown normalization rule %q (expected one of %s)", r, strings.Join(All, ", "))
+		}
+	}
+	return nil
+}
+
+func known(rule string) bool {
+	for _, r := range All {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply normalizes content with rules. The result ends every line with a
+// newline, so a missing trailing newline doesn't count either.
+func Apply(content string, rules []string) string {
+	has := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		has[r] = true
+	}
+	if has[UnicodeNFC] {
+		content = norm.NFC.String(content)
+	}
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if has[StripComments] && (trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";")) {
+			continue
+		}
+		if has[CollapseWhitespace] {
+			if trimmed == "" {
+				continue
+			}
+			line = strings.Join(strings.Fields(trimmed), " ")
+		}
+		if has[Lowercase] {
+			line = strings.ToLower(line)
+		}
+		kept = append(kept, line)
+	}
+	for len(kept) > 0 && kept[len(kept)-1] == "" {
+		kept = kept[:len(kept)-1]
+	}
+	if has[SortLines] {
+		sort.Strings(kept)
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return strings.Join(kept, "\n") + "\n"
+}
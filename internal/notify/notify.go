@@ -0,0 +1,267 @@
+// Package notify posts a summary of an analysis to a chat or generic
+// webhook, so scheduled runs can alert a channel when a host drifts.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Payload styles of a webhook
+const (
+	StyleSlack   = "slack"   // Slack incoming webhook ({"text": ...}, also understood by Mattermost and Rocket.Chat)
+	StyleTeams   = "teams"   // Microsoft Teams connector (MessageCard)
+	StyleGeneric = "generic" // The summary as JSON, optionally with the full report
+)
+
+// When a notification is sent
+const (
+	OnDrift  = "drift"  // Only when files differ, can't be compared or the run had errors
+	OnAlways = "always" // After every analysis
+)
+
+// URLEnvVar names a webhook to notify when none is given on the command
+// line, keeping its secret out of the process list
+const URLEnvVar = "REMOTE_DIFF_WEBHOOK"
+
+// maxListed is how many drifting files a message names
+const maxListed = 20
+
+// sendTimeout bounds a post, so an unreachable webhook doesn't hang a run
+const sendTimeout = 30 * time.Second
+
+// Retry is how often a post is retried within a run; it is the "notify"
+// phase of --retry
+var Retry = &sshutil.NotifyRetry
+
+// Webhook is where and how a notification is sent
+type Webhook struct {
+	URL          string
+	Style        string // StyleSlack, StyleTeams or StyleGeneric; "" picks one from the URL
+	On           string // OnDrift (the default) or OnAlways
+	AttachReport bool   // With StyleGeneric, include the full report
+	Title        string // Prefixes the message, e.g. the environment; "" uses a default
+	QueueDir     string // Where notifications that can't be delivered are kept for Flush; "" drops them
+}
+
+// Validate checks the settings of a webhook before anything is run
+func (h Webhook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", h.URL)
+	}
+	switch h.Style {
+	case StyleSlack, StyleTeams, StyleGeneric, "":
+	default:
+		return fmt.Errorf("unknown webhook style %q (expected %s, %s or %s)", h.Style, StyleSlack, StyleTeams, StyleGeneric)
+	}
+	switch h.On {
+	case OnDrift, OnAlways, "":
+	default:
+		return fmt.Errorf("unknown notification condition %q (expected %s or %s)", h.On, OnDrift, OnAlways)
+	}
+	if h.AttachReport && h.style() != StyleGeneric {
+		return fmt.Errorf("only %s webhooks can carry the report", StyleGeneric)
+	}
+	return nil
+}
+
+// style returns the payload style, recognizing Slack and Teams webhooks by host
+func (h Webhook) style() string {
+	if h.Style != "" {
+		return h.Style
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return StyleGeneric
+	}
+	switch host := strings.ToLower(u.Hostname()); {
+	case host == "hooks.slack.com":
+		return StyleSlack
+	case strings.HasSuffix(host, ".webhook.office.com"), strings.HasSuffix(host, ".logic.azure.com"):
+		return StyleTeams
+	}
+	return StyleGeneric
+}
+
+// drifted reports whether a report calls for a notification under OnDrift
+func drifted(rep *report.Report) bool {
+	return rep.HasDifferences() || len(rep.Errors) > 0
+}
+
+// Send posts the summary of rep to the webhook, unless it only notifies on
+// drift and there is none. Failed posts are retried as Retry allows; if they
+// keep failing and the webhook has a QueueDir, the notification is queued
+// there for Flush instead of being lost.
+func Send(h Webhook, rep *report.Report) error {
+	if h.On != OnAlways && !drifted(rep) {
+		log.Debugf("No drift, not notifying %s", redact(h.URL))
+		return nil
+	}
+	body, err := payload(h, rep)
+	if err != nil {
+		return err
+	}
+	err = deliver(h.URL, body)
+	if err == nil {
+		log.Infof("Sent notification to %s", redact(h.URL))
+		return nil
+	}
+	var perm *permanentError
+	if h.QueueDir == "" || errors.As(err, &perm) {
+		return err
+	}
+	if qerr := enqueue(h.QueueDir, h.URL, body, err); qerr != nil {
+		return errors.Wrapf(err, "failed to queue the notification (%v)", qerr)
+	}
+	log.Warnf("%v; queued the notification in %s to retry on a later run", err, h.QueueDir)
+	return nil
+}
+
+// payload renders the notification of rep in the webhook's style
+func payload(h Webhook, rep *report.Report) ([]byte, error) {
+	title, lines := Summarize(rep, h.Title)
+
+	var payload interface{}
+	switch h.style() {
+	case StyleSlack:
+		payload = map[string]string{"text": "*" + title + "*\n" + strings.Join(lines, "\n")}
+	case StyleTeams:
+		// Teams renders single newlines as spaces
+		payload = map[string]interface{}{
+			"@type":    "MessageCard",
+			"@context": "http://schema.org/extensions",
+			"summary":  title,
+			"title":    title,
+			"text":     strings.Join(lines, "\n\n"),
+		}
+	default:
+		generic := map[string]interface{}{
+			"title":        title,
+			"text":         strings.Join(lines, "\n"),
+			"drift":        drifted(rep),
+			"generated_at": rep.GeneratedAt,
+			"servers":      rep.Servers,
+			"summary":      rep.Summary,
+			"errors":       rep.Errors,
+		}
+		if h.AttachReport {
+			generic["report"] = rep
+		}
+		payload = generic
+	}
+	body, err := json.Marshal(payload)
+	return body, errors.Wrap(err, "failed to encode notification")
+}
+
+// permanentError is an answer of a webhook that retrying won't change, such
+// as 404 for a deleted webhook
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// deliver posts body to url, retrying as Retry allows while the webhook is
+// unreachable, times out or answers 429 or 5xx
+func deliver(url string, body []byte) error {
+	for attempt := 1; ; attempt++ {
+		err := post(url, body)
+		var perm *permanentError
+		if err == nil || errors.As(err, &perm) || attempt >= Retry.Attempts {
+			return err
+		}
+		delay := Retry.Delay(attempt)
+		log.Warnf("Notification failed (attempt %d/%d), retrying in %v: %v", attempt, Retry.Attempts, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// post sends body to url once
+func post(url string, body []byte) error {
+	resp, err := (&http.Client{Timeout: sendTimeout}).Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error repeats the URL, which holds the webhook's secret
+		return fmt.Errorf("failed to notify %s: %s", redact(url), strings.ReplaceAll(err.Error(), url, redact(url)))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("webhook %s answered %s: %s", redact(url), resp.Status, strings.TrimSpace(string(msg)))
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return &permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Summarize returns the title and lines of a notification: the counts, the
+// first drifting files and the run errors
+func Summarize(rep *report.Report, title string) (string, []string) {
+	if title == "" {
+		title = "remote-diff-tool"
+	}
+	s := rep.Summary
+	drifting := s.Different + s.Errors
+	if drifted(rep) {
+		title = fmt.Sprintf("%s: drift in %d of %d file(s) across %s", title, drifting, s.TotalCompared, strings.Join(rep.Servers, ", "))
+	} else {
+		title = fmt.Sprintf("%s: all %d file(s) match across %s", title, s.TotalCompared, strings.Join(rep.Servers, ", "))
+	}
+
+	var lines []string
+	listed := 0
+	for _, f := range rep.Files {
+		if !f.Drifting() {
+			continue
+		}
+		if listed == maxListed {
+			lines = append(lines, fmt.Sprintf("... and %d more", drifting-listed))
+			break
+		}
+		listed++
+		name := f.Path
+		if f.Server != "" {
+			name = f.Server + ": " + f.Path
+		}
+		detail := f.Status
+		if c := f.Category(); c != "" {
+			detail += ", " + c
+		}
+		if n := f.AffectedHosts(); n > 0 {
+			detail += fmt.Sprintf(", %d host(s) off", n)
+		}
+		lines = append(lines, fmt.Sprintf("- %s (%s)", name, detail))
+	}
+	for _, e := range rep.Errors {
+		lines = append(lines, "- error: "+e)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, fmt.Sprintf("%d identical", s.Identical))
+	}
+	return title, lines
+}
+
+// redact hides the path and query of a webhook URL, which usually hold its secret
+func redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
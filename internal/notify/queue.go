@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxAge is how long a queued notification is retried before it is dropped
+const DefaultMaxAge = 24 * time.Hour
+
+// Backoff between the retries of a queued notification, doubling per failed
+// Flush from the first to the longest
+const (
+	queueBackoff    = time.Minute
+	queueMaxBackoff = time.Hour
+)
+
+// queued is a notification that couldn't be delivered, kept as one JSON
+// file per notification. The files hold the webhook URL and its secret, so
+// only the owner can read them.
+type queued struct {
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+}
+
+// enqueue keeps a notification in dir for Flush
+func enqueue(dir, url string, body []byte, cause error) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create notification queue %s", dir)
+	}
+	now := time.Now().UTC()
+	q := queued{URL: url, Body: body, Created: now, Attempts: Retry.Attempts, NextAttempt: now.Add(queueBackoff), LastError: cause.Error()}
+	// Names sort by creation, so Flush delivers in order
+	return writeQueued(filepath.Join(dir, fmt.Sprintf("%020d.json", now.UnixNano())), q)
+}
+
+// writeQueued replaces the file of a queued notification in one step
+func writeQueued(path string, q queued) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode queued notification")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "failed to write %s", path)
+}
+
+// Flush tries once more to deliver the notifications queued in dir whose
+// backoff has passed, oldest first, and returns how many were delivered and
+// how many are still queued. Later notifications to a webhook wait while an
+// earlier one is still queued, so they arrive in order. Notifications older than
+// maxAge (0 keeps them forever) and those a webhook rejects for good are
+// dropped with an error in the log.
+func Flush(dir string, maxAge time.Duration) (delivered, left int, err error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to read notification queue %s", dir)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	blocked := map[string]bool{} // URLs with an earlier notification still queued
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return delivered, left, errors.Wrapf(err, "failed to read queued notification %s", path)
+		}
+		var q queued
+		if err := json.Unmarshal(data, &q); err != nil {
+			log.Errorf("Dropping unreadable queued notification %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		if maxAge > 0 && now.Sub(q.Created) > maxAge {
+			log.Errorf("Dropping the notification to %s from %s after %d attempt(s): %s", redact(q.URL), q.Created.Format(time.RFC3339), q.Attempts, q.LastError)
+			os.Remove(path)
+			continue
+		}
+		if blocked[q.URL] || now.Before(q.NextAttempt) {
+			blocked[q.URL] = true
+			left++
+			continue
+		}
+
+		q.Attempts++
+		err = post(q.URL, q.Body)
+		var perm *permanentError
+		switch {
+		case err == nil:
+			log.Infof("Sent the notification queued at %s to %s", q.Created.Format(time.RFC3339), redact(q.URL))
+			os.Remove(path)
+			delivered++
+			continue
+		case errors.As(err, &perm):
+			log.Errorf("Dropping the notification queued at %s: %v", q.Created.Format(time.RFC3339), err)
+			os.Remove(path)
+			continue
+		}
+		blocked[q.URL] = true
+		backoff := queueBackoff << uint(q.Attempts-Retry.Attempts)
+		if backoff > queueMaxBackoff || backoff <= 0 {
+			backoff = queueMaxBackoff
+		}
+		q.NextAttempt, q.LastError = now.Add(backoff), err.Error()
+		if err := writeQueued(path, q); err != nil {
+			return delivered, left, err
+		}
+		log.Warnf("Queued notification still not delivered, retrying after %s: %v", q.NextAttempt.Format(time.RFC3339), err)
+		left++
+	}
+	return delivered, left, nil
+}
@@ -0,0 +1,264 @@
+// Package pathfilter decides which files below the configured directories
+// are collected and compared, based on include/exclude patterns.
+//
+// Patterns are globs unless prefixed with "re:", which makes the rest a
+// regular expression matched against the absolute path. A glob without a
+// slash matches the base name (e.g. "*.gz"); one with a slash matches the
+// whole absolute path, where * and ? stop at slashes and ** crosses them
+// (e.g. "/etc/ssl/**"; "/etc/**/*.pem" includes /etc/x.pem). A pattern matching a directory applies to
+// everything below it.
+package pathfilter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+)
+
+// RegexPrefix marks a pattern as a regular expression
+const RegexPrefix = "re:"
+
+type pattern struct {
+	raw   string
+	glob  string         // Set for glob patterns
+	regex *regexp.Regexp // Compiled form of either kind, matched against the absolute path or base name
+	base  bool           // Glob without a slash, matched against the base name
+}
+
+// Filter applies include/exclude patterns to paths below the configured dirs.
+// Explicitly configured files are always kept.
+type Filter struct {
+	files   map[string]bool
+	dirs    []string
+	exclude []pattern
+	include []pattern
+}
+
+// New builds a filter. It fails if any pattern is invalid.
+func New(files, dirs, exclude, include []string) (*Filter, error) {
+	f := &Filter{files: make(map[string]bool, len(files)), dirs: dirs}
+	for _, p := range files {
+		f.files[p] = true
+	}
+	var err error
+	if f.exclude, err = compileAll(exclude); err != nil {
+		return nil, err
+	}
+	if f.include, err = compileAll(include); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate reports the first invalid pattern, if any
+func Validate(patterns []string) error {
+	_, err := compileAll(patterns)
+	return err
+}
+
+func compileAll(raw []string) ([]pattern, error) {
+	var out []pattern
+	for _, r := range raw {
+		p, err := compile(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func compile(raw string) (pattern, error) {
+	if strings.HasPrefix(raw, RegexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(raw, RegexPrefix))
+		if err != nil {
+			return pattern{}, fmt.Errorf("invalid regex pattern %q: %v", raw, err)
+		}
+		return pattern{raw: raw, regex: re}, nil
+	}
+	if raw == "" {
+		return pattern{}, fmt.Errorf("empty pattern")
+	}
+	if _, err := path.Match(strings.ReplaceAll(raw, "**", "*"), ""); err != nil {
+		return pattern{}, fmt.Errorf("invalid glob pattern %q: %v", raw, err)
+	}
+	re, err := regexp.Compile(globToRegex(raw))
+	if err != nil {
+		return pattern{}, fmt.Errorf("invalid glob pattern %q: %v", raw, err)
+	}
+	return pattern{raw: raw, glob: raw, regex: re, base: !strings.Contains(raw, "/")}, nil
+}
+
+// globToRegex translates a glob into an anchored regular expression
+func globToRegex(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+2 < len(glob) && glob[i+1] == '*' && glob[i+2] == '/' {
+				// As in gitignore, "a/**/b" also matches "a/b"
+				sb.WriteString("(?:.*/)?")
+				i += 2
+			} else if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+func (p pattern) matches(absPath string) bool {
+	if p.base {
+		return p.regex.MatchString(path.Base(absPath))
+	}
+	return p.regex.MatchString(absPath)
+}
+
+// Pattern is a single compiled glob or regex pattern
+type Pattern struct {
+	p pattern
+}
+
+// Compile parses one pattern with the same syntax as the filter's
+func Compile(raw string) (*Pattern, error) {
+	p, err := compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Pattern{p: p}, nil
+}
+
+// Match reports whether absPath or one of its parent directories matches
+func (p *Pattern) Match(absPath string) bool {
+	for c := absPath; c != "/" && c != "."; c = path.Dir(c) {
+		if p.p.matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the pattern as it was written
+func (p *Pattern) String() string {
+	return p.p.raw
+}
+
+// Empty reports whether the filter has no patterns
+func (f *Filter) Empty() bool {
+	return f == nil || len(f.exclude) == 0 && len(f.include) == 0
+}
+
+// Keep reports whether the file at absPath (e.g. "/etc/app/x.conf") should be
+// collected and compared
+func (f *Filter) Keep(absPath string) bool {
+	if f.Empty() || f.files[absPath] {
+		return true
+	}
+	dir := f.coveringDir(absPath)
+	if dir == "" {
+		return true // Only paths below configured dirs are filtered
+	}
+	// Check the file and each of its parents up to the configured dir
+	candidates := []string{absPath}
+	for p := path.Dir(absPath); p != dir && strings.HasPrefix(p, dir+"/"); p = path.Dir(p) {
+		candidates = append(candidates, p)
+	}
+	for _, c := range candidates {
+		for _, p := range f.exclude {
+			if p.matches(c) {
+				return false
+			}
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, c := range candidates {
+		for _, p := range f.include {
+			if p.matches(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *Filter) coveringDir(absPath string) string {
+	for _, d := range f.dirs {
+		if strings.HasPrefix(absPath, d+"/") {
+			return d
+		}
+	}
+	return ""
+}
+
+// FindPredicates returns shell-quoted find(1) tests that prune excluded
+// paths below dir on the remote host, to be placed between the starting point
+// and the action. When relative is set, find is started as "find ." inside dir.
+// This is only a pre-filter to save transfer: regexes, include patterns and
+// globs find can't express exactly are left to Keep, which runs locally.
+func (f *Filter) FindPredicates(dir string, relative bool) string {
+	if f.Empty() {
+		return ""
+	}
+	var terms []string
+	for _, p := range f.exclude {
+		switch {
+		case p.glob == "":
+			continue
+		case p.base:
+			terms = append(terms, "-name "+util.ShellQuote(p.glob))
+		case findSafe(p.glob):
+			// A trailing /* or /** matches the same subtree as the pruned directory itself
+			g := strings.TrimSuffix(strings.TrimSuffix(p.glob, "/**"), "/*")
+			if relative {
+				if g != dir && !strings.HasPrefix(g, dir+"/") {
+					continue
+				}
+				g = "." + strings.TrimPrefix(g, dir)
+			}
+			terms = append(terms, "-path "+util.ShellQuote(g))
+		}
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+	return `\( ` + strings.Join(terms, " -o ") + ` \) -prune -o `
+}
+
+// findSafe reports whether a path glob means the same to find -path, whose *
+// also matches slashes: only a final /* or /** segment may contain wildcards
+func findSafe(glob string) bool {
+	g := strings.TrimSuffix(strings.TrimSuffix(glob, "/**"), "/*")
+	return !strings.ContainsAny(g, "*?[\\")
+}
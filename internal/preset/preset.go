@@ -0,0 +1,196 @@
+// Package preset holds curated collections for common comparisons, so a new
+// user can run e.g. --preset sshd without knowing which files matter or which
+// of their lines are noise.
+//
+// Besides the built-in presets, every <name>.json in the presets directory is
+// a preset, so teams can define and share their own. A file preset with the
+// name of a built-in one replaces it.
+package preset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DirEnvVar overrides the location of the presets directory
+const DirEnvVar = "REMOTE_DIFF_PRESETS"
+
+// fileExt marks the preset files in the presets directory
+const fileExt = ".json"
+
+// BuiltIn is the Source of the presets compiled into the tool
+const BuiltIn = "built-in"
+
+// UserDir is the presets directory; empty means DefaultDir
+var UserDir string
+
+// Preset is a named set of paths plus the patterns that suit them. Fields
+// use the config.json syntax, which is also the preset file format.
+type Preset struct {
+	Name        string   `json:"-"`
+	Source      string   `json:"-"` // BuiltIn or the file the preset was read from
+	Description string   `json:"description,omitempty"`
+	Files       []string `json:"files,omitempty"`
+	Dirs        []string `json:"dirs,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+	Include     []string `json:"include,omitempty"`
+	IgnoreLines []string `json:"ignore_lines,omitempty"`
+}
+
+// Lines that rarely matter in hand-edited configuration
+const (
+	commentLines = `^\s*#`
+	blankLines   = `^\s*$`
+)
+
+// Left behind by editors and package managers next to the real files
+var leftovers = []string{"*~", "*.swp", "*.bak", "*.orig", "*.dpkg-*", "*.rpmnew", "*.rpmsave"}
+
+var presets = map[string]Preset{
+	"dotfiles": {
+		Name:        "dotfiles",
+		Description: "the SSH user's shell, editor and git settings",
+		Files: []string{
+			"~/.profile", "~/.bashrc", "~/.bash_profile", "~/.bash_aliases", "~/.zshrc",
+			"~/.inputrc", "~/.vimrc", "~/.tmux.conf", "~/.gitconfig", "~/.ssh/config",
+		},
+		IgnoreLines: []string{commentLines, blankLines},
+	},
+	"nginx": {
+		Name:        "nginx",
+		Description: "the nginx configuration tree",
+		Dirs:        []string{"/etc/nginx"},
+		Exclude:     leftovers,
+		IgnoreLines: []string{commentLines, blankLines},
+	},
+	"sshd": {
+		Name:        "sshd",
+		Description: "the OpenSSH server and client configuration, without host keys",
+		Files:       []string{"/etc/ssh/sshd_config", "/etc/ssh/ssh_config", "/etc/pam.d/sshd"},
+		Dirs:        []string{"/etc/ssh/sshd_config.d", "/etc/ssh/ssh_config.d"},
+		Exclude:     leftovers,
+		IgnoreLines: []string{commentLines, blankLines},
+	},
+}
+
+// DefaultDir returns the presets directory used when UserDir is empty:
+// $REMOTE_DIFF_PRESETS, or presets/ in the user's config directory
+func DefaultDir() (string, error) {
+	if p := os.Getenv(DirEnvVar); p != "" {
+		return p, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to determine user config directory")
+	}
+	return filepath.Join(configDir, "remote-diff-tool", "presets"), nil
+}
+
+// Dir returns the presets directory in use
+func Dir() (string, error) {
+	if UserDir != "" {
+		return UserDir, nil
+	}
+	return DefaultDir()
+}
+
+// Get returns the named preset, preferring a file in the presets directory
+// over a built-in preset
+func Get(name string) (Preset, error) {
+	all, err := List()
+	if err != nil {
+		return Preset{}, err
+	}
+	for _, p := range all {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	names := make([]string, 0, len(all))
+	for _, p := range all {
+		names = append(names, p.Name)
+	}
+	return Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// List returns the available presets in alphabetical order
+func List() ([]Preset, error) {
+	byName := make(map[string]Preset, len(presets))
+	for name, p := range presets {
+		p.Source = BuiltIn
+		byName[name] = p
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read presets directory %s", dir)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), fileExt) || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p, err := Load(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		byName[p.Name] = p
+	}
+
+	all := make([]Preset, 0, len(byName))
+	for _, p := range byName {
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all, nil
+}
+
+// Load reads a preset file; the preset is named after the file
+func Load(path string) (Preset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Preset{}, errors.Wrapf(err, "failed to read preset %s", path)
+	}
+	var p Preset
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Shared files are edited by hand, so a misspelled key is an error rather than a silently empty list
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return Preset{}, errors.Wrapf(err, "failed to parse preset %s", path)
+	}
+	p.Name = strings.TrimSuffix(filepath.Base(path), fileExt)
+	p.Source = path
+	if len(p.Files) == 0 && len(p.Dirs) == 0 {
+		return Preset{}, fmt.Errorf("preset %s has neither files nor dirs", path)
+	}
+	return p, nil
+}
+
+// Marshal formats a preset as a preset file
+func (p Preset) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal preset %s", p.Name)
+	}
+	return append(data, '\n'), nil
+}
+
+// BuiltInNames lists the built-in presets in alphabetical order
+func BuiltInNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,501 @@
+// Package replay records every remote interaction of a run (commands and
+// their output, uploaded and downloaded files) into a fixture directory, and
+// plays a fixture back in place of real servers. A user can record a run that
+// misbehaves and hand over the fixture, and the collection and analysis can
+// then be reproduced without access to their fleet.
+//
+// A fixture is a directory holding fixture.json and a blobs/ subdirectory with
+// transferred file contents, stored by sha256.
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+)
+
+// FixtureFileName is the fixture's index inside the fixture directory
+const FixtureFileName = "fixture.json"
+
+const blobDir = "blobs"
+const fixtureVersion = 1
+
+// Interaction operations, in the order a server's connections made them
+const (
+	OpConnect   = "connect"
+	OpRun       = "run"
+	OpUpload    = "upload"
+	OpDownload  = "download"
+	OpSudoCheck = "sudo-check"
+	OpStat      = "stat"
+	OpReadDir   = "readdir"
+	OpGetwd     = "getwd"
+)
+
+// Interaction is one call on a remote connection
+type Interaction struct {
+	Op         string      `json:"op"`
+	Command    string      `json:"command,omitempty"`
+	Sudo       bool        `json:"sudo,omitempty"`
+	Stdout     string      `json:"stdout,omitempty"` // Also the directory of a getwd
+	Stderr     string      `json:"stderr,omitempty"`
+	RemotePath string      `json:"remote_path,omitempty"`
+	Blob       string      `json:"blob,omitempty"`    // sha256 of the transferred contents, stored under blobs/
+	Result     bool        `json:"result,omitempty"`  // CheckSudoAccess outcome
+	Entries    []FileEntry `json:"entries,omitempty"` // Stat or ReadDir results
+	Error      string      `json:"error,omitempty"`
+	ErrorKind  string      `json:"error_kind,omitempty"` // Lets replayed transfer errors be classified as the originals were
+}
+
+// FileEntry is a recorded os.FileInfo
+type FileEntry struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	UID     uint32      `json:"uid"`
+	GID     uint32      `json:"gid"`
+}
+
+func newFileEntry(info os.FileInfo) FileEntry {
+	e := FileEntry{Name: info.Name(), Size: info.Size(), Mode: info.Mode(), ModTime: info.ModTime()}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		e.UID, e.GID = stat.UID, stat.GID
+	}
+	return e
+}
+
+// fileInfo serves a FileEntry as an os.FileInfo
+type fileInfo struct{ entry FileEntry }
+
+func (fi fileInfo) Name() string       { return fi.entry.Name }
+func (fi fileInfo) Size() int64        { return fi.entry.Size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.entry.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.entry.Mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return &sftp.FileStat{UID: fi.entry.UID, GID: fi.entry.GID} }
+
+// Fixture is the recorded run
+type Fixture struct {
+	Version    int                      `json:"version"`
+	RecordedAt time.Time                `json:"recorded_at"`
+	Config     *config.Config           `json:"config"`
+	Username   string                   `json:"username,omitempty"` // Default SSH user at recording time
+	Servers    map[string][]Interaction `json:"servers"`
+}
+
+// Recorder wraps a Connector and keeps every interaction made through it
+type Recorder struct {
+	dir     string
+	connect collect.Connector
+	mu      sync.Mutex
+	fixture Fixture
+}
+
+// NewRecorder records connections made with connect into dir, which is
+// created if needed. Call Save once the run is over.
+func NewRecorder(dir string, connect collect.Connector) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Join(dir, blobDir), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create fixture directory %s", dir)
+	}
+	return &Recorder{
+		dir:     dir,
+		connect: connect,
+		fixture: Fixture{Version: fixtureVersion, RecordedAt: time.Now().UTC(), Servers: make(map[string][]Interaction)},
+	}, nil
+}
+
+// Connect opens a connection through the wrapped Connector and records it
+func (r *Recorder) Connect(cfg *config.Config, server string, opts *collect.Options) (collect.Remote, error) {
+	r.mu.Lock()
+	if r.fixture.Config == nil {
+		r.fixture.Config = cfg
+		r.fixture.Username = cfg.SSHConfig.Username
+	}
+	r.mu.Unlock()
+
+	remote, err := r.connect(cfg, server, opts)
+	r.add(server, Interaction{Op: OpConnect, Error: errorString(err)})
+	if err != nil {
+		return nil, err
+	}
+	return &recordingRemote{recorder: r, server: server, remote: remote}, nil
+}
+
+func (r *Recorder) add(server string, in Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fixture.Servers[server] = append(r.fixture.Servers[server], in)
+}
+
+// storeBlob copies a transferred file into the fixture and returns its sha256
+func (r *Recorder) storeBlob(localPath string) (string, error) {
+	sum, err := util.CalculateSHA256(localPath)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", localPath)
+	}
+	blobPath := filepath.Join(r.dir, blobDir, sum)
+	if err := os.WriteFile(blobPath, data, 0644); err != nil {
+		return "", errors.Wrapf(err, "failed to write fixture blob %s", blobPath)
+	}
+	return sum, nil
+}
+
+// Save writes fixture.json. Interactions are kept in the order each server made them.
+func (r *Recorder) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.MarshalIndent(r.fixture, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode fixture")
+	}
+	fixturePath := filepath.Join(r.dir, FixtureFileName)
+	if err := os.WriteFile(fixturePath, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write fixture %s", fixturePath)
+	}
+	log.Infof("Recorded %d server(s) to %s", len(r.fixture.Servers), r.dir)
+	return nil
+}
+
+type recordingRemote struct {
+	recorder *Recorder
+	server   string
+	remote   collect.Remote
+}
+
+func (c *recordingRemote) RunCommand(command string, sudo bool) (string, string, error) {
+	stdout, stderr, err := c.remote.RunCommand(command, sudo)
+	c.recorder.add(c.server, Interaction{Op: OpRun, Command: command, Sudo: sudo, Stdout: stdout, Stderr: stderr, Error: errorString(err)})
+	return stdout, stderr, err
+}
+
+// RunCommandInput records the command but not its input, which holds the sudo password
+func (c *recordingRemote) RunCommandInput(command, input string, sudo bool) (string, string, error) {
+	r, ok := c.remote.(collect.InputRemote)
+	if !ok {
+		return "", "", fmt.Errorf("the connection to %s can't write to the standard input of commands", c.server)
+	}
+	stdout, stderr, err := r.RunCommandInput(command, input, sudo)
+	c.recorder.add(c.server, Interaction{Op: OpRun, Command: command, Sudo: sudo, Stdout: stdout, Stderr: stderr, Error: errorString(err)})
+	return stdout, stderr, err
+}
+
+func (c *recordingRemote) UploadFile(localPath, remotePath string) error {
+	err := c.remote.UploadFile(localPath, remotePath)
+	in := Interaction{Op: OpUpload, RemotePath: remotePath, Error: errorString(err), ErrorKind: errorKind(err)}
+	if err == nil {
+		// Keep what was sent (e.g. the collection script) for inspection
+		if in.Blob, err = c.recorder.storeBlob(localPath); err != nil {
+			log.Warnf("[%s] Failed to record upload of %s: %v", c.server, remotePath, err)
+			err = nil
+		}
+	}
+	c.recorder.add(c.server, in)
+	return err
+}
+
+func (c *recordingRemote) DownloadFile(remotePath, localPath string) error {
+	err := c.remote.DownloadFile(remotePath, localPath)
+	in := Interaction{Op: OpDownload, RemotePath: remotePath, Error: errorString(err), ErrorKind: errorKind(err)}
+	if err == nil {
+		var blobErr error
+		if in.Blob, blobErr = c.recorder.storeBlob(localPath); blobErr != nil {
+			// Without the contents the fixture can't be replayed, so this fails the run
+			return errors.Wrapf(blobErr, "failed to record download of %s", remotePath)
+		}
+	}
+	c.recorder.add(c.server, in)
+	return err
+}
+
+func (c *recordingRemote) CheckSudoAccess() bool {
+	ok := c.remote.CheckSudoAccess()
+	c.recorder.add(c.server, Interaction{Op: OpSudoCheck, Result: ok})
+	return ok
+}
+
+func (c *recordingRemote) Stat(remotePath string) (os.FileInfo, error) {
+	fsys, ok := c.remote.(collect.RemoteFS)
+	if !ok {
+		return nil, fmt.Errorf("the connection to %s does not support SFTP collection", c.server)
+	}
+	info, err := fsys.Stat(remotePath)
+	in := Interaction{Op: OpStat, RemotePath: remotePath, Error: errorString(err), ErrorKind: errorKind(err)}
+	if err == nil {
+		in.Entries = []FileEntry{newFileEntry(info)}
+	}
+	c.recorder.add(c.server, in)
+	return info, err
+}
+
+func (c *recordingRemote) ReadDir(remotePath string) ([]os.FileInfo, error) {
+	fsys, ok := c.remote.(collect.RemoteFS)
+	if !ok {
+		return nil, fmt.Errorf("the connection to %s does not support SFTP collection", c.server)
+	}
+	infos, err := fsys.ReadDir(remotePath)
+	in := Interaction{Op: OpReadDir, RemotePath: remotePath, Error: errorString(err), ErrorKind: errorKind(err)}
+	for _, info := range infos {
+		in.Entries = append(in.Entries, newFileEntry(info))
+	}
+	c.recorder.add(c.server, in)
+	return infos, err
+}
+
+func (c *recordingRemote) Getwd() (string, error) {
+	fsys, ok := c.remote.(collect.WorkingDirFS)
+	if !ok {
+		return "", fmt.Errorf("the connection to %s can't look up the SFTP working directory", c.server)
+	}
+	wd, err := fsys.Getwd()
+	c.recorder.add(c.server, Interaction{Op: OpGetwd, Stdout: wd, Error: errorString(err), ErrorKind: errorKind(err)})
+	return wd, err
+}
+
+func (c *recordingRemote) Close() {
+	c.remote.Close()
+}
+
+// Player serves connections from a recorded fixture
+type Player struct {
+	dir     string
+	fixture Fixture
+	mu      sync.Mutex
+	next    map[string]int // Index of each server's next interaction
+}
+
+// Load reads the fixture in dir
+func Load(dir string) (*Player, error) {
+	fixturePath := filepath.Join(dir, FixtureFileName)
+	data, err := os.ReadFile(fixturePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read fixture %s", fixturePath)
+	}
+	p := &Player{dir: dir, next: make(map[string]int)}
+	if err := json.Unmarshal(data, &p.fixture); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse fixture %s", fixturePath)
+	}
+	if p.fixture.Version != fixtureVersion {
+		return nil, fmt.Errorf("unsupported fixture version %d in %s (expected %d)", p.fixture.Version, fixturePath, fixtureVersion)
+	}
+	if p.fixture.Config == nil {
+		return nil, fmt.Errorf("fixture %s has no recorded configuration", fixturePath)
+	}
+	return p, nil
+}
+
+// Config returns the configuration the fixture was recorded with
+func (p *Player) Config() *config.Config {
+	return p.fixture.Config
+}
+
+// Username returns the default SSH user the fixture was recorded with
+func (p *Player) Username() string {
+	return p.fixture.Username
+}
+
+// Connect replays the server's next recorded connection
+func (p *Player) Connect(cfg *config.Config, server string, _ *collect.Options) (collect.Remote, error) {
+	in, err := p.take(server, OpConnect, "")
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != "" {
+		return nil, errors.New(in.Error)
+	}
+	return &replayRemote{player: p, server: server}, nil
+}
+
+// volatile matches the parts of commands that differ between runs, such as
+// the nanosecond timestamp in the remote script name
+var volatile = regexp.MustCompile(`[0-9]{9,}`)
+
+// take returns the server's next interaction, which must be of kind op.
+// A differing command only logs a warning: replay follows the recording.
+func (p *Player) take(server, op, detail string) (Interaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recorded := p.fixture.Servers[server]
+	i := p.next[server]
+	if i >= len(recorded) {
+		return Interaction{}, fmt.Errorf("replay: no more recorded interactions for %s (wanted %s %s)", server, op, detail)
+	}
+	in := recorded[i]
+	if in.Op != op {
+		return Interaction{}, fmt.Errorf("replay diverged for %s at interaction %d: run wants %s %s, fixture has %s %s", server, i+1, op, detail, in.Op, in.Command+in.RemotePath)
+	}
+	p.next[server] = i + 1
+	if recordedDetail := in.Command + in.RemotePath; volatile.ReplaceAllString(recordedDetail, "N") != volatile.ReplaceAllString(detail, "N") {
+		log.Warnf("[%s] Replay: %s differs from the recording (%q, recorded %q)", server, op, detail, recordedDetail)
+	}
+	return in, nil
+}
+
+type replayRemote struct {
+	player *Player
+	server string
+}
+
+func (c *replayRemote) RunCommand(command string, sudo bool) (string, string, error) {
+	in, err := c.player.take(c.server, OpRun, command)
+	if err != nil {
+		return "", "", err
+	}
+	if in.Error != "" {
+		return in.Stdout, in.Stderr, errors.New(in.Error)
+	}
+	return in.Stdout, in.Stderr, nil
+}
+
+// RunCommandInput replays a command; the input isn't recorded, so it's ignored
+func (c *replayRemote) RunCommandInput(command, input string, sudo bool) (string, string, error) {
+	return c.RunCommand(command, sudo)
+}
+
+func (c *replayRemote) UploadFile(localPath, remotePath string) error {
+	in, err := c.player.take(c.server, OpUpload, remotePath)
+	if err != nil {
+		return err
+	}
+	if in.Error != "" {
+		return in.transferError()
+	}
+	return nil
+}
+
+func (c *replayRemote) DownloadFile(remotePath, localPath string) error {
+	in, err := c.player.take(c.server, OpDownload, remotePath)
+	if err != nil {
+		return err
+	}
+	if in.Error != "" {
+		return in.transferError()
+	}
+	blobPath := filepath.Join(c.player.dir, blobDir, in.Blob)
+	data, err := os.ReadFile(blobPath)
+	if err != nil {
+		return errors.Wrapf(err, "replay: failed to read recorded download %s", blobPath)
+	}
+	return errors.Wrapf(os.WriteFile(localPath, data, 0644), "failed to write %s", localPath)
+}
+
+func (c *replayRemote) CheckSudoAccess() bool {
+	in, err := c.player.take(c.server, OpSudoCheck, "")
+	if err != nil {
+		log.Warnf("[%s] %v", c.server, err)
+		return false
+	}
+	return in.Result
+}
+
+func (c *replayRemote) Stat(remotePath string) (os.FileInfo, error) {
+	in, err := c.player.take(c.server, OpStat, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != "" {
+		return nil, in.transferError()
+	}
+	if len(in.Entries) != 1 {
+		return nil, fmt.Errorf("replay: recorded stat of %s has %d entries", remotePath, len(in.Entries))
+	}
+	return fileInfo{in.Entries[0]}, nil
+}
+
+func (c *replayRemote) ReadDir(remotePath string) ([]os.FileInfo, error) {
+	in, err := c.player.take(c.server, OpReadDir, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != "" {
+		return nil, in.transferError()
+	}
+	infos := make([]os.FileInfo, 0, len(in.Entries))
+	for _, e := range in.Entries {
+		infos = append(infos, fileInfo{e})
+	}
+	return infos, nil
+}
+
+func (c *replayRemote) Getwd() (string, error) {
+	in, err := c.player.take(c.server, OpGetwd, "")
+	if err != nil {
+		return "", err
+	}
+	if in.Error != "" {
+		return "", in.transferError()
+	}
+	return in.Stdout, nil
+}
+
+func (c *replayRemote) Close() {}
+
+// Error kinds
+const (
+	kindNotExist   = "not-exist"
+	kindPermission = "permission"
+	kindTransient  = "transient"
+)
+
+// errorKind classifies a transfer error the way the collectors tell them apart
+func errorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, os.ErrNotExist):
+		return kindNotExist
+	case errors.Is(err, os.ErrPermission):
+		return kindPermission
+	case sshutil.IsTransient(err):
+		return kindTransient
+	default:
+		return ""
+	}
+}
+
+// replayedError carries a recorded error message and the kind it was recorded as
+type replayedError struct {
+	msg  string
+	kind error
+}
+
+func (e *replayedError) Error() string { return e.msg }
+func (e *replayedError) Unwrap() error { return e.kind }
+
+// transferError rebuilds a recorded transfer error, including its kind
+func (in Interaction) transferError() error {
+	err := &replayedError{msg: in.Error}
+	switch in.ErrorKind {
+	case kindNotExist:
+		err.kind = os.ErrNotExist
+	case kindPermission:
+		err.kind = os.ErrPermission
+	case kindTransient:
+		err.kind = sftp.ErrSSHFxConnectionLost
+	}
+	return err
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,107 @@
+package report
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CSVColumns is the header of CSV exports. New columns are only ever added
+// at the end, so files keep loading with the same schema.
+var CSVColumns = []string{
+	"run_at",           // When the analysis ran, RFC 3339 in UTC; the same for every row of a run
+	"path",             // Empty for run-level errors
+	"server",           // Set for per-server reports (history, compare-bundles)
+	"status",           // A file status, or "run-error"
+	"category",         // Riskiest change category, if the file has content diffs
+	"similarity",       // Percent, of the least similar pair; empty if none
+	"affected_hosts",   // Servers whose copy differs from the one most have
+	"servers_compared", // Servers with a copy of the file
+	"lines_added",      // Over all pairs
+	"lines_removed",    // Over all pairs
+	"binary",           // true or false
+	"checksums",        // server=sha256 pairs, separated by ;
+	"errors",           // Separated by ;
+}
+
+// StatusRunError marks CSV rows holding a run-level error
+const StatusRunError = "run-error"
+
+// WriteCSV writes one row per file of r, and one per run-level error,
+// optionally preceded by the header
+func WriteCSV(w io.Writer, r *Report, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		cw.Write(CSVColumns)
+	}
+	runAt := r.GeneratedAt.UTC().Format(time.RFC3339)
+	for _, f := range r.Files {
+		similarity := ""
+		if sim, ok := f.Similarity(); ok {
+			similarity = strconv.FormatFloat(sim, 'f', 1, 64)
+		}
+		var added, removed int
+		for _, d := range f.Diffs {
+			a, rm := d.Changes()
+			added += a
+			removed += rm
+		}
+		servers := make([]string, 0, len(f.Checksums))
+		for s := range f.Checksums {
+			servers = append(servers, s)
+		}
+		sort.Strings(servers)
+		sums := make([]string, len(servers))
+		for i, s := range servers {
+			sums[i] = s + "=" + f.Checksums[s]
+		}
+		cw.Write([]string{
+			runAt, f.Path, f.Server, f.Status, f.Category(), similarity,
+			strconv.Itoa(f.AffectedHosts()), strconv.Itoa(len(f.Checksums)),
+			strconv.Itoa(added), strconv.Itoa(removed), strconv.FormatBool(f.Binary),
+			strings.Join(sums, ";"), strings.Join(f.Errors, ";"),
+		})
+	}
+	for _, e := range r.Errors {
+		cw.Write([]string{runAt, "", "", StatusRunError, "", "", "0", "0", "0", "0", "false", "", e})
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "failed to write CSV")
+}
+
+// AppendCSV adds the rows of r to the CSV file at path, creating it with a
+// header if needed. A file with a different header is left alone, so runs
+// never mix schemas.
+func AppendCSV(path string, r *Report) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open CSV export %s", path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", path)
+	}
+	if info.Size() > 0 {
+		first, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "failed to read the header of %s", path)
+		}
+		if got := strings.TrimRight(first, "\r\n"); got != strings.Join(CSVColumns, ",") {
+			return fmt.Errorf("%s has a different header (%q); export to a new file", path, got)
+		}
+	}
+	if err := WriteCSV(f, r, info.Size() == 0); err != nil {
+		return errors.Wrapf(err, "failed to append to %s", path)
+	}
+	return errors.Wrapf(f.Close(), "failed to write %s", path)
+}
@@ -0,0 +1,305 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Differs reports whether a file counts as different in the summary
+func (f FileResult) Differs() bool {
+	switch f.Status {
+	case StatusDifferent, StatusFormatOnly, StatusMetadataOnly, StatusMoved:
+		return true
+	}
+	return false
+}
+
+// Drifting reports whether a file needs attention: it differs or could not
+// be compared, and the difference wasn't acknowledged or expected
+func (f FileResult) Drifting() bool {
+	return (f.Differs() || f.Status == StatusError) && !f.Acknowledged && !f.Expected
+}
+
+// Load reads a report written by Write in JSON or YAML, as its extension says
+func Load(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read report %s", path)
+	}
+	var r Report
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &r)
+	default:
+		data = bytes.TrimSpace(data)
+		if err := reportSchema.Validate(data); err != nil {
+			return nil, errors.Wrapf(err, "report %s", path)
+		}
+		err = json.Unmarshal(data, &r)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse report %s (expected the json or yaml output of analyze)", path)
+	}
+	return &r, nil
+}
+
+// FileChange is how one file's result changed between two reports
+type FileChange struct {
+	Path      string   `json:"path" yaml:"path"`
+	Server    string   `json:"server,omitempty" yaml:"server,omitempty"`
+	OldStatus string   `json:"old_status,omitempty" yaml:"old_status,omitempty"` // Empty when the file wasn't in the old report
+	NewStatus string   `json:"new_status,omitempty" yaml:"new_status,omitempty"` // Empty when the file isn't in the new report
+	Details   []string `json:"details,omitempty" yaml:"details,omitempty"`       // What changed about a file that drifts in both
+}
+
+// Delta summarizes what changed between an old and a new report
+type Delta struct {
+	OldGeneratedAt time.Time    `json:"old_generated_at" yaml:"old_generated_at"`
+	NewGeneratedAt time.Time    `json:"new_generated_at" yaml:"new_generated_at"`
+	NewDrift       []FileChange `json:"new_drift" yaml:"new_drift"`                 // Drifting now, but not before
+	Resolved       []FileChange `json:"resolved" yaml:"resolved"`                   // Drifting before, but not now
+	Changed        []FileChange `json:"changed" yaml:"changed"`                     // Drifting in both, differently
+	Unchanged      int          `json:"unchanged_drift" yaml:"unchanged_drift"`     // Drifting in both, the same way
+	Added          []string     `json:"added,omitempty" yaml:"added,omitempty"`     // Matching files only in the new report
+	Removed        []string     `json:"removed,omitempty" yaml:"removed,omitempty"` // Matching files only in the old report
+}
+
+// Empty reports whether nothing drifts differently
+func (d *Delta) Empty() bool {
+	return len(d.NewDrift)+len(d.Resolved)+len(d.Changed) == 0
+}
+
+// Compare works out what changed from the old to the new report. Files are matched by path
+// and, for per-server reports, server. A file only in one of the reports
+// counts as matching in the other.
+func Compare(oldRep, newRep *Report) *Delta {
+	d := &Delta{
+		OldGeneratedAt: oldRep.GeneratedAt,
+		NewGeneratedAt: newRep.GeneratedAt,
+		NewDrift:       []FileChange{},
+		Resolved:       []FileChange{},
+		Changed:        []FileChange{},
+	}
+	key := func(f FileResult) string { return f.Server + "\x00" + f.Path }
+	before := make(map[string]FileResult, len(oldRep.Files))
+	for _, f := range oldRep.Files {
+		before[key(f)] = f
+	}
+	seen := make(map[string]bool, len(newRep.Files))
+	for _, f := range newRep.Files {
+		seen[key(f)] = true
+		o, existed := before[key(f)]
+		change := FileChange{Path: f.Path, Server: f.Server, NewStatus: f.Status}
+		if existed {
+			change.OldStatus = o.Status
+		}
+		switch {
+		case !existed && !f.Drifting():
+			d.Added = append(d.Added, label(f))
+		case !existed || !o.Drifting():
+			if f.Drifting() {
+				d.NewDrift = append(d.NewDrift, change)
+			}
+		case !f.Drifting():
+			d.Resolved = append(d.Resolved, change)
+		default:
+			if change.Details = driftChanges(o, f); len(change.Details) > 0 {
+				d.Changed = append(d.Changed, change)
+			} else {
+				d.Unchanged++
+			}
+		}
+	}
+	for _, f := range oldRep.Files {
+		if seen[key(f)] {
+			continue
+		}
+		if f.Drifting() {
+			// Left out of the new run, e.g. no longer configured
+			d.Resolved = append(d.Resolved, FileChange{Path: f.Path, Server: f.Server, OldStatus: f.Status})
+		} else {
+			d.Removed = append(d.Removed, label(f))
+		}
+	}
+	for _, changes := range [][]FileChange{d.NewDrift, d.Resolved, d.Changed} {
+		sort.Slice(changes, func(i, j int) bool {
+			if changes[i].Path != changes[j].Path {
+				return changes[i].Path < changes[j].Path
+			}
+			return changes[i].Server < changes[j].Server
+		})
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// label names a file in a delta, with its server for per-server reports
+func label(f FileResult) string {
+	if f.Server != "" {
+		return f.Server + ": " + f.Path
+	}
+	return f.Path
+}
+
+// driftChanges describes how a file that drifts in both reports changed
+func driftChanges(o, f FileResult) []string {
+	var details []string
+	if o.Status != f.Status {
+		details = append(details, fmt.Sprintf("status %s -> %s", o.Status, f.Status))
+	}
+	if oc, nc := o.Category(), f.Category(); oc != nc && oc != "" && nc != "" {
+		details = append(details, fmt.Sprintf("category %s -> %s", oc, nc))
+	}
+	servers := make(map[string]bool)
+	for s := range o.Checksums {
+		servers[s] = true
+	}
+	for s := range f.Checksums {
+		servers[s] = true
+	}
+	var content, gone, appeared []string
+	for s := range servers {
+		oldSum, inOld := o.Checksums[s]
+		newSum, inNew := f.Checksums[s]
+		switch {
+		case !inNew:
+			gone = append(gone, s)
+		case !inOld:
+			appeared = append(appeared, s)
+		case oldSum != newSum:
+			content = append(content, s)
+		}
+	}
+	if len(content) > 0 {
+		sort.Strings(content)
+		details = append(details, "content changed on "+strings.Join(content, ", "))
+	}
+	if len(appeared) > 0 {
+		sort.Strings(appeared)
+		details = append(details, "now compared on "+strings.Join(appeared, ", "))
+	}
+	if len(gone) > 0 {
+		sort.Strings(gone)
+		details = append(details, "no longer compared on "+strings.Join(gone, ", "))
+	}
+	if !sameStrings(o.Metadata, f.Metadata) {
+		details = append(details, "mode or ownership changed")
+	}
+	if !sameStrings(o.Locations, f.Locations) {
+		details = append(details, "locations changed")
+	}
+	if !equalSlices(o.Errors, f.Errors) {
+		details = append(details, "errors changed")
+	}
+	return details
+}
+
+// sameStrings reports whether two maps hold the same entries
+func sameStrings(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// equalSlices reports whether two slices hold the same strings in the same order
+func equalSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidDeltaFormat reports whether format is accepted by WriteDelta
+func ValidDeltaFormat(format string) bool {
+	switch format {
+	case FormatText, FormatJSON, FormatYAML, "":
+		return true
+	}
+	return false
+}
+
+// WriteDelta renders a delta in the requested format
+func WriteDelta(w io.Writer, d *Delta, format string) error {
+	switch format {
+	case FormatText, "":
+		return writeDeltaText(w, d)
+	case FormatJSON:
+		return writeJSON(w, d, deltaSchema, "delta")
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(d); err != nil {
+			return errors.Wrap(err, "failed to encode YAML delta")
+		}
+		return errors.Wrap(enc.Close(), "failed to encode YAML delta")
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+// writeDeltaText renders a delta short enough to post as a daily summary
+func writeDeltaText(w io.Writer, d *Delta) error {
+	fmt.Fprintf(w, "===== Changes since %s =====\n", d.OldGeneratedAt.Format(time.RFC3339))
+	section := func(title string, changes []FileChange, describe func(c FileChange) string) {
+		if len(changes) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s (%d):\n", title, len(changes))
+		for _, c := range changes {
+			fmt.Fprintf(w, "  %s: %s\n", label(FileResult{Path: c.Path, Server: c.Server}), describe(c))
+		}
+	}
+	orNew := func(status string) string {
+		if status == "" {
+			return "not in the old report"
+		}
+		return status
+	}
+	section("New drift", d.NewDrift, func(c FileChange) string {
+		return fmt.Sprintf("%s -> %s", orNew(c.OldStatus), c.NewStatus)
+	})
+	section("Resolved", d.Resolved, func(c FileChange) string {
+		if c.NewStatus == "" {
+			return fmt.Sprintf("%s -> not in the new report", c.OldStatus)
+		}
+		return fmt.Sprintf("%s -> %s", c.OldStatus, c.NewStatus)
+	})
+	section("Changed", d.Changed, func(c FileChange) string {
+		return strings.Join(c.Details, "; ")
+	})
+	if len(d.Added) > 0 {
+		fmt.Fprintf(w, "\nNew matching files: %d\n", len(d.Added))
+	}
+	if len(d.Removed) > 0 {
+		fmt.Fprintf(w, "Matching files no longer reported: %d\n", len(d.Removed))
+	}
+
+	fmt.Fprintln(w, "\n===== Summary =====")
+	fmt.Fprintf(w, "New drift:        %d\n", len(d.NewDrift))
+	fmt.Fprintf(w, "Resolved:         %d\n", len(d.Resolved))
+	fmt.Fprintf(w, "Changed:          %d\n", len(d.Changed))
+	_, err := fmt.Fprintf(w, "Still drifting:   %d (unchanged)\n", d.Unchanged)
+	return err
+}
@@ -0,0 +1,144 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JUnit XML, as Jenkins, GitLab and GitHub test reporters read it: every
+// compared file is a test case, a difference a failure, a file that could
+// not be compared an error, and one left uncompared (unstable, volatile) is
+// skipped, as is an acknowledged difference. Run-level errors are an extra
+// errored case.
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	Skipped   *junitProblem `xml:"skipped,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",cdata"`
+}
+
+// writeJUnit renders the report as JUnit XML
+func writeJUnit(w io.Writer, r *Report) error {
+	suite := junitSuite{Name: "remote-diff-tool", Timestamp: r.GeneratedAt.UTC().Format("2006-01-02T15:04:05")}
+	for _, f := range r.Files {
+		c := junitCase{Classname: "drift", Name: f.Path}
+		if f.Server != "" {
+			c.Classname = "drift." + f.Server
+		}
+		switch {
+		case f.Acknowledged && (f.Differs() || f.Status == StatusError):
+			c.Skipped = &junitProblem{Message: "acknowledged: " + resultMessage(f)}
+			suite.Skipped++
+		case f.Expected:
+			c.Skipped = &junitProblem{Message: "expected to differ: " + resultMessage(f)}
+			suite.Skipped++
+		case f.Status == StatusError:
+			c.Error = &junitProblem{Message: resultMessage(f), Type: f.Status, Text: FileText(f)}
+			suite.Errors++
+		case f.Differs():
+			c.Failure = &junitProblem{Message: resultMessage(f), Type: f.Status, Text: FileText(f)}
+			suite.Failures++
+		case f.Status == StatusUnstable || f.Status == StatusVolatile:
+			c.Skipped = &junitProblem{Message: resultMessage(f)}
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if len(r.Errors) > 0 {
+		suite.Cases = append(suite.Cases, junitCase{
+			Classname: "drift",
+			Name:      "(run)",
+			Error:     &junitProblem{Message: fmt.Sprintf("%d run error(s)", len(r.Errors)), Type: StatusError, Text: strings.Join(r.Errors, "\n")},
+		})
+		suite.Errors++
+	}
+	suite.Tests = len(suite.Cases)
+	suites := junitSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Skipped:  suite.Skipped,
+		Suites:   []junitSuite{suite},
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.Wrap(err, "failed to write JUnit report")
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return errors.Wrap(err, "failed to encode JUnit report")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// resultMessage summarizes a file's result in one line, e.g.
+// "different: web1 vs web2 (66.7% similar, value-changes)"
+func resultMessage(f FileResult) string {
+	var details []string
+	switch {
+	case f.Status == StatusError && len(f.Errors) > 0:
+		details = append(details, f.Errors...)
+	case f.Status == StatusUnstable:
+		details = []string{"changed during collection on " + strings.Join(f.Unstable, ", ")}
+	case f.Status == StatusVolatile:
+		details = []string{"open for writing on " + strings.Join(f.Volatile, ", ")}
+	case f.Status == StatusMoved:
+		details = []string{"same content at different paths"}
+	case f.Status == StatusMetadataOnly:
+		details = []string{"mode or owner differs"}
+	}
+	for _, d := range f.Diffs {
+		from, to := f.pairLabel(d.From, d.To)
+		details = append(details, fmt.Sprintf("%s vs %s%s", from, to, similarityNote(d)))
+	}
+	for _, d := range f.Formats {
+		from, to := f.pairLabel(d.From, d.To)
+		details = append(details, fmt.Sprintf("%s vs %s: %s", from, to, strings.Join(d.Differences, "; ")))
+	}
+	for _, d := range f.Chunks {
+		from, to := f.pairLabel(d.From, d.To)
+		details = append(details, fmt.Sprintf("%s vs %s: %d of %d chunk(s) differ", from, to, d.Differing, d.Chunks))
+	}
+	if f.Binary {
+		details = append(details, "binary content differs")
+	}
+	if len(details) == 0 {
+		return f.Status
+	}
+	return f.Status + ": " + strings.Join(details, "; ")
+}
@@ -0,0 +1,152 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Matrix cells that aren't a variant letter
+const (
+	matrixAbsent   = "-" // Missing, failed, or not part of a per-server row
+	matrixUnstable = "*" // Suffix of a copy that changed during collection or was open for writing
+)
+
+// matrixRow is a file with the variant of each server's copy, in the
+// report's server order
+type matrixRow struct {
+	Name   string
+	Status string
+	Cells  []matrixCell
+}
+
+type matrixCell struct {
+	Text    string
+	Variant int // Index of the copy's content group, -1 without a copy
+}
+
+// matrixRows lays the report out as rows of files and columns of servers.
+// Each file's distinct copies are lettered A, B, ... in server order, so the
+// same letter in a row means the same content.
+func matrixRows(r *Report) []matrixRow {
+	rows := make([]matrixRow, 0, len(r.Files))
+	for _, f := range r.Files {
+		row := matrixRow{Name: f.Path, Status: f.Status}
+		switch {
+		case f.Acknowledged:
+			row.Status += " (acknowledged)"
+		case f.Expected:
+			row.Status += " (expected)"
+		}
+		if f.Server != "" {
+			row.Name = fmt.Sprintf("%s [%s]", f.Path, f.Server)
+		}
+		variant := make(map[string]int)
+		for i, g := range GroupContents(r.Servers, f.Checksums) {
+			for _, s := range g.Servers {
+				variant[s] = i
+			}
+		}
+		unstable := make(map[string]bool)
+		for _, s := range append(append([]string(nil), f.Unstable...), f.Volatile...) {
+			unstable[s] = true
+		}
+		for _, s := range r.Servers {
+			i, ok := variant[s]
+			cell := matrixCell{Text: matrixAbsent, Variant: -1}
+			if ok {
+				cell = matrixCell{Text: groupName(i), Variant: i}
+			}
+			if unstable[s] {
+				cell.Text += matrixUnstable
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// matrixLegend explains the cells of the matrix
+const matrixLegend = "A, B, ...: the distinct copies of each file, lettered in server order; -: missing or not compared; *: changed during collection or open for writing"
+
+// writeMatrix renders the report as a grid of files by servers
+func writeMatrix(w io.Writer, r *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\t%s\tSTATUS\n", strings.Join(r.Servers, "\t"))
+	for _, row := range matrixRows(r) {
+		cells := make([]string, len(row.Cells))
+		for i, c := range row.Cells {
+			cells[i] = c.Text
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", row.Name, strings.Join(cells, "\t"), row.Status)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write matrix")
+	}
+	fmt.Fprintf(w, "\n%s\n", matrixLegend)
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "Error: %s\n", e)
+	}
+	return nil
+}
+
+// variantColors are the background colors of the variants in the HTML
+// matrix; later variants reuse them
+var variantColors = []string{"#d4edda", "#fff3cd", "#f8d7da", "#d1ecf1", "#e2d4f0", "#ffe0c2", "#d6d8db"}
+
+var matrixTemplate = template.Must(template.New("matrix").Funcs(template.FuncMap{
+	"color": func(variant int) string {
+		if variant < 0 {
+			return "#ffffff"
+		}
+		return variantColors[variant%len(variantColors)]
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>remote-diff-tool: {{len .Rows}} file(s) on {{len .Servers}} server(s)</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.6em; }
+th { background: #f4f4f4; position: sticky; top: 0; }
+td.cell { text-align: center; font-family: monospace; }
+td.file { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>Files by server</h1>
+<p>Generated {{.GeneratedAt}}. {{.Legend}}.</p>
+<table>
+<tr><th>File</th>{{range .Servers}}<th>{{.}}</th>{{end}}<th>Status</th></tr>
+{{range .Rows}}<tr><td class="file">{{.Name}}</td>{{range .Cells}}<td class="cell" style="background: {{color .Variant}}">{{.Text}}</td>{{end}}<td>{{.Status}}</td></tr>
+{{end}}</table>
+{{range .Errors}}<p>Error: {{.}}</p>
+{{end}}</body>
+</html>
+`))
+
+// writeMatrixHTML renders the matrix as a standalone HTML page, each
+// variant in its own color
+func writeMatrixHTML(w io.Writer, r *Report) error {
+	data := struct {
+		GeneratedAt string
+		Legend      string
+		Servers     []string
+		Rows        []matrixRow
+		Errors      []string
+	}{
+		GeneratedAt: r.GeneratedAt.UTC().Format("2006-01-02 15:04:05 UTC"),
+		Legend:      matrixLegend,
+		Servers:     r.Servers,
+		Rows:        matrixRows(r),
+		Errors:      r.Errors,
+	}
+	return errors.Wrap(matrixTemplate.Execute(w, data), "failed to write HTML matrix")
+}
@@ -0,0 +1,214 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Sort orders accepted by Report.Sort
+const (
+	SortPath       = "path"       // Alphabetically (the default)
+	SortSeverity   = "severity"   // Riskiest first, see FileResult.Severity
+	SortSimilarity = "similarity" // Least similar first; files without a similarity last
+	SortHosts      = "hosts"      // Most affected hosts first, see FileResult.AffectedHosts
+)
+
+// Groupings of the files of a report, set as FileResult.Group by the analyzer
+const (
+	GroupNone     = "none"
+	GroupStatus   = "status"
+	GroupCategory = "category"
+	GroupOwner    = "owner" // The file's owner on most servers
+	GroupPath     = "path"  // The configured file or dir the file was collected for
+)
+
+// ValidSort reports whether by is accepted by Report.Sort
+func ValidSort(by string) bool {
+	switch by {
+	case SortPath, SortSeverity, SortSimilarity, SortHosts, "":
+		return true
+	}
+	return false
+}
+
+// ValidGroup reports whether by is a known grouping
+func ValidGroup(by string) bool {
+	switch by {
+	case GroupNone, GroupStatus, GroupCategory, GroupOwner, GroupPath, "":
+		return true
+	}
+	return false
+}
+
+// statusSeverity ranks statuses from harmless to worst
+var statusSeverity = map[string]int{
+	StatusIdentical:           0,
+	StatusIdenticalIgnoring:   0,
+	StatusIdenticalNormalized: 0,
+	StatusEquivalent:          0,
+	StatusUnstable:            1,
+	StatusVolatile:            1,
+	StatusFormatOnly:          2,
+	StatusMetadataOnly:        3,
+	StatusMoved:               4,
+	StatusDifferent:           5,
+	StatusError:               6 + len(Categories),
+}
+
+// Severity ranks a file for review: errors first, then content differences
+// by category (a rewrite before an appended line), then moved files, mode or
+// owner changes, format-only changes, files not compared and identical ones.
+// Higher is worse.
+func (f FileResult) Severity() int {
+	s := statusSeverity[f.Status]
+	if f.Status == StatusDifferent {
+		for i, c := range Categories {
+			if c == f.Category() {
+				s += 1 + i
+			}
+		}
+		if f.Binary || len(f.Chunks) > 0 {
+			s += len(Categories) // Unknown extent, so treated like a rewrite
+		}
+	}
+	return s
+}
+
+// AffectedHosts counts the servers whose copy differs from the one most
+// servers have, in content or in mode and ownership. Servers without a
+// valid copy count as affected.
+func (f FileResult) AffectedHosts() int {
+	if f.Status == StatusIdentical || statusSeverity[f.Status] == 0 {
+		return 0
+	}
+	if len(f.Locations) > 0 {
+		return outliers(f.Locations, len(f.Locations))
+	}
+	servers := make(map[string]bool)
+	for s := range f.Checksums {
+		servers[s] = true
+	}
+	for s := range f.Metadata {
+		servers[s] = true
+	}
+	affected := outliers(f.Checksums, len(servers))
+	if n := outliers(f.Metadata, len(servers)); n > affected {
+		affected = n
+	}
+	return affected
+}
+
+// outliers counts the servers of total that don't have the most common value;
+// servers missing from values count as outliers
+func outliers(values map[string]string, total int) int {
+	if len(values) == 0 {
+		return 0
+	}
+	counts := make(map[string]int)
+	most := 0
+	for _, v := range values {
+		counts[v]++
+		if counts[v] > most {
+			most = counts[v]
+		}
+	}
+	return total - most
+}
+
+// Sort orders the files by group and then by the given order, with the path
+// (and server) breaking ties. Call it after Finalize.
+func (r *Report) Sort(by string) error {
+	if !ValidSort(by) {
+		return fmt.Errorf("unknown sort order %q (expected %s, %s, %s or %s)", by, SortPath, SortSeverity, SortSimilarity, SortHosts)
+	}
+	sort.SliceStable(r.Files, func(i, j int) bool {
+		a, b := r.Files[i], r.Files[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		switch by {
+		case SortSeverity:
+			if sa, sb := a.Severity(), b.Severity(); sa != sb {
+				return sa > sb
+			}
+		case SortSimilarity:
+			sa, okA := a.Similarity()
+			sb, okB := b.Similarity()
+			if okA != okB {
+				return okA
+			}
+			if sa != sb {
+				return sa < sb
+			}
+		case SortHosts:
+			if ha, hb := a.AffectedHosts(), b.AffectedHosts(); ha != hb {
+				return ha > hb
+			}
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Server < b.Server
+	})
+	return nil
+}
+
+// DriftedServers returns the servers of a drifting file whose copy is out of
+// line: in a per-server result its server, else those whose content (or path,
+// for moved files) or mode and ownership differ from what most servers have.
+// Servers without a valid copy are out of line. When no value is held by
+// more servers than any other, every server is.
+func (f FileResult) DriftedServers(servers []string) []string {
+	if !f.Drifting() {
+		return nil
+	}
+	if f.Server != "" {
+		return []string{f.Server}
+	}
+	values := f.Checksums
+	if len(f.Locations) > 0 {
+		values = f.Locations
+	}
+	off := minority(values, servers)
+	for s := range minority(f.Metadata, servers) {
+		off[s] = true
+	}
+	var drifted []string
+	for _, s := range servers {
+		if off[s] {
+			drifted = append(drifted, s)
+		}
+	}
+	return drifted
+}
+
+// minority returns the servers that don't have the most common value of
+// values, or all of them if several values are the most common; servers
+// missing from values are in the minority
+func minority(values map[string]string, servers []string) map[string]bool {
+	off := make(map[string]bool)
+	if len(values) == 0 {
+		return off
+	}
+	counts := make(map[string]int)
+	for _, s := range servers {
+		if v, ok := values[s]; ok {
+			counts[v]++
+		}
+	}
+	majority, most, tie := "", 0, false
+	for v, n := range counts {
+		switch {
+		case n > most:
+			majority, most, tie = v, n, false
+		case n == most:
+			tie = true
+		}
+	}
+	for _, s := range servers {
+		if v, ok := values[s]; !ok || tie || v != majority {
+			off[s] = true
+		}
+	}
+	return off
+}
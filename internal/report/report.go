@@ -0,0 +1,855 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/diffengine"
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats accepted by Write
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	// For CI: JUnit XML for test reporters and SARIF for code scanning UIs
+	FormatJUnit = "junit"
+	FormatSARIF = "sarif"
+	// Grids of files by servers, in the terminal or as an HTML page
+	FormatMatrix = "matrix"
+	FormatHTML   = "html"
+)
+
+// File status values
+const (
+	StatusIdentical           = "identical"
+	StatusIdenticalIgnoring   = "identical-ignoring-patterns" // Differs only in lines matched by ignore patterns
+	StatusIdenticalNormalized = "identical-normalized"        // Same after the path's normalization rules
+	StatusEquivalent          = "equivalent"                  // Structured file that differs only in formatting or key order
+	StatusDifferent           = "different"
+	StatusFormatOnly          = "format-only"   // Same text, but line endings, trailing newline or byte order mark differ
+	StatusMetadataOnly        = "metadata-only" // Same contents, but the recorded mode or ownership differs
+	StatusMoved               = "moved"         // Same contents on every server, but at different paths
+	StatusUnstable            = "unstable"      // Changed while it was collected on some servers, so not compared
+	StatusVolatile            = "volatile"      // Open for writing on some servers and not identical, so not compared
+	StatusError               = "error"         // Missing on some servers or could not be compared
+)
+
+// Statuses lists the status values, from identical to error
+var Statuses = []string{StatusIdentical, StatusIdenticalIgnoring, StatusIdenticalNormalized, StatusEquivalent,
+	StatusDifferent, StatusFormatOnly, StatusMetadataOnly, StatusMoved, StatusUnstable, StatusVolatile, StatusError}
+
+// Categories of a content diff, from the least to the most risky. A file's
+// category is that of its riskiest pair.
+const (
+	CategoryReorderOnly = "reorder-only" // The same lines in a different order
+	CategoryAppendOnly  = "append-only"  // Only added lines (or keys)
+	CategoryRemoveOnly  = "remove-only"  // Only removed lines (or keys)
+	CategoryValueChange = "value-changes"
+	CategoryRewrite     = "rewrite" // Little of the file is left, see RewriteSimilarity
+)
+
+// Categories lists the categories from the least to the most risky
+var Categories = []string{CategoryReorderOnly, CategoryAppendOnly, CategoryRemoveOnly, CategoryValueChange, CategoryRewrite}
+
+// RewriteSimilarity is the similarity, in percent, below which a diff counts as a rewrite
+const RewriteSimilarity = 30.0
+
+// Report is the complete result of one analysis run
+type Report struct {
+	GeneratedAt time.Time    `json:"generated_at" yaml:"generated_at"`
+	Servers     []string     `json:"servers" yaml:"servers"`
+	Files       []FileResult `json:"files" yaml:"files"`
+	Summary     Summary      `json:"summary" yaml:"summary"`
+	Errors      []string     `json:"errors,omitempty" yaml:"errors,omitempty"` // Run-level errors not tied to one file
+	// server -> why it was left out of the comparison, e.g. its collection failed
+	Excluded    map[string]string `json:"excluded,omitempty" yaml:"excluded,omitempty"`
+	Annotations []Annotation      `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Events      []Event           `json:"events,omitempty" yaml:"events,omitempty"` // External events between the compared runs, e.g. deploys
+}
+
+// Event is something registered in the timeline, such as a deploy or a
+// patching window, that happened between the compared runs
+type Event struct {
+	Kind    string     `json:"kind" yaml:"kind"`
+	Title   string     `json:"title" yaml:"title"`
+	Start   time.Time  `json:"start" yaml:"start"`
+	End     *time.Time `json:"end,omitempty" yaml:"end,omitempty"`
+	Servers []string   `json:"servers,omitempty" yaml:"servers,omitempty"`
+}
+
+// Annotation is the note and labels a compared collection was made with
+type Annotation struct {
+	Run    string            `json:"run,omitempty" yaml:"run,omitempty"` // Set when a report compares runs (e.g. history)
+	Note   string            `json:"note,omitempty" yaml:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// FileResult holds the comparison outcome for one file path
+type FileResult struct {
+	Path      string            `json:"path" yaml:"path"`
+	Server    string            `json:"server,omitempty" yaml:"server,omitempty"` // Set when a report covers per-server comparisons (e.g. compare-bundles)
+	Group     string            `json:"group,omitempty" yaml:"group,omitempty"`   // Set when results are grouped, e.g. by owner
+	Status    string            `json:"status" yaml:"status"`
+	Checksums map[string]string `json:"checksums" yaml:"checksums"` // server -> sha256
+	Diffs     []PairDiff        `json:"diffs,omitempty" yaml:"diffs,omitempty"`
+	Formats   []FormatDiff      `json:"format_diffs,omitempty" yaml:"format_diffs,omitempty"`
+	Errors    []string          `json:"errors,omitempty" yaml:"errors,omitempty"`
+	Binary    bool              `json:"binary,omitempty" yaml:"binary,omitempty"`           // Compared by size and checksum only, without a content diff
+	Sizes     map[string]int64  `json:"sizes,omitempty" yaml:"sizes,omitempty"`             // server -> bytes, set for binary and large files
+	Chunks    []ChunkDiff       `json:"chunk_diffs,omitempty" yaml:"chunk_diffs,omitempty"` // Set instead of Diffs for large files compared by chunk hashes
+	Metadata  map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`       // server -> "mode owner:group", set only when they differ, whatever the status
+	Unstable  []string          `json:"unstable_on,omitempty" yaml:"unstable_on,omitempty"` // Servers where the file changed during collection
+	Volatile  []string          `json:"volatile_on,omitempty" yaml:"volatile_on,omitempty"` // Servers where the file was open for writing
+	Locations map[string]string `json:"locations,omitempty" yaml:"locations,omitempty"`     // server -> path, for moved files
+	// Servers whose copies are identical, set when more than two copies
+	// differ; Diffs, Formats and Chunks then hold one pair per pair of groups
+	ContentGroups []ContentGroup `json:"content_groups,omitempty" yaml:"content_groups,omitempty"`
+	// Set when the difference is a known, accepted one (see the ack
+	// package); it's listed apart and not counted as a file with diffs
+	Acknowledged bool `json:"acknowledged,omitempty" yaml:"acknowledged,omitempty"`
+	// Set when the config expects the file to differ between servers
+	// (unique); it's listed apart and not counted as a file with diffs either
+	Expected bool `json:"expected,omitempty" yaml:"expected,omitempty"`
+}
+
+// ContentGroup is a set of servers holding the same copy of a file. Groups
+// are named A, B, ... in the order of their first server.
+type ContentGroup struct {
+	Name     string   `json:"name" yaml:"name"`
+	Checksum string   `json:"checksum" yaml:"checksum"`
+	Servers  []string `json:"servers" yaml:"servers"`
+}
+
+// GroupContents groups the servers with a copy of a file by checksum, in
+// the order of their first server. Servers without a checksum are left out.
+func GroupContents(servers []string, checksums map[string]string) []ContentGroup {
+	var groups []ContentGroup
+	index := make(map[string]int)
+	for _, server := range servers {
+		sum, ok := checksums[server]
+		if !ok {
+			continue
+		}
+		i, seen := index[sum]
+		if !seen {
+			i = len(groups)
+			index[sum] = i
+			groups = append(groups, ContentGroup{Name: groupName(i), Checksum: sum})
+		}
+		groups[i].Servers = append(groups[i].Servers, server)
+	}
+	return groups
+}
+
+// groupName names the i-th group A to Z, then AA, AB, ...
+func groupName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// pairLabel names the two sides of a pair in the text format: the servers,
+// or the groups of the servers if the file has content groups
+func (f FileResult) pairLabel(from, to string) (string, string) {
+	label := func(server string) string {
+		for _, g := range f.ContentGroups {
+			for _, s := range g.Servers {
+				if s == server {
+					return "group " + g.Name
+				}
+			}
+		}
+		return server
+	}
+	return label(from), label(to)
+}
+
+// PairTitle names a diff of the file the way its text header does, e.g.
+// "web1 vs web2 (66.7% similar, value-changes)"
+func (f FileResult) PairTitle(d PairDiff) string {
+	from, to := f.pairLabel(d.From, d.To)
+	return from + " vs " + to + similarityNote(d)
+}
+
+// PairDiff is the diff between two servers' copies of a file
+type PairDiff struct {
+	From    string `json:"from" yaml:"from"`
+	To      string `json:"to" yaml:"to"`
+	Hunks   []Hunk `json:"hunks" yaml:"hunks"`
+	Unified string `json:"-" yaml:"-"`                                   // Raw unified text, used by the text format
+	SavedTo string `json:"saved_to,omitempty" yaml:"saved_to,omitempty"` // Diff file, if one was written
+	// Set when the diff is too long to print; the text format only points to SavedTo
+	Collapsed bool `json:"collapsed,omitempty" yaml:"collapsed,omitempty"`
+	// Percentage of lines the copies have in common; unset if it couldn't be computed
+	Similarity *float64 `json:"similarity,omitempty" yaml:"similarity,omitempty"`
+	// Keys that differ, for structured files (JSON, YAML, TOML, INI) that could be parsed
+	KeyChanges []KeyChange `json:"key_changes,omitempty" yaml:"key_changes,omitempty"`
+	Category   string      `json:"category,omitempty" yaml:"category,omitempty"` // One of Categories
+}
+
+// KeyChange is a key of a structured file that was added, removed or changed
+// between two copies. Values are compact JSON.
+type KeyChange struct {
+	Path string `json:"path" yaml:"path"` // e.g. "server.tls.port" or "upstreams[2]"
+	Kind string `json:"kind" yaml:"kind"` // added, removed or changed
+	Old  string `json:"old,omitempty" yaml:"old,omitempty"`
+	New  string `json:"new,omitempty" yaml:"new,omitempty"`
+}
+
+// String formats the change like "~ server.port: 8080 -> 8081"
+func (c KeyChange) String() string {
+	switch c.Kind {
+	case "added":
+		return fmt.Sprintf("+ %s: %s", c.Path, c.New)
+	case "removed":
+		return fmt.Sprintf("- %s: %s", c.Path, c.Old)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// Changes counts the added and removed lines of the diff
+func (d PairDiff) Changes() (added, removed int) {
+	for _, h := range d.Hunks {
+		for _, line := range h.Lines {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				added++
+			case strings.HasPrefix(line, "-"):
+				removed++
+			}
+		}
+	}
+	return added, removed
+}
+
+// ChunkDiff is where two servers' copies of a large file differ, found by
+// comparing the checksums of fixed-size blocks
+type ChunkDiff struct {
+	From      string      `json:"from" yaml:"from"`
+	To        string      `json:"to" yaml:"to"`
+	ChunkSize int64       `json:"chunk_size" yaml:"chunk_size"`
+	Chunks    int         `json:"chunks" yaml:"chunks"`       // Blocks in the longer copy
+	Differing int         `json:"differing" yaml:"differing"` // Blocks that differ
+	Ranges    []ByteRange `json:"ranges" yaml:"ranges"`       // Differing blocks, adjacent ones merged
+}
+
+// ByteRange is an inclusive range of byte offsets
+type ByteRange struct {
+	Start int64 `json:"start" yaml:"start"`
+	End   int64 `json:"end" yaml:"end"`
+}
+
+// String formats the range like "4194304-8388607"
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Similarity returns the similarity of the file's least similar pair of
+// copies, in percent. The bool result is false if no pair has one, e.g. for
+// identical files or ones compared without a content diff.
+func (f FileResult) Similarity() (float64, bool) {
+	lowest, ok := 0.0, false
+	for _, d := range f.Diffs {
+		if d.Similarity != nil && (!ok || *d.Similarity < lowest) {
+			lowest, ok = *d.Similarity, true
+		}
+	}
+	return lowest, ok
+}
+
+// Category returns the riskiest category of the file's pairs, or "" if none has one
+func (f FileResult) Category() string {
+	rank := func(c string) int {
+		for i, known := range Categories {
+			if c == known {
+				return i
+			}
+		}
+		return -1
+	}
+	category := ""
+	for _, d := range f.Diffs {
+		if rank(d.Category) > rank(category) {
+			category = d.Category
+		}
+	}
+	return category
+}
+
+// FormatDiff is a pair of copies holding the same text in different formats
+type FormatDiff struct {
+	From        string   `json:"from" yaml:"from"`
+	To          string   `json:"to" yaml:"to"`
+	Differences []string `json:"differences" yaml:"differences"` // e.g. "line endings: CRLF vs LF"
+}
+
+// Hunk is a serializable unified diff hunk. Lines keep their " ", "-" or "+" prefix.
+type Hunk struct {
+	OldStart int      `json:"old_start" yaml:"old_start"`
+	OldLines int      `json:"old_lines" yaml:"old_lines"`
+	NewStart int      `json:"new_start" yaml:"new_start"`
+	NewLines int      `json:"new_lines" yaml:"new_lines"`
+	Lines    []string `json:"lines" yaml:"lines"`
+}
+
+// Summary holds the run totals
+type Summary struct {
+	TotalCompared       int            `json:"total_compared" yaml:"total_compared"`
+	Identical           int            `json:"identical" yaml:"identical"` // Includes IdenticalIgnoring, Equivalent and IdenticalNormalized
+	IdenticalIgnoring   int            `json:"identical_ignoring_patterns" yaml:"identical_ignoring_patterns"`
+	Equivalent          int            `json:"equivalent" yaml:"equivalent"`
+	IdenticalNormalized int            `json:"identical_normalized" yaml:"identical_normalized"`
+	Different           int            `json:"different" yaml:"different"` // Includes FormatOnly, MetadataOnly and Moved
+	FormatOnly          int            `json:"format_only" yaml:"format_only"`
+	Binary              int            `json:"binary" yaml:"binary"` // Different files with binary content
+	MetadataOnly        int            `json:"metadata_only" yaml:"metadata_only"`
+	Moved               int            `json:"moved" yaml:"moved"`
+	ContentAndMetadata  int            `json:"content_and_metadata" yaml:"content_and_metadata"` // Different or FormatOnly files whose mode or ownership differs too
+	Unstable            int            `json:"unstable" yaml:"unstable"`                         // Neither identical nor different
+	Volatile            int            `json:"volatile" yaml:"volatile"`                         // Neither identical nor different
+	Errors              int            `json:"errors" yaml:"errors"`
+	Acknowledged        int            `json:"acknowledged,omitempty" yaml:"acknowledged,omitempty"` // Files with acknowledged differences, counted in none of the above
+	Expected            int            `json:"expected,omitempty" yaml:"expected,omitempty"`         // Files the config expects to differ, counted in none of the above
+	Categories          map[string]int `json:"categories,omitempty" yaml:"categories,omitempty"`     // Files with content diffs per category (see Categories)
+	Drift               []ServerDrift  `json:"drift,omitempty" yaml:"drift,omitempty"`               // Servers with out-of-line files, most drifted first
+}
+
+// ServerDrift scores how far a server is out of line with the others: the
+// sum of the severities (see FileResult.Severity) of the files where its copy
+// differs from what most servers have
+type ServerDrift struct {
+	Server string `json:"server" yaml:"server"`
+	Score  int    `json:"score" yaml:"score"`
+	Files  int    `json:"files" yaml:"files"`
+}
+
+// HunksFromEngine converts diff engine hunks to their report representation
+func HunksFromEngine(hunks []diffengine.Hunk) []Hunk {
+	out := make([]Hunk, 0, len(hunks))
+	for _, h := range hunks {
+		rh := Hunk{OldStart: h.OldStart, OldLines: h.OldLines, NewStart: h.NewStart, NewLines: h.NewLines}
+		for _, l := range h.Lines {
+			prefix := " "
+			switch l.Kind {
+			case diffengine.Delete:
+				prefix = "-"
+			case diffengine.Insert:
+				prefix = "+"
+			}
+			rh.Lines = append(rh.Lines, prefix+strings.TrimSuffix(l.Text, "\n"))
+		}
+		out = append(out, rh)
+	}
+	return out
+}
+
+// Finalize sorts the file results by path and recomputes the summary
+func (r *Report) Finalize() {
+	sort.Slice(r.Files, func(i, j int) bool {
+		if r.Files[i].Path != r.Files[j].Path {
+			return r.Files[i].Path < r.Files[j].Path
+		}
+		return r.Files[i].Server < r.Files[j].Server
+	})
+	r.Summary = Summary{}
+	for _, f := range r.Files {
+		r.Summary.TotalCompared++
+		if f.Acknowledged {
+			r.Summary.Acknowledged++
+			continue
+		}
+		if f.Expected {
+			r.Summary.Expected++
+			continue
+		}
+		switch f.Status {
+		case StatusIdentical:
+			r.Summary.Identical++
+		case StatusIdenticalIgnoring:
+			r.Summary.Identical++
+			r.Summary.IdenticalIgnoring++
+		case StatusEquivalent:
+			r.Summary.Identical++
+			r.Summary.Equivalent++
+		case StatusIdenticalNormalized:
+			r.Summary.Identical++
+			r.Summary.IdenticalNormalized++
+		case StatusDifferent, StatusFormatOnly:
+			r.Summary.Different++
+			if f.Status == StatusFormatOnly {
+				r.Summary.FormatOnly++
+			}
+			if f.Binary {
+				r.Summary.Binary++
+			}
+			if len(f.Metadata) > 0 {
+				r.Summary.ContentAndMetadata++
+			}
+			if c := f.Category(); c != "" {
+				if r.Summary.Categories == nil {
+					r.Summary.Categories = make(map[string]int)
+				}
+				r.Summary.Categories[c]++
+			}
+		case StatusMetadataOnly:
+			r.Summary.Different++
+			r.Summary.MetadataOnly++
+		case StatusMoved:
+			r.Summary.Different++
+			r.Summary.Moved++
+		case StatusUnstable:
+			r.Summary.Unstable++
+		case StatusVolatile:
+			r.Summary.Volatile++
+		default:
+			r.Summary.Errors++
+		}
+	}
+	r.Summary.Drift = r.drift()
+}
+
+// drift scores the servers by their out-of-line files, highest score first
+func (r *Report) drift() []ServerDrift {
+	index := make(map[string]int)
+	var drift []ServerDrift
+	for _, f := range r.Files {
+		severity := f.Severity()
+		for _, s := range f.DriftedServers(r.Servers) {
+			i, ok := index[s]
+			if !ok {
+				i = len(drift)
+				index[s] = i
+				drift = append(drift, ServerDrift{Server: s})
+			}
+			drift[i].Score += severity
+			drift[i].Files++
+		}
+	}
+	sort.SliceStable(drift, func(i, j int) bool {
+		if drift[i].Score != drift[j].Score {
+			return drift[i].Score > drift[j].Score
+		}
+		if drift[i].Files != drift[j].Files {
+			return drift[i].Files > drift[j].Files
+		}
+		return drift[i].Server < drift[j].Server
+	})
+	return drift
+}
+
+// HasDifferences reports whether any file differed or could not be compared
+func (r *Report) HasDifferences() bool {
+	return r.Summary.Different+r.Summary.Errors > 0
+}
+
+// Write renders the report in the requested format
+func Write(w io.Writer, r *Report, format string) error {
+	switch format {
+	case FormatText, "":
+		return writeText(w, r)
+	case FormatJSON:
+		return writeJSON(w, r, reportSchema, "report")
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(r); err != nil {
+			return errors.Wrap(err, "failed to encode YAML report")
+		}
+		return errors.Wrap(enc.Close(), "failed to encode YAML report")
+	case FormatJUnit:
+		return writeJUnit(w, r)
+	case FormatSARIF:
+		return writeSARIF(w, r)
+	case FormatMatrix:
+		return writeMatrix(w, r)
+	case FormatHTML:
+		return writeMatrixHTML(w, r)
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+// writeJSON encodes v as indented JSON, checked against its schema so that
+// tools reading the output can rely on it
+func writeJSON(w io.Writer, v interface{}, schema *jsonschema.Schema, what string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode JSON %s", what)
+	}
+	if err := schema.Validate(data); err != nil {
+		return errors.Wrapf(err, "JSON %s", what)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// ValidFormat reports whether format is accepted by Write
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatText, FormatJSON, FormatYAML, FormatJUnit, FormatSARIF, FormatMatrix, FormatHTML, "":
+		return true
+	}
+	return false
+}
+
+// writeText renders the human-readable report printed by `analyze`
+func writeText(w io.Writer, r *Report) error {
+	fmt.Fprintln(w, "\n===== Analysis Results =====")
+	for _, a := range r.Annotations {
+		writeAnnotation(w, a)
+	}
+	if len(r.Events) > 0 {
+		fmt.Fprintln(w, "Events between the runs:")
+		for _, e := range r.Events {
+			when := e.Start.UTC().Format(time.RFC3339)
+			if e.End != nil {
+				when += " to " + e.End.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "  %s %s: %s", when, e.Kind, e.Title)
+			if len(e.Servers) > 0 {
+				fmt.Fprintf(w, " (%s)", strings.Join(e.Servers, ", "))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	group := ""
+	var acknowledged, expected []FileResult
+	for _, f := range r.Files {
+		if f.Acknowledged {
+			acknowledged = append(acknowledged, f)
+			continue
+		}
+		if f.Expected {
+			expected = append(expected, f)
+			continue
+		}
+		if f.Group != group {
+			group = f.Group
+			fmt.Fprintf(w, "\n=== %s ===\n", group)
+		}
+		writeFileText(w, f)
+	}
+
+	// Known differences stay visible without drowning the rest
+	writeApart(w, "Acknowledged", acknowledged)
+	writeApart(w, "Expected to differ", expected)
+
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "\nError: %s\n", e)
+	}
+
+	fmt.Fprintln(w, "\n===== Analysis Summary =====")
+	if len(r.Excluded) > 0 {
+		excluded := make([]string, 0, len(r.Excluded))
+		for s := range r.Excluded {
+			excluded = append(excluded, s)
+		}
+		sort.Strings(excluded)
+		fmt.Fprintf(w, "Servers compared:     %d of %d (left out: %s)\n", len(r.Servers), len(r.Servers)+len(excluded), strings.Join(excluded, ", "))
+	}
+	fmt.Fprintf(w, "Total files compared: %d\n", r.Summary.TotalCompared)
+	var alike []string
+	if r.Summary.IdenticalIgnoring > 0 {
+		alike = append(alike, fmt.Sprintf("%d ignoring patterns", r.Summary.IdenticalIgnoring))
+	}
+	if r.Summary.Equivalent > 0 {
+		alike = append(alike, fmt.Sprintf("%d equivalent", r.Summary.Equivalent))
+	}
+	if r.Summary.IdenticalNormalized > 0 {
+		alike = append(alike, fmt.Sprintf("%d after normalization", r.Summary.IdenticalNormalized))
+	}
+	if len(alike) > 0 {
+		fmt.Fprintf(w, "Identical files:      %d (%s)\n", r.Summary.Identical, strings.Join(alike, ", "))
+	} else {
+		fmt.Fprintf(w, "Identical files:      %d\n", r.Summary.Identical)
+	}
+	if r.Summary.Unstable > 0 {
+		fmt.Fprintf(w, "Unstable files:       %d (not compared)\n", r.Summary.Unstable)
+	}
+	if r.Summary.Volatile > 0 {
+		fmt.Fprintf(w, "Volatile files:       %d (not compared)\n", r.Summary.Volatile)
+	}
+	if r.Summary.Acknowledged > 0 {
+		fmt.Fprintf(w, "Acknowledged files:   %d (known differences)\n", r.Summary.Acknowledged)
+	}
+	if r.Summary.Expected > 0 {
+		fmt.Fprintf(w, "Expected to differ:   %d (unique in the config)\n", r.Summary.Expected)
+	}
+	var kinds []string
+	if r.Summary.FormatOnly > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d format only", r.Summary.FormatOnly))
+	}
+	if r.Summary.Binary > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d binary", r.Summary.Binary))
+	}
+	if r.Summary.Moved > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d moved", r.Summary.Moved))
+	}
+	if r.Summary.MetadataOnly > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d mode/owner only", r.Summary.MetadataOnly))
+	}
+	if r.Summary.ContentAndMetadata > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d also in mode/owner", r.Summary.ContentAndMetadata))
+	}
+	if len(kinds) > 0 {
+		fmt.Fprintf(w, "Files with diffs:   %d (%s)\n", r.Summary.Different+r.Summary.Errors, strings.Join(kinds, ", "))
+	} else {
+		fmt.Fprintf(w, "Files with diffs:   %d\n", r.Summary.Different+r.Summary.Errors)
+	}
+	if len(r.Summary.Categories) > 0 {
+		// Riskiest first, so a glance tells whether anything was rewritten
+		fmt.Fprintln(w, "Change categories:")
+		for i := len(Categories) - 1; i >= 0; i-- {
+			if n := r.Summary.Categories[Categories[i]]; n > 0 {
+				fmt.Fprintf(w, "  %-15s %d\n", Categories[i], n)
+			}
+		}
+	}
+	return writeDrift(w, r.Summary.Drift)
+}
+
+// writeApart lists files that differ as expected with a one-line summary each
+func writeApart(w io.Writer, title string, files []FileResult) {
+	if len(files) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n=== %s ===\n", title)
+	for _, f := range files {
+		name := DisplayPath(f.Path)
+		if f.Server != "" {
+			name = fmt.Sprintf("%s [%s]", name, f.Server)
+		}
+		fmt.Fprintf(w, "  %s: %s\n", name, resultMessage(f))
+	}
+}
+
+// maxDriftLines caps the servers listed in the text summary
+const maxDriftLines = 10
+
+// writeDrift lists the most drifted servers with their scores
+func writeDrift(w io.Writer, drift []ServerDrift) error {
+	if len(drift) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "Drift by server (severity-weighted):")
+	for i, d := range drift {
+		if i == maxDriftLines {
+			fmt.Fprintf(w, "  ... and %d more\n", len(drift)-i)
+			break
+		}
+		if _, err := fmt.Fprintf(w, "  %-20s %4d  (%d file(s))\n", d.Server, d.Score, d.Files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileText renders a file's result in the text format, without the blank
+// line around it
+func FileText(f FileResult) string {
+	var buf bytes.Buffer
+	writeFileText(&buf, f)
+	return strings.TrimSpace(buf.String())
+}
+
+// writeFileText renders the result of one file in the text format
+func writeFileText(w io.Writer, f FileResult) {
+	name := DisplayPath(f.Path)
+	if f.Server != "" {
+		name = fmt.Sprintf("%s [%s]", name, f.Server)
+	}
+	switch f.Status {
+	case StatusIdentical:
+		fmt.Fprintf(w, "--- Identical: %s ---\n", name)
+		return
+	case StatusIdenticalIgnoring:
+		fmt.Fprintf(w, "--- Identical (ignoring patterns): %s ---\n", name)
+		return
+	case StatusEquivalent:
+		fmt.Fprintf(w, "--- Equivalent (formatting or key order differs): %s ---\n", name)
+		return
+	case StatusIdenticalNormalized:
+		fmt.Fprintf(w, "--- Identical (after normalization): %s ---\n", name)
+		return
+	case StatusMetadataOnly:
+		fmt.Fprintf(w, "\n--- Mode/owner differences in: %s ---\n", name)
+		writeMetadata(w, f.Metadata)
+		return
+	case StatusMoved:
+		fmt.Fprintf(w, "\n--- Same content, different location: %s ---\n", name)
+		writeLocations(w, f.Locations)
+		return
+	case StatusUnstable:
+		fmt.Fprintf(w, "--- Unstable (changed during collection on %s): %s ---\n", strings.Join(f.Unstable, ", "), name)
+		return
+	case StatusVolatile:
+		fmt.Fprintf(w, "--- Volatile (open for writing on %s): %s ---\n", strings.Join(f.Volatile, ", "), name)
+		return
+	case StatusFormatOnly:
+		fmt.Fprintf(w, "\n--- Format-only differences in: %s ---\n", name)
+	default:
+		if f.Binary {
+			fmt.Fprintf(w, "\n--- Binary files differ: %s ---\n", name)
+		} else if len(f.Chunks) > 0 {
+			fmt.Fprintf(w, "\n--- Large files differ: %s ---\n", name)
+		} else if sim, ok := f.Similarity(); ok {
+			fmt.Fprintf(w, "\n--- Differences found in: %s (%.1f%% similar) ---\n", name, sim)
+		} else {
+			fmt.Fprintf(w, "\n--- Differences found in: %s ---\n", name)
+		}
+	}
+	writeMetadata(w, f.Metadata)
+	for _, g := range f.ContentGroups {
+		fmt.Fprintf(w, "  group %s: %s\n", g.Name, strings.Join(g.Servers, ", "))
+	}
+	for _, d := range f.Formats {
+		from, to := f.pairLabel(d.From, d.To)
+		fmt.Fprintf(w, "  %s vs %s: %s\n", from, to, strings.Join(d.Differences, "; "))
+	}
+	if len(f.Diffs) == 0 && len(f.Formats) == 0 && len(f.Checksums) > 0 {
+		// Checksum-only and binary comparisons have no content diff to show
+		servers := make([]string, 0, len(f.Checksums))
+		for s := range f.Checksums {
+			servers = append(servers, s)
+		}
+		sort.Strings(servers)
+		for _, s := range servers {
+			if size, ok := f.Sizes[s]; ok {
+				fmt.Fprintf(w, "  %s  %10d bytes  %s\n", f.Checksums[s], size, s)
+			} else {
+				fmt.Fprintf(w, "  %s  %s\n", f.Checksums[s], s)
+			}
+		}
+	}
+	for _, d := range f.Chunks {
+		ranges := make([]string, len(d.Ranges))
+		for i, r := range d.Ranges {
+			ranges[i] = r.String()
+		}
+		from, to := f.pairLabel(d.From, d.To)
+		fmt.Fprintf(w, "  %s vs %s: %d of %d chunk(s) of %s differ, bytes %s\n",
+			from, to, d.Differing, d.Chunks, util.FormatBytes(d.ChunkSize), strings.Join(ranges, ", "))
+	}
+	for _, d := range f.Diffs {
+		from, to := f.pairLabel(d.From, d.To)
+		if d.Collapsed {
+			added, removed := d.Changes()
+			fmt.Fprintf(w, "--- Diff %s_vs_%s: %d lines (+%d -%d in %d hunk(s))%s, too long to show ---\n    Full diff: %s\n",
+				from, to, strings.Count(d.Unified, "\n"), added, removed, len(d.Hunks), similarityNote(d), d.SavedTo)
+			continue
+		}
+		if len(d.KeyChanges) > 0 {
+			// Key changes stay readable when a reordered file makes the line diff long
+			fmt.Fprintf(w, "--- Changed keys %s_vs_%s%s ---\n", from, to, similarityNote(d))
+			for _, c := range d.KeyChanges {
+				fmt.Fprintf(w, "  %s\n", c)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "--- Diff %s_vs_%s%s ---\n%s\n", from, to, similarityNote(d), d.Unified)
+	}
+}
+
+// writeAnnotation prints the note and labels of a compared run
+func writeAnnotation(w io.Writer, a Annotation) {
+	run := "Run"
+	if a.Run != "" {
+		run = "Run " + a.Run
+	}
+	if a.Note != "" {
+		fmt.Fprintf(w, "%s note: %s\n", run, a.Note)
+	}
+	if len(a.Labels) > 0 {
+		keys := make([]string, 0, len(a.Labels))
+		for k := range a.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			keys[i] = k + "=" + a.Labels[k]
+		}
+		fmt.Fprintf(w, "%s labels: %s\n", run, strings.Join(keys, ", "))
+	}
+}
+
+// similarityNote formats a pair's similarity and category for a diff header, if it has them
+func similarityNote(d PairDiff) string {
+	var notes []string
+	if d.Similarity != nil {
+		notes = append(notes, fmt.Sprintf("%.1f%% similar", *d.Similarity))
+	}
+	if d.Category != "" {
+		notes = append(notes, d.Category)
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(notes, ", ") + ")"
+}
+
+// writeMetadata lists each server's mode and ownership of a file whose metadata differs
+func writeMetadata(w io.Writer, metadata map[string]string) {
+	if len(metadata) == 0 {
+		return
+	}
+	servers := make([]string, 0, len(metadata))
+	for s := range metadata {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	fmt.Fprintln(w, "    Mode/owner differs:")
+	for _, s := range servers {
+		fmt.Fprintf(w, "      %s  %s\n", metadata[s], s)
+	}
+}
+
+// writeLocations lists each server's path of a moved file. Paths that only
+// differ in their Unicode form are escaped, or they would look the same.
+func writeLocations(w io.Writer, locations map[string]string) {
+	servers := make([]string, 0, len(locations))
+	forms := make(map[string]map[string]bool) // NFC path -> paths
+	for s, p := range locations {
+		servers = append(servers, s)
+		nfc := norm.NFC.String(p)
+		if forms[nfc] == nil {
+			forms[nfc] = make(map[string]bool)
+		}
+		forms[nfc][p] = true
+	}
+	sort.Strings(servers)
+	for _, s := range servers {
+		p := locations[s]
+		name := DisplayPath(p)
+		if len(forms[norm.NFC.String(p)]) > 1 {
+			name = fmt.Sprintf("%+q", p)
+		}
+		fmt.Fprintf(w, "  %s  %s\n", name, s)
+	}
+}
+
+// DisplayPath returns a path for the text output: quoted if it holds control
+// characters (e.g. a newline) or isn't valid UTF-8, which would garble the
+// line it's printed on, and as is otherwise
+func DisplayPath(p string) string {
+	if !utf8.ValidString(p) || strings.IndexFunc(p, unicode.IsControl) >= 0 {
+		return strconv.Quote(p)
+	}
+	return p
+}
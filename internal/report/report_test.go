@@ -0,0 +1,69 @@
+package report
+
+import "testing"
+
+func TestFileTextQuotesPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		file FileResult
+		want string
+	}{
+		{
+			name: "plain path",
+			file: FileResult{Path: "/etc/hosts", Status: StatusIdentical},
+			want: "--- Identical: /etc/hosts ---",
+		},
+		{
+			name: "non-ASCII path as is",
+			file: FileResult{Path: "/etc/i18n/日本.conf", Status: StatusIdentical},
+			want: "--- Identical: /etc/i18n/日本.conf ---",
+		},
+		{
+			name: "newline",
+			file: FileResult{Path: "/etc/app/two\nlines.conf", Status: StatusIdentical},
+			want: `--- Identical: "/etc/app/two\nlines.conf" ---`,
+		},
+		{
+			name: "tab and escape",
+			file: FileResult{Path: "/etc/app/a\tb\x1b[31m", Status: StatusIdentical},
+			want: `--- Identical: "/etc/app/a\tb\x1b[31m" ---`,
+		},
+		{
+			name: "invalid UTF-8",
+			file: FileResult{Path: "/etc/app/\xff.conf", Status: StatusIdentical},
+			want: `--- Identical: "/etc/app/\xff.conf" ---`,
+		},
+		{
+			name: "per-server result",
+			file: FileResult{Path: "/etc/a\rb", Server: "web1", Status: StatusIdentical},
+			want: `--- Identical: "/etc/a\rb" [web1] ---`,
+		},
+		{
+			name: "moved between Unicode spellings",
+			file: FileResult{Path: "/etc/i18n/caf\u00e9.conf", Status: StatusMoved, Locations: map[string]string{
+				"web1": "/etc/i18n/caf\u00e9.conf",
+				"web2": "/etc/i18n/cafe\u0301.conf",
+			}},
+			want: "--- Same content, different location: /etc/i18n/caf\u00e9.conf ---\n" +
+				`  "/etc/i18n/caf\u00e9.conf"  web1` + "\n" +
+				`  "/etc/i18n/cafe\u0301.conf"  web2`,
+		},
+		{
+			name: "moved to a name with a newline",
+			file: FileResult{Path: "/etc/a.conf", Status: StatusMoved, Locations: map[string]string{
+				"web1": "/etc/a.conf",
+				"web2": "/etc/a\n.conf",
+			}},
+			want: "--- Same content, different location: /etc/a.conf ---\n" +
+				"  /etc/a.conf  web1\n" +
+				`  "/etc/a\n.conf"  web2`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FileText(tt.file); got != tt.want {
+				t.Errorf("FileText() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// SARIF 2.1.0, as code scanning UIs read it: every file that isn't
+// identical is a result whose rule is its status. Errors are of level
+// error, content differences warnings, and the rest notes.
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Results     []sarifResult     `json:"results"`
+	Invocations []sarifInvocation `json:"invocations,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string                 `json:"ruleId"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	// Set for acknowledged differences, which code scanning UIs then hide
+	Suppressions []sarifSuppression `json:"suppressions,omitempty"`
+}
+
+type sarifSuppression struct {
+	Kind string `json:"kind"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level   string       `json:"level"`
+	Message sarifMessage `json:"message"`
+}
+
+// sarifRules describes the statuses reported as SARIF rules
+var sarifRules = map[string]string{
+	StatusDifferent:    "The copies of the file differ between servers",
+	StatusFormatOnly:   "The copies hold the same text in different formats (line endings, trailing newline, byte order mark)",
+	StatusMetadataOnly: "The copies are the same, but their mode or ownership differs",
+	StatusMoved:        "The same content is at different paths on different servers",
+	StatusUnstable:     "The file changed while it was collected, so it wasn't compared",
+	StatusVolatile:     "The file was open for writing and differs, so it wasn't compared",
+	StatusError:        "The file is missing on some servers or could not be compared",
+}
+
+// sarifLevel returns the SARIF level of a file's result
+func sarifLevel(f FileResult) string {
+	switch f.Status {
+	case StatusError:
+		return "error"
+	case StatusDifferent:
+		return "warning"
+	}
+	return "note"
+}
+
+// writeSARIF renders the report as a SARIF log
+func writeSARIF(w io.Writer, r *Report) error {
+	used := make(map[string]bool)
+	results := []sarifResult{}
+	for _, f := range r.Files {
+		if _, ok := sarifRules[f.Status]; !ok {
+			continue // Identical in some way
+		}
+		used[f.Status] = true
+		result := sarifResult{
+			RuleID:    f.Status,
+			Level:     sarifLevel(f),
+			Message:   sarifMessage{Text: f.Path + ": " + resultMessage(f)},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: f.Path}}}},
+		}
+		props := make(map[string]interface{})
+		if f.Server != "" {
+			props["server"] = f.Server
+		}
+		if c := f.Category(); c != "" {
+			props["category"] = c
+		}
+		if sim, ok := f.Similarity(); ok {
+			props["similarity"] = sim
+		}
+		if len(f.Checksums) > 0 {
+			props["checksums"] = f.Checksums
+		}
+		if len(props) > 0 {
+			result.Properties = props
+		}
+		switch {
+		case f.Acknowledged:
+			result.Suppressions = []sarifSuppression{{Kind: "external"}}
+		case f.Expected:
+			result.Suppressions = []sarifSuppression{{Kind: "inSource"}} // Declared in the config
+		}
+		results = append(results, result)
+	}
+
+	ids := make([]string, 0, len(used))
+	for id := range used {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	rules := []sarifRule{}
+	for _, id := range ids {
+		rules = append(rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: sarifRules[id]}})
+	}
+
+	run := sarifRun{
+		Tool:    sarifTool{Driver: sarifDriver{Name: "remote-diff-tool", Rules: rules}},
+		Results: results,
+	}
+	if len(r.Errors) > 0 {
+		inv := sarifInvocation{ExecutionSuccessful: false}
+		for _, e := range r.Errors {
+			inv.ToolExecutionNotifications = append(inv.ToolExecutionNotifications, sarifNotification{Level: "error", Message: sarifMessage{Text: e}})
+		}
+		run.Invocations = []sarifInvocation{inv}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(sarifLog{Version: "2.1.0", Schema: sarifSchema, Runs: []sarifRun{run}}), "failed to encode SARIF report")
+}
@@ -0,0 +1,50 @@
+package report
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+)
+
+// enums are the allowed values of the report's string fields
+var enums = map[string][]string{
+	"FileResult.status":     Statuses,
+	"FileChange.old_status": Statuses,
+	"FileChange.new_status": Statuses,
+	"PairDiff.category":     Categories,
+	"KeyChange.kind":        {"added", "removed", "changed"},
+}
+
+var (
+	reportSchema = jsonschema.For(Report{}, jsonschema.Options{
+		Name:        "report",
+		Title:       "Analysis report",
+		Description: "The output of analyze --format json: every compared file's status and diffs, and the summary",
+		Enums:       enums,
+	})
+	summarySchema = jsonschema.For(Summary{}, jsonschema.Options{
+		Name:        "summary",
+		Title:       "Analysis summary",
+		Description: "The summary of an analysis report: files by status and the servers ranked by drift",
+		Enums:       enums,
+	})
+	deltaSchema = jsonschema.For(Delta{}, jsonschema.Options{
+		Name:        "delta",
+		Title:       "Report delta",
+		Description: "The output of report diff --format json: how the drift changed between two reports",
+		Enums:       enums,
+	})
+)
+
+// Schema returns the JSON Schema of reports written with FormatJSON
+func Schema() *jsonschema.Schema {
+	return reportSchema
+}
+
+// SummarySchema returns the JSON Schema of a report's summary
+func SummarySchema() *jsonschema.Schema {
+	return summarySchema
+}
+
+// DeltaSchema returns the JSON Schema of deltas written with FormatJSON
+func DeltaSchema() *jsonschema.Schema {
+	return deltaSchema
+}
@@ -0,0 +1,469 @@
+// Package server exposes collection and analysis as a REST API: clients start
+// a job, poll its status and fetch its report and diffs, instead of running
+// the CLI themselves.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/timeline"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenEnvVar holds the bearer token clients must send, when none is given
+// on the command line
+const TokenEnvVar = "REMOTE_DIFF_API_TOKEN"
+
+// APIPrefix is the path all API endpoints are under
+const APIPrefix = "/api/v1"
+
+// Job statuses
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded" // Collected and analyzed, whether or not files differ
+	StatusFailed    = "failed"
+	StatusCanceled  = "canceled"
+)
+
+// Request is what a job collects. Empty fields keep the settings of the
+// server's config file.
+type Request struct {
+	Servers []string `json:"servers,omitempty"`
+	Files   []string `json:"files,omitempty"`
+	Dirs    []string `json:"dirs,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	Include []string `json:"include,omitempty"`
+	Presets []string `json:"presets,omitempty"`
+	// Saved with the collection, e.g. to tie it to the deployment it verifies
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RunFunc collects and analyzes a request into dir. It may return a partial
+// report with an error.
+type RunFunc func(ctx context.Context, dir string, req Request) (*report.Report, error)
+
+// Job is one collection and analysis
+type Job struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	Request  Request         `json:"request"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Drift    *bool           `json:"drift,omitempty"` // Set once analyzed: files differ, can't be compared or the run had errors
+	Summary  *report.Summary `json:"summary,omitempty"`
+
+	dir    string
+	report *report.Report
+	cancel context.CancelFunc
+}
+
+// done reports whether the job has finished, one way or another
+func (j *Job) done() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCanceled
+}
+
+// Server runs jobs one at a time, in the order they were started, each in
+// its own directory below a data directory
+type Server struct {
+	dataDir     string
+	timelineDir string // Output directory whose timeline the API registers events in
+	token       string
+	keepJobs    int
+	run         RunFunc
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string // IDs, oldest first
+	queue chan *Job
+}
+
+// New returns a Server keeping job directories in dataDir and registering
+// timeline events in timelineDir. Clients must send token as a bearer token
+// unless it is empty. Only the newest keepJobs finished jobs are kept (0
+// keeps all); at most maxQueued wait to run.
+func New(dataDir, timelineDir, token string, keepJobs, maxQueued int, run RunFunc) (*Server, error) {
+	if maxQueued < 1 {
+		return nil, fmt.Errorf("the queue must hold at least one job")
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create data directory %s", dataDir)
+	}
+	return &Server{
+		dataDir:     dataDir,
+		timelineDir: timelineDir,
+		token:       token,
+		keepJobs:    keepJobs,
+		run:         run,
+		jobs:        map[string]*Job{},
+		queue:       make(chan *Job, maxQueued),
+	}, nil
+}
+
+// Work runs queued jobs until ctx is done, and returns once the running job
+// has stopped
+func (s *Server) Work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-s.queue:
+			if ctx.Err() != nil {
+				return // Both were ready; don't start a job only to cancel it
+			}
+			s.runJob(ctx, job)
+		}
+	}
+}
+
+// runJob runs one job and records its outcome
+func (s *Server) runJob(ctx context.Context, job *Job) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	if job.Status != StatusQueued { // Canceled while waiting
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	job.Status, job.Started, job.cancel = StatusRunning, &now, cancel
+	s.mu.Unlock()
+
+	log.Infof("Job %s: started", job.ID)
+	rep, err := s.run(jobCtx, job.dir, job.Request)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	job.Finished, job.cancel = &finished, nil
+	if rep != nil {
+		drift := rep.HasDifferences() || len(rep.Errors) > 0
+		job.report, job.Summary, job.Drift = rep, &rep.Summary, &drift
+	}
+	switch {
+	case jobCtx.Err() != nil:
+		job.Status, job.Error = StatusCanceled, "canceled"
+	case err != nil:
+		job.Status, job.Error = StatusFailed, err.Error()
+	default:
+		job.Status = StatusSucceeded
+	}
+	log.Infof("Job %s: %s in %s", job.ID, job.Status, finished.Sub(*job.Started).Round(time.Millisecond))
+	s.prune()
+}
+
+// prune drops the oldest finished jobs beyond keepJobs, with their
+// directories. The caller holds s.mu.
+func (s *Server) prune() {
+	if s.keepJobs <= 0 {
+		return
+	}
+	finished := 0
+	for i := len(s.order) - 1; i >= 0; i-- {
+		job := s.jobs[s.order[i]]
+		if !job.done() {
+			continue
+		}
+		if finished++; finished <= s.keepJobs {
+			continue
+		}
+		if err := os.RemoveAll(job.dir); err != nil {
+			log.Warnf("Failed to remove the directory of job %s: %v", job.ID, err)
+		}
+		delete(s.jobs, job.ID)
+		s.order = append(s.order[:i], s.order[i+1:]...)
+	}
+}
+
+// newID returns a sortable, unique job ID like 20261016T131626-3f9a1c
+func newID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// Handler returns the HTTP handler of the API:
+//
+//	GET    /healthz
+//	POST   /api/v1/jobs                start a job (body: Request)
+//	GET    /api/v1/jobs                list jobs, newest first
+//	GET    /api/v1/jobs/{id}           status of a job
+//	DELETE /api/v1/jobs/{id}           cancel a job
+//	GET    /api/v1/jobs/{id}/report    report (?format=json, yaml or text)
+//	GET    /api/v1/jobs/{id}/diff      result of one file (?path=...[&server=...][&format=text])
+//	POST   /api/v1/timeline            register an external event (body: timeline.Event)
+//	GET    /api/v1/timeline            list events, oldest first (?since=...&until=...)
+//	DELETE /api/v1/timeline/{id}       delete an event
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.Handle(APIPrefix+"/jobs", s.authorize(http.HandlerFunc(s.handleJobs)))
+	mux.Handle(APIPrefix+"/jobs/", s.authorize(http.HandlerFunc(s.handleJob)))
+	mux.Handle(APIPrefix+"/timeline", s.authorize(http.HandlerFunc(s.handleTimeline)))
+	mux.Handle(APIPrefix+"/timeline/", s.authorize(http.HandlerFunc(s.handleTimelineEvent)))
+	return mux
+}
+
+// authorize rejects requests without the bearer token
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleJobs starts and lists jobs
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		jobs := make([]Job, 0, len(s.order))
+		for i := len(s.order) - 1; i >= 0; i-- {
+			jobs = append(jobs, *s.jobs[s.order[i]])
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		var req Request
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		job := &Job{ID: newID(), Status: StatusQueued, Request: req, Created: time.Now().UTC()}
+		job.dir = filepath.Join(s.dataDir, job.ID)
+		s.mu.Lock()
+		select {
+		case s.queue <- job:
+		default:
+			s.mu.Unlock()
+			writeError(w, http.StatusServiceUnavailable, "too many jobs waiting, try again later")
+			return
+		}
+		s.jobs[job.ID] = job
+		s.order = append(s.order, job.ID)
+		snapshot := *job
+		s.mu.Unlock()
+		log.Infof("Job %s: queued", job.ID)
+		w.Header().Set("Location", APIPrefix+"/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, snapshot)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// handleTimeline registers and lists timeline events
+func (s *Server) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		events, err := timeline.List(s.timelineDir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("since") != "" || q.Get("until") != "" {
+			from, to := time.Time{}, time.Now()
+			if v := q.Get("since"); v != "" {
+				if from, err = timeline.ParseTime(v); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			if v := q.Get("until"); v != "" {
+				if to, err = timeline.ParseTime(v); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			events = timeline.Between(events, from, to, nil)
+		}
+		if events == nil {
+			events = []timeline.Event{}
+		}
+		writeJSON(w, http.StatusOK, events)
+	case http.MethodPost:
+		var e timeline.Event
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid event: "+err.Error())
+			return
+		}
+		if e.Start.IsZero() {
+			e.Start = time.Now()
+		}
+		if err := e.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		e, err := timeline.Add(s.timelineDir, e)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Infof("Registered %s event %s: %s", e.Kind, e.ID, e.Title)
+		w.Header().Set("Location", APIPrefix+"/timeline/"+e.ID)
+		writeJSON(w, http.StatusCreated, e)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// handleTimelineEvent deletes one timeline event
+func (s *Server) handleTimelineEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "use DELETE")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, APIPrefix+"/timeline/")
+	if err := timeline.Remove(s.timelineDir, id); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleJob serves one job, its report and its diffs
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, APIPrefix+"/jobs/"), "/")
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no job %q", id))
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, snapshot)
+	case sub == "" && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		switch {
+		case job.Status == StatusQueued:
+			now := time.Now().UTC()
+			job.Status, job.Error, job.Finished = StatusCanceled, "canceled", &now
+		case job.cancel != nil:
+			job.cancel() // runJob records the outcome
+		}
+		snapshot = *job
+		s.mu.Unlock()
+		writeJSON(w, http.StatusAccepted, snapshot)
+	case r.Method != http.MethodGet:
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+	case sub != "report" && sub != "diff":
+		writeError(w, http.StatusNotFound, "unknown endpoint "+r.URL.Path)
+	case snapshot.report == nil:
+		writeError(w, http.StatusConflict, fmt.Sprintf("job %s has no report (status %s)", id, snapshot.Status))
+	case sub == "report":
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = report.FormatJSON
+		}
+		if !report.ValidFormat(format) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+			return
+		}
+		w.Header().Set("Content-Type", contentType(format))
+		if err := report.Write(w, snapshot.report, format); err != nil {
+			log.Errorf("Job %s: failed to send the report: %v", id, err)
+		}
+	default:
+		s.serveDiff(w, r, snapshot.report)
+	}
+}
+
+// serveDiff sends the result of one file of rep, or its unified diffs with format=text
+func (s *Server) serveDiff(w http.ResponseWriter, r *http.Request, rep *report.Report) {
+	q := r.URL.Query()
+	path := strings.TrimPrefix(q.Get("path"), "/")
+	var found []report.FileResult
+	for _, f := range rep.Files {
+		if f.Path == path && (q.Get("server") == "" || f.Server == q.Get("server")) {
+			found = append(found, f)
+		}
+	}
+	if len(found) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no file %q in the report", q.Get("path")))
+		return
+	}
+	if q.Get("format") != report.FormatText {
+		if len(found) == 1 {
+			writeJSON(w, http.StatusOK, found[0])
+		} else {
+			writeJSON(w, http.StatusOK, found)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", contentType(report.FormatText))
+	for _, f := range found {
+		for _, d := range f.Diffs {
+			fmt.Fprint(w, d.Unified)
+		}
+	}
+}
+
+// contentType returns the media type of a report format
+func contentType(format string) string {
+	switch format {
+	case report.FormatJSON:
+		return "application/json"
+	case report.FormatYAML:
+		return "application/yaml"
+	case report.FormatJUnit:
+		return "application/xml"
+	case report.FormatSARIF:
+		return "application/sarif+json"
+	case report.FormatHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// writeJSON sends v as JSON with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debugf("Failed to send response: %v", err)
+	}
+}
+
+// writeError sends an error as {"error": msg}
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
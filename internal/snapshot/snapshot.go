@@ -0,0 +1,129 @@
+// Package snapshot keeps timestamped copies of collections, so a server can be
+// compared with its own earlier state as well as with other servers.
+//
+// A snapshot is a directory below <outputDir>/snapshots/ laid out like an
+// output directory: it holds collected-files/ with the manifest and a
+// files-<server>/ dir per server. Collected files are hard-linked from
+// collected-files/ where possible, which is safe because collections replace
+// a server's files instead of rewriting them.
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dir is the directory below the output directory that holds the snapshots
+const Dir = "snapshots"
+
+// idFormat names snapshots by their UTC creation time, so they sort by age
+const idFormat = "20060102-150405"
+
+// Path returns the directory of a snapshot
+func Path(outputDir, id string) string {
+	return filepath.Join(outputDir, Dir, id)
+}
+
+// Time returns when a snapshot was taken, from its ID
+func Time(id string) (time.Time, error) {
+	if len(id) < len(idFormat) {
+		return time.Time{}, fmt.Errorf("snapshot ID %s is not a timestamp", id)
+	}
+	t, err := time.Parse(idFormat, id[:len(idFormat)])
+	return t, errors.Wrapf(err, "snapshot ID %s is not a timestamp", id)
+}
+
+// Take copies the current collection of outputDir into a new snapshot and
+// returns its ID
+func Take(outputDir string) (string, error) {
+	collected := filepath.Join(outputDir, config.CollectedFilesBaseDir)
+	manifest, err := config.LoadManifest(outputDir)
+	if err != nil {
+		return "", errors.Wrap(err, "nothing to snapshot")
+	}
+
+	id := time.Now().UTC().Format(idFormat)
+	dir := Path(outputDir, id)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		// Two collections within one second
+		id = fmt.Sprintf("%s-%d", time.Now().UTC().Format(idFormat), n)
+		dir = Path(outputDir, id)
+	}
+
+	for server := range manifest.FilesByServer {
+		serverDir := fmt.Sprintf("files-%s", server)
+		src := filepath.Join(collected, serverDir)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := util.CopyTree(src, filepath.Join(dir, config.CollectedFilesBaseDir, serverDir), true); err != nil {
+			os.RemoveAll(dir)
+			return "", errors.Wrapf(err, "failed to snapshot the files of %s", server)
+		}
+	}
+	// The manifest is rewritten in place by the next collection, so it is always copied
+	if err := manifest.Save(dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	log.Infof("Saved snapshot %s in %s", id, dir)
+	return id, nil
+}
+
+// List returns the IDs of the snapshots in outputDir, oldest first
+func List(outputDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(outputDir, Dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Annotation returns the note and labels of a snapshot's collection, or nil
+// if it has none
+func Annotation(outputDir, id string) (*config.RunAnnotation, error) {
+	manifest, err := config.LoadManifest(Path(outputDir, id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read snapshot %s", id)
+	}
+	return manifest.Annotation, nil
+}
+
+// Prune deletes all but the newest keep snapshots and returns the deleted IDs
+func Prune(outputDir string, keep int) ([]string, error) {
+	ids, err := List(outputDir)
+	if err != nil || len(ids) <= keep {
+		return nil, err
+	}
+	removed := ids[:len(ids)-keep]
+	for _, id := range removed {
+		if err := os.RemoveAll(Path(outputDir, id)); err != nil {
+			return nil, errors.Wrapf(err, "failed to delete snapshot %s", id)
+		}
+		log.Infof("Deleted snapshot %s", id)
+	}
+	return removed, nil
+}
@@ -0,0 +1,298 @@
+package sshconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxIncludeDepth stops Include loops, matching OpenSSH's limit
+const maxIncludeDepth = 16
+
+// HostSettings holds the subset of ssh_config keywords the tool understands.
+// Empty fields mean the keyword wasn't set for the host.
+type HostSettings struct {
+	HostName     string
+	User         string
+	Port         int
+	IdentityFile string
+	ProxyJump    string
+}
+
+// block is one Host section; the settings before the first Host line use the pattern "*"
+type block struct {
+	patterns []string
+	settings []setting
+}
+
+type setting struct {
+	key   string // Lower-cased keyword
+	value string
+}
+
+// Config is a parsed OpenSSH client configuration
+type Config struct {
+	blocks []block
+}
+
+// DefaultPath returns the user's OpenSSH config file (~/.ssh/config)
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// Load parses the file at path. A missing file yields an empty Config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if err := cfg.loadFile(path, 0); err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			log.Debugf("No SSH config at %s", path)
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Parse reads a configuration from r. Include directives are resolved relative to ~/.ssh.
+func Parse(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	if err := cfg.parse(r, "<input>", 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(file string, depth int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open SSH config %s", file)
+	}
+	defer f.Close()
+	return c.parse(f, file, depth)
+}
+
+func (c *Config) parse(r io.Reader, file string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("too many nested Include directives in %s", file)
+	}
+	if len(c.blocks) == 0 {
+		c.blocks = append(c.blocks, block{patterns: []string{"*"}})
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		key, value, ok := splitLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		switch key {
+		case "host":
+			c.blocks = append(c.blocks, block{patterns: splitArgs(value)})
+		case "match":
+			// Match criteria aren't evaluated; its settings never apply
+			log.Debugf("%s:%d: ignoring Match block", file, lineNo)
+			c.blocks = append(c.blocks, block{})
+		case "include":
+			for _, pattern := range splitArgs(value) {
+				if err := c.include(pattern, depth); err != nil {
+					return err
+				}
+			}
+		default:
+			cur := &c.blocks[len(c.blocks)-1]
+			cur.settings = append(cur.settings, setting{key: key, value: value})
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "failed to read SSH config %s", file)
+}
+
+// include parses every file matching pattern; relative patterns are below ~/.ssh
+func (c *Config) include(pattern string, depth int) error {
+	pattern = expandTilde(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(DefaultPath()), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "invalid Include pattern %s", pattern)
+	}
+	for _, m := range matches {
+		// Settings after an Include stay in the block the Include appeared in
+		current := c.blocks[len(c.blocks)-1]
+		if err := c.loadFile(m, depth+1); err != nil {
+			return err
+		}
+		c.blocks = append(c.blocks, block{patterns: current.patterns})
+	}
+	return nil
+}
+
+// splitLine returns the lower-cased keyword and value of a config line.
+// Both "Key value" and "Key=value" forms are accepted.
+func splitLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	idx := strings.IndexAny(line, " \t=")
+	if idx < 0 {
+		return strings.ToLower(line), "", true
+	}
+	key := strings.ToLower(line[:idx])
+	value := strings.TrimSpace(line[idx:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	return key, value, true
+}
+
+// splitArgs splits a value on whitespace, honoring double quotes
+func splitArgs(value string) []string {
+	var args []string
+	var cur strings.Builder
+	inQuote := false
+	for _, r := range value {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case (r == ' ' || r == '\t') && !inQuote:
+			if cur.Len() > 0 {
+				args = append(args, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// matches implements Host pattern matching: * and ? wildcards, and !negation,
+// which rejects the host even if another pattern matched
+func (b block) matches(host string) bool {
+	matched := false
+	for _, p := range b.patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		ok, err := path.Match(strings.ToLower(p), strings.ToLower(host))
+		if err != nil || !ok {
+			continue
+		}
+		if negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Lookup returns the settings that apply to alias. As in OpenSSH, the first
+// value found for each keyword wins.
+func (c *Config) Lookup(alias string) HostSettings {
+	seen := make(map[string]bool)
+	var hs HostSettings
+	for _, b := range c.blocks {
+		if !b.matches(alias) {
+			continue
+		}
+		for _, s := range b.settings {
+			if seen[s.key] {
+				continue
+			}
+			value := unquote(s.value)
+			switch s.key {
+			case "hostname":
+				hs.HostName = value
+			case "user":
+				hs.User = value
+			case "port":
+				port, err := strconv.Atoi(value)
+				if err != nil {
+					log.Warnf("Ignoring invalid Port %q for %s in SSH config", value, alias)
+					continue
+				}
+				hs.Port = port
+			case "identityfile":
+				hs.IdentityFile = value
+			case "proxyjump":
+				hs.ProxyJump = value
+			default:
+				continue
+			}
+			seen[s.key] = true
+		}
+	}
+
+	// Tokens are expanded once every value is known
+	if hs.HostName != "" {
+		hs.HostName = expandTokens(hs.HostName, alias, hs)
+	}
+	if hs.IdentityFile != "" {
+		hs.IdentityFile = expandTilde(expandTokens(hs.IdentityFile, alias, hs))
+	}
+	return hs
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// expandTokens replaces the %-tokens that are meaningful for HostName and IdentityFile
+func expandTokens(s, alias string, hs HostSettings) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	host := hs.HostName
+	if host == "" || strings.Contains(host, "%") {
+		host = alias
+	}
+	home, _ := os.UserHomeDir()
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	port := ""
+	if hs.Port != 0 {
+		port = strconv.Itoa(hs.Port)
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%n", alias,
+		"%d", home,
+		"%u", localUser,
+		"%r", hs.User,
+		"%p", port,
+	).Replace(s)
+}
+
+// expandTilde replaces a leading ~ with the user's home directory
+func expandTilde(p string) string {
+	if !strings.HasPrefix(p, "~") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
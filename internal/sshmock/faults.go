@@ -0,0 +1,239 @@
+package sshmock
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+)
+
+// AllServers stands for every server of the fleet in a fault spec
+const AllServers = "*"
+
+// Faults are the failures a mock server simulates, so that retries, partial
+// results and reporting can be tested end to end
+type Faults struct {
+	Refuse  bool  // Every connection is closed before the SSH handshake
+	Drop    int   // The first Drop connections are closed before the handshake
+	Slow    int64 // The server sends at most this many bytes per second (0 = unlimited)
+	Cut     int64 // The first connection to send this many bytes is closed there
+	Corrupt int   // The first Corrupt tarball downloads have a byte flipped; -1 for all of them
+}
+
+// ParseFaults parses --mock-fault specs, each <server>=<fault>[,<fault>...]
+// with the faults refuse, drop[:N], slow:RATE, cut:BYTES and corrupt[:N]
+// (e.g. web2=drop:2 or *=slow:256K). Server "*" applies to every server;
+// a server's own spec overrides it fault by fault.
+func ParseFaults(specs []string) (map[string]Faults, error) {
+	faults := make(map[string]Faults)
+	for _, spec := range specs {
+		server, list, ok := strings.Cut(spec, "=")
+		server = strings.TrimSpace(server)
+		if !ok || server == "" || strings.TrimSpace(list) == "" {
+			return nil, fmt.Errorf("invalid mock fault %q (expected <server>=<fault>[,<fault>...])", spec)
+		}
+		f := faults[server]
+		for _, fault := range strings.Split(list, ",") {
+			name, value, hasValue := strings.Cut(strings.TrimSpace(fault), ":")
+			count := func(def int) (int, error) {
+				if !hasValue {
+					return def, nil
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return 0, fmt.Errorf("mock fault %q: %s takes a positive count", spec, name)
+				}
+				return n, nil
+			}
+			var err error
+			switch name {
+			case "refuse":
+				f.Refuse = true
+			case "drop":
+				f.Drop, err = count(1)
+			case "corrupt":
+				f.Corrupt, err = count(-1)
+			case "slow", "cut":
+				var n int64
+				if n, err = sshutil.ParseRate(value); err != nil || n == 0 {
+					return nil, fmt.Errorf("mock fault %q: %s takes a size in bytes with an optional K, M or G suffix, e.g. %s:64K", spec, name, name)
+				}
+				if name == "slow" {
+					f.Slow = n
+				} else {
+					f.Cut = n
+				}
+			default:
+				return nil, fmt.Errorf("mock fault %q: unknown fault %q (expected refuse, drop, slow, cut or corrupt)", spec, name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		faults[server] = f
+	}
+	return faults, nil
+}
+
+// ForServer returns the faults of a server: those of AllServers, overridden
+// by its own
+func ForServer(faults map[string]Faults, server string) Faults {
+	f := faults[AllServers]
+	own, ok := faults[server]
+	if !ok {
+		return f
+	}
+	f.Refuse = f.Refuse || own.Refuse
+	if own.Drop != 0 {
+		f.Drop = own.Drop
+	}
+	if own.Corrupt != 0 {
+		f.Corrupt = own.Corrupt
+	}
+	if own.Slow != 0 {
+		f.Slow = own.Slow
+	}
+	if own.Cut != 0 {
+		f.Cut = own.Cut
+	}
+	return f
+}
+
+// Empty reports whether no fault is set
+func (f Faults) Empty() bool {
+	return f == Faults{}
+}
+
+// String describes the faults for the log, e.g. "drop:2,slow:64.0 KiB/s"
+func (f Faults) String() string {
+	var parts []string
+	if f.Refuse {
+		parts = append(parts, "refuse")
+	}
+	if f.Drop > 0 {
+		parts = append(parts, fmt.Sprintf("drop:%d", f.Drop))
+	}
+	if f.Slow > 0 {
+		parts = append(parts, "slow:"+util.FormatBytes(f.Slow)+"/s")
+	}
+	if f.Cut > 0 {
+		parts = append(parts, "cut:"+util.FormatBytes(f.Cut))
+	}
+	switch {
+	case f.Corrupt > 0:
+		parts = append(parts, fmt.Sprintf("corrupt:%d", f.Corrupt))
+	case f.Corrupt < 0:
+		parts = append(parts, "corrupt")
+	}
+	return strings.Join(parts, ",")
+}
+
+// faultState counts what a server's faults have used up
+type faultState struct {
+	mu        sync.Mutex
+	conns     int  // Connections accepted
+	cut       bool // A connection was cut
+	downloads int  // Tarball downloads opened
+}
+
+// accept decides whether to go on with a new connection, and wraps it to
+// throttle or cut it
+func (s *Server) accept(conn net.Conn) (net.Conn, bool) {
+	f := s.Faults
+	s.state.mu.Lock()
+	s.state.conns++
+	n := s.state.conns
+	s.state.mu.Unlock()
+	if f.Refuse || n <= f.Drop {
+		return conn, false
+	}
+	if f.Slow > 0 || f.Cut > 0 {
+		conn = &faultyConn{Conn: conn, server: s}
+	}
+	return conn, true
+}
+
+// corrupts decides whether a file being opened for download is served
+// with a flipped byte
+func (s *Server) corrupts(remotePath string) bool {
+	if s.Faults.Corrupt == 0 || !isTarball(remotePath) {
+		return false
+	}
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.downloads++
+	return s.Faults.Corrupt < 0 || s.state.downloads <= s.Faults.Corrupt
+}
+
+func isTarball(remotePath string) bool {
+	for _, name := range util.RemoteTarFilenames() {
+		if path.Base(remotePath) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// faultyConn throttles what the server sends, or closes the connection once
+// it has sent Cut bytes
+type faultyConn struct {
+	net.Conn
+	server *Server
+	sent   int64
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	f := c.server.Faults
+	if f.Cut > 0 && c.sent+int64(len(p)) >= f.Cut {
+		st := &c.server.state
+		st.mu.Lock()
+		first := !st.cut
+		st.cut = true
+		st.mu.Unlock()
+		if first {
+			c.Conn.Close()
+			return 0, io.ErrClosedPipe
+		}
+	}
+	if f.Slow > 0 {
+		time.Sleep(time.Duration(float64(len(p)) / float64(f.Slow) * float64(time.Second)))
+	}
+	n, err := c.Conn.Write(p)
+	c.sent += int64(n)
+	return n, err
+}
+
+// corruptFile serves a file with the byte in its middle flipped
+type corruptFile struct {
+	*os.File
+	flip int64
+}
+
+func openCorrupt(p string) (io.ReaderAt, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &corruptFile{File: file, flip: info.Size() / 2}, nil
+}
+
+func (c *corruptFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.File.ReadAt(p, off)
+	if i := c.flip - off; i >= 0 && i < int64(n) {
+		p[i] ^= 0xff
+	}
+	return n, err
+}
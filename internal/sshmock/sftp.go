@@ -0,0 +1,96 @@
+package sshmock
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// rootedFS serves SFTP requests from a directory that stands in for "/"
+type rootedFS struct {
+	root     string
+	corrupts func(remotePath string) bool // Whether to serve a download with a flipped byte
+}
+
+func rootedHandlers(root string, corrupts func(remotePath string) bool) sftp.Handlers {
+	r := &rootedFS{root: root, corrupts: corrupts}
+	return sftp.Handlers{FileGet: r, FilePut: r, FileCmd: r, FileList: r}
+}
+
+// hostPath maps a remote path below the root. Cleaning an absolute path drops
+// any ".." that would climb above it.
+func hostPath(root, remotePath string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+remotePath)))
+}
+
+func (r *rootedFS) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	if r.corrupts(req.Filepath) {
+		return openCorrupt(hostPath(r.root, req.Filepath))
+	}
+	return os.Open(hostPath(r.root, req.Filepath))
+}
+
+func (r *rootedFS) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	return os.OpenFile(hostPath(r.root, req.Filepath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (r *rootedFS) Filecmd(req *sftp.Request) error {
+	p := hostPath(r.root, req.Filepath)
+	switch req.Method {
+	case "Setstat":
+		return nil
+	case "Rename":
+		return os.Rename(p, hostPath(r.root, req.Target))
+	case "Rmdir", "Remove":
+		return os.Remove(p)
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (r *rootedFS) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	p := hostPath(r.root, req.Filepath)
+	switch req.Method {
+	case "List":
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		infos := make(listerAt, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, info)
+		}
+		return infos, nil
+	case "Stat":
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// listerAt pages a fixed slice of file infos to the SFTP server
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,923 @@
+package sshmock
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxScriptDepth bounds scripts running scripts (sh -c, bash <file>)
+const maxScriptDepth = 8
+
+// token is one shell word or operator (";", "&&", "||", "|")
+type token struct {
+	text string
+	op   bool
+}
+
+// shell interprets the subset of sh used by the tool's generated scripts and
+// commands: if/else on [ -f ] and [ -d ], &&, ||, a find | cpio copy, a
+// tar | gzip or zstd archive, and
+// echo, printf, export, mkdir, cp, touch, cd, chmod, rm, tar, sha256sum, cat, find
+// (-exec sha256sum and -printf), an nproc of 1, an lsof that finds nothing,
+// and a journalctl that prints /var/log/journal/<unit>.log. sudo, doas, nice
+// and ionice just run the command they wrap. Standard input is ignored: read
+// reads nothing and piping printf into a command just runs the command.
+// $HOME expands to the mock user's home; other variables are never expanded
+// and assignments before a command are dropped. Paths resolve below root.
+// Anything else fails with status 127, like a missing command.
+type shell struct {
+	root    string
+	cwd     string // Remote working directory
+	errexit bool
+	depth   int
+	stdout  bytes.Buffer
+	stderr  bytes.Buffer
+}
+
+func newShell(root string) *shell {
+	return &shell{root: root, cwd: "/"}
+}
+
+// ifFrame tracks one if/else/fi block
+type ifFrame struct {
+	outerActive bool // Whether the enclosing code runs at all
+	cond        bool
+	active      bool // Whether the current branch runs
+}
+
+// run executes a script and returns its exit status
+func (sh *shell) run(script string) int {
+	if sh.depth > maxScriptDepth {
+		fmt.Fprintln(&sh.stderr, "sh: scripts nested too deeply")
+		return 2
+	}
+	sh.depth++
+	defer func() { sh.depth-- }()
+
+	var stack []ifFrame
+	running := func() bool { return len(stack) == 0 || stack[len(stack)-1].active }
+	tokens, err := tokenize(script)
+	if err != nil {
+		fmt.Fprintf(&sh.stderr, "sh: %v\n", err)
+		return 2
+	}
+	status := 0
+	for _, stmt := range splitOn(tokens, ";") {
+		if len(stmt) == 0 {
+			continue
+		}
+		switch word := stmt[0]; {
+		case !word.op && word.text == "if":
+			frame := ifFrame{outerActive: running()}
+			if frame.outerActive {
+				frame.cond = sh.test(stmt[1:])
+			}
+			frame.active = frame.outerActive && frame.cond
+			stack = append(stack, frame)
+			continue
+		case !word.op && word.text == "then":
+			stmt = stmt[1:]
+		case !word.op && word.text == "else":
+			if len(stack) == 0 {
+				fmt.Fprintln(&sh.stderr, "sh: else without if")
+				return 2
+			}
+			top := &stack[len(stack)-1]
+			top.active = top.outerActive && !top.cond
+			stmt = stmt[1:]
+		case !word.op && word.text == "fi":
+			if len(stack) == 0 {
+				fmt.Fprintln(&sh.stderr, "sh: fi without if")
+				return 2
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if len(stmt) == 0 || !running() {
+			continue
+		}
+		status = sh.runList(stmt)
+		if status != 0 && sh.errexit {
+			return status
+		}
+	}
+	if len(stack) > 0 {
+		fmt.Fprintln(&sh.stderr, "sh: unterminated if")
+		return 2
+	}
+	return status
+}
+
+// test evaluates "[ -f path ]" and "[ -d path ]"
+func (sh *shell) test(args []token) bool {
+	if len(args) != 4 || args[0].text != "[" || args[3].text != "]" {
+		fmt.Fprintf(&sh.stderr, "sh: unsupported condition %v\n", words(args))
+		return false
+	}
+	info, err := os.Stat(sh.hostPath(args[2].text))
+	if err != nil {
+		return false
+	}
+	switch args[1].text {
+	case "-f":
+		return info.Mode().IsRegular()
+	case "-d":
+		return info.IsDir()
+	}
+	fmt.Fprintf(&sh.stderr, "sh: unsupported test %s\n", args[1].text)
+	return false
+}
+
+// runList runs commands joined by && and ||, which bind equally from left to right
+func (sh *shell) runList(tokens []token) int {
+	start := 0
+	op := ""
+	status := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !(tokens[i].op && (tokens[i].text == "&&" || tokens[i].text == "||")) {
+			continue
+		}
+		segment := tokens[start:i]
+		if op == "" || (op == "&&" && status == 0) || (op == "||" && status != 0) {
+			status = sh.runPipeline(segment)
+		}
+		if i < len(tokens) {
+			op = tokens[i].text
+		}
+		start = i + 1
+	}
+	return status
+}
+
+func (sh *shell) runPipeline(tokens []token) int {
+	stages := splitOn(tokens, "|")
+	// The sudo password is piped with printf to commands that don't otherwise read their input
+	if len(stages) == 2 && len(stages[0]) > 0 && stages[0][0].text == "printf" {
+		stages = stages[1:]
+	}
+	if len(stages) == 1 {
+		return sh.runCommand(words(stages[0]))
+	}
+	// The collection script copies directory trees with: find . -mindepth 1 -print0 | cpio -pdum0 <dest>
+	if len(stages) == 2 {
+		find, cpio := stripWrappers(words(stages[0])), stripWrappers(words(stages[1]))
+		if len(find) > 1 && find[0] == "find" && len(cpio) > 0 && cpio[0] == "cpio" {
+			args := nonFlags(cpio[1:])
+			if len(args) != 1 {
+				fmt.Fprintln(&sh.stderr, "cpio: expected one destination directory")
+				return 2
+			}
+			expr, err := parseFind(find[1:])
+			if err != nil || len(expr.action) != 1 || expr.action[0] != "-print0" {
+				fmt.Fprintf(&sh.stderr, "find: unsupported arguments: %v\n", find[1:])
+				return 1
+			}
+			if err := copyDir(sh.hostPath(expr.dir), sh.hostPath(args[0]), expr.pruneFunc(expr.dir)); err != nil {
+				fmt.Fprintf(&sh.stderr, "cpio: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+		// The collection script compresses with a level with: tar cf - . | gzip|zstd [-q] [-N] > <archive>
+		compressor := stripWrappers(words(stages[1]))
+		if t := stripWrappers(words(stages[0])); len(t) == 4 && t[0] == "tar" && t[1] == "cf" && t[2] == "-" && t[3] == "." &&
+			len(compressor) >= 3 && (compressor[0] == "gzip" || compressor[0] == "zstd") && compressor[len(compressor)-2] == ">" {
+			if err := writeTar(sh.hostPath(sh.cwd), sh.hostPath(compressor[len(compressor)-1]), compressor[0]); err != nil {
+				fmt.Fprintf(&sh.stderr, "%s: %v\n", compressor[0], err)
+				return 1
+			}
+			return 0
+		}
+	}
+	fmt.Fprintf(&sh.stderr, "sh: unsupported pipeline: %v\n", words(tokens))
+	return 127
+}
+
+func (sh *shell) runCommand(argv []string) int {
+	for len(argv) > 0 && assignment.MatchString(argv[0]) {
+		argv = argv[1:]
+	}
+	argv = stripWrappers(argv)
+	for i, a := range argv {
+		argv[i] = strings.ReplaceAll(a, "$HOME", "/home/"+Username)
+	}
+	if len(argv) == 0 {
+		return 0
+	}
+	args := argv[1:]
+	switch argv[0] {
+	case "true", "chmod", "export", "read":
+		return 0 // Variables are accepted but never expanded, apart from $HOME
+	case "set":
+		for _, a := range args {
+			if a == "-e" {
+				sh.errexit = true
+			}
+		}
+		return 0
+	case "echo":
+		fmt.Fprintln(&sh.stdout, strings.Join(args, " "))
+		return 0
+	case "printf":
+		// Only %s and the \n and \0 escapes; the format is reused for each argument
+		if len(args) == 0 {
+			return sh.fail("printf", "missing format")
+		}
+		format := strings.NewReplacer(`\n`, "\n", `\0`, "\x00").Replace(args[0])
+		values := args[1:]
+		for first := true; first || len(values) > 0; first = false {
+			var value string
+			if len(values) > 0 {
+				value, values = values[0], values[1:]
+			}
+			sh.stdout.WriteString(strings.ReplaceAll(format, "%s", value))
+		}
+		return 0
+	case "nproc":
+		fmt.Fprintln(&sh.stdout, 1)
+		return 0
+	case "cd":
+		if len(args) != 1 {
+			return sh.fail("cd", "expected one directory")
+		}
+		target := sh.remotePath(args[0])
+		if info, err := os.Stat(sh.hostPath(target)); err != nil || !info.IsDir() {
+			return sh.fail("cd", args[0]+": No such file or directory")
+		}
+		sh.cwd = target
+		return 0
+	case "mkdir":
+		for _, p := range nonFlags(args) {
+			if err := os.MkdirAll(sh.hostPath(p), 0755); err != nil {
+				return sh.fail("mkdir", err.Error())
+			}
+		}
+		return 0
+	case "touch":
+		for _, p := range nonFlags(args) {
+			f, err := os.OpenFile(sh.hostPath(p), os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return sh.fail("touch", err.Error())
+			}
+			f.Close()
+		}
+		return 0
+	case "cp":
+		paths := nonFlags(args)
+		if len(paths) != 2 {
+			return sh.fail("cp", "expected a source and a destination")
+		}
+		src := sh.hostPath(paths[0])
+		info, err := os.Stat(src)
+		if err != nil {
+			return sh.fail("cp", paths[0]+": No such file or directory")
+		}
+		if err := copyFile(src, sh.hostPath(paths[1]), info.Mode().Perm()); err != nil {
+			return sh.fail("cp", err.Error())
+		}
+		return 0
+	case "rm":
+		for _, p := range nonFlags(args) {
+			if err := os.RemoveAll(sh.hostPath(p)); err != nil {
+				return sh.fail("rm", err.Error())
+			}
+		}
+		return 0
+	case "tar":
+		// Only "tar czf <archive> ." and "tar cf <archive> ." as used by the collection script
+		if len(args) != 3 || (args[0] != "czf" && args[0] != "cf") || args[2] != "." {
+			return sh.fail("tar", "only 'tar czf <archive> .' and 'tar cf <archive> .' are supported")
+		}
+		compressor := ""
+		if args[0] == "czf" {
+			compressor = "gzip"
+		}
+		if err := writeTar(sh.hostPath(sh.cwd), sh.hostPath(args[1]), compressor); err != nil {
+			return sh.fail("tar", err.Error())
+		}
+		return 0
+	case "sha256sum":
+		if len(args) == 2 && args[0] == "-c" {
+			return sh.sha256Check(args[1])
+		}
+		status := 0
+		for _, p := range args {
+			if sh.sha256Line(p, sh.hostPath(p)) != nil {
+				status = sh.fail("sha256sum", p+": No such file or directory")
+			}
+		}
+		return status
+	case "lsof":
+		// No process holds files open on a mock server; lsof exits with 1 when it finds nothing
+		return 1
+	case "journalctl":
+		// Prints the fixture's /var/log/journal/<unit>.log as is; the time window is ignored
+		for i, a := range args {
+			if a == "--unit" && i+1 < len(args) {
+				if data, err := os.ReadFile(sh.hostPath(path.Join("/var/log/journal", args[i+1]+".log"))); err == nil {
+					sh.stdout.Write(data)
+				}
+				return 0
+			}
+		}
+		return sh.fail("journalctl", "only --unit excerpts are supported")
+	case "cat":
+		for _, p := range args {
+			data, err := os.ReadFile(sh.hostPath(p))
+			if err != nil {
+				return sh.fail("cat", p+": No such file or directory")
+			}
+			sh.stdout.Write(data)
+		}
+		return 0
+	case "find":
+		// Only "find <dir> [...] -type f -exec sha256sum {} +" as used by remote
+		// checksums, and "find [-H] <path> ... -printf <format>" as used by plan
+		expr, err := parseFind(args)
+		a := expr.action
+		switch {
+		case err != nil:
+		case len(a) == 6 && a[0] == "-type" && a[1] == "f" && a[2] == "-exec" && a[3] == "sha256sum":
+			return sh.findSHA256(expr)
+		case len(a) == 2 && a[0] == "-printf":
+			return sh.findPrintf(expr, false, a[1])
+		case len(a) == 4 && a[0] == "-type" && a[1] == "f" && a[2] == "-printf":
+			return sh.findPrintf(expr, true, a[3])
+		}
+		return sh.fail("find", "unsupported arguments")
+	case "sh", "bash":
+		if len(args) == 2 && args[0] == "-c" {
+			return sh.subshell(args[1])
+		}
+		if len(args) == 1 {
+			return sh.runFile(args[0])
+		}
+		return sh.fail(argv[0], "unsupported arguments")
+	default:
+		if strings.HasPrefix(argv[0], "/") && len(args) == 0 {
+			return sh.runFile(argv[0])
+		}
+		fmt.Fprintf(&sh.stderr, "sh: %s: command not found\n", argv[0])
+		return 127
+	}
+}
+
+// subshell runs script with its own errexit setting and working directory
+func (sh *shell) subshell(script string) int {
+	savedCwd, savedErrexit := sh.cwd, sh.errexit
+	sh.errexit = false
+	defer func() { sh.cwd, sh.errexit = savedCwd, savedErrexit }()
+	return sh.run(script)
+}
+
+func (sh *shell) runFile(p string) int {
+	data, err := os.ReadFile(sh.hostPath(p))
+	if err != nil {
+		fmt.Fprintf(&sh.stderr, "sh: %s: No such file or directory\n", p)
+		return 127
+	}
+	return sh.subshell(string(data))
+}
+
+func (sh *shell) fail(cmd, msg string) int {
+	fmt.Fprintf(&sh.stderr, "%s: %s\n", cmd, msg)
+	return 1
+}
+
+// sha256Line prints a sha256sum line, escaping names the way GNU coreutils does
+func (sh *shell) sha256Line(display, hostFile string) error {
+	f, err := os.Open(hostFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	prefix := ""
+	if strings.ContainsAny(display, "\\\n") {
+		prefix = "\\"
+		display = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(display)
+	}
+	fmt.Fprintf(&sh.stdout, "%s%s  %s\n", prefix, hex.EncodeToString(h.Sum(nil)), display)
+	return nil
+}
+
+// sha256Check checks the files of a sha256sum list the way "sha256sum -c" does
+func (sh *shell) sha256Check(list string) int {
+	data, err := os.ReadFile(sh.hostPath(list))
+	if err != nil {
+		return sh.fail("sha256sum", list+": No such file or directory")
+	}
+	status := 0
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		want, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		f, err := os.Open(sh.hostPath(name))
+		if err != nil {
+			fmt.Fprintf(&sh.stdout, "%s: FAILED open or read\n", name)
+			status = 1
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil || hex.EncodeToString(h.Sum(nil)) != want {
+			fmt.Fprintf(&sh.stdout, "%s: FAILED\n", name)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(&sh.stdout, "%s: OK\n", name)
+	}
+	return status
+}
+
+func (sh *shell) findSHA256(expr findExpr) int {
+	dir := expr.dir
+	hostDir := sh.hostPath(dir)
+	prune := expr.pruneFunc(dir)
+	err := filepath.WalkDir(hostDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostDir, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && prune(filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return sh.sha256Line(strings.TrimSuffix(dir, "/")+"/"+filepath.ToSlash(rel), p)
+	})
+	if err != nil {
+		return sh.fail("find", err.Error())
+	}
+	return 0
+}
+
+// findPrintf prints the format for the start point (with -maxdepth 0) or for
+// everything below it. Symlinks on the command line are followed, as with -H.
+// Mock files are reported as owned by root.
+func (sh *shell) findPrintf(expr findExpr, onlyFiles bool, format string) int {
+	dir := expr.dir
+	hostDir := sh.hostPath(dir)
+	if expr.maxDepth0 {
+		info, err := os.Stat(hostDir)
+		if err != nil {
+			return sh.fail("find", dir+": No such file or directory")
+		}
+		if !onlyFiles || info.Mode().IsRegular() {
+			sh.stdout.WriteString(findFormat(format, dir, info))
+		}
+		return 0
+	}
+	prune := expr.pruneFunc(dir)
+	err := filepath.WalkDir(hostDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil // -mindepth 1
+		}
+		if prune(filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if onlyFiles && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sh.stdout.WriteString(findFormat(format, strings.TrimSuffix(dir, "/")+"/"+filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err != nil {
+		return sh.fail("find", err.Error())
+	}
+	return 0
+}
+
+// findFormat expands the -printf directives %M, %m, %u, %g, %s, %p, \n and \0
+func findFormat(format, name string, info os.FileInfo) string {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if (c != '%' && c != '\\') || i+1 == len(format) {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		switch string([]byte{c, format[i]}) {
+		case "%M":
+			sb.WriteString(info.Mode().String())
+		case "%m":
+			sb.WriteString(util.OctalMode(info.Mode()))
+		case "%u", "%g":
+			sb.WriteString("root")
+		case "%s":
+			sb.WriteString(fmt.Sprint(info.Size()))
+		case "%p":
+			sb.WriteString(name)
+		case "\\n":
+			sb.WriteByte('\n')
+		case "\\0":
+			sb.WriteByte(0)
+		case "%%":
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte(c)
+			sb.WriteByte(format[i])
+		}
+	}
+	return sb.String()
+}
+
+// remotePath resolves p against the working directory
+func (sh *shell) remotePath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(sh.cwd, p)
+	}
+	return path.Clean(p)
+}
+
+func (sh *shell) hostPath(p string) string {
+	return hostPath(sh.root, sh.remotePath(p))
+}
+
+// assignment matches a variable assignment before a command, like IFS=
+var assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// stripWrappers drops leading sudo, doas, nice and ionice with their options;
+// mock commands always run with full access and at normal priority
+func stripWrappers(argv []string) []string {
+	for len(argv) > 0 {
+		switch argv[0] {
+		case "sudo", "doas":
+			argv = argv[1:]
+			for len(argv) > 0 && strings.HasPrefix(argv[0], "-") {
+				if (argv[0] == "-p" || argv[0] == "-u" || argv[0] == "-g") && len(argv) > 1 {
+					argv = argv[1:] // -p '', -u root
+				}
+				argv = argv[1:]
+			}
+		case "nice", "ionice":
+			argv = argv[1:]
+			for len(argv) > 0 && strings.HasPrefix(argv[0], "-") {
+				if len(argv[0]) == 2 && len(argv) > 1 {
+					argv = argv[1:] // -n 10, -c 3
+				}
+				argv = argv[1:]
+			}
+		default:
+			return argv
+		}
+	}
+	return argv
+}
+
+func nonFlags(args []string) []string {
+	var out []string
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func words(tokens []token) []string {
+	out := make([]string, len(tokens))
+	for i, t := range tokens {
+		out[i] = t.text
+	}
+	return out
+}
+
+// splitOn splits tokens at every operator equal to op
+func splitOn(tokens []token, op string) [][]token {
+	var parts [][]token
+	start := 0
+	for i, t := range tokens {
+		if t.op && t.text == op {
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, tokens[start:])
+}
+
+// tokenize splits a script into words and operators; unquoted newlines
+// separate statements like ";". Quoting follows sh: nothing is special inside
+// '...', and inside "..." a backslash only escapes $ ` " \. Redirections such
+// as 2>/dev/null are dropped and # starts a comment that runs to the line end.
+func tokenize(line string) ([]token, error) {
+	var tokens []token
+	var cur strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			word := cur.String()
+			if !isRedirect(word) {
+				tokens = append(tokens, token{text: word})
+			}
+			cur.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '#' && !inWord:
+			end := strings.IndexByte(line[i:], '\n')
+			if end < 0 {
+				i = len(line)
+				continue
+			}
+			i += end - 1 // The newline itself ends the statement
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			cur.WriteString(line[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$`\"\\", line[i+1]) >= 0 {
+					i++
+				}
+				cur.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+		case c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+			inWord = true
+		case c == ';' || c == '\n':
+			flush()
+			tokens = append(tokens, token{text: ";", op: true})
+		case c == '&' && i+1 < len(line) && line[i+1] == '&':
+			flush()
+			tokens = append(tokens, token{text: "&&", op: true})
+			i++
+		case c == '|':
+			flush()
+			if i+1 < len(line) && line[i+1] == '|' {
+				tokens = append(tokens, token{text: "||", op: true})
+				i++
+			} else {
+				tokens = append(tokens, token{text: "|", op: true})
+			}
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+// isRedirect reports whether word is an output redirection like 2>/dev/null
+func isRedirect(word string) bool {
+	trimmed := strings.TrimLeft(word, "0123456789")
+	return strings.HasPrefix(trimmed, ">") && len(trimmed) > 1
+}
+
+// copyDir copies the contents of src into dst, like the collection script's cpio pass
+func copyDir(src, dst string, prune func(rel string) bool) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && prune(filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// writeTarGz archives dir as "./..." entries, like `tar czf archive .` run inside dir
+func writeTar(dir, archive, compressor string) error {
+	out, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	var compressed io.WriteCloser = nopWriteCloser{out}
+	switch compressor {
+	case "gzip":
+		compressed = gzip.NewWriter(out)
+	case "zstd":
+		if compressed, err = zstd.NewWriter(out); err != nil {
+			return err
+		}
+	}
+	tw := tar.NewWriter(compressed)
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == archive {
+			return nil // Never include the archive itself
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = "./" + filepath.ToSlash(rel)
+		if rel == "." {
+			hdr.Name = "./"
+		} else if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// nopWriteCloser writes an uncompressed tarball
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// findExpr is the subset of find(1) arguments the tool generates:
+// [-H] <dir> [-mindepth 1 | -maxdepth 0] [\( -name P -o -path P ... \) -prune -o] <action...>
+type findExpr struct {
+	dir       string
+	maxDepth0 bool
+	names     []string
+	paths     []string
+	action    []string
+}
+
+func parseFind(args []string) (findExpr, error) {
+	if len(args) > 0 && args[0] == "-H" {
+		args = args[1:] // The mock always follows symlinks given as starting points
+	}
+	if len(args) == 0 {
+		return findExpr{}, fmt.Errorf("missing starting point")
+	}
+	expr := findExpr{dir: args[0]}
+	args = args[1:]
+	if len(args) >= 2 && args[0] == "-mindepth" && args[1] == "1" {
+		args = args[2:]
+	} else if len(args) >= 2 && args[0] == "-maxdepth" && args[1] == "0" {
+		expr.maxDepth0 = true
+		args = args[2:]
+	}
+	if len(args) > 0 && args[0] == "(" {
+		end := -1
+		for i, a := range args {
+			if a == ")" {
+				end = i
+				break
+			}
+		}
+		if end < 0 || len(args) < end+3 || args[end+1] != "-prune" || args[end+2] != "-o" {
+			return findExpr{}, fmt.Errorf("unsupported prune expression")
+		}
+		terms := args[1:end]
+		for i := 0; i < len(terms); i += 3 {
+			if i+1 >= len(terms) || (i+2 < len(terms) && terms[i+2] != "-o") {
+				return findExpr{}, fmt.Errorf("unsupported prune expression")
+			}
+			switch terms[i] {
+			case "-name":
+				expr.names = append(expr.names, terms[i+1])
+			case "-path":
+				expr.paths = append(expr.paths, terms[i+1])
+			default:
+				return findExpr{}, fmt.Errorf("unsupported test %s", terms[i])
+			}
+		}
+		args = args[end+3:]
+	}
+	expr.action = args
+	return expr, nil
+}
+
+// pruneFunc reports whether the entry at rel (relative to dir) is pruned.
+// As in find, -path patterns are matched against dir joined with rel, and
+// their * matches slashes too.
+func (e findExpr) pruneFunc(dir string) func(rel string) bool {
+	return func(rel string) bool {
+		for _, n := range e.names {
+			if ok, _ := path.Match(n, path.Base(rel)); ok {
+				return true
+			}
+		}
+		full := strings.TrimSuffix(dir, "/") + "/" + rel
+		for _, p := range e.paths {
+			if findPathMatch(p, full) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func findPathMatch(pattern, name string) bool {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	ok, _ := regexp.MatchString(sb.String(), name)
+	return ok
+}
@@ -0,0 +1,306 @@
+// Package sshmock runs in-process SSH/SFTP servers that stand in for real
+// hosts. Each server's filesystem is a directory on disk, and commands are
+// handled by a small interpreter for the shell subset the tool's generated
+// scripts use, so collection runs without network access or real servers.
+package sshmock
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Username is the account every mock server accepts
+const Username = "mock"
+
+// SFTPOnlyMarker is a file that, in a host's root, makes the host refuse
+// commands like an appliance that only allows the SFTP subsystem
+const SFTPOnlyMarker = ".sftp-only"
+
+// Server is one mock SSH host
+type Server struct {
+	Name     string
+	Root     string // Directory the host's "/" maps to
+	Faults   Faults // Failures simulated from the first connection on
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+	state    faultState
+}
+
+// Start serves root as the filesystem of a new mock host on a loopback port,
+// simulating faults. Any public key is accepted.
+func Start(name, root string, faults Faults) (*Server, error) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate mock host key")
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create mock host key signer")
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil },
+	}
+	cfg.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for mock server")
+	}
+	s := &Server{Name: name, Root: root, Faults: faults, listener: listener, config: cfg}
+	s.wg.Add(1)
+	go s.serve()
+	log.Debugf("Mock server %s listening on %s (root %s)", name, listener.Addr(), root)
+	return s, nil
+}
+
+// Port returns the loopback port the server listens on
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops accepting connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return // Listener closed
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	conn, ok := s.accept(conn)
+	if !ok {
+		log.Debugf("Mock server %s: dropping a connection (%s)", s.Name, s.Faults)
+		conn.Close()
+		return
+	}
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Debugf("Mock server %s: handshake failed: %v", s.Name, err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(ch, chReqs)
+	}
+}
+
+func (s *Server) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			status := 1
+			if _, err := os.Stat(filepath.Join(s.Root, SFTPOnlyMarker)); err == nil {
+				io.WriteString(ch, "This service allows sftp connections only.\n")
+			} else {
+				sh := newShell(s.Root)
+				status = sh.run(payload.Command)
+				ch.Write(sh.stdout.Bytes())
+				ch.Stderr().Write(sh.stderr.Bytes())
+			}
+			exit := make([]byte, 4)
+			binary.BigEndian.PutUint32(exit, uint32(status))
+			ch.SendRequest("exit-status", false, exit)
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			// Sessions start in the home directory, as with OpenSSH on Windows
+			server := sftp.NewRequestServer(ch, rootedHandlers(s.Root, s.corrupts), sftp.WithStartDirectory("/home/"+Username))
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Debugf("Mock server %s: sftp session ended: %v", s.Name, err)
+			}
+			server.Close()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// Fleet is a set of mock servers built from a fixture directory holding one
+// subdirectory per server (e.g. fixtures/web1/etc/hosts)
+type Fleet struct {
+	servers map[string]*Server
+	keyPath string
+	workDir string
+}
+
+// StartFleet starts a mock server for every name in servers, simulating the
+// faults given for it (see ParseFaults). Each gets a scratch copy of
+// fixtureDir/<server>, so runs never modify the fixtures.
+func StartFleet(fixtureDir string, servers []string, faults map[string]Faults) (*Fleet, error) {
+	workDir, err := os.MkdirTemp("", "remote-diff-mock-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create mock working directory")
+	}
+	f := &Fleet{servers: make(map[string]*Server), workDir: workDir}
+
+	f.keyPath = filepath.Join(workDir, "id_ed25519")
+	if err := writeClientKey(f.keyPath); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	for _, name := range servers {
+		root := filepath.Join(workDir, "hosts", name)
+		src := filepath.Join(fixtureDir, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			log.Warnf("No mock fixture for %s at %s; the server will have an empty filesystem", name, src)
+			err = os.MkdirAll(root, 0755)
+			if err != nil {
+				f.Close()
+				return nil, errors.Wrapf(err, "failed to create mock root %s", root)
+			}
+		} else if err := copyTree(src, root); err != nil {
+			f.Close()
+			return nil, err
+		}
+		server, err := Start(name, root, ForServer(faults, name))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !server.Faults.Empty() {
+			log.Warnf("Mock server %s simulates faults: %s", name, server.Faults)
+		}
+		f.servers[name] = server
+	}
+	log.Infof("Started %d mock server(s) from %s", len(f.servers), fixtureDir)
+	return f, nil
+}
+
+// Target returns the connection settings for a mock server
+func (f *Fleet) Target(server string) (sshutil.Target, error) {
+	s, ok := f.servers[server]
+	if !ok {
+		return sshutil.Target{}, fmt.Errorf("no mock server named %s", server)
+	}
+	return sshutil.Target{Hostname: "127.0.0.1", Port: s.Port(), Username: Username, KeyPath: f.keyPath}, nil
+}
+
+// Root returns the directory a mock server's "/" maps to, or "" for an unknown server
+func (f *Fleet) Root(server string) string {
+	if s, ok := f.servers[server]; ok {
+		return s.Root
+	}
+	return ""
+}
+
+// Credentials returns SSH defaults matching the mock servers, for use in place of the environment
+func (f *Fleet) Credentials() config.SSHCredentials {
+	return config.SSHCredentials{Username: Username, KeyPath: f.keyPath}
+}
+
+// Close stops every server and removes the scratch copies
+func (f *Fleet) Close() {
+	for _, s := range f.servers {
+		s.Close()
+	}
+	os.RemoveAll(f.workDir)
+}
+
+// writeClientKey stores a fresh unencrypted ed25519 key for connecting to the fleet
+func writeClientKey(keyPath string) error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate mock client key")
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode mock client key")
+	}
+	return errors.Wrapf(os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600), "failed to write mock client key %s", keyPath)
+}
+
+// copyTree copies regular files and directories from src to dst, keeping modes
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %s", p)
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", p)
+		}
+		switch {
+		case d.IsDir():
+			return errors.Wrapf(os.MkdirAll(target, info.Mode().Perm()|0700), "failed to create %s", target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		default:
+			return nil // Fixtures only need files and directories
+		}
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", src)
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %s", dst)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", dst)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "failed to copy %s", src)
+	}
+	return errors.Wrapf(out.Close(), "failed to write %s", dst)
+}
@@ -0,0 +1,107 @@
+package sshutil
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthLimit caps the SFTP throughput of each connection, uploads and
+// downloads together, in bytes per second (0 = unlimited). Concurrent
+// transfers over one connection share it. main sets it from the command line.
+var BandwidthLimit int64
+
+// limitChunk is the most a throttled transfer reads at once, which keeps
+// the rate smooth at low limits
+const limitChunk = 32 << 10
+
+// ParseRate parses a --bwlimit value: bytes per second with an optional K,
+// M or G suffix (powers of 1024), e.g. 500K or 1.5M. "0" means unlimited.
+func ParseRate(s string) (int64, error) {
+	num, mult := strings.TrimSpace(s), float64(1)
+	if n := len(num); n > 0 {
+		switch strings.ToUpper(num[n-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			num = num[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid --bwlimit value %q (expected bytes per second, e.g. 500K or 10M)", s)
+	}
+	rate := int64(v * mult)
+	if v > 0 && rate < 1024 {
+		return 0, fmt.Errorf("--bwlimit %s is below the minimum of 1K per second", s)
+	}
+	return rate, nil
+}
+
+// rateLimiter is a token bucket holding up to a second's worth of bytes.
+// Callers take what they transferred and sleep off any deficit, so
+// concurrent transfers queue behind each other.
+type rateLimiter struct {
+	rate   float64 // Bytes per second
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// take accounts for n transferred bytes, waiting as long as the bucket is overdrawn
+func (l *rateLimiter) take(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedReader throttles the reads of r
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.l.take(n)
+	}
+	return n, err
+}
+
+// throttle returns r, throttled when the connection has a bandwidth limit
+func (c *Client) throttle(r io.Reader) io.Reader {
+	if c.limiter == nil {
+		return r
+	}
+	return limitedReader{r: r, l: c.limiter}
+}
@@ -0,0 +1,156 @@
+package sshutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyFile is the file next to config.json that holds the pinned host keys
+const HostKeyFile = "host_keys.json"
+
+// HostKeyPath returns the pin file of the output directory dir
+func HostKeyPath(dir string) string {
+	return filepath.Join(dir, config.ConfigDir, HostKeyFile)
+}
+
+// HostKeyPin is the key a host presented the first time it was connected to
+type HostKeyPin struct {
+	Type        string    `json:"type"`
+	Fingerprint string    `json:"fingerprint"` // SHA256:...
+	FirstSeen   time.Time `json:"first_seen"`
+}
+
+// HostKeyPins trusts the key each host presents on first use and refuses
+// connections to a host whose key changed since. Hosts are told apart by
+// the address dialed, host:port, so jump hosts are pinned too.
+type HostKeyPins struct {
+	path string
+	mu   sync.Mutex
+	pins map[string]HostKeyPin
+}
+
+// HostKeyChangedError is returned when a host presents a key other than the pinned one
+type HostKeyChangedError struct {
+	Address   string
+	Pinned    HostKeyPin
+	Presented string // Fingerprint of the key presented
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("the host key of %s has changed: pinned %s %s on %s, presented %s; if the change is expected, forget the pinned key (--forget-hostkey)",
+		e.Address, e.Pinned.Type, e.Pinned.Fingerprint, e.Pinned.FirstSeen.Format("2006-01-02"), e.Presented)
+}
+
+// LoadHostKeyPins reads the pinned host keys of the output directory dir; a
+// missing file holds none. Keys pinned by older versions, which kept the file
+// at the top of dir, are moved next to config.json first.
+func LoadHostKeyPins(dir string) (*HostKeyPins, error) {
+	path := HostKeyPath(dir)
+	if err := migrateHostKeys(filepath.Join(dir, HostKeyFile), path); err != nil {
+		return nil, err
+	}
+	p := &HostKeyPins{path: path, pins: make(map[string]HostKeyPin)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read the pinned host keys")
+	}
+	if err := json.Unmarshal(data, &p.pins); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return p, nil
+}
+
+// migrateHostKeys moves the pin file from old to path, unless path already exists
+func migrateHostKeys(old, path string) error {
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", old)
+	}
+	if _, err := os.Stat(path); err == nil {
+		log.Warnf("Ignoring %s: the host keys are pinned in %s", old, path)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to stat %s", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", filepath.Dir(path))
+	}
+	if err := os.Rename(old, path); err != nil {
+		return errors.Wrapf(err, "failed to move %s to %s", old, path)
+	}
+	log.Infof("Moved the pinned host keys from %s to %s", old, path)
+	return nil
+}
+
+// Forget drops the pinned keys of host, given as a host name or as
+// host:port, so the next connection pins whatever key it presents. It
+// returns the addresses whose keys were dropped.
+func (p *HostKeyPins) Forget(host string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var forgotten []string
+	for address := range p.pins {
+		if h, _, err := net.SplitHostPort(address); address == host || (err == nil && h == host) {
+			forgotten = append(forgotten, address)
+			delete(p.pins, address)
+		}
+	}
+	sort.Strings(forgotten)
+	if len(forgotten) == 0 {
+		return nil, nil
+	}
+	return forgotten, p.save()
+}
+
+// callback checks the key presented by a host against its pin, pinning it
+// if the host has none yet
+func (p *HostKeyPins) callback() ssh.HostKeyCallback {
+	return func(address string, _ net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		pin, ok := p.pins[address]
+		if !ok {
+			p.pins[address] = HostKeyPin{Type: key.Type(), Fingerprint: fingerprint, FirstSeen: time.Now().UTC()}
+			log.Infof("Pinned the host key of %s on first use: %s %s", address, key.Type(), fingerprint)
+			return p.save()
+		}
+		if pin.Fingerprint != fingerprint {
+			return &HostKeyChangedError{Address: address, Pinned: pin, Presented: key.Type() + " " + fingerprint}
+		}
+		return nil
+	}
+}
+
+// save replaces the pin file in one step; the caller holds mu
+func (p *HostKeyPins) save() error {
+	data, err := json.MarshalIndent(p.pins, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the pinned host keys")
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", filepath.Dir(p.path))
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, p.path), "failed to write %s", p.path)
+}
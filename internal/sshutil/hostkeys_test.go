@@ -0,0 +1,58 @@
+package sshutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHostKeyPinsMigrates(t *testing.T) {
+	const pinned = `{"web1:22":{"type":"ssh-ed25519","fingerprint":"SHA256:old","first_seen":"2024-01-02T00:00:00Z"}}`
+	tests := []struct {
+		name    string
+		root    bool   // A pin file at the top of the output directory
+		current string // The pin file under conf/, if any
+		want    string // Fingerprint of web1:22 once loaded; empty if none
+	}{
+		{name: "nothing pinned"},
+		{name: "root-level file", root: true, want: "SHA256:old"},
+		{name: "already moved", current: pinned, want: "SHA256:old"},
+		{name: "both", root: true, current: `{"web1:22":{"type":"ssh-ed25519","fingerprint":"SHA256:new","first_seen":"2024-02-03T00:00:00Z"}}`, want: "SHA256:new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			old := filepath.Join(dir, HostKeyFile)
+			if tt.root {
+				if err := os.WriteFile(old, []byte(pinned), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.current != "" {
+				if err := os.MkdirAll(filepath.Dir(HostKeyPath(dir)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(HostKeyPath(dir), []byte(tt.current), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p, err := LoadHostKeyPins(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.pins["web1:22"].Fingerprint; got != tt.want {
+				t.Errorf("web1:22 pinned to %q, want %q", got, tt.want)
+			}
+			// A root-level file is only left in place when conf/ already has one
+			_, err = os.Stat(old)
+			if left := err == nil; left != (tt.root && tt.current != "") {
+				t.Errorf("root-level file left behind: %v", left)
+			}
+			if tt.want != "" {
+				if _, err := os.Stat(HostKeyPath(dir)); err != nil {
+					t.Errorf("no pin file under conf/: %v", err)
+				}
+			}
+		})
+	}
+}
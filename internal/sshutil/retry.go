@@ -0,0 +1,151 @@
+package sshutil
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backoff strategies of a RetryPolicy
+const (
+	BackoffConstant    = "constant"    // Wait Backoff before every retry
+	BackoffExponential = "exponential" // Double the wait after every retry, up to MaxDelay
+)
+
+// RetryPolicy says how often and how patiently an operation is retried while
+// it keeps failing with transient errors
+type RetryPolicy struct {
+	Attempts int           // Total tries, including the first
+	Backoff  time.Duration // Wait before the first retry
+	Strategy string        // BackoffConstant or BackoffExponential
+	MaxDelay time.Duration // Upper bound of the wait; 0 means unbounded
+	Jitter   float64       // Fraction of each wait, from 0 to 1, that is randomly shortened
+}
+
+// The retry policy of each phase. The defaults suit most networks; flaky WAN
+// links want more attempts and longer waits, LAN users may prefer to fail fast.
+var (
+	// DialRetry covers establishing the SSH connection, including jump hosts
+	DialRetry = RetryPolicy{Attempts: 3, Backoff: 2 * time.Second, Strategy: BackoffConstant}
+	// CommandRetry covers remote commands whose session broke before they
+	// finished. A command that ran and exited non-zero is never retried.
+	CommandRetry = RetryPolicy{Attempts: 1, Backoff: time.Second, Strategy: BackoffExponential, MaxDelay: 30 * time.Second}
+	// TransferRetry covers SFTP uploads, downloads, stats and listings
+	TransferRetry = RetryPolicy{Attempts: 4, Backoff: 500 * time.Millisecond, Strategy: BackoffExponential, MaxDelay: 30 * time.Second}
+	// NotifyRetry covers webhook notifications while the endpoint is
+	// unreachable or answers 429 or 5xx
+	NotifyRetry = RetryPolicy{Attempts: 3, Backoff: 2 * time.Second, Strategy: BackoffExponential, MaxDelay: 30 * time.Second}
+)
+
+// RetryPhases maps the phase names used by --retry and config.json to their policies
+var RetryPhases = map[string]*RetryPolicy{
+	"dial":     &DialRetry,
+	"command":  &CommandRetry,
+	"transfer": &TransferRetry,
+	"notify":   &NotifyRetry,
+}
+
+// Delay returns the wait before the given retry (1 for the first)
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.Backoff
+	if p.Strategy == BackoffExponential {
+		for i := 1; i < retry && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+			delay *= 2
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Do calls fn until it succeeds, fails with a permanent error, or has been
+// tried p.Attempts times, backing off between attempts. beforeRetry, if not
+// nil, runs before each retry (e.g. to reconnect). It returns the last error
+// and the number of attempts made.
+func (p RetryPolicy) Do(what string, fn func() error, beforeRetry func()) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsTransient(err) || attempt >= p.Attempts {
+			return attempt, err
+		}
+		delay := p.Delay(attempt)
+		log.Warnf("Transient error during %s (attempt %d/%d), retrying in %v: %v", what, attempt, p.Attempts, delay, err)
+		time.Sleep(delay)
+		if beforeRetry != nil {
+			beforeRetry()
+		}
+	}
+}
+
+// Validate checks that the policy makes sense
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.Attempts < 1:
+		return fmt.Errorf("attempts must be at least 1")
+	case p.Backoff < 0 || p.MaxDelay < 0:
+		return fmt.Errorf("backoff and max-delay can't be negative")
+	case p.Strategy != BackoffConstant && p.Strategy != BackoffExponential:
+		return fmt.Errorf("unknown backoff strategy %q (expected %s or %s)", p.Strategy, BackoffConstant, BackoffExponential)
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// String formats the policy in the ApplyRetrySpec syntax
+func (p RetryPolicy) String() string {
+	s := fmt.Sprintf("attempts=%d,backoff=%v,strategy=%s", p.Attempts, p.Backoff, p.Strategy)
+	if p.MaxDelay > 0 {
+		s += fmt.Sprintf(",max-delay=%v", p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		s += fmt.Sprintf(",jitter=%g", p.Jitter)
+	}
+	return s
+}
+
+// ApplyRetrySpec changes a phase's policy from a spec such as
+// "dial:attempts=6,backoff=5s,strategy=exponential,max-delay=1m,jitter=0.3".
+// Settings the spec leaves out keep their current values.
+func ApplyRetrySpec(spec string) error {
+	phase, settings, ok := strings.Cut(spec, ":")
+	policy := RetryPhases[strings.TrimSpace(phase)]
+	if !ok || policy == nil {
+		return fmt.Errorf("invalid retry spec %q (expected dial|command|transfer|notify:key=value,...)", spec)
+	}
+	updated := *policy
+	for _, setting := range strings.Split(settings, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		var err error
+		switch key {
+		case "attempts":
+			updated.Attempts, err = strconv.Atoi(value)
+		case "backoff":
+			updated.Backoff, err = time.ParseDuration(value)
+		case "strategy":
+			updated.Strategy = value
+		case "max-delay":
+			updated.MaxDelay, err = time.ParseDuration(value)
+		case "jitter":
+			updated.Jitter, err = strconv.ParseFloat(value, 64)
+		default:
+			err = fmt.Errorf("unknown setting %q (expected attempts, backoff, strategy, max-delay or jitter)", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid retry spec %q: %v", spec, err)
+		}
+	}
+	if err := updated.Validate(); err != nil {
+		return fmt.Errorf("invalid retry spec %q: %v", spec, err)
+	}
+	*policy = updated
+	return nil
+}
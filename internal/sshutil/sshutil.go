@@ -7,8 +7,14 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
 	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	log "github.com/sirupsen/logrus"
@@ -17,13 +23,48 @@ import (
 
 // Client wraps ssh.Client and sftp.Client
 type Client struct {
-	Hostname   string
-	sshClient  *ssh.Client
-	sftpClient *sftp.Client
+	Hostname    string
+	sshClient   *ssh.Client
+	sftpClient  *sftp.Client
+	jumpClients []*ssh.Client // Jump hosts the connection goes through, outermost first
+	hops        []hop         // Kept to reconnect after transient transfer errors
+	mu          sync.Mutex    // Guards the clients, which concurrent transfers may replace
+	become      util.Escalation
+	password    string       // sudo password, written to the standard input of sudo -S
+	limiter     *rateLimiter // Shared by the transfers when BandwidthLimit is set
+}
+
+// Target describes how to reach and authenticate to one SSH server
+type Target struct {
+	Hostname      string
+	Port          int // 22 when zero
+	Username      string
+	KeyPath       string
+	KeyPassphrase string
+	JumpHosts     []Target     // Bastions to connect through, outermost first
+	Become        string       // How commands run with sudo set gain root: util.BecomeSudo (default), BecomeDoas or BecomeNone
+	SudoPassword  string       // Given to sudo, which otherwise must not ask for one
+	HostKeys      *HostKeyPins // Checks the keys of the host and its jump hosts; nil accepts any key
+}
+
+// address returns the host:port to dial
+func (t Target) address() string {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(t.Hostname, strconv.Itoa(port))
 }
 
-// Connect establishes an SSH connection
-func Connect(hostname, username, keyPath, keyPassphrase string) (*Client, error) {
+// clientConfig builds the handshake settings for one hop from its key,
+// checking the host key against pins if set
+func clientConfig(target Target, pins *HostKeyPins) (*ssh.ClientConfig, error) {
+	keyPassphrase := target.KeyPassphrase
+	keyPath, err := config.ExpandHome(target.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
 	key, err := os.ReadFile(keyPath)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to read private key %s", keyPath)
@@ -35,7 +76,7 @@ func Connect(hostname, username, keyPath, keyPassphrase string) (*Client, error)
 		if err != nil {
 			// Check if the error is specifically about passphrase needed but not provided correctly
 			if errors.Is(err, &ssh.PassphraseMissingError{}) {
-				return nil, errors.Wrapf(err, "private key %s requires a passphrase (check SSHKEYPIN)", keyPath)
+				return nil, errors.Wrapf(err, "private key %s requires a passphrase (check SSHKEYPIN or --key-passphrase)", keyPath)
 			}
 			return nil, errors.Wrapf(err, "failed to parse encrypted private key %s", keyPath)
 		}
@@ -44,57 +85,105 @@ func Connect(hostname, username, keyPath, keyPassphrase string) (*Client, error)
 		if err != nil {
 			// Check if it needed a passphrase
 			if _, ok := err.(*ssh.PassphraseMissingError); ok {
-				return nil, errors.Wrapf(err, "private key %s seems to require a passphrase, but SSHKEYPIN was not provided or is empty", keyPath)
+				return nil, errors.Wrapf(err, "private key %s seems to require a passphrase, but none was given (set SSHKEYPIN or use --key-passphrase)", keyPath)
 			}
 			return nil, errors.Wrapf(err, "failed to parse private key %s", keyPath)
 		}
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User: username,
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if pins != nil {
+		hostKeyCallback = pins.callback()
+	}
+	return &ssh.ClientConfig{
+		User: target.Username,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Use ssh.FixedHostKey or knownhosts for production
-		Timeout:         15 * time.Second,            // Connection timeout
-	}
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         15 * time.Second, // Connection timeout
+	}, nil
+}
 
-	var sshClient *ssh.Client
-	var connErr error
-	maxRetries := 3
-	retryDelay := 2 * time.Second
+// hop is one SSH connection in a (possibly jumped) chain
+type hop struct {
+	target Target
+	config *ssh.ClientConfig
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Infof("Connecting to %s@%s (attempt %d/%d)...", username, hostname, attempt, maxRetries)
-		conn, err := net.DialTimeout("tcp", hostname+":22", sshConfig.Timeout)
+// dialChain connects through every jump host in turn and returns the client for
+// the last hop plus the jump clients, which must stay open while it is in use
+func dialChain(hops []hop) (*ssh.Client, []*ssh.Client, error) {
+	var jumps []*ssh.Client
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			jumps[i].Close()
+		}
+	}
+
+	for i, h := range hops {
+		address := h.target.address()
+		var conn net.Conn
+		var err error
+		if i == 0 {
+			conn, err = net.DialTimeout("tcp", address, h.config.Timeout)
+		} else {
+			conn, err = jumps[i-1].Dial("tcp", address)
+		}
 		if err != nil {
-			connErr = errors.Wrapf(err, "failed to dial %s", hostname)
-			if attempt < maxRetries {
-				log.Warnf("Dial failed: %v. Retrying in %v...", connErr, retryDelay)
-				time.Sleep(retryDelay)
-				continue
+			closeJumps()
+			if i > 0 {
+				return nil, nil, errors.Wrapf(err, "failed to dial %s via jump host %s", address, hops[i-1].target.Hostname)
 			}
-			return nil, connErr // Final attempt failed
+			return nil, nil, errors.Wrapf(err, "failed to dial %s", address)
 		}
 
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, hostname+":22", sshConfig)
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, h.config)
 		if err != nil {
-			connErr = errors.Wrapf(err, "failed to establish SSH connection to %s", hostname)
 			conn.Close() // Close the underlying net.Conn
-			if attempt < maxRetries {
-				log.Warnf("SSH handshake failed: %v. Retrying in %v...", connErr, retryDelay)
-				time.Sleep(retryDelay)
-				continue
-			}
-			return nil, connErr // Final attempt failed
+			closeJumps()
+			return nil, nil, errors.Wrapf(err, "failed to establish SSH connection to %s", h.target.Hostname)
 		}
-		sshClient = ssh.NewClient(sshConn, chans, reqs)
-		connErr = nil // Success
-		break         // Exit retry loop on success
+		client := ssh.NewClient(sshConn, chans, reqs)
+		if i == len(hops)-1 {
+			return client, jumps, nil
+		}
+		log.Debugf("Connected to jump host %s", address)
+		jumps = append(jumps, client)
+	}
+	return nil, nil, errors.New("no hosts to connect to")
+}
+
+// Connect establishes an SSH connection, going through target.JumpHosts in order if any are set
+func Connect(target Target) (*Client, error) {
+	hostname := target.Hostname
+
+	var hops []hop
+	for _, t := range append(append([]Target{}, target.JumpHosts...), target) {
+		cfg, err := clientConfig(t, target.HostKeys)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop{target: t, config: cfg})
 	}
 
+	var sshClient *ssh.Client
+	var jumpClients []*ssh.Client
+	attempt := 0
+	attempts, connErr := DialRetry.Do("connection to "+hostname, func() error {
+		attempt++
+		if len(target.JumpHosts) > 0 {
+			log.Infof("Connecting to %s@%s via %s (attempt %d/%d)...", target.Username, target.address(), jumpDescription(target.JumpHosts), attempt, DialRetry.Attempts)
+		} else {
+			log.Infof("Connecting to %s@%s (attempt %d/%d)...", target.Username, target.address(), attempt, DialRetry.Attempts)
+		}
+		var err error
+		sshClient, jumpClients, err = dialChain(hops)
+		return err
+	}, nil)
+
 	if connErr != nil {
-		return nil, errors.Wrapf(connErr, "failed to connect to %s after %d attempts", hostname, maxRetries)
+		return nil, errors.Wrapf(connErr, "failed to connect to %s after %d attempt(s)", hostname, attempts)
 	}
 
 	log.Infof("Successfully connected to %s", hostname)
@@ -102,19 +191,38 @@ func Connect(hostname, username, keyPath, keyPassphrase string) (*Client, error)
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
 		sshClient.Close()
+		for _, j := range jumpClients {
+			j.Close()
+		}
 		return nil, errors.Wrap(err, "failed to create SFTP client")
 	}
 	log.Debugf("SFTP client created for %s", hostname)
 
 	return &Client{
-		Hostname:   hostname,
-		sshClient:  sshClient,
-		sftpClient: sftpClient,
+		Hostname:    hostname,
+		sshClient:   sshClient,
+		sftpClient:  sftpClient,
+		jumpClients: jumpClients,
+		hops:        hops,
+		become:      util.Escalation{Become: target.Become, Password: target.SudoPassword != ""},
+		password:    target.SudoPassword,
+		limiter:     newRateLimiter(BandwidthLimit),
 	}, nil
 }
 
+// jumpDescription renders a jump chain for log messages, like ProxyJump does
+func jumpDescription(jumps []Target) string {
+	parts := make([]string, len(jumps))
+	for i, j := range jumps {
+		parts[i] = j.Username + "@" + j.address()
+	}
+	return strings.Join(parts, ",")
+}
+
 // Close closes the SFTP and SSH connections
 func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.sftpClient != nil {
 		log.Debugf("Closing SFTP client for %s", c.Hostname)
 		c.sftpClient.Close()
@@ -125,25 +233,71 @@ func (c *Client) Close() {
 		c.sshClient.Close()
 		c.sshClient = nil
 	}
+	// Jump hosts are closed last, innermost first, since the session runs through them
+	for i := len(c.jumpClients) - 1; i >= 0; i-- {
+		c.jumpClients[i].Close()
+	}
+	c.jumpClients = nil
 }
 
-// RunCommand executes a command on the remote server
+// RunCommand executes a command on the remote server, as root if sudo is set
+// (through the Target's Become). If the session breaks before the command
+// finishes, the connection is re-established and the command retried as
+// CommandRetry allows.
 func (c *Client) RunCommand(command string, sudo bool) (string, string, error) {
-	session, err := c.sshClient.NewSession()
+	return c.RunCommandInput(command, "", sudo)
+}
+
+// RunCommandInput is RunCommand writing input to the command's standard
+// input. With sudo and a sudo password, the password comes first.
+func (c *Client) RunCommandInput(command, input string, sudo bool) (string, string, error) {
+	if sudo {
+		command = c.become.Prefix() + command
+		if c.become.PipesPassword() {
+			input = c.password + "\n" + input
+		}
+	}
+	var stdout, stderr string
+	var used *ssh.Client
+	_, err := CommandRetry.Do("command on "+c.Hostname, func() error {
+		c.mu.Lock()
+		used = c.sshClient
+		c.mu.Unlock()
+		var err error
+		stdout, stderr, err = c.runOnce(used, command, input)
+		return err
+	}, func() { c.reconnect(used) })
+	return stdout, stderr, err
+}
+
+// runOnce runs command in a new session on sshClient
+func (c *Client) runOnce(sshClient *ssh.Client, command, input string) (string, string, error) {
+	if sshClient == nil {
+		return "", "", errors.Wrapf(sftp.ErrSSHFxNoConnection, "not connected to %s", c.Hostname)
+	}
+	session, err := sshClient.NewSession()
 	if err != nil {
 		return "", "", errors.Wrap(err, "failed to create SSH session")
 	}
 	defer session.Close()
 
-	if sudo {
-		command = "sudo " + command
-	}
-
 	log.Debugf("Executing on %s: %s", c.Hostname, command)
 
 	var stdoutBuf, stderrBuf bytes.Buffer
 	session.Stdout = &stdoutBuf
 	session.Stderr = &stderrBuf
+	if input != "" {
+		// Written apart from the command's outcome: a command that exits without
+		// reading its input, such as a sudo that needs no password, still succeeds
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to open standard input of SSH session")
+		}
+		go func() {
+			io.WriteString(stdin, input)
+			stdin.Close()
+		}()
+	}
 
 	err = session.Run(command) // Use Run for commands that finish
 
@@ -167,10 +321,16 @@ func (c *Client) RunCommand(command string, sudo bool) (string, string, error) {
 	return stdout, stderr, nil
 }
 
-// UploadFile uploads a local file to a remote path using SFTP
+// UploadFile uploads a local file to a remote path using SFTP. Transient
+// errors are retried; failures are returned as *TransferError.
 func (c *Client) UploadFile(localPath, remotePath string) error {
 	log.Debugf("Uploading %s to %s:%s", localPath, c.Hostname, remotePath)
+	return c.transfer("upload", remotePath, func(sftpClient *sftp.Client) error {
+		return c.uploadOnce(sftpClient, localPath, remotePath)
+	})
+}
 
+func (c *Client) uploadOnce(sftpClient *sftp.Client, localPath, remotePath string) error {
 	localFile, err := os.Open(localPath)
 	if err != nil {
 		return errors.Wrapf(err, "failed to open local file %s for upload", localPath)
@@ -179,19 +339,19 @@ func (c *Client) UploadFile(localPath, remotePath string) error {
 
 	// Ensure remote directory exists
 	remoteDir := filepath.Dir(remotePath)
-	if err := c.sftpClient.MkdirAll(remoteDir); err != nil {
+	if err := sftpClient.MkdirAll(remoteDir); err != nil {
 		// MkdirAll returns nil if directory already exists
 		// Check for other errors if necessary
 		log.Warnf("Could not ensure remote directory %s exists (maybe OK): %v", remoteDir, err)
 	}
 
-	remoteFile, err := c.sftpClient.Create(remotePath)
+	remoteFile, err := sftpClient.Create(remotePath)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create remote file %s:%s", c.Hostname, remotePath)
 	}
 	defer remoteFile.Close()
 
-	bytesCopied, err := io.Copy(remoteFile, localFile)
+	bytesCopied, err := io.Copy(remoteFile, c.throttle(localFile))
 	if err != nil {
 		return errors.Wrapf(err, "failed to copy data to remote file %s:%s", c.Hostname, remotePath)
 	}
@@ -200,15 +360,34 @@ func (c *Client) UploadFile(localPath, remotePath string) error {
 	return nil
 }
 
-// DownloadFile downloads a remote file to a local path using SFTP
+// DownloadFile downloads a remote file to a local path using SFTP. Transient
+// errors are retried, resuming from the bytes already downloaded as long as
+// the remote file keeps its size and modification time; failures are
+// returned as *TransferError and leave no local file behind.
 func (c *Client) DownloadFile(remotePath, localPath string) error {
 	log.Debugf("Downloading %s:%s to %s", c.Hostname, remotePath, localPath)
+	var first os.FileInfo // The remote file as the first attempt found it
+	err := c.transfer("download", remotePath, func(sftpClient *sftp.Client) error {
+		return c.downloadOnce(sftpClient, remotePath, localPath, &first)
+	})
+	if err != nil {
+		os.Remove(localPath)
+	}
+	return err
+}
 
-	remoteFile, err := c.sftpClient.Open(remotePath)
+// downloadOnce makes one attempt at a download. Unless it is the first
+// (*first is nil), it appends to what earlier attempts downloaded.
+func (c *Client) downloadOnce(sftpClient *sftp.Client, remotePath, localPath string, first *os.FileInfo) error {
+	remoteFile, err := sftpClient.Open(remotePath)
 	if err != nil {
 		return errors.Wrapf(err, "failed to open remote file %s:%s", c.Hostname, remotePath)
 	}
 	defer remoteFile.Close()
+	remoteInfo, err := remoteFile.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat remote file %s:%s", c.Hostname, remotePath)
+	}
 
 	// Ensure local directory exists
 	localDir := filepath.Dir(localPath)
@@ -216,32 +395,110 @@ func (c *Client) DownloadFile(remotePath, localPath string) error {
 		return errors.Wrapf(err, "failed to create local directory %s", localDir)
 	}
 
-	localFile, err := os.Create(localPath)
+	localFile, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create local file %s", localPath)
 	}
 	defer localFile.Close()
 
-	bytesCopied, err := io.Copy(localFile, remoteFile)
+	var offset int64
+	if *first != nil {
+		localInfo, err := localFile.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat local file %s", localPath)
+		}
+		switch {
+		case remoteInfo.Size() != (*first).Size() || !remoteInfo.ModTime().Equal((*first).ModTime()):
+			log.Warnf("%s:%s changed since the interrupted download; downloading it again from the start", c.Hostname, remotePath)
+		case localInfo.Size() > remoteInfo.Size():
+			log.Warnf("%s is larger than %s:%s; downloading it again from the start", localPath, c.Hostname, remotePath)
+		default:
+			offset = localInfo.Size()
+		}
+	}
+	*first = remoteInfo
+	if err := localFile.Truncate(offset); err != nil {
+		return errors.Wrapf(err, "failed to truncate local file %s", localPath)
+	}
+	if offset > 0 {
+		log.Infof("Resuming the download of %s:%s at %d of %d bytes", c.Hostname, remotePath, offset, remoteInfo.Size())
+		if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "failed to seek in local file %s", localPath)
+		}
+		if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "failed to seek in remote file %s:%s", c.Hostname, remotePath)
+		}
+	}
+
+	bytesCopied, err := io.Copy(localFile, c.throttle(remoteFile))
 	if err != nil {
-		// Clean up potentially incomplete local file on error
-		localFile.Close()
-		os.Remove(localPath)
+		// The bytes written so far are kept for the next attempt to resume from
 		return errors.Wrapf(err, "failed to copy data from remote file %s:%s", c.Hostname, remotePath)
 	}
+	if total := offset + bytesCopied; total != remoteInfo.Size() {
+		// Callers that need an exact copy, like the tarball download, verify its checksum
+		log.Warnf("Downloaded %d bytes of %s:%s, which had %d when the download started; it changed meanwhile", total, c.Hostname, remotePath, remoteInfo.Size())
+	}
 
 	log.Debugf("Successfully downloaded %d bytes from %s:%s to %s", bytesCopied, c.Hostname, remotePath, localPath)
 	return nil
 }
 
-// CheckSudoAccess tries to run a harmless sudo command without a password
+// Stat returns information about a remote path over SFTP, following symlinks
+func (c *Client) Stat(remotePath string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := c.transfer("stat", remotePath, func(sftpClient *sftp.Client) error {
+		var err error
+		info, err = sftpClient.Stat(remotePath)
+		return err
+	})
+	return info, err
+}
+
+// ReadDir lists a remote directory over SFTP. Entries describe the links
+// themselves, not their targets.
+func (c *Client) ReadDir(remotePath string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := c.transfer("list", remotePath, func(sftpClient *sftp.Client) error {
+		var err error
+		entries, err = sftpClient.ReadDir(remotePath)
+		return err
+	})
+	return entries, err
+}
+
+// Getwd returns the directory SFTP sessions start in, which is the user's
+// home on Windows OpenSSH
+func (c *Client) Getwd() (string, error) {
+	var wd string
+	err := c.transfer("getwd", ".", func(sftpClient *sftp.Client) error {
+		var err error
+		wd, err = sftpClient.Getwd()
+		return err
+	})
+	return wd, err
+}
+
+// CheckSudoAccess tries to run a harmless command as root, without a
+// password unless a sudo password is set. It always succeeds when commands
+// run unprivileged.
 func (c *Client) CheckSudoAccess() bool {
-	log.Infof("Checking passwordless sudo access on %s...", c.Hostname)
-	_, stderr, err := c.RunCommand("-n true", true) // sudo -n true
+	if c.sshClient == nil {
+		return false
+	}
+	if c.become.Unprivileged() {
+		return true
+	}
+	how, check := "passwordless "+strings.TrimSpace(c.become.Prefix())+" access", "-n true" // sudo -n true, doas -n true
+	if c.become.PipesPassword() {
+		how, check = "sudo access with the given password", "true"
+	}
+	log.Infof("Checking %s on %s...", how, c.Hostname)
+	_, stderr, err := c.RunCommand(check, true)
 	if err == nil {
-		log.Infof("User %s has passwordless sudo access on %s", c.sshClient.User(), c.Hostname)
+		log.Infof("User %s has %s on %s", c.sshClient.User(), how, c.Hostname)
 		return true
 	}
-	log.Warnf("User %s may not have passwordless sudo access on %s (command failed: %v, stderr: %s)", c.sshClient.User(), c.Hostname, err, stderr)
+	log.Warnf("User %s may not have %s on %s (command failed: %v, stderr: %s)", c.sshClient.User(), how, c.Hostname, err, stderr)
 	return false
 }
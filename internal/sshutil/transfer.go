@@ -0,0 +1,158 @@
+package sshutil
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// TransferError is returned by the SFTP operations. Permanent errors,
+// such as a missing file or denied permission, can't be fixed by retrying;
+// transient ones, such as a dropped connection, were retried Attempts times.
+type TransferError struct {
+	Op        string // "upload", "download", "stat" or "list"
+	Path      string // Remote path
+	Permanent bool
+	Attempts  int
+	Err       error
+}
+
+func (e *TransferError) Error() string {
+	kind := "transient"
+	if e.Permanent {
+		kind = "permanent"
+	}
+	return fmt.Sprintf("%s of %s failed (%s error, %d attempt(s)): %v", e.Op, e.Path, kind, e.Attempts, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether err is worth retrying: the connection dropped,
+// timed out, was refused or was reset. Anything else, including failed
+// authentication and a remote command that ran and failed, is permanent.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return !transferErr.Permanent
+	}
+	var exitErr *ssh.ExitError
+	var hostKeyErr *HostKeyChangedError
+	if errors.As(err, &exitErr) || errors.As(err, &hostKeyErr) || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return false
+	}
+	switch {
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost),
+		errors.Is(err, sftp.ErrSSHFxNoConnection),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ETIMEDOUT):
+		return true
+	}
+	var netErr net.Error
+	var channelErr *ssh.OpenChannelError // e.g. a jump host couldn't reach the next hop
+	if errors.As(err, &netErr) || errors.As(err, &channelErr) {
+		return true
+	}
+	var exitMissing *ssh.ExitMissingError
+	return errors.As(err, &exitMissing) // The session ended without a status, e.g. the connection died
+}
+
+// transfer runs one SFTP transfer with retries, re-establishing the SFTP
+// session (and the SSH connection, if that is gone too) between attempts.
+// Transfers may run concurrently on one Client.
+func (c *Client) transfer(op, remotePath string, fn func(*sftp.Client) error) error {
+	var used *sftp.Client
+	attempts, err := TransferRetry.Do(fmt.Sprintf("%s of %s:%s", op, c.Hostname, remotePath), func() error {
+		c.mu.Lock()
+		used = c.sftpClient
+		c.mu.Unlock()
+		if used == nil {
+			return sftp.ErrSSHFxNoConnection
+		}
+		return fn(used)
+	}, func() { c.reconnectSFTP(used) })
+	if err == nil {
+		return nil
+	}
+	return &TransferError{Op: op, Path: remotePath, Permanent: !IsTransient(err), Attempts: attempts, Err: err}
+}
+
+// reconnectSFTP replaces the SFTP session that failed. If the SSH connection
+// can't carry a new one, the whole connection is redialed. Nothing is done if
+// a concurrent transfer has already replaced it.
+func (c *Client) reconnectSFTP(failed *sftp.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sftpClient != failed {
+		return
+	}
+	if c.sftpClient != nil {
+		c.sftpClient.Close()
+		c.sftpClient = nil
+	}
+	if c.sshClient != nil {
+		if sftpClient, err := sftp.NewClient(c.sshClient); err == nil {
+			c.sftpClient = sftpClient
+			return
+		}
+	}
+	c.redial()
+}
+
+// reconnect replaces the SSH connection a command failed on, along with its
+// SFTP session. Nothing is done if it has already been replaced.
+func (c *Client) reconnect(failed *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sshClient != failed {
+		return
+	}
+	c.redial()
+}
+
+// redial closes the connection and dials the whole chain again. The caller
+// must hold c.mu. On failure the client is left disconnected, so the next
+// attempt fails at once and is retried in turn.
+func (c *Client) redial() {
+	if c.sftpClient != nil {
+		c.sftpClient.Close()
+		c.sftpClient = nil
+	}
+	if c.sshClient != nil {
+		c.sshClient.Close()
+		c.sshClient = nil
+	}
+	for i := len(c.jumpClients) - 1; i >= 0; i-- {
+		c.jumpClients[i].Close()
+	}
+	c.jumpClients = nil
+
+	log.Infof("Reconnecting to %s...", c.Hostname)
+	sshClient, jumpClients, err := dialChain(c.hops)
+	if err != nil {
+		log.Warnf("Reconnecting to %s failed: %v", c.Hostname, err)
+		return
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		log.Warnf("Failed to create SFTP client for %s: %v", c.Hostname, err)
+		c.sshClient, c.jumpClients = sshClient, jumpClients // Closed by Close or the next reconnect
+		return
+	}
+	c.sshClient, c.jumpClients, c.sftpClient = sshClient, jumpClients, sftpClient
+}
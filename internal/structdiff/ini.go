@@ -0,0 +1,62 @@
+package structdiff
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// parseINI reads an INI file into a map of sections, each a map of keys to
+// string values. Keys before the first section are kept at the top level.
+// Lines starting with ; or # are comments; a repeated key keeps its last value.
+func parseINI(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	current := root
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header", n)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			section, ok := root[name].(map[string]interface{})
+			if !ok {
+				section = make(map[string]interface{})
+				root[name] = section
+			}
+			current = section
+		default:
+			i := strings.IndexAny(line, "=:")
+			if i < 0 {
+				current[line] = "" // A bare key, as in my.cnf's skip-name-resolve
+				continue
+			}
+			key := strings.TrimSpace(line[:i])
+			if key == "" {
+				return nil, fmt.Errorf("line %d: missing key", n)
+			}
+			current[key] = unquote(strings.TrimSpace(line[i+1:]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// unquote strips matching double or single quotes around a value
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
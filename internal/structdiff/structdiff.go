@@ -0,0 +1,265 @@
+// Package structdiff compares structured config files (JSON, YAML, TOML and
+// INI) by their parsed content, so copies that only differ in key order,
+// whitespace, comments or quoting compare equal, and real differences are
+// reported per key instead of per line.
+package structdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats returned by Detect
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+	FormatINI  = "ini"
+)
+
+// Kinds of Change
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Change is one key whose value differs between two copies. Path names the
+// key like "server.tls.port" or "upstreams[2]"; Old and New are the values
+// as compact JSON, empty for added and removed keys respectively.
+type Change struct {
+	Path string
+	Kind string
+	Old  string
+	New  string
+}
+
+// Detect returns the format of a file by its extension, or "" if it isn't a
+// structured format
+func Detect(filePath string) string {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	case ".ini":
+		return FormatINI
+	}
+	return ""
+}
+
+// CompareFiles parses two copies of a file in format and returns their
+// differences, sorted by path. No changes means the copies are equivalent.
+func CompareFiles(format, path1, path2 string) ([]Change, error) {
+	a, err := parseFile(format, path1)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseFile(format, path2)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	compare("", a, b, &changes)
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func parseFile(format, filePath string) (interface{}, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filePath)
+	}
+	v, err := Parse(format, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s as %s", filePath, format)
+	}
+	return v, nil
+}
+
+// Parse decodes data in format into maps, slices and scalars, with map keys
+// as strings and integers as int64
+func Parse(format string, data []byte) (interface{}, error) {
+	var v interface{}
+	switch format {
+	case FormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("trailing data after the JSON value")
+		}
+	case FormatYAML:
+		var docs []interface{}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc interface{}
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, doc)
+		}
+		if len(docs) == 1 {
+			v = docs[0]
+		} else if len(docs) > 1 {
+			v = docs // A multi-document file compares document by document
+		}
+	case FormatTOML:
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		v = m
+	case FormatINI:
+		m, err := parseINI(data)
+		if err != nil {
+			return nil, err
+		}
+		v = m
+	default:
+		return nil, fmt.Errorf("unknown structured format %q", format)
+	}
+	return normalize(v), nil
+}
+
+// normalize gives equal values from every decoder the same Go types
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = normalize(e)
+		}
+		return t
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalize(e)
+		}
+		return t
+	case []map[string]interface{}: // TOML arrays of tables
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = normalize(e)
+		}
+		return s
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if f, err := t.Float64(); err == nil {
+			return normalize(f)
+		}
+		return t.String()
+	case float64:
+		// 1.0 and 1 are the same number; only exact integers are folded
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return int64(t)
+		}
+		return t
+	case int:
+		return int64(t)
+	case uint64:
+		if t <= 1<<63-1 {
+			return int64(t)
+		}
+		return float64(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+func compare(p string, a, b interface{}, changes *[]Change) {
+	if ma, ok := a.(map[string]interface{}); ok {
+		if mb, ok := b.(map[string]interface{}); ok {
+			for k, va := range ma {
+				if vb, ok := mb[k]; ok {
+					compare(join(p, k), va, vb, changes)
+				} else {
+					*changes = append(*changes, Change{Path: join(p, k), Kind: Removed, Old: render(va)})
+				}
+			}
+			for k, vb := range mb {
+				if _, ok := ma[k]; !ok {
+					*changes = append(*changes, Change{Path: join(p, k), Kind: Added, New: render(vb)})
+				}
+			}
+			return
+		}
+	}
+	if sa, ok := a.([]interface{}); ok {
+		if sb, ok := b.([]interface{}); ok {
+			// Order is part of a list's meaning, so elements are compared by index
+			for i := 0; i < len(sa) || i < len(sb); i++ {
+				ip := fmt.Sprintf("%s[%d]", p, i)
+				switch {
+				case i >= len(sb):
+					*changes = append(*changes, Change{Path: ip, Kind: Removed, Old: render(sa[i])})
+				case i >= len(sa):
+					*changes = append(*changes, Change{Path: ip, Kind: Added, New: render(sb[i])})
+				default:
+					compare(ip, sa[i], sb[i], changes)
+				}
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, Change{Path: displayPath(p), Kind: Changed, Old: render(a), New: render(b)})
+	}
+}
+
+// join appends a key to a path, quoting keys that would be ambiguous
+func join(p, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\" ") {
+		return p + "[" + strconv.Quote(key) + "]"
+	}
+	if p == "" {
+		return key
+	}
+	return p + "." + key
+}
+
+// displayPath names the document root, which has an empty path
+func displayPath(p string) string {
+	if p == "" {
+		return "(document)"
+	}
+	return p
+}
+
+// render formats a value as compact JSON
+func render(v interface{}) string {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
@@ -0,0 +1,204 @@
+// Package syslogsink sends the findings of an analysis to a syslog server as
+// RFC 5424 messages with structured data, one per drifting file, for SIEM
+// pipelines that ingest syslog.
+package syslogsink
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// AppName is the APP-NAME of every message
+const AppName = "remote-diff-tool"
+
+// SDID is the SD-ID of the structured data element. 32473 is the private
+// enterprise number reserved for documentation (RFC 5612).
+const SDID = "drift@32473"
+
+// Message IDs
+const (
+	MsgIDFinding = "finding"
+	MsgIDSummary = "summary"
+)
+
+// Severities used, as defined by RFC 5424
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+// Facilities by name, as defined by RFC 5424
+var Facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// dialTimeout bounds connecting, so an unreachable server doesn't hang a run
+const dialTimeout = 10 * time.Second
+
+// Target is a syslog server to send to
+type Target struct {
+	Network  string // "udp" or "tcp"
+	Address  string // host:port
+	Facility int
+}
+
+// ParseTarget reads a server as udp://host[:port] or tcp://host[:port]
+// (default ports 514 and 601), or host[:port] for UDP, and a facility name
+func ParseTarget(spec, facility string) (Target, error) {
+	fac, ok := Facilities[strings.ToLower(facility)]
+	if !ok {
+		return Target{}, fmt.Errorf("unknown syslog facility %q (e.g. local0, daemon, user)", facility)
+	}
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Hostname() == "" {
+		return Target{}, fmt.Errorf("invalid syslog server %q (expected udp://host:514 or tcp://host:601)", spec)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "udp":
+		if port == "" {
+			port = "514"
+		}
+	case "tcp":
+		if port == "" {
+			port = "601"
+		}
+	default:
+		return Target{}, fmt.Errorf("unsupported syslog transport %q (use udp or tcp)", u.Scheme)
+	}
+	return Target{Network: u.Scheme, Address: net.JoinHostPort(u.Hostname(), port), Facility: fac}, nil
+}
+
+// Send writes a message per drifting file of rep, and one summarizing the
+// run, to the target
+func Send(t Target, rep *report.Report) error {
+	conn, err := net.DialTimeout(t.Network, t.Address, dialTimeout)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to syslog server %s", t.Address)
+	}
+	defer conn.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	sent := 0
+	write := func(severity int, msgID string, params [][2]string, msg string) error {
+		line := Format(t.Facility, severity, rep.GeneratedAt, hostname, msgID, params, msg)
+		if t.Network == "tcp" {
+			// Octet counting (RFC 6587), so messages may hold newlines
+			line = strconv.Itoa(len(line)) + " " + line
+		}
+		conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return errors.Wrapf(err, "failed to send to syslog server %s", t.Address)
+		}
+		sent++
+		return nil
+	}
+
+	servers := strings.Join(rep.Servers, ",")
+	for _, f := range rep.Files {
+		if !f.Drifting() {
+			continue
+		}
+		params := [][2]string{{"path", f.Path}, {"status", f.Status}}
+		if f.Server != "" {
+			params = append(params, [2]string{"server", f.Server})
+		}
+		if c := f.Category(); c != "" {
+			params = append(params, [2]string{"category", c})
+		}
+		if sim, ok := f.Similarity(); ok {
+			params = append(params, [2]string{"similarity", strconv.FormatFloat(sim, 'f', 1, 64)})
+		}
+		params = append(params, [2]string{"affected_hosts", strconv.Itoa(f.AffectedHosts())}, [2]string{"servers", servers})
+
+		severity, msg := severityNotice, fmt.Sprintf("%s is %s", f.Path, f.Status)
+		switch {
+		case f.Status == report.StatusError:
+			severity, msg = severityError, fmt.Sprintf("%s could not be compared: %s", f.Path, strings.Join(f.Errors, "; "))
+		case f.Category() == report.CategoryRewrite || f.Binary:
+			severity = severityWarning
+		}
+		if err := write(severity, MsgIDFinding, params, msg); err != nil {
+			return err
+		}
+	}
+
+	s := rep.Summary
+	severity := severityInfo
+	if rep.HasDifferences() {
+		severity = severityNotice
+	}
+	if len(rep.Errors) > 0 {
+		severity = severityError
+	}
+	params := [][2]string{
+		{"compared", strconv.Itoa(s.TotalCompared)},
+		{"identical", strconv.Itoa(s.Identical)},
+		{"different", strconv.Itoa(s.Different)},
+		{"errors", strconv.Itoa(s.Errors + len(rep.Errors))},
+		{"servers", servers},
+	}
+	msg := fmt.Sprintf("%d of %d file(s) drift", s.Different+s.Errors, s.TotalCompared)
+	if len(rep.Errors) > 0 {
+		msg += "; " + strings.Join(rep.Errors, "; ")
+	}
+	if err := write(severity, MsgIDSummary, params, msg); err != nil {
+		return err
+	}
+	log.Infof("Sent %d syslog message(s) to %s", sent, t.Address)
+	return nil
+}
+
+// Format renders one RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID param="value"...] MSG
+func Format(facility, severity int, ts time.Time, hostname, msgID string, params [][2]string, msg string) string {
+	var sd strings.Builder
+	sd.WriteString("[" + SDID)
+	for _, p := range params {
+		fmt.Fprintf(&sd, ` %s="%s"`, p[0], sdEscaper.Replace(p[1]))
+	}
+	sd.WriteString("]")
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		facility*8+severity, ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		field(hostname, 255), AppName, os.Getpid(), msgID, sd.String(), msg)
+}
+
+// sdEscaper escapes PARAM-VALUEs as RFC 5424 requires
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// field makes a header field valid: printable ASCII without spaces, at most max characters
+func field(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
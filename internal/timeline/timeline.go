@@ -0,0 +1,229 @@
+// Package timeline keeps the external events registered in an output
+// directory, such as deploys and patching windows, so that drift found
+// between two collections can be shown next to what happened in between.
+//
+// The events are kept in timeline.json in the output directory, oldest first.
+package timeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+
+	"github.com/pkg/errors"
+)
+
+// FileName is the file below the output directory that holds the events
+const FileName = "timeline.json"
+
+// DefaultKind is the kind of events registered without one
+const DefaultKind = "deploy"
+
+var schema = jsonschema.For([]Event{}, jsonschema.Options{
+	Name:        "timeline",
+	Title:       "Timeline",
+	Description: "timeline.json: external events such as deploys and patching windows, oldest first",
+})
+
+// Schema returns the JSON Schema of timeline.json
+func Schema() *jsonschema.Schema {
+	return schema
+}
+
+// Event is something that happened to the servers outside of the tool. It
+// either happened at Start or, with End, spans a window.
+type Event struct {
+	ID      string            `json:"id"`
+	Kind    string            `json:"kind"` // e.g. deploy, patching or maintenance
+	Title   string            `json:"title"`
+	Start   time.Time         `json:"start"`
+	End     *time.Time        `json:"end,omitempty"`
+	Servers []string          `json:"servers,omitempty"` // Empty when it concerns every server
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// Validate checks that the event has a title and a sensible time
+func (e Event) Validate() error {
+	if strings.TrimSpace(e.Title) == "" {
+		return fmt.Errorf("an event needs a title")
+	}
+	if e.Start.IsZero() {
+		return fmt.Errorf("event %q has no start time", e.Title)
+	}
+	if e.End != nil && e.End.Before(e.Start) {
+		return fmt.Errorf("event %q ends before it starts", e.Title)
+	}
+	return nil
+}
+
+// Overlaps reports whether the event happened during (from, to]
+func (e Event) Overlaps(from, to time.Time) bool {
+	end := e.Start
+	if e.End != nil {
+		end = *e.End
+	}
+	return !e.Start.After(to) && end.After(from)
+}
+
+// Concerns reports whether the event concerns any of servers (nil: any server)
+func (e Event) Concerns(servers []string) bool {
+	if len(e.Servers) == 0 || servers == nil {
+		return true
+	}
+	for _, s := range servers {
+		for _, es := range e.Servers {
+			if s == es {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String formats the event like "2026-10-16T13:00:00Z deploy: v2.3.1 rollout (web1, web2)"
+func (e Event) String() string {
+	when := e.Start.UTC().Format(time.RFC3339)
+	if e.End != nil {
+		when += " to " + e.End.UTC().Format(time.RFC3339)
+	}
+	s := fmt.Sprintf("%s %s: %s", when, e.Kind, e.Title)
+	if len(e.Servers) > 0 {
+		s += " (" + strings.Join(e.Servers, ", ") + ")"
+	}
+	return s
+}
+
+// mu serializes changes to timeline files, e.g. from the API and a job
+var mu sync.Mutex
+
+// Path returns the timeline file of an output directory
+func Path(outputDir string) string {
+	return filepath.Join(outputDir, FileName)
+}
+
+// List returns the events of outputDir, oldest first
+func List(outputDir string) ([]Event, error) {
+	data, err := os.ReadFile(Path(outputDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read the timeline")
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", Path(outputDir))
+	}
+	if err := schema.Validate(data); err != nil {
+		return nil, errors.Wrapf(err, "timeline %s", Path(outputDir))
+	}
+	return events, nil
+}
+
+// Add registers an event in outputDir and returns it with its ID. Times are
+// stored in UTC; an empty kind becomes DefaultKind.
+func Add(outputDir string, e Event) (Event, error) {
+	if err := e.Validate(); err != nil {
+		return Event{}, err
+	}
+	if e.Kind == "" {
+		e.Kind = DefaultKind
+	}
+	e.Start = e.Start.UTC()
+	if e.End != nil {
+		end := e.End.UTC()
+		e.End = &end
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	e.ID = e.Start.Format("20060102-150405") + "-" + hex.EncodeToString(b)
+
+	mu.Lock()
+	defer mu.Unlock()
+	events, err := List(outputDir)
+	if err != nil {
+		return Event{}, err
+	}
+	events = append(events, e)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return e, save(outputDir, events)
+}
+
+// Remove deletes the event with the given ID from outputDir
+func Remove(outputDir, id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	events, err := List(outputDir)
+	if err != nil {
+		return err
+	}
+	for i, e := range events {
+		if e.ID == id {
+			return save(outputDir, append(events[:i], events[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no event %s (see 'timeline list')", id)
+}
+
+// Between returns the events that happened during (from, to] and concern any
+// of servers (nil: any server)
+func Between(events []Event, from, to time.Time, servers []string) []Event {
+	var out []Event
+	for _, e := range events {
+		if e.Overlaps(from, to) && e.Concerns(servers) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// save replaces the timeline file in one step
+func save(outputDir string, events []Event) error {
+	if events == nil {
+		events = []Event{}
+	}
+	data, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the timeline")
+	}
+	if err := schema.Validate(data); err != nil {
+		return errors.Wrap(err, "timeline")
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", outputDir)
+	}
+	path := Path(outputDir)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "failed to write %s", path)
+}
+
+// ParseTime reads a time given on the command line: RFC 3339, a local
+// "2006-01-02 15:04[:05]" (or with a T), a local date, or a duration before
+// now such as -2h
+func ParseTime(s string) (time.Time, error) {
+	if strings.HasPrefix(s, "-") {
+		if d, err := time.ParseDuration(s); err == nil {
+			return time.Now().Add(d), nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (expected RFC 3339, \"2006-01-02 15:04\", a date or e.g. -2h)", s)
+}
@@ -0,0 +1,117 @@
+// Package timing accumulates how long each phase of a run took per server,
+// for the --timings breakdown.
+package timing
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Phases, in the order they are shown
+const (
+	Connect  = "connect"
+	Wait     = "wait" // For a busy server's load to drop
+	Script   = "script"
+	Exec     = "exec"
+	Download = "download"
+	Extract  = "extract"
+	Hash     = "hash"
+	Diff     = "diff"
+)
+
+var phases = []string{Connect, Wait, Script, Exec, Download, Extract, Hash, Diff}
+
+// AnalysisRow holds phases that span all servers, like diffing
+const AnalysisRow = "(analysis)"
+
+// Recorder sums phase durations per server. It is safe for concurrent use.
+type Recorder struct {
+	mu        sync.Mutex
+	durations map[string]map[string]time.Duration // server -> phase -> total
+}
+
+// NewRecorder returns an empty recorder
+func NewRecorder() *Recorder {
+	return &Recorder{durations: make(map[string]map[string]time.Duration)}
+}
+
+// Default is the recorder the collectors and analyzer report to
+var Default = NewRecorder()
+
+// Add adds d to the server's phase
+func (r *Recorder) Add(server, phase string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.durations[server] == nil {
+		r.durations[server] = make(map[string]time.Duration)
+	}
+	r.durations[server][phase] += d
+}
+
+// Since adds the time elapsed since start to the server's phase
+func (r *Recorder) Since(server, phase string, start time.Time) {
+	r.Add(server, phase, time.Since(start))
+}
+
+// Since records on the Default recorder
+func Since(server, phase string, start time.Time) {
+	Default.Since(server, phase, start)
+}
+
+// Write prints a table with a row per server and a column per phase.
+// Nothing is written if no timings were recorded.
+func (r *Recorder) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.durations) == 0 {
+		return nil
+	}
+	servers := make([]string, 0, len(r.durations))
+	for s := range r.durations {
+		if s != AnalysisRow {
+			servers = append(servers, s)
+		}
+	}
+	sort.Strings(servers)
+	if _, ok := r.durations[AnalysisRow]; ok {
+		servers = append(servers, AnalysisRow)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "server\t")
+	for _, p := range phases {
+		fmt.Fprintf(tw, "%s\t", p)
+	}
+	fmt.Fprint(tw, "total\n")
+	for _, s := range servers {
+		fmt.Fprintf(tw, "%s\t", s)
+		var total time.Duration
+		for _, p := range phases {
+			d, ok := r.durations[s][p]
+			total += d
+			if !ok {
+				fmt.Fprint(tw, "-\t")
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t", format(d))
+		}
+		fmt.Fprintf(tw, "%s\n", format(total))
+	}
+	return tw.Flush()
+}
+
+// format rounds to a precision that suits the magnitude
+func format(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(100 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
@@ -0,0 +1,490 @@
+// Package tui browses an analysis report in the terminal: a list of the
+// compared files to filter by server and acknowledge, and each file's diffs,
+// one pair of servers at a time.
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/ack"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/pkg/errors"
+)
+
+// Options are the initial settings of the browser
+type Options struct {
+	Acks          *ack.Store // Where acknowledgements are read from and saved to
+	Server        string     // Only list files where this server's copy is out of line
+	ShowIdentical bool       // Also list identical files
+	HideAcked     bool       // Leave acknowledged and expected files out of the list
+}
+
+// Run browses rep until the user quits
+func Run(rep *report.Report, opts Options) error {
+	if opts.Server != "" && indexOf(rep.Servers, opts.Server) < 0 {
+		return fmt.Errorf("server %s is not in the report (servers: %s)", opts.Server, strings.Join(rep.Servers, ", "))
+	}
+	for i := range rep.Files {
+		rep.Files[i].Acknowledged = false // Looked up in opts.Acks as they change
+	}
+	m := &model{rep: rep, opts: opts, server: indexOf(rep.Servers, opts.Server) + 1}
+	m.filter()
+	if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+		return errors.Wrap(err, "failed to run the terminal UI")
+	}
+	return nil
+}
+
+var (
+	titleStyle   = lipgloss.NewStyle().Bold(true)
+	helpStyle    = lipgloss.NewStyle().Faint(true)
+	cursorStyle  = lipgloss.NewStyle().Reverse(true)
+	ackStyle     = lipgloss.NewStyle().Faint(true)
+	errorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	addedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	removedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	changedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+	hunkStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	headerStyle  = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("5"))
+	statusStyles = map[string]lipgloss.Style{
+		report.StatusDifferent:    changedStyle,
+		report.StatusError:        errorStyle,
+		report.StatusFormatOnly:   hunkStyle,
+		report.StatusMetadataOnly: hunkStyle,
+		report.StatusMoved:        hunkStyle,
+		report.StatusUnstable:     helpStyle,
+		report.StatusVolatile:     helpStyle,
+	}
+)
+
+// model is the state of the browser: the file list, and the file opened
+// from it, if any
+type model struct {
+	rep    *report.Report
+	opts   Options
+	server int // Index of the server filter in rep.Servers plus one; 0 lists all servers' files
+	files  []report.FileResult
+
+	cursor, offset int
+	width, height  int
+	message        string // Result of the last action, shown until the next key
+
+	detail *detail
+}
+
+// detail is an opened file, paged by pair of servers
+type detail struct {
+	file   report.FileResult
+	pages  []page
+	page   int
+	offset int
+}
+
+type page struct {
+	title string
+	lines []line
+}
+
+// line is a line of a page, styled when it's rendered so it can be cut to
+// the terminal's width first
+type line struct {
+	text  string
+	style lipgloss.Style
+}
+
+func (m *model) Init() tea.Cmd {
+	return nil
+}
+
+func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.scroll()
+	case tea.KeyMsg:
+		m.message = ""
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		if m.detail != nil {
+			return m, m.detailKey(msg.String())
+		}
+		return m, m.listKey(msg.String())
+	}
+	return m, nil
+}
+
+// bodyHeight is the number of lines left for the list or diff between the
+// title and help lines
+func (m *model) bodyHeight() int {
+	if m.height < 4 {
+		return 1
+	}
+	return m.height - 3
+}
+
+func (m *model) listKey(key string) tea.Cmd {
+	switch key {
+	case "q", "esc":
+		return tea.Quit
+	case "up", "k":
+		m.cursor--
+	case "down", "j":
+		m.cursor++
+	case "pgup":
+		m.cursor -= m.bodyHeight()
+	case "pgdown", " ":
+		m.cursor += m.bodyHeight()
+	case "home", "g":
+		m.cursor = 0
+	case "end", "G":
+		m.cursor = len(m.files) - 1
+	case "enter", "right", "l":
+		if len(m.files) > 0 {
+			m.detail = newDetail(m.files[m.cursor])
+		}
+	case "a":
+		if len(m.files) > 0 {
+			m.acknowledge(m.files[m.cursor])
+		}
+	case "s", "S":
+		// Cycle through all servers and each single one
+		step := 1
+		if key == "S" {
+			step = len(m.rep.Servers)
+		}
+		m.server = (m.server + step) % (len(m.rep.Servers) + 1)
+		m.filter()
+	case "i":
+		m.opts.ShowIdentical = !m.opts.ShowIdentical
+		m.filter()
+	case "h":
+		m.opts.HideAcked = !m.opts.HideAcked
+		m.filter()
+	}
+	m.scroll()
+	return nil
+}
+
+func (m *model) detailKey(key string) tea.Cmd {
+	d := m.detail
+	switch key {
+	case "q":
+		return tea.Quit
+	case "esc", "left", "backspace":
+		m.detail = nil
+	case "up", "k":
+		d.offset--
+	case "down", "j":
+		d.offset++
+	case "pgup":
+		d.offset -= m.bodyHeight()
+	case "pgdown", " ":
+		d.offset += m.bodyHeight()
+	case "home", "g":
+		d.offset = 0
+	case "end", "G":
+		d.offset = len(d.pages[d.page].lines)
+	case "tab", "n", "]":
+		d.page, d.offset = (d.page+1)%len(d.pages), 0
+	case "shift+tab", "p", "[":
+		d.page, d.offset = (d.page+len(d.pages)-1)%len(d.pages), 0
+	case "a":
+		m.acknowledge(d.file)
+	}
+	if last := len(d.pages[d.page].lines) - m.bodyHeight(); d.offset > last {
+		d.offset = last
+	}
+	if d.offset < 0 {
+		d.offset = 0
+	}
+	return nil
+}
+
+// acknowledge toggles the acknowledgement of f and saves it
+func (m *model) acknowledge(f report.FileResult) {
+	if m.opts.Acks == nil {
+		m.message = "Acknowledgements are not available"
+		return
+	}
+	if f.Expected {
+		m.message = f.Path + " is expected to differ (unique in the config)"
+		return
+	}
+	if !f.Drifting() {
+		m.message = f.Path + " doesn't differ"
+		return
+	}
+	switch e := m.opts.Acks.Covering(f, m.rep.Servers); {
+	case e == nil:
+		// Only while it differs this way, unlike ack add
+		entry := ack.Entry{Path: f.Path, Fingerprint: ack.Fingerprint(f)}
+		if f.Server != "" {
+			entry.Servers = []string{f.Server}
+		}
+		if _, err := m.opts.Acks.Add(entry); err != nil {
+			m.message = err.Error()
+			return
+		}
+		m.message = "Acknowledged " + f.Path
+	case e.Path != f.Path:
+		m.message = fmt.Sprintf("%s is acknowledged by the pattern %s; remove it with ack remove", f.Path, e.Path)
+		return
+	default:
+		m.opts.Acks.Remove(f.Path)
+		m.message = "Withdrew the acknowledgement of " + f.Path
+	}
+	if err := m.opts.Acks.Save(); err != nil {
+		m.message = err.Error()
+	}
+	if m.opts.HideAcked && m.detail == nil {
+		m.filter()
+	}
+}
+
+// filter lists the files the current filters let through, keeping the
+// cursor in range
+func (m *model) filter() {
+	m.files = m.files[:0]
+	server := m.serverName()
+	for _, f := range m.rep.Files {
+		if f.Severity() == 0 && !m.opts.ShowIdentical {
+			continue
+		}
+		if m.opts.HideAcked && (m.acked(f) || f.Expected) {
+			continue
+		}
+		if server != "" && !involves(f, server, m.rep.Servers) {
+			continue
+		}
+		m.files = append(m.files, f)
+	}
+	m.scroll()
+}
+
+// involves reports whether a file concerns server: its copy is out of line,
+// or, for identical files, it has one
+func involves(f report.FileResult, server string, servers []string) bool {
+	if f.Severity() == 0 {
+		_, ok := f.Checksums[server]
+		return ok
+	}
+	return indexOf(f.DriftedServers(servers), server) >= 0
+}
+
+// scroll keeps the cursor on a file and in view
+func (m *model) scroll() {
+	if m.cursor >= len(m.files) {
+		m.cursor = len(m.files) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	}
+	if h := m.bodyHeight(); m.cursor >= m.offset+h {
+		m.offset = m.cursor - h + 1
+	}
+}
+
+func (m *model) serverName() string {
+	if m.server == 0 {
+		return ""
+	}
+	return m.rep.Servers[m.server-1]
+}
+
+func (m *model) acked(f report.FileResult) bool {
+	return m.opts.Acks != nil && f.Drifting() && m.opts.Acks.Covering(f, m.rep.Servers) != nil
+}
+
+func (m *model) View() string {
+	if m.detail != nil {
+		return m.detailView()
+	}
+	return m.listView()
+}
+
+func (m *model) listView() string {
+	var b strings.Builder
+	server := m.serverName()
+	if server == "" {
+		server = "all"
+	}
+	acked := 0
+	for _, f := range m.rep.Files {
+		if m.acked(f) {
+			acked++
+		}
+	}
+	title := fmt.Sprintf("%d of %d file(s) on %d server(s) | server: %s | %d acknowledged",
+		len(m.files), len(m.rep.Files), len(m.rep.Servers), server, acked)
+	if len(m.rep.Errors) > 0 {
+		title += fmt.Sprintf(" | %d run error(s)", len(m.rep.Errors))
+	}
+	b.WriteString(titleStyle.Render(m.clip(title)))
+	b.WriteString("\n")
+
+	h := m.bodyHeight()
+	for i := m.offset; i < m.offset+h; i++ {
+		switch {
+		case i < len(m.files):
+			b.WriteString(m.row(i))
+		case i == 0:
+			b.WriteString("No files match the filters")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(m.footer("↑/↓ move  enter open  a acknowledge  s/S next/previous server  i identical  h hide acknowledged  q quit"))
+	return b.String()
+}
+
+// row renders the i-th listed file
+func (m *model) row(i int) string {
+	f := m.files[i]
+	mark := " "
+	switch {
+	case m.acked(f):
+		mark = "✓"
+	case f.Expected:
+		mark = "="
+	}
+	name := f.Path
+	if f.Server != "" {
+		name = fmt.Sprintf("%s [%s]", f.Path, f.Server)
+	}
+	hosts := ""
+	if n := f.AffectedHosts(); n > 0 {
+		hosts = fmt.Sprintf("%d host(s)", n)
+	}
+	line := m.clip(fmt.Sprintf("%s %-20s %-14s %-10s %s", mark, f.Status, f.Category(), hosts, name))
+	switch {
+	case i == m.cursor:
+		return cursorStyle.Render(line)
+	case m.acked(f) || f.Expected:
+		return ackStyle.Render(line)
+	}
+	if style, ok := statusStyles[f.Status]; ok {
+		return style.Render(line)
+	}
+	return line
+}
+
+func (m *model) detailView() string {
+	d := m.detail
+	p := d.pages[d.page]
+	var b strings.Builder
+	title := fmt.Sprintf("%s | %s (%d of %d)", d.file.Path, p.title, d.page+1, len(d.pages))
+	switch {
+	case m.acked(d.file):
+		title += " | acknowledged"
+	case d.file.Expected:
+		title += " | expected to differ"
+	}
+	b.WriteString(titleStyle.Render(m.clip(title)))
+	b.WriteString("\n")
+	h := m.bodyHeight()
+	for i := d.offset; i < d.offset+h; i++ {
+		if i < len(p.lines) {
+			b.WriteString(p.lines[i].style.Render(m.clip(p.lines[i].text)))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(m.footer("↑/↓ scroll  tab/shift+tab next/previous pair  a acknowledge  esc back  q quit"))
+	return b.String()
+}
+
+// footer shows the message of the last action, or else the key help
+func (m *model) footer(help string) string {
+	if m.message != "" {
+		return m.clip(m.message)
+	}
+	return helpStyle.Render(m.clip(help))
+}
+
+// clip cuts a line to the terminal's width
+func (m *model) clip(s string) string {
+	return clip(s, m.width)
+}
+
+func clip(s string, width int) string {
+	if width <= 0 || lipgloss.Width(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && lipgloss.Width(string(r)) > width {
+		r = r[:len(r)-1]
+	}
+	return string(r)
+}
+
+// newDetail pages a file: an overview with what the text report says about
+// it besides its diffs, then each pair's diff
+func newDetail(f report.FileResult) *detail {
+	d := &detail{file: f}
+	overview := f
+	overview.Diffs = nil
+	d.pages = append(d.pages, page{title: "overview", lines: styleLines(strings.Split(report.FileText(overview), "\n"))})
+	for _, pair := range f.Diffs {
+		p := page{title: f.PairTitle(pair)}
+		for _, c := range pair.KeyChanges {
+			p.lines = append(p.lines, styleKeyChange(c))
+		}
+		if len(pair.KeyChanges) > 0 {
+			p.lines = append(p.lines, line{})
+		}
+		p.lines = append(p.lines, line{"--- " + pair.From, headerStyle}, line{"+++ " + pair.To, headerStyle})
+		for _, h := range pair.Hunks {
+			p.lines = append(p.lines, line{fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.OldStart, h.OldLines, h.NewStart, h.NewLines), hunkStyle})
+			p.lines = append(p.lines, styleLines(h.Lines)...)
+		}
+		d.pages = append(d.pages, p)
+	}
+	if len(d.pages) > 1 {
+		d.page = 1 // Straight to the first diff
+	}
+	return d
+}
+
+// styleLines colors diff and report lines by their first character
+func styleLines(lines []string) []line {
+	out := make([]line, len(lines))
+	for i, l := range lines {
+		out[i].text = strings.ReplaceAll(l, "\t", "    ")
+		switch {
+		case strings.HasPrefix(l, "---"):
+			out[i].style = headerStyle
+		case strings.HasPrefix(l, "@@"):
+			out[i].style = hunkStyle
+		case strings.HasPrefix(l, "+"):
+			out[i].style = addedStyle
+		case strings.HasPrefix(l, "-"):
+			out[i].style = removedStyle
+		}
+	}
+	return out
+}
+
+func styleKeyChange(c report.KeyChange) line {
+	switch c.Kind {
+	case "added":
+		return line{c.String(), addedStyle}
+	case "removed":
+		return line{c.String(), removedStyle}
+	}
+	return line{c.String(), changedStyle}
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
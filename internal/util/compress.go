@@ -0,0 +1,127 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression algorithms of the remote tarball
+const (
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+	CompressNone = "none"
+)
+
+// Compression is how the collection script compresses its tarball
+type Compression struct {
+	Algorithm string // CompressGzip, CompressZstd or CompressNone
+	Level     int    // 0 for the compressor's default
+}
+
+// RemoteCompression applies to the tarball of collections that don't set
+// their own; main sets it from the command line
+var RemoteCompression = Compression{Algorithm: CompressGzip}
+
+// TarFilename is the name of the tarball in the user's home directory
+func (c Compression) TarFilename() string {
+	return "remote_backup" + c.Extension()
+}
+
+// ParseCompression parses the --compress syntax: gzip[:1-9], zstd[:1-19] or none
+func ParseCompression(s string) (Compression, error) {
+	algorithm, levelStr, hasLevel := strings.Cut(s, ":")
+	c := Compression{Algorithm: algorithm}
+	maxLevel := 0
+	switch algorithm {
+	case CompressGzip:
+		maxLevel = 9
+	case CompressZstd:
+		maxLevel = 19
+	case CompressNone:
+		if hasLevel {
+			return Compression{}, fmt.Errorf("--compress none takes no level")
+		}
+		return c, nil
+	default:
+		return Compression{}, fmt.Errorf("invalid --compress value %q (expected %s[:1-9], %s[:1-19] or %s)", s, CompressGzip, CompressZstd, CompressNone)
+	}
+	if hasLevel {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil || level < 1 || level > maxLevel {
+			return Compression{}, fmt.Errorf("invalid %s level %q (expected 1 to %d)", algorithm, levelStr, maxLevel)
+		}
+		c.Level = level
+	}
+	return c, nil
+}
+
+// String formats the compression in the --compress syntax
+func (c Compression) String() string {
+	if c.Level > 0 {
+		return fmt.Sprintf("%s:%d", c.Algorithm, c.Level)
+	}
+	return c.Algorithm
+}
+
+// Extension returns the file name extension of the tarball
+func (c Compression) Extension() string {
+	switch c.Algorithm {
+	case CompressZstd:
+		return ".tar.zst"
+	case CompressNone:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+// tarCommand returns the shell command that archives the current directory
+// into archive. Compressors other than tar's own gzip run in a pipeline,
+// which the script makes fail along with tar (set -o pipefail).
+func (c Compression) tarCommand(prio, archive string) string {
+	switch {
+	case c.Algorithm == CompressNone:
+		return fmt.Sprintf("%star cf %s .", prio, archive)
+	case c.Algorithm == CompressZstd && c.Level > 0:
+		return fmt.Sprintf("%star cf - . | %szstd -q -%d > %s", prio, prio, c.Level, archive)
+	case c.Algorithm == CompressZstd:
+		return fmt.Sprintf("%star cf - . | %szstd -q > %s", prio, prio, archive)
+	case c.Level > 0:
+		return fmt.Sprintf("%star cf - . | %sgzip -%d > %s", prio, prio, c.Level, archive)
+	default:
+		return fmt.Sprintf("%star czf %s .", prio, archive)
+	}
+}
+
+// Extract extracts a tarball compressed this way to a destination directory
+func (c Compression) Extract(r io.Reader, dest string) error {
+	switch c.Algorithm {
+	case CompressZstd:
+		compressed := &CountingReader{R: r}
+		dec, err := zstd.NewReader(compressed)
+		if err != nil {
+			return errors.Wrap(err, "failed to create zstd reader")
+		}
+		defer dec.Close()
+		return ExtractCompressedTar(dec, compressed, dest)
+	case CompressNone:
+		return ExtractTar(r, dest)
+	default:
+		return ExtractTarGz(r, dest)
+	}
+}
+
+// RemoteTarFilenames returns the names the tarball can have in the user's
+// home directory, whatever compression a collection used
+func RemoteTarFilenames() []string {
+	var names []string
+	for _, algorithm := range []string{CompressGzip, CompressZstd, CompressNone} {
+		names = append(names, Compression{Algorithm: algorithm}.TarFilename())
+	}
+	return names
+}
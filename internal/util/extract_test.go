@@ -0,0 +1,166 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive: a symlink if link is set, else a
+// regular file holding body
+type tarEntry struct {
+	name, link, body string
+}
+
+func buildTar(t testing.TB, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// symlinkChain climbs out of the destination through links that each
+// resolve inside it when read on their own
+var symlinkChain = []tarEntry{
+	{name: "d1", link: "."},
+	{name: "x/d2", link: "../d1/.."},
+	{name: "x/y/d3", link: "../d2/.."},
+	{name: "x/y/z/leak", link: "../d3/../secret"},
+}
+
+func extractBytes(data []byte, dest string) error {
+	r := &CountingReader{R: bytes.NewReader(data)}
+	return ExtractCompressedTar(r, r, dest)
+}
+
+// checkConfined fails if any link below dest resolves outside of it
+func checkConfined(t *testing.T, dest string) {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return // Nothing was extracted
+	}
+	filepath.Walk(dest, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		resolved, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return nil // Dangling, or a loop: nothing is read through it
+		}
+		if resolved != root && !strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+			t.Errorf("%s resolves to %s, outside %s", p, resolved, root)
+		}
+		return nil
+	})
+}
+
+func TestExtractSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		kept    []string // Links that must be extracted
+		skipped []string // Links that must be left out
+	}{
+		{
+			name:    "chain of links climbing out",
+			entries: symlinkChain,
+			kept:    []string{"d1"},
+			skipped: []string{"x/d2", "x/y/d3", "x/y/z/leak"},
+		},
+		{
+			name:    "absolute and outside links",
+			entries: []tarEntry{{name: "localtime", link: "/usr/share/zoneinfo/UTC"}, {name: "a/up", link: "../../etc"}},
+			skipped: []string{"localtime", "a/up"},
+		},
+		{
+			name: "links inside",
+			entries: []tarEntry{
+				{name: "conf/real.conf", body: "x=1\n"},
+				{name: "conf/alias.conf", link: "real.conf"},
+				{name: "sites/enabled", link: "../conf/./real.conf"},
+			},
+			kept: []string{"conf/alias.conf", "sites/enabled"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := extractBytes(buildTar(t, tt.entries), dest); err != nil {
+				t.Fatalf("extraction failed: %v", err)
+			}
+			for _, name := range tt.kept {
+				if _, err := os.Lstat(filepath.Join(dest, name)); err != nil {
+					t.Errorf("%s was not extracted: %v", name, err)
+				}
+			}
+			for _, name := range tt.skipped {
+				if _, err := os.Lstat(filepath.Join(dest, name)); err == nil {
+					t.Errorf("%s was extracted", name)
+				}
+			}
+			checkConfined(t, dest)
+		})
+	}
+}
+
+func TestExtractRejectsHostileNames(t *testing.T) {
+	for _, name := range []string{"/etc/passwd", "../outside", "a/../../outside"} {
+		dest := filepath.Join(t.TempDir(), "dest")
+		if err := extractBytes(buildTar(t, []tarEntry{{name: name, body: "x"}}), dest); err == nil {
+			t.Errorf("%q was extracted", name)
+		}
+	}
+	// A file written through a link extracted before it
+	dest := filepath.Join(t.TempDir(), "dest")
+	entries := []tarEntry{{name: "sub/real", body: ""}, {name: "link", link: "sub"}, {name: "link/file", body: "x"}}
+	if err := extractBytes(buildTar(t, entries), dest); err == nil {
+		t.Error("a file was written through a symlink")
+	}
+}
+
+func FuzzExtractCompressedTar(f *testing.F) {
+	f.Add(buildTar(f, symlinkChain))
+	f.Add(buildTar(f, []tarEntry{{name: "a", link: "."}, {name: "b/c", link: "../a/../a"}, {name: "b/d", body: "x"}}))
+	f.Add(buildTar(f, []tarEntry{{name: "etc/hosts", body: "127.0.0.1 localhost\n"}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		root := t.TempDir()
+		secret := filepath.Join(root, "secret")
+		if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(root, "dest")
+		extractBytes(data, dest) // Errors are fine; escapes are not
+		checkConfined(t, dest)
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Name() != "secret" && e.Name() != "dest" {
+				t.Errorf("%s was written outside the destination", e.Name())
+			}
+		}
+		if data, err := os.ReadFile(secret); err != nil || string(data) != "secret" {
+			t.Errorf("the file next to the destination was changed")
+		}
+	})
+}
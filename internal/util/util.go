@@ -9,25 +9,213 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-// GenerateCollectionScript creates the shell script content
-func GenerateCollectionScript(filePaths, dirPaths []string, username string) string {
+// I/O scheduling classes of ionice(1)
+const (
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// Priority lowers the CPU and I/O priority of the remote commands that read
+// the configured trees (cp, cpio, find, sha256sum, tar), so collections don't
+// starve the host's own workload
+type Priority struct {
+	Nice    int    // nice(1) adjustment from 1 to 19; 0 leaves the CPU priority alone
+	IOClass string // IOClassIdle, IOClassBestEffort, or "" to leave the I/O priority alone
+	IOLevel int    // Best-effort level, from 0 (highest) to 7 (lowest)
+}
+
+// RemotePriority applies to every remote command it covers, unless a
+// collection sets its own; main sets it from the command line
+var RemotePriority Priority
+
+// ParseIONice parses the --ionice syntax, idle or best-effort[:level]
+func ParseIONice(s string) (class string, level int, err error) {
+	class, levelStr, hasLevel := strings.Cut(s, ":")
+	switch {
+	case class == IOClassIdle && !hasLevel:
+		return class, 0, nil
+	case class == IOClassBestEffort && !hasLevel:
+		return class, 7, nil
+	case class == IOClassBestEffort:
+		if _, err := fmt.Sscanf(levelStr, "%d", &level); err != nil || level < 0 || level > 7 || fmt.Sprint(level) != levelStr {
+			return "", 0, fmt.Errorf("invalid --ionice level %q (expected 0 to 7)", levelStr)
+		}
+		return class, level, nil
+	}
+	return "", 0, fmt.Errorf("invalid --ionice value %q (expected %s or %s[:0-7])", s, IOClassIdle, IOClassBestEffort)
+}
+
+// Validate checks the nice adjustment; negative ones would need root and raise the priority
+func (p Priority) Validate() error {
+	if p.Nice < 0 || p.Nice > 19 {
+		return fmt.Errorf("--nice must be between 0 and 19, got %d", p.Nice)
+	}
+	return nil
+}
+
+// Prefix returns the nice/ionice words to put before a command, with a
+// trailing space, or "" when the priority is left alone
+func (p Priority) Prefix() string {
+	var words []string
+	if p.Nice > 0 {
+		words = append(words, fmt.Sprintf("nice -n %d", p.Nice))
+	}
+	switch p.IOClass {
+	case IOClassIdle:
+		words = append(words, "ionice -c 3")
+	case IOClassBestEffort:
+		words = append(words, fmt.Sprintf("ionice -c 2 -n %d", p.IOLevel))
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.Join(words, " ") + " "
+}
+
+// Privilege escalation methods of the remote commands that read files as root
+const (
+	BecomeSudo = "sudo" // sudo, with the password piped to sudo -S if one is set
+	BecomeDoas = "doas" // doas, which must not ask for a password
+	BecomeNone = "none" // No escalation: files are read as the SSH user and unreadable ones skipped
+)
+
+// ValidateBecome checks a privilege escalation method; "" stands for BecomeSudo
+func ValidateBecome(become string) error {
+	switch become {
+	case "", BecomeSudo, BecomeDoas, BecomeNone:
+		return nil
+	}
+	return fmt.Errorf("unknown privilege escalation %q (expected %s, %s or %s)", become, BecomeSudo, BecomeDoas, BecomeNone)
+}
+
+// Escalation is how remote commands gain root
+type Escalation struct {
+	Become   string // BecomeSudo (also ""), BecomeDoas or BecomeNone
+	Password bool   // sudo is given a password on standard input; ignored by doas
+}
+
+// Unprivileged reports whether commands run as the SSH user
+func (e Escalation) Unprivileged() bool {
+	return e.Become == BecomeNone
+}
+
+// Prefix returns the words to put before a command to run it as root, with a
+// trailing space, or "" when commands run unprivileged. With a password, the
+// password must be the first line of the command's standard input.
+func (e Escalation) Prefix() string {
+	switch {
+	case e.Become == BecomeNone:
+		return ""
+	case e.Become == BecomeDoas:
+		return "doas "
+	case e.PipesPassword():
+		return "sudo -S -p '' "
+	}
+	return "sudo "
+}
+
+// PipesPassword reports whether sudo is given a password
+func (e Escalation) PipesPassword() bool {
+	return e.Password && (e.Become == "" || e.Become == BecomeSudo)
+}
+
+// sudoPasswordVar holds the sudo password in the collection script, which
+// reads it from its standard input so it is never written to disk
+const sudoPasswordVar = "RDT_SUDO_PASS"
+
+// The collection script reports what it couldn't copy on stdout, in lines of
+// ScriptStatusPrefix, a status and a remote path, separated by tabs. The
+// messages of a directory's cpio follow its StatusDir line.
+const (
+	ScriptStatusPrefix = "RDT-STATUS"
+	StatusCopyFailed   = "copy-failed" // cp failed on a file; its message is on the line before
+	StatusDir          = "dir"         // The copy of a directory starts
+	StatusDirFailed    = "dir-failed"  // cpio exited with an error on a directory
+)
+
+// leaveOutBatch is how many files one rm of the collection script removes
+const leaveOutBatch = 100
+
+// scriptPrefix is Prefix for a command of the collection script, piping it
+// the password when there is one
+func (e Escalation) scriptPrefix() string {
+	if e.PipesPassword() {
+		return `printf '%s\n' "$` + sudoPasswordVar + `" | ` + e.Prefix()
+	}
+	return e.Prefix()
+}
+
+// ScriptOptions are how the collection script's commands run on the server
+type ScriptOptions struct {
+	Priority    Priority    // Of the commands that read the configured trees
+	Compression Compression // Of the tarball
+}
+
+// GenerateCollectionScript creates the shell script content. env is exported
+// at the top of the script. esc is how the copies are made as root; with a
+// sudo password, the script reads it from the first line of its standard
+// input. unprivileged, if not nil, tells which of the paths are copied
+// without escalating, and the script only escalates when some path needs it.
+// Files copied without privileges are skipped if they can't be read.
+// findPredicates, if not nil, returns extra find(1) tests for a directory
+// (run as "find ." inside it). The files of leaveOut, remote paths below
+// filePaths or dirPaths, are removed from the copy before it is archived.
+func GenerateCollectionScript(filePaths, dirPaths []string, username string, env map[string]string, esc Escalation, opts ScriptOptions, unprivileged func(path string) bool, findPredicates func(dir string) string, leaveOut []string) string {
 	// Using a template might be cleaner for more complex scripts
 	var script strings.Builder
+	prio := opts.Priority.Prefix()
+
+	// Each path escalates as esc says unless it doesn't need to; the copies
+	// are only owned by root, and cleaned up as root, if some path escalated
+	pathEsc := func(p string) Escalation {
+		if unprivileged != nil && unprivileged(p) {
+			return Escalation{Become: BecomeNone}
+		}
+		return esc
+	}
+	housekeeping := Escalation{Become: BecomeNone}
+	for _, p := range append(append([]string{}, filePaths...), dirPaths...) {
+		if !pathEsc(p).Unprivileged() {
+			housekeeping = esc
+			break
+		}
+	}
+	root := housekeeping.scriptPrefix()
 
 	remoteBaseDir := fmt.Sprintf("/home/%s/remote_backup", username) // Use ~ doesn't always expand in non-interactive shell
-	remoteTarFile := fmt.Sprintf("/home/%s/remote_backup.tar.gz", username)
+	remoteTarFile := fmt.Sprintf("/home/%s/%s", username, opts.Compression.TarFilename())
 
-	script.WriteString(`#!/bin/bash
-set -e # Exit on first error
+	script.WriteString("#!/bin/bash\nset -e # Exit on first error\n")
+	if strings.Contains(opts.Compression.tarCommand("", ""), "|") {
+		script.WriteString("set -o pipefail # A failing tar fails the compressor's pipeline\n")
+	}
+	if housekeeping.PipesPassword() {
+		script.WriteString(fmt.Sprintf("\n# The sudo password comes on standard input and is only ever piped to sudo\nIFS= read -r %s || true\n", sudoPasswordVar))
+	}
+	if len(env) > 0 {
+		names := make([]string, 0, len(env))
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		script.WriteString("\n# Per-server environment\n")
+		for _, name := range names {
+			script.WriteString(fmt.Sprintf("export %s=%s\n", name, ShellQuote(env[name])))
+		}
+	}
 
+	script.WriteString(`
 echo "Cleaning up previous backup (if any)..."
-sudo rm -rf ` + remoteBaseDir + ` ` + remoteTarFile + `
+` + root + `rm -rf ` + remoteBaseDir + ` ` + remoteTarFile + `
 
 echo "Creating backup directory structure..."
 mkdir -p ` + remoteBaseDir + "\n")
@@ -51,60 +239,188 @@ mkdir -p ` + remoteBaseDir + "\n")
 
 	script.WriteString("\n# Copy individual files\n")
 	for _, p := range filePaths {
+		fileEsc := pathEsc(p)
+		skip := ""
+		if fileEsc.Unprivileged() {
+			// A file that can't be read is left out; the collector records it from the remote listing
+			skip = fmt.Sprintf(" || echo \"WARNING: Cannot read %s without privileges\"", p)
+		}
+		if skip == "" {
+			// A file that can't be copied is reported to the collector instead of ending the script
+			skip = fmt.Sprintf(" || echo %s", ShellQuote(ScriptStatusPrefix+"\t"+StatusCopyFailed+"\t"+p))
+		}
 		script.WriteString(fmt.Sprintf(`echo "Copying file %s"
 if [ -f %q ]; then
-    sudo cp -p %q %q # -p preserves mode and timestamps
+    %s%scp -p %q %q 2>&1%s # -p preserves mode and timestamps
 else
     echo "WARNING: File %s not found"
     # Create a marker file to indicate absence
     touch %q.MISSING
 fi
-`, p, p, p, remoteBaseDir+p, p, remoteBaseDir+p))
+`, p, p, fileEsc.scriptPrefix(), prio, p, remoteBaseDir+p, skip, p, remoteBaseDir+p))
 	}
 
 	script.WriteString("\n# Copy directory contents\n")
 	for _, p := range dirPaths {
 		p = strings.TrimRight(p, "/") // Ensure consistent path format
+		predicates := ""
+		if findPredicates != nil {
+			predicates = findPredicates(p)
+		}
+		dirEsc := pathEsc(p)
+		dirRoot := dirEsc.scriptPrefix()
+		copyCmd := fmt.Sprintf("%s%sfind . -mindepth 1 %s-print0 | %s%scpio -pdum0 %q", dirRoot, prio, predicates, dirRoot, prio, remoteBaseDir+p)
+		if dirEsc.PipesPassword() {
+			// cpio reads the file list from find, so both run under one sudo that gets the password
+			copyCmd = fmt.Sprintf("%ssh -c %s", dirRoot, ShellQuote(fmt.Sprintf("%sfind . -mindepth 1 %s-print0 | %scpio -pdum0 %s", prio, predicates, prio, ShellQuote(remoteBaseDir+p))))
+		}
 		script.WriteString(fmt.Sprintf(`echo "Copying directory contents %s"
+echo %s
 if [ -d %q ]; then
     # Use find to copy contents, preserving structure relative to remoteBaseDir
     # Note: This copies contents INTO the target dir, mirroring find's behavior
     # Using -mindepth 1 to avoid copying the source directory itself
-    cd %q && sudo find . -mindepth 1 -print0 | sudo cpio -pdum0 %q 2>/dev/null || echo "Warning: cpio encountered errors in %s"
+    # cpio's complaints go to stdout, after the status line above, for the collector
+    cd %q && %s 2>&1 || echo %s
     # Alternative using cp -a (archive mode) if available and preferred:
     # sudo cp -aT %q %q # -T treats source as file/dir, not contents
 else
     echo "WARNING: Directory %s not found"
     touch %qDIRECTORY.MISSING
 fi
-`, p, p, p, remoteBaseDir+p, p, p, remoteBaseDir+p, p, remoteBaseDir+p))
+`, p, ShellQuote(ScriptStatusPrefix+"\t"+StatusDir+"\t"+p), p, p, copyCmd, ShellQuote(ScriptStatusPrefix+"\t"+StatusDirFailed+"\t"+p), p, remoteBaseDir+p, p, remoteBaseDir+p))
+	}
+
+	if len(leaveOut) > 0 {
+		script.WriteString(fmt.Sprintf("\n# Leave out the files unchanged since the previous collection; the collector keeps its copies\necho \"Leaving out %d unchanged file(s)...\"\n", len(leaveOut)))
+		for i := 0; i < len(leaveOut); i += leaveOutBatch {
+			end := i + leaveOutBatch
+			if end > len(leaveOut) {
+				end = len(leaveOut)
+			}
+			batch := leaveOut[i:end]
+			quoted := make([]string, len(batch))
+			for j, p := range batch {
+				quoted[j] = ShellQuote(remoteBaseDir + p)
+			}
+			script.WriteString(root + "rm -f " + strings.Join(quoted, " ") + "\n")
+		}
 	}
 
 	script.WriteString(fmt.Sprintf(`
 # Set broad read permissions for the user to tar it up
 echo "Setting permissions for tarring..."
-sudo chmod -R u+rX,go-w %s || echo "Warning: chmod failed on backup dir"
+%s%schmod -R u+rX,go-w %s || echo "Warning: chmod failed on backup dir"
 
 # Create tar archive (run as user, not sudo)
 echo "Creating tar archive..."
 cd %s # Go into the base directory for relative paths in tar
-tar czf %s . # Tar contents of current dir (.)
+%s # Tar contents of current dir (.)
+
+# Checksum of the archive, checked against the downloaded copy before it is extracted
+%ssha256sum %s
 
 echo "Collection script finished."
-`, remoteBaseDir, remoteBaseDir, remoteTarFile))
+`, root, prio, remoteBaseDir, remoteBaseDir, opts.Compression.tarCommand(prio, remoteTarFile), prio, ShellQuote(remoteTarFile)))
 
 	return script.String()
 }
 
+// ExtractLimits caps what a single archive extraction may produce, as a
+// defense against decompression bombs. A zero field disables that cap.
+type ExtractLimits struct {
+	MaxEntries int     // Number of tar entries
+	MaxBytes   int64   // Total bytes written to disk
+	MaxRatio   float64 // Extracted bytes per compressed byte read
+}
+
+// DefaultExtractLimits are generous for configuration trees but stop runaway archives
+var DefaultExtractLimits = ExtractLimits{
+	MaxEntries: 200000,
+	MaxBytes:   4 << 30, // 4 GiB
+	MaxRatio:   250,
+}
+
+// ExtractionLimits applies to every extraction; main sets it from the command line
+var ExtractionLimits = DefaultExtractLimits
+
+// ratioCheckMinBytes is how much must be extracted before the ratio cap applies,
+// so small, highly compressible files don't trip it
+const ratioCheckMinBytes = 16 << 20
+
+// CountingReader counts the bytes read through it
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// extractGuard enforces ExtractLimits while an archive is extracted
+type extractGuard struct {
+	limits     ExtractLimits
+	compressed *CountingReader // nil when the compressed size is unknown
+	entries    int
+	written    int64
+}
+
+func (g *extractGuard) addEntry(name string) error {
+	g.entries++
+	if g.limits.MaxEntries > 0 && g.entries > g.limits.MaxEntries {
+		return fmt.Errorf("archive exceeds the limit of %d entries (at %q)", g.limits.MaxEntries, name)
+	}
+	return nil
+}
+
+// reserve checks that size more bytes fit in the byte cap before they are written
+func (g *extractGuard) reserve(name string, size int64) error {
+	if g.limits.MaxBytes > 0 && g.written+size > g.limits.MaxBytes {
+		return fmt.Errorf("archive exceeds the limit of %d extracted bytes (at %q)", g.limits.MaxBytes, name)
+	}
+	return nil
+}
+
+// Write counts extracted bytes and checks the compression ratio as data flows
+func (g *extractGuard) Write(p []byte) (int, error) {
+	g.written += int64(len(p))
+	if g.limits.MaxRatio > 0 && g.compressed != nil && g.compressed.N > 0 && g.written > ratioCheckMinBytes {
+		if ratio := float64(g.written) / float64(g.compressed.N); ratio > g.limits.MaxRatio {
+			return 0, fmt.Errorf("archive compression ratio %.0f:1 exceeds the limit of %.0f:1", ratio, g.limits.MaxRatio)
+		}
+	}
+	return len(p), nil
+}
+
 // ExtractTarGz extracts a .tar.gz file to a destination directory
 func ExtractTarGz(gzipStream io.Reader, dest string) error {
-	uncompressedStream, err := gzip.NewReader(gzipStream)
+	compressed := &CountingReader{R: gzipStream}
+	uncompressedStream, err := gzip.NewReader(compressed)
 	if err != nil {
 		return errors.Wrap(err, "failed to create gzip reader")
 	}
 	defer uncompressedStream.Close()
 
-	tarReader := tar.NewReader(uncompressedStream)
+	return ExtractCompressedTar(uncompressedStream, compressed, dest)
+}
+
+// ExtractTar extracts an uncompressed tar stream to a destination directory.
+// The entry and byte caps apply; the ratio cap needs ExtractCompressedTar.
+func ExtractTar(stream io.Reader, dest string) error {
+	return extractTar(stream, dest, &extractGuard{limits: ExtractionLimits})
+}
+
+// ExtractCompressedTar extracts a decompressed tar stream whose compressed
+// input is read through compressed, so the compression ratio cap applies too
+func ExtractCompressedTar(stream io.Reader, compressed *CountingReader, dest string) error {
+	return extractTar(stream, dest, &extractGuard{limits: ExtractionLimits, compressed: compressed})
+}
+
+func extractTar(stream io.Reader, dest string, guard *extractGuard) error {
+	tarReader := tar.NewReader(stream)
 
 	// Ensure the destination directory exists before starting extraction loop
 	if err := os.MkdirAll(dest, 0755); err != nil {
@@ -130,6 +446,16 @@ func ExtractTarGz(gzipStream io.Reader, dest string) error {
 		}
 		// --- End of FIX ---
 
+		if err := guard.addEntry(header.Name); err != nil {
+			return err
+		}
+
+		// Reject hostile names outright instead of silently rewriting them
+		if err := validateEntryName(header.Name); err != nil {
+			log.Errorf("Path sanitization failed: header.Name='%s': %v", header.Name, err)
+			return err
+		}
+
 		// Construct target path and perform sanitization check
 		target := filepath.Join(cleanDest, header.Name)
 		if !strings.HasPrefix(target, cleanDest+string(os.PathSeparator)) && target != cleanDest {
@@ -139,16 +465,26 @@ func ExtractTarGz(gzipStream io.Reader, dest string) error {
 			return fmt.Errorf("invalid file path in tar: %q attempts to escape destination %q", header.Name, dest)
 		}
 
+		// Never write through a symlink created by an earlier entry
+		if err := checkNoSymlinkParents(cleanDest, target); err != nil {
+			log.Errorf("Path sanitization failed: %v", err)
+			return err
+		}
+
 		// Extract based on type
 		switch header.Typeflag {
 		case tar.TypeDir:
-			// Create directory with permissions from tar header
+			// Create directory with safe permissions derived from the tar header
 			// MkdirAll handles nested directories and is idempotent
-			if err := os.MkdirAll(target, header.FileInfo().Mode()); err != nil {
+			if err := os.MkdirAll(target, LocalMode(header.FileInfo().Mode())); err != nil {
 				log.Errorf("Failed to MkdirAll %s: %v (Header mode: %v)", target, err, header.FileInfo().Mode())
 				return errors.Wrapf(err, "failed to create directory %s", target)
 			}
 		case tar.TypeReg:
+			if err := guard.reserve(header.Name, header.Size); err != nil {
+				return err
+			}
+
 			// Ensure parent directory exists (necessary for files in potentially new subdirs)
 			parentDir := filepath.Dir(target)
 			if err := os.MkdirAll(parentDir, 0755); err != nil { // Use default perms for parent, let file set its own
@@ -156,9 +492,17 @@ func ExtractTarGz(gzipStream io.Reader, dest string) error {
 				return errors.Wrapf(err, "failed to create parent directory for file %s", target)
 			}
 
-			// Create file with permissions from tar header
+			// Replace rather than follow an existing symlink at the target
+			if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(target); err != nil {
+					return errors.Wrapf(err, "failed to replace symlink %s", target)
+				}
+			}
+
+			// Create file with safe permissions derived from the tar header; the
+			// original mode is recorded in the manifest, not on the local copy
 			// O_TRUNC ensures we overwrite any existing file with the same name
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, header.FileInfo().Mode())
+			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, LocalMode(header.FileInfo().Mode()))
 			if err != nil {
 				log.Errorf("Failed to OpenFile %s: %v (Header mode: %v)", target, err, header.FileInfo().Mode())
 				return errors.Wrapf(err, "failed to create file %s", target)
@@ -167,7 +511,7 @@ func ExtractTarGz(gzipStream io.Reader, dest string) error {
 			// Use defer with a closure to handle potential copy error and ensure Close
 			copyErr := func() error {
 				defer outFile.Close()
-				bytesCopied, copyErr := io.Copy(outFile, tarReader)
+				bytesCopied, copyErr := io.Copy(io.MultiWriter(outFile, guard), tarReader)
 				if copyErr != nil {
 					log.Errorf("Failed to io.Copy to file %s: %v", target, copyErr)
 					// Attempt to remove partially written file
@@ -183,10 +527,22 @@ func ExtractTarGz(gzipStream io.Reader, dest string) error {
 			}
 
 		case tar.TypeSymlink:
-			log.Warnf("Skipping symlink extraction (feature not implemented): %s -> %s", target, header.Linkname)
-			// Optional: Implement symlink creation if needed, carefully handling targets
-			// Example (needs error handling and security checks):
-			// if err := os.Symlink(header.Linkname, target); err != nil { ... }
+			// Only links that resolve inside dest are created; /etc commonly holds
+			// absolute links (e.g. localtime), so those are skipped, not fatal
+			if !symlinkWithin(cleanDest, target, header.Linkname) {
+				log.Warnf("Skipping symlink pointing outside the extraction directory: %s -> %s", target, header.Linkname)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.Wrapf(err, "failed to create parent directory for symlink %s", target)
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return errors.Wrapf(err, "failed to replace existing entry at %s", target)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return errors.Wrapf(err, "failed to create symlink %s", target)
+			}
+			log.Debugf("Extracted symlink %s -> %s", target, header.Linkname)
 		case tar.TypeLink:
 			log.Warnf("Skipping hardlink extraction (feature not implemented): %s -> %s", target, header.Linkname)
 			// Optional: Implement hardlink creation if needed
@@ -200,6 +556,95 @@ func ExtractTarGz(gzipStream io.Reader, dest string) error {
 	return nil
 }
 
+// validateEntryName rejects absolute tar entry names and names containing ".."
+// components. The collection script archives "." so neither appears legitimately.
+func validateEntryName(name string) error {
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid file path in tar: %q contains a NUL byte", name)
+	}
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return fmt.Errorf("invalid file path in tar: %q is absolute", name)
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == os.PathSeparator }) {
+		if part == ".." {
+			return fmt.Errorf("invalid file path in tar: %q contains a '..' component", name)
+		}
+	}
+	return nil
+}
+
+// symlinkWithin reports whether a symlink at target pointing to linkname stays
+// inside dest. Absolute link targets are never considered inside, and ".."
+// may only lead the link target: after a name it would climb out of wherever
+// that name resolves to, so links into links (d -> ".", x -> "../d/..") could
+// escape dest one step at a time, although each looks inside on its own. With
+// every link kept inside and going down from its first named component,
+// following any chain of them stays inside too.
+func symlinkWithin(dest, target, linkname string) bool {
+	if linkname == "" || filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return false
+	}
+	named := false
+	for _, part := range strings.FieldsFunc(linkname, func(r rune) bool { return r == '/' || r == os.PathSeparator }) {
+		switch {
+		case part == ".." && named:
+			return false
+		case part != "." && part != "..":
+			named = true
+		}
+	}
+	resolved := filepath.Join(filepath.Dir(target), linkname)
+	return resolved == dest || strings.HasPrefix(resolved, dest+string(os.PathSeparator))
+}
+
+// checkNoSymlinkParents makes sure no directory between dest and target is a
+// symlink, so a chain of individually valid links can't redirect a later entry
+func checkNoSymlinkParents(dest, target string) error {
+	rel, err := filepath.Rel(dest, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	current := dest
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil // Nothing below a missing directory can be a symlink yet
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to inspect %s", current)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid file path in tar: %q would be written through symlink %s", target, current)
+		}
+	}
+	return nil
+}
+
+// HashBufferSize is how many bytes of a file are read at a time while it is
+// checksummed; main sets it from the command line. Larger reads speed up
+// the checksums of multi-GB files.
+var HashBufferSize = 1 << 20
+
+// MinHashBufferSize is the smallest HashBufferSize accepted
+const MinHashBufferSize = 4 << 10
+
+// hashBuffers keeps the read buffers of the checksums for reuse
+var hashBuffers sync.Pool
+
+// hashBuffer returns a buffer of HashBufferSize bytes, to be given back with putHashBuffer
+func hashBuffer() *[]byte {
+	if b, ok := hashBuffers.Get().(*[]byte); ok && len(*b) == HashBufferSize {
+		return b
+	}
+	b := make([]byte, HashBufferSize)
+	return &b
+}
+
+func putHashBuffer(b *[]byte) {
+	hashBuffers.Put(b)
+}
+
 // CalculateSHA256 calculates the SHA256 checksum of a file
 func CalculateSHA256(filePath string) (string, error) {
 	file, err := os.Open(filePath)
@@ -208,10 +653,164 @@ func CalculateSHA256(filePath string) (string, error) {
 	}
 	defer file.Close()
 
+	buf := hashBuffer()
+	defer putHashBuffer(buf)
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	// Wrapped so io.CopyBuffer uses buf instead of the 32 KiB one of os.File's WriteTo
+	if _, err := io.CopyBuffer(hash, struct{ io.Reader }{file}, *buf); err != nil {
 		return "", errors.Wrapf(err, "failed to read file %s for checksum", filePath)
 	}
 
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
+
+// CalculateXXH64 calculates the xxHash64 of a file, a fast but
+// non-cryptographic checksum
+func CalculateXXH64(filePath string) (uint64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open file %s for checksum", filePath)
+	}
+	defer file.Close()
+
+	buf := hashBuffer()
+	defer putHashBuffer(buf)
+	hash := xxhash.New()
+	if _, err := io.CopyBuffer(hash, struct{ io.Reader }{file}, *buf); err != nil {
+		return 0, errors.Wrapf(err, "failed to read file %s for checksum", filePath)
+	}
+	return hash.Sum64(), nil
+}
+
+// CalculateChunkedSHA256 reads a file once for its sha256 and the sha256 of
+// each chunkSize block, and also returns its size
+func CalculateChunkedSHA256(filePath string, chunkSize int64) (string, []string, int64, error) {
+	if chunkSize <= 0 {
+		return "", nil, 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, 0, errors.Wrapf(err, "failed to open file %s for checksum", filePath)
+	}
+	defer file.Close()
+
+	buf := hashBuffer()
+	defer putHashBuffer(buf)
+	whole := sha256.New()
+	var chunks []string
+	var size int64
+	for {
+		chunk := sha256.New()
+		n, err := io.CopyBuffer(io.MultiWriter(whole, chunk), io.LimitReader(file, chunkSize), *buf)
+		if err != nil {
+			return "", nil, 0, errors.Wrapf(err, "failed to read file %s for checksum", filePath)
+		}
+		if n > 0 {
+			chunks = append(chunks, hex.EncodeToString(chunk.Sum(nil)))
+			size += n
+		}
+		if n < chunkSize {
+			break
+		}
+	}
+	return hex.EncodeToString(whole.Sum(nil)), chunks, size, nil
+}
+
+// LocalMode returns the permissions a local copy of a remote file is written
+// with: the owner can always read and write it, nobody else can write it, and
+// setuid, setgid and sticky bits are dropped. Dirs also stay searchable.
+func LocalMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() {
+		return mode.Perm()&0755 | 0700
+	}
+	return mode.Perm()&0755 | 0600
+}
+
+// OctalMode formats a mode's permission and special bits the way chmod takes
+// them, e.g. "0640" or "4755"
+func OctalMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// ShellQuote quotes s for safe use as a single word in a POSIX shell command
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// CopyTree copies the directory tree at src to dst, recreating symlinks as
+// they are. With link set, regular files are hard-linked instead of copied
+// where the filesystem allows, so the copy is cheap; the caller must then
+// only ever replace files in either tree, never rewrite them in place.
+func CopyTree(src, dst string, link bool) error {
+	return filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, LocalMode(info.Mode()))
+		case d.Type()&os.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(p)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read symlink %s", p)
+			}
+			return errors.Wrapf(os.Symlink(linkTarget, target), "failed to create symlink %s", target)
+		case !d.Type().IsRegular():
+			return nil // Collected trees only hold files, dirs and symlinks
+		}
+		if link && os.Link(p, target) == nil {
+			return nil
+		}
+		return copyFile(p, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", src)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, LocalMode(mode))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", dst)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "failed to copy %s to %s", src, dst)
+	}
+	return errors.Wrapf(out.Close(), "failed to write %s", dst)
+}
+
+// FormatBytes renders a byte count with a binary unit, e.g. "1.5 GiB"
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,143 @@
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryEnvVar overrides the location of the workspace registry file
+const RegistryEnvVar = "REMOTE_DIFF_WORKSPACES"
+
+const registryFileName = "workspaces.json"
+
+// Workspace is a named output directory, typically one per environment
+type Workspace struct {
+	Name string `json:"name"`
+	Path string `json:"path"` // Absolute path of the output directory
+}
+
+// Registry lists the known workspaces and which one is active
+type Registry struct {
+	Active     string               `json:"active,omitempty"`
+	Workspaces map[string]Workspace `json:"workspaces"`
+
+	path string // Where the registry was loaded from
+}
+
+// RegistryPath returns the registry location: $REMOTE_DIFF_WORKSPACES, or
+// workspaces.json in the user's config directory
+func RegistryPath() (string, error) {
+	if p := os.Getenv(RegistryEnvVar); p != "" {
+		return p, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to determine user config directory")
+	}
+	return filepath.Join(configDir, "remote-diff-tool", registryFileName), nil
+}
+
+// Load reads the registry, returning an empty one if it doesn't exist yet
+func Load() (*Registry, error) {
+	registryPath, err := RegistryPath()
+	if err != nil {
+		return nil, err
+	}
+	reg := &Registry{Workspaces: make(map[string]Workspace), path: registryPath}
+
+	data, err := os.ReadFile(registryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return reg, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read workspace registry %s", registryPath)
+	}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse workspace registry %s", registryPath)
+	}
+	if reg.Workspaces == nil {
+		reg.Workspaces = make(map[string]Workspace)
+	}
+	return reg, nil
+}
+
+// Save writes the registry back to where it was loaded from
+func (r *Registry) Save() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for workspace registry %s", r.path)
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal workspace registry")
+	}
+	if err := os.WriteFile(r.path, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write workspace registry %s", r.path)
+	}
+	log.Debugf("Workspace registry saved to %s", r.path)
+	return nil
+}
+
+// List returns the workspaces sorted by name
+func (r *Registry) List() []Workspace {
+	list := make([]Workspace, 0, len(r.Workspaces))
+	for _, ws := range r.Workspaces {
+		list = append(list, ws)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Create registers a new workspace and creates its output directory.
+// The first workspace created becomes the active one.
+func (r *Registry) Create(name, dir string) (Workspace, error) {
+	if name == "" {
+		return Workspace{}, fmt.Errorf("workspace name must not be empty")
+	}
+	if _, exists := r.Workspaces[name]; exists {
+		return Workspace{}, fmt.Errorf("workspace %q already exists", name)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return Workspace{}, errors.Wrapf(err, "failed to resolve workspace path %s", dir)
+	}
+	for _, other := range r.Workspaces {
+		if other.Path == absDir {
+			return Workspace{}, fmt.Errorf("directory %s is already used by workspace %q", absDir, other.Name)
+		}
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		return Workspace{}, errors.Wrapf(err, "failed to create workspace directory %s", absDir)
+	}
+
+	ws := Workspace{Name: name, Path: absDir}
+	r.Workspaces[name] = ws
+	if r.Active == "" {
+		r.Active = name
+	}
+	return ws, nil
+}
+
+// Switch makes name the active workspace
+func (r *Registry) Switch(name string) (Workspace, error) {
+	ws, ok := r.Workspaces[name]
+	if !ok {
+		return Workspace{}, fmt.Errorf("workspace %q does not exist (see 'workspace list')", name)
+	}
+	r.Active = name
+	return ws, nil
+}
+
+// ActiveWorkspace returns the active workspace, if any
+func (r *Registry) ActiveWorkspace() (Workspace, bool) {
+	if r.Active == "" {
+		return Workspace{}, false
+	}
+	ws, ok := r.Workspaces[r.Active]
+	return ws, ok
+}
@@ -4,28 +4,133 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
 	"github.com/brndnsvr/remote-diff-tool/internal/collect"
 	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/jsonschema"
+	"github.com/brndnsvr/remote-diff-tool/internal/keyring"
+	"github.com/brndnsvr/remote-diff-tool/internal/preset"
+	"github.com/brndnsvr/remote-diff-tool/internal/replay"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshmock"
+	"github.com/brndnsvr/remote-diff-tool/internal/sshutil"
+	"github.com/brndnsvr/remote-diff-tool/internal/timing"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	serversStr     string
-	filesStr       string
-	dirsStr        string
-	outputDir      string
-	saveDiffs      bool
-	diffDir        string
-	logFile        string
-	logLevel       string
-	maxConcurrency int
+	serversStr      string
+	filesStr        string
+	dirsStr         string
+	excludePatterns []string
+	includePatterns []string
+	journalSpecs    []string
+	retrySpecs      []string
+	ioniceSpec      string
+	compressSpec    string
+	bwlimitSpec     string
+	presetNames     []string
+	outputDir       string
+	saveDiffs       bool
+	diffDir         string
+	maxInlineLines  int
+	minSimilarity   float64
+	structured      bool
+	sortBy          string
+	groupBy         string
+	ignoreAcks      bool
+	unicodePaths    string
+	maxSimilarity   float64
+	logFile         string
+	currentLogFile  string // The log file of this run, which clean keeps
+	logLevel        string
+	maxConcurrency  int
+	strictConfig    bool
+	sshConfigPath   string
+	mockDir         string
+	mockFaults      []string
+	recordDir       string
+	replayDir       string
+	showTimings     bool
+	diffEngine      string
+	outputFormat    string
+	remoteOnly      bool
+	fetchMismatch   bool
+	exitCodes       bool
+	failOnDiff      bool
+	failOnError     bool
+	exitStatus      int // Set by the analysis commands according to the exit code policy
 )
 
+// defaultMaxInlineLines keeps a badly drifted file from flooding the terminal
+const defaultMaxInlineLines = 200
+
+// analysisOptions gathers the analyze-related flags
+func analysisOptions() analyze.Options {
+	return analyze.Options{
+		DiffDir:        diffDir,
+		SaveDiffs:      saveDiffs,
+		MaxConcurrency: maxConcurrency,
+		DiffEngine:     diffEngine,
+		Format:         outputFormat,
+		MaxInlineLines: maxInlineLines,
+		MinSimilarity:  minSimilarity,
+		MaxSimilarity:  maxSimilarity,
+		TextOnly:       !structured,
+		SortBy:         sortBy,
+		GroupBy:        groupBy,
+		IgnoreAcks:     ignoreAcks,
+		UnicodePaths:   unicodePaths,
+	}
+}
+
+// Exit statuses under --exit-code, as with diff(1)
+const (
+	exitDifferences = 1
+	exitErrors      = 2
+)
+
+// addExitCodeFlags adds the exit code policy flags to a command that reports differences
+func addExitCodeFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&exitCodes, "exit-code", false, "Exit with 1 if differences were found and 2 on errors, like diff (same as --fail-on-diff --fail-on-error)")
+	cmd.Flags().BoolVar(&failOnDiff, "fail-on-diff", false, "Exit with 1 if any file differs")
+	cmd.Flags().BoolVar(&failOnError, "fail-on-error", false, "Exit with 2 if the run fails or any file could not be compared")
+}
+
+// addComparisonFlags adds the flags that shape content comparisons to a command that reports differences
+func addComparisonFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&structured, "structured", true, "Compare JSON, YAML, TOML and INI files by their parsed content, reporting changed keys and treating reordered or reformatted copies as equivalent")
+	cmd.Flags().Float64Var(&minSimilarity, "min-similarity", 0, "Only report files with content diffs that are at least this similar, in percent (e.g. 90 for small tweaks)")
+	cmd.Flags().Float64Var(&maxSimilarity, "max-similarity", 100, "Only report files with content diffs that are at most this similar, in percent (e.g. 50 for heavily diverged files)")
+	cmd.Flags().StringVar(&sortBy, "sort", report.SortPath, "Order of the reported files: path, severity (riskiest first), similarity (least similar first) or hosts (most affected servers first)")
+	cmd.Flags().StringVar(&groupBy, "group-by", report.GroupNone, "Group the reported files by status, category, owner or path (the configured file or dir they belong to), or none")
+	cmd.Flags().BoolVar(&ignoreAcks, "ignore-acks", false, "Report the differences acknowledged in ack.json like any other")
+	cmd.Flags().StringVar(&unicodePaths, "unicode-paths", analyze.UnicodePathsExact, "How file names match across servers: exact (byte for byte) or nfc (names in different Unicode forms, e.g. an accent composed on one server and decomposed on another, are the same file)")
+}
+
+// addChunkFlags adds the chunk hash flags to a command that collects
+func addChunkFlags(cmd *cobra.Command) {
+	cmd.Flags().Int64Var(&collect.ChunkThreshold, "chunk-threshold", collect.ChunkThreshold, "Also hash collected files of at least this many bytes in chunks, and report the byte ranges that differ instead of a diff (0 = never)")
+	cmd.Flags().Int64Var(&collect.ChunkSize, "chunk-size", collect.ChunkSize, "Size in bytes of the chunks large files are hashed in")
+}
+
+// setExitStatus applies the exit code policy to a finished analysis.
+// Errors take precedence over differences.
+func setExitStatus(rep *report.Report) {
+	switch {
+	case (exitCodes || failOnError) && (rep.Summary.Errors > 0 || len(rep.Errors) > 0):
+		exitStatus = exitErrors
+	case (exitCodes || failOnDiff) && rep.Summary.Different > 0:
+		exitStatus = exitDifferences
+	}
+}
+
 // main.go (Replace the setupLogging function)
 
 func setupLogging() {
@@ -66,6 +171,7 @@ func setupLogging() {
 	// Open and set the log file
 	file, err := os.OpenFile(effectiveLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
 	if err == nil {
+		currentLogFile = effectiveLogFile
 		log.SetOutput(file) // Log only to file
 		// If you want both file and stderr:
 		// log.SetOutput(io.MultiWriter(os.Stderr, file))
@@ -75,6 +181,241 @@ func setupLogging() {
 	}
 }
 
+// printTimings writes the --timings table to stderr, keeping stdout for the report
+func printTimings() {
+	if !showTimings {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "\n===== Timings =====")
+	if err := timing.Default.Write(os.Stderr); err != nil {
+		log.Warnf("Failed to write timings: %v", err)
+	}
+}
+
+// presetHelp describes --preset, naming the built-in presets
+var presetHelp = fmt.Sprintf("Add the files, dirs and patterns of a preset: built-in (%s) or <name>.json in the presets directory (see 'preset list'); repeatable, saved to config.json", strings.Join(preset.BuiltInNames(), ", "))
+
+// configOverrides gathers the config-related flags
+func configOverrides() config.Overrides {
+	return config.Overrides{
+		Servers:  serversStr,
+		Files:    filesStr,
+		Dirs:     dirsStr,
+		Exclude:  excludePatterns,
+		Include:  includePatterns,
+		Journals: journalSpecs,
+		Presets:  presetNames,
+	}
+}
+
+// journalStrings formats journal excerpts in the --journal syntax
+func journalStrings(journals []config.JournalExcerpt) []string {
+	specs := make([]string, len(journals))
+	for i, j := range journals {
+		specs[i] = j.String()
+	}
+	return specs
+}
+
+// loadCollectionConfig loads the config for commands that connect to servers.
+// With --mock, connections go to in-process servers built from the fixture
+// directory instead, and no SSH credentials are needed. With --replay, they
+// are served from a recording made with --record. The returned cleanup
+// function must be called once the servers are no longer used.
+func loadCollectionConfig(saveConfig bool) (*config.Config, func(), error) {
+	return loadCollectionConfigIn(outputDir, configOverrides(), saveConfig)
+}
+
+// loadCollectionConfigIn is loadCollectionConfig for the output directory
+// dir, with the given overrides instead of the config flags
+func loadCollectionConfigIn(dir string, overrides config.Overrides, saveConfig bool) (*config.Config, func(), error) {
+	if replayDir != "" && (mockDir != "" || recordDir != "") {
+		return nil, nil, fmt.Errorf("--replay cannot be combined with --mock or --record")
+	}
+	if len(mockFaults) > 0 && mockDir == "" {
+		return nil, nil, fmt.Errorf("--mock-fault only applies to the servers of --mock")
+	}
+	if err := collect.ValidateMethod(collect.Method); err != nil {
+		return nil, nil, err
+	}
+	if err := collect.ValidateOpenFiles(collect.OpenFiles, collect.Method); err != nil {
+		return nil, nil, err
+	}
+	if collect.Incremental && collect.Method == collect.MethodSFTP {
+		return nil, nil, fmt.Errorf("--incremental needs the collection script to check checksums remotely; it can't be combined with --method sftp")
+	}
+	if collect.FileConcurrency < 1 {
+		return nil, nil, fmt.Errorf("--file-concurrency must be at least 1")
+	}
+	if util.HashBufferSize < util.MinHashBufferSize {
+		return nil, nil, fmt.Errorf("--hash-buffer must be at least %d bytes", util.MinHashBufferSize)
+	}
+	if collect.ExtractConcurrency < 1 || collect.HashConcurrency < 1 {
+		return nil, nil, fmt.Errorf("--extract-concurrency and --hash-concurrency must be at least 1")
+	}
+	if _, err := webhooks(); err != nil {
+		return nil, nil, err
+	}
+	if err := checkExportFlags(); err != nil {
+		return nil, nil, err
+	}
+	if err := applyAnnotation(); err != nil {
+		return nil, nil, err
+	}
+	if collect.MaxLoad < 0 || collect.LoadWait < 0 {
+		return nil, nil, fmt.Errorf("--max-load and --load-wait can't be negative")
+	}
+	if err := collect.ValidateChunks(collect.ChunkThreshold, collect.ChunkSize); err != nil {
+		return nil, nil, err
+	}
+	if err := util.RemotePriority.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if ioniceSpec != "" {
+		class, level, err := util.ParseIONice(ioniceSpec)
+		if err != nil {
+			return nil, nil, err
+		}
+		util.RemotePriority.IOClass, util.RemotePriority.IOLevel = class, level
+	}
+	compression, err := util.ParseCompression(compressSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	util.RemoteCompression = compression
+	if sshutil.BandwidthLimit, err = sshutil.ParseRate(bwlimitSpec); err != nil {
+		return nil, nil, err
+	}
+	if (recordDir != "" || replayDir != "") && collect.Method != collect.MethodScript && collect.FileConcurrency > 1 {
+		// Fixtures hold each server's interactions in order; concurrent transfers would shuffle them
+		log.Infof("Transferring one file at a time while recording or replaying")
+		collect.FileConcurrency = 1
+	}
+
+	var cfg *config.Config
+	cleanup := func() {}
+	switch {
+	case replayDir != "":
+		cfg, err = loadReplayConfig(dir, saveConfig)
+	case mockDir != "":
+		cfg, cleanup, err = loadMockConfig(dir, overrides, saveConfig)
+	default:
+		cfg, err = config.LoadOrInitializeConfig(dir, overrides, saveConfig)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := applyRetrySpecs(cfg); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := applyBecome(cfg); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := applyKeyPassphrase(cfg); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if replayDir == "" && mockDir == "" {
+		// Mock servers get new host keys on every run
+		if err := applyHostKeys(cfg); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+
+	if recordDir != "" {
+		recorder, err := replay.NewRecorder(recordDir, collect.Connect)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		collect.Connect = recorder.Connect
+		log.Warnf("Recording all remote interactions to %s; the fixture contains collected file contents", recordDir)
+		stop := cleanup
+		cleanup = func() {
+			if err := recorder.Save(); err != nil {
+				log.Errorf("Failed to save recording: %v", err)
+			}
+			stop()
+		}
+	}
+	return cfg, cleanup, nil
+}
+
+// applyRetrySpecs tunes the retry policies from config.json, then from --retry
+func applyRetrySpecs(cfg *config.Config) error {
+	for _, spec := range append(append([]string{}, cfg.Retry...), retrySpecs...) {
+		if err := sshutil.ApplyRetrySpec(spec); err != nil {
+			return err
+		}
+	}
+	for _, phase := range []string{"dial", "command", "transfer", "notify"} {
+		log.Debugf("Retry policy for %s: %s", phase, sshutil.RetryPhases[phase])
+	}
+	return nil
+}
+
+func loadMockConfig(dir string, overrides config.Overrides, saveConfig bool) (*config.Config, func(), error) {
+	config.RequireSSHCredentials = false
+	cfg, err := config.LoadOrInitializeConfig(dir, overrides, saveConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	faults, err := sshmock.ParseFaults(mockFaults)
+	if err != nil {
+		return nil, nil, err
+	}
+	fleet, err := sshmock.StartFleet(mockDir, cfg.Servers, faults)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.SSHConfig = fleet.Credentials()
+	collect.Connect = func(cfg *config.Config, server string, opts *collect.Options) (collect.Remote, error) {
+		target, err := fleet.Target(server)
+		if err != nil {
+			return nil, err
+		}
+		collect.ConfigureTarget(cfg, server, opts, &target)
+		client, err := sshutil.Connect(target)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	log.Warnf("Mock mode: connecting to in-process servers from %s instead of real hosts", mockDir)
+	return cfg, fleet.Close, nil
+}
+
+// loadReplayConfig uses the servers, paths and patterns the fixture was
+// recorded with, so the run follows the same sequence of remote interactions
+func loadReplayConfig(dir string, saveConfig bool) (*config.Config, error) {
+	player, err := replay.Load(replayDir)
+	if err != nil {
+		return nil, err
+	}
+	recorded := player.Config()
+	config.RequireSSHCredentials = false
+	config.SSHConfigPath = "" // Local aliases must not change the recorded settings
+	cfg, err := config.LoadOrInitializeConfig(dir, config.Overrides{
+		Servers:  strings.Join(recorded.Servers, ","),
+		Files:    strings.Join(recorded.Files, ","),
+		Dirs:     strings.Join(recorded.Dirs, ","),
+		Exclude:  recorded.Exclude,
+		Include:  recorded.Include,
+		Journals: journalStrings(recorded.Journals),
+	}, saveConfig)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Hosts = recorded.Hosts
+	cfg.SSHConfig.Username = player.Username()
+	collect.Connect = player.Connect
+	log.Warnf("Replay mode: serving remote interactions from %s instead of real hosts", replayDir)
+	return cfg, nil
+}
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "remote-diff-tool",
@@ -83,55 +424,132 @@ func main() {
 Handles:
 1. Concurrent collection of files/dirs from remote servers via SSH.
 2. Efficient comparison using checksums and parallel diffing.`,
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			setupLogging()
+			config.StrictDecoding = strictConfig
+			jsonschema.Strict = strictConfig
+			config.SSHConfigPath = sshConfigPath
+			resolveWorkspaceOutputDir(cmd)
+			// Applied again after the config's retry settings by commands that connect
+			return applyRetrySpecs(&config.Config{})
 		},
 	}
 
-	rootCmd.PersistentFlags().StringVarP(&outputDir, "output-dir", "o", ".", "Directory to store collected files and config")
+	rootCmd.PersistentFlags().StringVarP(&outputDir, "output-dir", "o", ".", "Directory to store collected files and config (defaults to the active workspace, if any)")
 	rootCmd.PersistentFlags().IntVarP(&maxConcurrency, "concurrency", "c", 10, "Maximum number of concurrent server operations")
+	rootCmd.PersistentFlags().IntVar(&collect.FileConcurrency, "file-concurrency", collect.FileConcurrency, "Maximum number of files checksummed (or transferred with --method sftp) at once per server")
+	rootCmd.PersistentFlags().IntVar(&collect.ExtractConcurrency, "extract-concurrency", collect.ExtractConcurrency, "Maximum number of downloaded tarballs extracted at once; servers give up their --concurrency slot once downloaded")
+	rootCmd.PersistentFlags().IntVar(&collect.HashConcurrency, "hash-concurrency", collect.HashConcurrency, "Maximum number of servers whose collected files are checksummed at once")
+	rootCmd.PersistentFlags().IntVar(&util.HashBufferSize, "hash-buffer", util.HashBufferSize, "Bytes read at a time while checksumming a file; larger reads speed up multi-GB files")
+	rootCmd.PersistentFlags().BoolVar(&collect.FastHash, "fast-hash", false, "Hash collected files with xxHash64 first and compute the SHA-256 only once per distinct content across servers")
+	rootCmd.PersistentFlags().Float64Var(&collect.MaxLoad, "max-load", 0, "Before copying or checksumming, wait for servers whose 1-minute load average per CPU is above this, then copy one file at a time (0 = don't check)")
+	rootCmd.PersistentFlags().DurationVar(&collect.LoadWait, "load-wait", collect.LoadWait, "How long to wait for a server above --max-load before going ahead anyway")
+	rootCmd.PersistentFlags().IntVar(&util.RemotePriority.Nice, "nice", 0, "Run the remote cp, find, cpio, sha256sum and tar under nice with this adjustment, 1 to 19 (0 = normal priority)")
+	rootCmd.PersistentFlags().StringVar(&bwlimitSpec, "bwlimit", "0", "Limit the SFTP transfers of each server to this many bytes per second, with an optional K, M or G suffix, e.g. 10M (0 = unlimited)")
+	rootCmd.PersistentFlags().StringVar(&compressSpec, "compress", util.CompressGzip, "How the collection script compresses its tarball: gzip[:1-9], zstd[:1-19] (needs zstd on the server) or none")
+	rootCmd.PersistentFlags().StringVar(&ioniceSpec, "ionice", "", "Run the remote cp, find, cpio, sha256sum and tar under ionice: idle, or best-effort[:0-7] (default level 7)")
+	rootCmd.PersistentFlags().StringVar(&collect.Become, "become", util.BecomeSudo, "How remote commands that read files gain root: sudo, doas, or none to read them as the SSH user and record the unreadable ones (a hosts entry's become overrides it)")
+	rootCmd.PersistentFlags().StringVar(&sudoPasswordFrom, "sudo-password", "", "Give sudo a password, piped to sudo -S and never written to the remote: env ($"+sudoPasswordEnvVar+"), prompt, or keyring (the macOS keychain, the Windows Credential Manager or secret-tool, service "+keyring.Service+", account the SSH user)")
+	rootCmd.PersistentFlags().StringVar(&keyPassphraseFrom, "key-passphrase", keyPassphraseEnv, "Where the passphrase of an encrypted SSH key comes from: env ($SSHKEYPIN), prompt, or keyring (the macOS keychain, the Windows Credential Manager or secret-tool, service "+keyring.Service+", account "+keyPassphraseAccount+")")
+	rootCmd.PersistentFlags().StringSliceVar(&forgetHostKeys, "forget-hostkey", nil, "Forget the pinned host key of these servers or host names before connecting, e.g. after a reinstall, and trust the key they present next")
+	rootCmd.PersistentFlags().StringArrayVar(&retrySpecs, "retry", nil, "Tune retries of a phase, as dial|command|transfer|notify:key=value,... with keys attempts, backoff, strategy (constant or exponential), max-delay and jitter (e.g. dial:attempts=6,backoff=5s,strategy=exponential); repeatable")
 	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Path to log file (defaults to remote_diff_YYYYMMDD_HHMMSS.log)")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().BoolVar(&strictConfig, "strict-config", true, "Reject unknown fields in the config file (config.json, .yaml or .toml), manifest.json and the other JSON files read, and missing required properties")
+	rootCmd.PersistentFlags().StringVar(&sshConfigPath, "ssh-config", config.SSHConfigPath, "OpenSSH config used to resolve server aliases (empty to disable)")
+	rootCmd.PersistentFlags().StringVar(&preset.UserDir, "presets-dir", "", "Directory of user-defined presets, one <name>.json each (default: $"+preset.DirEnvVar+" or presets/ in the user config directory)")
+	rootCmd.PersistentFlags().StringVar(&mockDir, "mock", "", "Collect from in-process mock servers serving <dir>/<server>/ instead of real hosts (for demos and testing)")
+	rootCmd.PersistentFlags().StringArrayVar(&mockFaults, "mock-fault", nil, "Make a --mock server fail, as <server>=<fault>[,<fault>...] with refuse, drop[:N] (connections), slow:RATE, cut:BYTES and corrupt[:N] (tarball downloads); server * is every server (for testing retries and partial results); repeatable")
+	rootCmd.PersistentFlags().StringVar(&recordDir, "record", "", "Record every remote command, output and transferred file into this fixture directory")
+	rootCmd.PersistentFlags().BoolVar(&showTimings, "timings", false, "Print a per-server, per-phase duration table to stderr at the end of the run")
+	rootCmd.PersistentFlags().StringVar(&replayDir, "replay", "", "Serve remote interactions from a fixture directory made with --record instead of connecting")
+	rootCmd.PersistentFlags().IntVar(&util.ExtractionLimits.MaxEntries, "max-extract-entries", util.DefaultExtractLimits.MaxEntries, "Maximum number of entries extracted from one tarball or bundle (0 = unlimited)")
+	rootCmd.PersistentFlags().Int64Var(&util.ExtractionLimits.MaxBytes, "max-extract-bytes", util.DefaultExtractLimits.MaxBytes, "Maximum bytes extracted from one tarball or bundle (0 = unlimited)")
+	rootCmd.PersistentFlags().Float64Var(&util.ExtractionLimits.MaxRatio, "max-extract-ratio", util.DefaultExtractLimits.MaxRatio, "Maximum decompression ratio when extracting a tarball or bundle (0 = unlimited)")
 
 	collectCmd := &cobra.Command{
 		Use:   "collect",
 		Short: "Collect files from remote servers",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := config.LoadOrInitializeConfig(outputDir, serversStr, filesStr, dirsStr, true)
+			defer printTimings()
+			cfg, cleanup, err := loadCollectionConfig(true)
 			if err != nil {
 				return err
 			}
+			defer cleanup()
+			if err := confirmCollection(cfg); err != nil {
+				return err
+			}
 			log.Infof("Starting collection with concurrency %d", maxConcurrency)
 			success := collect.RunCollection(cfg, outputDir, maxConcurrency)
+			eventErr := publishCollection(cfg, outputDir, success)
 			if !success {
 				return fmt.Errorf("collection completed with errors")
 			}
 			log.Info("Collection finished successfully")
-			return nil
+			if err := snapshotCollection(); err != nil {
+				return err
+			}
+			return eventErr
 		},
 	}
 	collectCmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Comma-separated list of server hostnames (required if no config.json)")
-	collectCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths")
-	collectCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths")
+	collectCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths (or ~/ paths in the SSH user's home)")
+	collectCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths (or ~/ paths in the SSH user's home)")
+	collectCmd.Flags().StringArrayVar(&presetNames, "preset", nil, presetHelp)
+	collectCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Skip files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	collectCmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Only keep files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	collectCmd.Flags().StringArrayVar(&journalSpecs, "journal", nil, "Also collect the journald entries of a unit, as unit[@since[..until]] (e.g. nginx.service@-1h); repeatable, saved to config.json")
+	collectCmd.Flags().StringVar(&collect.Method, "method", collect.MethodScript, "How files are fetched: script (sudo copy and tarball on the remote) , sftp (stream each file, no sudo, nothing written remotely) or auto (script, or sftp on servers without shell access)")
+	collectCmd.Flags().BoolVar(&collect.Incremental, "incremental", false, "Only transfer the files whose checksum changed since the previous collection in the output directory, checked on each server with sha256sum, and keep the copies of the others")
+	collectCmd.Flags().BoolVar(&collect.Strict, "strict", false, "Fail the collection if any file failed to copy, read or checksum, listing them all, instead of recording the errors and going on")
+	collectCmd.Flags().BoolVar(&collect.AllowPartial, "allow-partial", false, "Save the manifest when some servers fail to collect, recording why, and analyze the others instead of failing the whole run")
+	collectCmd.Flags().BoolVar(&collect.StableReads, "stable-reads", false, "Check that each file stayed the same while it was copied and mark files that changed as unstable instead of diffing them")
+	collectCmd.Flags().StringVar(&collect.OpenFiles, "open-files", collect.OpenFilesIgnore, "What to do with files open for writing on the remote, found with lsof: ignore, flag (mark them volatile) or skip (mark them volatile and don't compare them)")
+	addChunkFlags(collectCmd)
+	addSnapshotFlags(collectCmd)
+	addAnnotationFlags(collectCmd)
+	addConfirmFlags(collectCmd)
+	addEventFlags(collectCmd)
 
 	analyzeCmd := &cobra.Command{
 		Use:   "analyze",
 		Short: "Analyze differences between collected files",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := config.LoadOrInitializeConfig(outputDir, "", "", "", false) // Don't overwrite if reading for analyze
+			defer printTimings()
+			opts, err := scopedAnalysisOptions()
+			if err != nil {
+				return err
+			}
+			if len(analyzeRoots) > 0 {
+				if serversStr != "" {
+					return fmt.Errorf("with --root, pick servers with --server")
+				}
+				return analyzeAcrossRoots(opts)
+			}
+			cfg, err := config.LoadConfigForAnalysis(outputDir) // Don't overwrite if reading for analyze
 			if err != nil {
 				log.Errorf("Failed to load config: %v. Did you run 'collect' first?", err)
 				return err
 			}
+			if err := checkFileScope(cfg, opts); err != nil {
+				return err
+			}
+			if err := scopeServers(cfg); err != nil {
+				return err
+			}
 			log.Infof("Starting analysis with concurrency %d", maxConcurrency)
-			diffFound, err := analyze.RunAnalysis(cfg, outputDir, diffDir, saveDiffs, maxConcurrency)
+			rep, err := analyze.RunAnalysis(cfg, outputDir, opts)
+			publishErr := publishResult(rep, outputDir)
 			if err != nil {
 				return fmt.Errorf("analysis failed: %w", err)
 			}
-			if diffFound {
+			if publishErr != nil {
+				return publishErr
+			}
+			setExitStatus(rep)
+			if rep.HasDifferences() {
 				log.Warn("Analysis finished: Differences found.")
-				// Optionally exit with non-zero status if differences found
-				// os.Exit(1)
 			} else {
 				log.Info("Analysis finished: No differences found.")
 			}
@@ -140,36 +558,66 @@ Handles:
 	}
 	analyzeCmd.Flags().BoolVar(&saveDiffs, "save-diffs", false, "Save diff outputs to files")
 	analyzeCmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory to store diff files")
+	analyzeCmd.Flags().IntVar(&maxInlineLines, "max-inline-diff-lines", defaultMaxInlineLines, "Write diffs longer than this many lines to --diff-dir and only point to them (0 prints every diff)")
+	analyzeCmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	analyzeCmd.Flags().StringVar(&outputFormat, "format", report.FormatText, "Output format for analysis results (text, json, yaml, junit, sarif, matrix, html)")
+	analyzeCmd.Flags().StringArrayVar(&analyzeRoots, "root", nil, "Compare the servers of these output directories with each other instead of those of --output-dir, as dir or label=dir; repeatable")
+	analyzeCmd.Flags().StringSliceVar(&rootServers, "server", nil, "With --root, only compare these servers (comma-separated or repeated)")
+	analyzeCmd.Flags().BoolVar(&keepRootsMerge, "keep", false, "With --root, keep the merged collections instead of deleting them afterwards")
+	analyzeCmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Only compare these of the collected servers (comma-separated, @group for a group of the config)")
+	analyzeCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Only compare these of the collected files (comma-separated absolute or ~/ paths)")
+	analyzeCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Only compare the collected files below these directories (comma-separated absolute or ~/ paths)")
+	addExitCodeFlags(analyzeCmd)
+	addComparisonFlags(analyzeCmd)
+	addExportFlags(analyzeCmd)
+	addEventFlags(analyzeCmd)
+	addNotifyFlags(analyzeCmd)
 
 	allCmd := &cobra.Command{
 		Use:   "all",
 		Short: "Perform both collection and analysis",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			defer printTimings()
 			// --- Collection Phase ---
-			cfg, err := config.LoadOrInitializeConfig(outputDir, serversStr, filesStr, dirsStr, true)
+			cfg, cleanup, err := loadCollectionConfig(true)
 			if err != nil {
 				return err
 			}
+			defer cleanup()
+			if err := confirmCollection(cfg); err != nil {
+				return err
+			}
 			log.Infof("Starting collection (part of 'all') with concurrency %d", maxConcurrency)
 			success := collect.RunCollection(cfg, outputDir, maxConcurrency)
+			if err := publishCollection(cfg, outputDir, success); err != nil {
+				log.Errorf("Failed to publish the collection: %v", err)
+			}
 			if !success {
 				return fmt.Errorf("collection step failed, aborting analysis")
 			}
 			log.Info("Collection finished successfully")
+			if err := snapshotCollection(); err != nil {
+				return err
+			}
 
 			// --- Analysis Phase ---
 			// Re-read config in case it was just created/updated
-			cfg, err = config.LoadOrInitializeConfig(outputDir, "", "", "", false)
+			cfg, err = config.LoadConfigForAnalysis(outputDir)
 			if err != nil {
 				log.Errorf("Failed to load config for analysis: %v", err)
 				return err
 			}
 			log.Infof("Starting analysis (part of 'all') with concurrency %d", maxConcurrency)
-			diffFound, err := analyze.RunAnalysis(cfg, outputDir, diffDir, saveDiffs, maxConcurrency)
+			rep, err := analyze.RunAnalysis(cfg, outputDir, analysisOptions())
+			publishErr := publishResult(rep, outputDir)
 			if err != nil {
 				return fmt.Errorf("analysis step failed: %w", err)
 			}
-			if diffFound {
+			if publishErr != nil {
+				return publishErr
+			}
+			setExitStatus(rep)
+			if rep.HasDifferences() {
 				log.Warn("Analysis finished: Differences found.")
 			} else {
 				log.Info("Analysis finished: No differences found.")
@@ -179,15 +627,137 @@ Handles:
 	}
 	// Inherit flags from collect and analyze where applicable
 	allCmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Comma-separated list of server hostnames (required if no config.json)")
-	allCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths")
-	allCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths")
+	allCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths (or ~/ paths in the SSH user's home)")
+	allCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths (or ~/ paths in the SSH user's home)")
+	allCmd.Flags().StringArrayVar(&presetNames, "preset", nil, presetHelp)
+	allCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Skip files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	allCmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Only keep files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	allCmd.Flags().StringArrayVar(&journalSpecs, "journal", nil, "Also collect the journald entries of a unit, as unit[@since[..until]] (e.g. nginx.service@-1h); repeatable, saved to config.json")
+	allCmd.Flags().StringVar(&collect.Method, "method", collect.MethodScript, "How files are fetched: script (sudo copy and tarball on the remote) , sftp (stream each file, no sudo, nothing written remotely) or auto (script, or sftp on servers without shell access)")
+	allCmd.Flags().BoolVar(&collect.Incremental, "incremental", false, "Only transfer the files whose checksum changed since the previous collection in the output directory, checked on each server with sha256sum, and keep the copies of the others")
+	allCmd.Flags().BoolVar(&collect.Strict, "strict", false, "Fail the collection if any file failed to copy, read or checksum, listing them all, instead of recording the errors and going on")
+	allCmd.Flags().BoolVar(&collect.AllowPartial, "allow-partial", false, "Save the manifest when some servers fail to collect, recording why, and analyze the others instead of failing the whole run")
+	allCmd.Flags().BoolVar(&collect.StableReads, "stable-reads", false, "Check that each file stayed the same while it was copied and mark files that changed as unstable instead of diffing them")
+	allCmd.Flags().StringVar(&collect.OpenFiles, "open-files", collect.OpenFilesIgnore, "What to do with files open for writing on the remote, found with lsof: ignore, flag (mark them volatile) or skip (mark them volatile and don't compare them)")
+	addChunkFlags(allCmd)
+	addSnapshotFlags(allCmd)
+	addAnnotationFlags(allCmd)
+	addConfirmFlags(allCmd)
 	allCmd.Flags().BoolVar(&saveDiffs, "save-diffs", false, "Save diff outputs to files")
 	allCmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory to store diff files")
+	allCmd.Flags().IntVar(&maxInlineLines, "max-inline-diff-lines", defaultMaxInlineLines, "Write diffs longer than this many lines to --diff-dir and only point to them (0 prints every diff)")
+	allCmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	allCmd.Flags().StringVar(&outputFormat, "format", report.FormatText, "Output format for analysis results (text, json, yaml, junit, sarif, matrix, html)")
+	addExitCodeFlags(allCmd)
+	addComparisonFlags(allCmd)
+	addExportFlags(allCmd)
+	addEventFlags(allCmd)
+	addNotifyFlags(allCmd)
+
+	compareCmd := &cobra.Command{
+		Use:   "compare",
+		Short: "Compare files across servers (--remote-only compares checksums over SSH without downloading)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !remoteOnly {
+				// Without --remote-only this is the regular collect + analyze pipeline
+				return allCmd.RunE(cmd, args)
+			}
+			defer printTimings()
+			cfg, cleanup, err := loadCollectionConfig(false)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			log.Infof("Starting remote-only comparison with concurrency %d", maxConcurrency)
+			compareDir, err := collect.RunRemoteCompare(cfg, outputDir, maxConcurrency, fetchMismatch)
+			if err != nil {
+				return fmt.Errorf("remote comparison failed: %w", err)
+			}
+			opts := analysisOptions()
+			opts.ChecksumOnly = !fetchMismatch
+			rep, err := analyze.RunAnalysis(cfg, compareDir, opts)
+			publishErr := publishResult(rep, compareDir)
+			if err != nil {
+				return fmt.Errorf("analysis failed: %w", err)
+			}
+			if publishErr != nil {
+				return publishErr
+			}
+			setExitStatus(rep)
+			if rep.HasDifferences() {
+				log.Warn("Comparison finished: Differences found.")
+			} else {
+				log.Info("Comparison finished: No differences found.")
+			}
+			return nil
+		},
+	}
+	compareCmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Comma-separated list of server hostnames (required if no config.json)")
+	compareCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths (or ~/ paths in the SSH user's home)")
+	compareCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths (or ~/ paths in the SSH user's home)")
+	compareCmd.Flags().StringArrayVar(&presetNames, "preset", nil, presetHelp)
+	compareCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Skip files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	compareCmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Only keep files below --dirs matching this glob (or re:<regex>); repeatable, saved to config.json")
+	compareCmd.Flags().StringVar(&collect.Method, "method", collect.MethodScript, "How files are fetched: script (sudo copy and tarball on the remote) , sftp (stream each file, no sudo, nothing written remotely) or auto (script, or sftp on servers without shell access)")
+	addChunkFlags(compareCmd)
+	compareCmd.Flags().BoolVar(&saveDiffs, "save-diffs", false, "Save diff outputs to files")
+	compareCmd.Flags().StringVar(&diffDir, "diff-dir", "./diff_output", "Directory to store diff files")
+	compareCmd.Flags().IntVar(&maxInlineLines, "max-inline-diff-lines", defaultMaxInlineLines, "Write diffs longer than this many lines to --diff-dir and only point to them (0 prints every diff)")
+	compareCmd.Flags().StringVar(&diffEngine, "diff-engine", analyze.DiffEngineNative, "Diff implementation to use (native, external)")
+	compareCmd.Flags().StringVar(&outputFormat, "format", report.FormatText, "Output format for analysis results (text, json, yaml, junit, sarif, matrix, html)")
+	addExitCodeFlags(compareCmd)
+	addComparisonFlags(compareCmd)
+	addExportFlags(compareCmd)
+	addEventFlags(compareCmd)
+	addNotifyFlags(compareCmd)
+	compareCmd.Flags().BoolVar(&remoteOnly, "remote-only", false, "Compare sha256sum output from each server without transferring file contents")
+	compareCmd.Flags().BoolVar(&fetchMismatch, "fetch-diffs", false, "With --remote-only, download files whose checksums differ and show content diffs")
 
-	rootCmd.AddCommand(collectCmd, analyzeCmd, allCmd)
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "List the files a collection would copy from each server, without copying anything",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, cleanup, err := loadCollectionConfig(false)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			plans, err := collect.RunPlan(cfg, maxConcurrency)
+			if err != nil {
+				return err
+			}
+			if err := collect.WritePlan(os.Stdout, plans); err != nil {
+				return err
+			}
+			failed := 0
+			for _, plan := range plans {
+				if plan.Err != nil {
+					log.Errorf("[%s] %v", plan.Server, plan.Err)
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d server(s) could not be inspected", failed, len(plans))
+			}
+			return nil
+		},
+	}
+	planCmd.Flags().StringVarP(&serversStr, "servers", "s", "", "Comma-separated list of server hostnames (required if no config.json)")
+	planCmd.Flags().StringVarP(&filesStr, "files", "f", "", "Comma-separated list of absolute file paths (or ~/ paths in the SSH user's home)")
+	planCmd.Flags().StringVarP(&dirsStr, "dirs", "d", "", "Comma-separated list of absolute directory paths (or ~/ paths in the SSH user's home)")
+	planCmd.Flags().StringArrayVar(&presetNames, "preset", nil, presetHelp)
+	planCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Skip files below --dirs matching this glob (or re:<regex>); repeatable")
+	planCmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Only keep files below --dirs matching this glob (or re:<regex>); repeatable")
+	planCmd.Flags().StringVar(&collect.Method, "method", collect.MethodScript, "List files as the given collection method sees them: script (as root, via sudo) , sftp (as the SSH user) or auto (script, or sftp on servers without shell access)")
+
+	rootCmd.AddCommand(collectCmd, analyzeCmd, allCmd, compareCmd, planCmd, newWorkspaceCmd(), newShowCmd(), newHistoryCmd(), newPresetCmd(), newExportBundleCmd(), newImportBundleCmd(), newCompareBundlesCmd(), newReportCmd(), newWatchCmd(), newServeCmd(), newTimelineCmd(), newCleanCmd(), newSummaryCmd(), newHashDirCmd(), newTUICmd(), newAckCmd(), newExplainCmd(), newSchemaCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Errorf("Error: %v", err)
+		if exitCodes || failOnError {
+			os.Exit(exitErrors)
+		}
 		os.Exit(1)
 	}
+	os.Exit(exitStatus)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/keyring"
+)
+
+// Where --key-passphrase reads the passphrase of the SSH key from
+const (
+	keyPassphraseEnv     = "env"     // $SSHKEYPIN, read with the rest of the SSH settings
+	keyPassphrasePrompt  = "prompt"  // Asked once on the terminal
+	keyPassphraseKeyring = "keyring" // See keyring.Lookup
+)
+
+// keyPassphraseAccount is the keyring account the SSH key passphrase is stored under
+const keyPassphraseAccount = "ssh-key-passphrase"
+
+var (
+	keyPassphraseFrom string
+	keyPassphrase     *string // Read once, like sudoPassword
+)
+
+// applyKeyPassphrase puts the SSH key passphrase from --key-passphrase into cfg
+func applyKeyPassphrase(cfg *config.Config) error {
+	switch keyPassphraseFrom {
+	case keyPassphraseEnv:
+		return nil
+	case keyPassphrasePrompt, keyPassphraseKeyring:
+	default:
+		return fmt.Errorf("invalid --key-passphrase %q (expected %s, %s or %s)", keyPassphraseFrom, keyPassphraseEnv, keyPassphrasePrompt, keyPassphraseKeyring)
+	}
+	if replayDir != "" || mockDir != "" {
+		return nil // Neither uses an encrypted key
+	}
+	if keyPassphrase == nil {
+		var passphrase string
+		var err error
+		if keyPassphraseFrom == keyPassphrasePrompt {
+			passphrase, err = promptSecret("--key-passphrase", "Passphrase for the SSH key: ")
+		} else {
+			passphrase, err = keyring.Lookup(keyPassphraseAccount)
+		}
+		if err != nil {
+			return err
+		}
+		if passphrase == "" {
+			return fmt.Errorf("the SSH key passphrase from %s is empty", keyPassphraseFrom)
+		}
+		keyPassphrase = &passphrase
+	}
+	cfg.SSHConfig.KeyPassphrase = *keyPassphrase
+	return nil
+}
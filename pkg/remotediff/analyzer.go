@@ -0,0 +1,124 @@
+package remotediff
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+)
+
+// Analyzer compares the collected copies of an output directory
+type Analyzer struct {
+	opts    analyze.Options
+	servers []string
+}
+
+// AnalyzerOption configures an Analyzer
+type AnalyzerOption func(*Analyzer)
+
+// NewAnalyzer returns an Analyzer with the CLI's defaults
+func NewAnalyzer(opts ...AnalyzerOption) *Analyzer {
+	a := &Analyzer{opts: analyze.Options{
+		MaxConcurrency: 10,
+		DiffEngine:     analyze.DiffEngineNative,
+	}}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// WithAnalyzeServers compares only these servers; by default those of the
+// config file, or else every server in the manifest
+func WithAnalyzeServers(servers ...string) AnalyzerOption {
+	return func(a *Analyzer) { a.servers = servers }
+}
+
+// WithAnalyzePaths compares only the collected files at or below these
+// remote paths (e.g. "/etc/nginx"); by default every collected file
+func WithAnalyzePaths(paths ...string) AnalyzerOption {
+	return func(a *Analyzer) { a.opts.Within = paths }
+}
+
+// WithDiffConcurrency sets how many files are compared at once (default 10)
+func WithDiffConcurrency(n int) AnalyzerOption {
+	return func(a *Analyzer) { a.opts.MaxConcurrency = n }
+}
+
+// WithSavedDiffs also writes each diff to a file in dir
+func WithSavedDiffs(dir string) AnalyzerOption {
+	return func(a *Analyzer) { a.opts.SaveDiffs, a.opts.DiffDir = true, dir }
+}
+
+// WithTextOnly diffs JSON, YAML, TOML and INI files as text only, without
+// comparing their parsed content
+func WithTextOnly() AnalyzerOption {
+	return func(a *Analyzer) { a.opts.TextOnly = true }
+}
+
+// WithSimilarity only reports files with content diffs whose similarity, in
+// percent, is within min and max
+func WithSimilarity(min, max float64) AnalyzerOption {
+	return func(a *Analyzer) { a.opts.MinSimilarity, a.opts.MaxSimilarity = min, max }
+}
+
+// WithSort orders the files of the Result: "path" (the default), "severity",
+// "similarity" or "hosts"
+func WithSort(by string) AnalyzerOption {
+	return func(a *Analyzer) { a.opts.SortBy = by }
+}
+
+// WithGroupBy groups the files of the Result by "status", "category",
+// "owner" or "path"
+func WithGroupBy(by string) AnalyzerOption {
+	return func(a *Analyzer) { a.opts.GroupBy = by }
+}
+
+// WithUnicodePaths matches file names across servers by their Unicode NFC
+// form, so names spelled with composed and decomposed accents are one file
+func WithUnicodePaths() AnalyzerOption {
+	return func(a *Analyzer) { a.opts.UnicodePaths = analyze.UnicodePathsNFC }
+}
+
+// Analyze compares the collected copies in outputDir. Once ctx is done, files
+// not yet compared are skipped and reported as errors. If some comparisons
+// failed, both the partial Result and an error are returned.
+func (a *Analyzer) Analyze(ctx context.Context, outputDir string) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cfg, err := a.config(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	return analyze.AnalyzeContext(ctx, cfg, outputDir, a.opts)
+}
+
+// config returns the config to analyze outputDir with
+func (a *Analyzer) config(outputDir string) (*config.Config, error) {
+	cfg, err := config.LoadConfigForAnalysis(outputDir)
+	if err != nil {
+		// Collected without saving a config: compare whatever the manifest holds
+		manifest, manifestErr := config.LoadManifest(outputDir)
+		if manifestErr != nil {
+			return nil, err
+		}
+		cfg = &config.Config{}
+		for server := range manifest.FilesByServer {
+			cfg.Servers = append(cfg.Servers, server)
+		}
+		sort.Strings(cfg.Servers)
+	}
+	if a.servers != nil {
+		cfg.Servers = a.servers
+	}
+	return cfg, nil
+}
+
+// WriteResult renders a Result as the CLI does, in "text", "json" or "yaml"
+func WriteResult(w io.Writer, r *Result, format string) error {
+	return report.Write(w, r, format)
+}
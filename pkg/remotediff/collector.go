@@ -0,0 +1,164 @@
+package remotediff
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+)
+
+// Collection methods
+const (
+	MethodScript = collect.MethodScript // Copy with sudo into a tarball on the server and download it
+	MethodSFTP   = collect.MethodSFTP   // Stream each file over SFTP as the SSH user; nothing is written remotely
+	MethodAuto   = collect.MethodAuto   // MethodScript, or MethodSFTP on servers that refuse shell commands
+)
+
+// Privilege escalation methods
+const (
+	BecomeSudo = util.BecomeSudo // sudo, without a password unless WithSudoPassword is given
+	BecomeDoas = util.BecomeDoas // doas, without a password
+	BecomeNone = util.BecomeNone // Read files as the SSH user and record the unreadable ones
+)
+
+// Collector copies files from servers into an output directory
+type Collector struct {
+	outputDir   string
+	overrides   config.Overrides
+	concurrency int
+	method      string
+	become      string
+	password    string
+	annotation  config.RunAnnotation
+	saveConfig  bool
+	partial     bool
+}
+
+// CollectorOption configures a Collector
+type CollectorOption func(*Collector)
+
+// NewCollector returns a Collector writing to outputDir. Settings not given
+// as options come from the config file in outputDir, if there is one.
+func NewCollector(outputDir string, opts ...CollectorOption) *Collector {
+	c := &Collector{outputDir: outputDir, concurrency: 10, method: MethodScript, become: BecomeSudo, saveConfig: true}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithServers sets the servers to collect from; @name selects a group of the config file
+func WithServers(servers ...string) CollectorOption {
+	return func(c *Collector) { c.overrides.Servers = strings.Join(servers, ",") }
+}
+
+// WithFiles sets the absolute (or ~/) paths of the files to collect
+func WithFiles(paths ...string) CollectorOption {
+	return func(c *Collector) { c.overrides.Files = strings.Join(paths, ",") }
+}
+
+// WithDirs sets the absolute (or ~/) paths of the directories to collect
+func WithDirs(paths ...string) CollectorOption {
+	return func(c *Collector) { c.overrides.Dirs = strings.Join(paths, ",") }
+}
+
+// WithExclude skips the files below the directories matching these globs (or re:<regex>)
+func WithExclude(patterns ...string) CollectorOption {
+	return func(c *Collector) { c.overrides.Exclude = patterns }
+}
+
+// WithInclude only keeps the files below the directories matching these globs (or re:<regex>)
+func WithInclude(patterns ...string) CollectorOption {
+	return func(c *Collector) { c.overrides.Include = patterns }
+}
+
+// WithPresets adds the paths and patterns of these presets
+func WithPresets(names ...string) CollectorOption {
+	return func(c *Collector) { c.overrides.Presets = names }
+}
+
+// WithSSHKey sets the default SSH user and private key, instead of the
+// SSHUSER, SSHKEYPATH and SSHKEYPIN environment variables
+func WithSSHKey(user, keyPath, passphrase string) CollectorOption {
+	return func(c *Collector) {
+		c.overrides.SSH = &config.SSHCredentials{Username: user, KeyPath: keyPath, KeyPassphrase: passphrase}
+	}
+}
+
+// WithConcurrency sets how many servers are collected from at once (default 10)
+func WithConcurrency(n int) CollectorOption {
+	return func(c *Collector) { c.concurrency = n }
+}
+
+// WithMethod sets how files are fetched, MethodScript (the default), MethodSFTP
+// or MethodAuto
+func WithMethod(method string) CollectorOption {
+	return func(c *Collector) { c.method = method }
+}
+
+// WithBecome sets how servers without a become setting of their own gain
+// root: BecomeSudo (the default), BecomeDoas or BecomeNone
+func WithBecome(become string) CollectorOption {
+	return func(c *Collector) { c.become = become }
+}
+
+// WithSudoPassword gives sudo a password on standard input
+func WithSudoPassword(password string) CollectorOption {
+	return func(c *Collector) { c.password = password }
+}
+
+// WithNote saves a note with the collection, e.g. the deployment it verifies
+func WithNote(note string) CollectorOption {
+	return func(c *Collector) { c.annotation.Note = note }
+}
+
+// WithLabels saves key/value labels with the collection
+func WithLabels(labels map[string]string) CollectorOption {
+	return func(c *Collector) { c.annotation.Labels = labels }
+}
+
+// WithoutSavingConfig leaves the config file of the output directory as it
+// is; by default the settings are saved there for later analyses
+func WithoutSavingConfig() CollectorOption {
+	return func(c *Collector) { c.saveConfig = false }
+}
+
+// WithAllowPartial saves the manifest when some servers fail, as long as one
+// succeeded; Manifest.Failed says why each failed one did, and analyses
+// leave them out. By default Collect fails if any server does.
+func WithAllowPartial() CollectorOption {
+	return func(c *Collector) { c.partial = true }
+}
+
+// Collect copies the files from every server and returns the manifest. Once
+// ctx is done, servers that haven't started are skipped.
+func (c *Collector) Collect(ctx context.Context) (*Manifest, error) {
+	if c.concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1")
+	}
+	if err := collect.ValidateMethod(c.method); err != nil {
+		return nil, err
+	}
+	if err := util.ValidateBecome(c.become); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cfg, err := config.LoadOrInitializeConfig(c.outputDir, c.overrides, c.saveConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SSHConfig.SudoPassword = c.password
+	// The built-in settings, not those a CLI in the same process was run with
+	opts := collect.DefaultOptions()
+	opts.Method, opts.Become, opts.Annotation, opts.AllowPartial = c.method, c.become, c.annotation, c.partial
+	if err := collect.Run(ctx, cfg, c.outputDir, c.concurrency, opts); err != nil {
+		return nil, err
+	}
+	return LoadManifest(c.outputDir)
+}
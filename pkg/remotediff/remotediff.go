@@ -0,0 +1,90 @@
+// Package remotediff is the library API of remote-diff-tool, for Go programs
+// that embed collection and comparison instead of running the CLI.
+//
+// A Collector copies files from servers over SSH into an output directory and
+// returns the manifest of what it collected; an Analyzer compares the
+// collected copies and returns the Result:
+//
+//	c := remotediff.NewCollector("./out",
+//		remotediff.WithServers("web1", "web2"),
+//		remotediff.WithFiles("/etc/hosts"),
+//		remotediff.WithDirs("/etc/nginx"),
+//	)
+//	if _, err := c.Collect(ctx); err != nil {
+//		return err
+//	}
+//	result, err := remotediff.NewAnalyzer().Analyze(ctx, "./out")
+//
+// The output directory is laid out as the CLI's, so both can work on the same
+// one. The types below are the ones the CLI writes as manifest.json and as
+// the json report; fields are only ever added to them.
+//
+// The library is not safe for concurrent use: besides its options, a
+// collection reads process-wide settings (the SSH config file, config
+// decoding, extraction limits, the hash buffer, the bandwidth limit, retry
+// policies and the timing recorder), so run one Collector at a time.
+// Progress is logged through logrus' standard logger.
+package remotediff
+
+import (
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+)
+
+// Manifest lists the collected files of every server with their checksums
+type Manifest struct {
+	SchemaVersion int                            `json:"schema_version,omitempty"`
+	FilesByServer map[string]map[string]FileInfo `json:"files_by_server"` // server -> relative path -> FileInfo
+	Unprivileged  map[string]bool                `json:"unprivileged,omitempty"`
+	Annotation    *RunAnnotation                 `json:"annotation,omitempty"`
+	Methods       map[string]string              `json:"methods,omitempty"` // server -> MethodScript or MethodSFTP
+	Failed        map[string]string              `json:"failed,omitempty"`  // server -> why it failed, with WithAllowPartial
+}
+
+// newManifest returns the fields of a loaded manifest, which nothing else
+// holds, without its lock
+func newManifest(m *config.Manifest) *Manifest {
+	return &Manifest{
+		SchemaVersion: m.SchemaVersion,
+		FilesByServer: m.FilesByServer,
+		Unprivileged:  m.Unprivileged,
+		Annotation:    m.Annotation,
+		Methods:       m.Methods,
+		Failed:        m.Failed,
+	}
+}
+
+// FileInfo is one collected file of one server in the Manifest
+type FileInfo = config.FileInfo
+
+// RunAnnotation is the note and labels a Manifest was collected with
+type RunAnnotation = config.RunAnnotation
+
+// Result is the outcome of an analysis: a FileResult per compared file and
+// a summary
+type Result = report.Report
+
+// FileResult is the comparison of one file across the servers
+type FileResult = report.FileResult
+
+// Summary counts the files of a Result by outcome
+type Summary = report.Summary
+
+// File statuses of a FileResult
+const (
+	StatusIdentical    = report.StatusIdentical
+	StatusDifferent    = report.StatusDifferent
+	StatusFormatOnly   = report.StatusFormatOnly
+	StatusMetadataOnly = report.StatusMetadataOnly
+	StatusMoved        = report.StatusMoved
+	StatusError        = report.StatusError
+)
+
+// LoadManifest reads the manifest of an output directory
+func LoadManifest(outputDir string) (*Manifest, error) {
+	m, err := config.LoadManifest(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	return newManifest(m), nil
+}
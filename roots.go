@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/report"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	analyzeRoots   []string // Output dirs analyze compares with each other, as [label=]dir
+	rootServers    []string // Servers of the roots to compare; all when empty
+	keepRootsMerge bool     // Keep the merged roots instead of deleting them
+)
+
+// parseRoot parses a --root value, dir or label=dir. The label defaults to
+// the dir's base name.
+func parseRoot(s string) (analyze.Run, error) {
+	label, dir, ok := strings.Cut(s, "=")
+	if !ok || strings.ContainsAny(label, "/\\") {
+		label, dir = "", s
+	}
+	if dir == "" {
+		return analyze.Run{}, fmt.Errorf("invalid --root %q (expected dir or label=dir)", s)
+	}
+	if label == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return analyze.Run{}, errors.Wrapf(err, "failed to resolve %s", dir)
+		}
+		label = filepath.Base(abs)
+	}
+	return analyze.Run{Dir: dir, Label: label}, nil
+}
+
+// analyzeAcrossRoots compares the servers of the --root output dirs with
+// each other and writes the report. The comparison settings are those of
+// the first root's config. Like history, the report isn't exported.
+func analyzeAcrossRoots(opts analyze.Options) error {
+	if len(analyzeRoots) < 2 {
+		return fmt.Errorf("--root needs at least 2 output directories")
+	}
+	if !report.ValidFormat(outputFormat) {
+		return fmt.Errorf("unknown output format %q", outputFormat)
+	}
+	var runs []analyze.Run
+	for _, s := range analyzeRoots {
+		run, err := parseRoot(s)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	cfg, err := config.LoadConfigForAnalysis(runs[0].Dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the config of %s", runs[0].Dir)
+	}
+	if err := checkFileScope(cfg, opts); err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("", "remote-diff-roots-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create working directory")
+	}
+	if keepRootsMerge {
+		log.Infof("Keeping the merged collections in %s", workDir)
+	} else {
+		defer os.RemoveAll(workDir)
+	}
+
+	rep, err := analyze.CompareRoots(cfg, runs, rootServers, workDir, opts)
+	if rep == nil {
+		return err
+	}
+	if writeErr := report.Write(os.Stdout, rep, outputFormat); writeErr != nil {
+		return writeErr
+	}
+	if err != nil {
+		return fmt.Errorf("analysis failed: %w", err)
+	}
+	setExitStatus(rep)
+	if rep.HasDifferences() {
+		log.Warn("Analysis finished: Differences found.")
+	} else {
+		log.Info("Analysis finished: No differences found.")
+	}
+	return nil
+}
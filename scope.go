@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/analyze"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scopeServers narrows cfg.Servers to those of analyze --servers, which may
+// name @groups of the config. Each must be one of the collected servers; they
+// are compared in the config's order.
+func scopeServers(cfg *config.Config) error {
+	if serversStr == "" {
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for _, entry := range strings.Split(serversStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.HasPrefix(entry, config.GroupPrefix) {
+			wanted[entry] = true
+			continue
+		}
+		members, ok := cfg.Groups[strings.TrimPrefix(entry, config.GroupPrefix)]
+		if !ok {
+			return fmt.Errorf("unknown server group %s", entry)
+		}
+		for _, m := range members {
+			wanted[m] = true
+		}
+	}
+	var servers []string
+	for _, s := range cfg.Servers {
+		if wanted[s] {
+			servers = append(servers, s)
+			delete(wanted, s)
+		}
+	}
+	if len(wanted) > 0 {
+		unknown := make([]string, 0, len(wanted))
+		for s := range wanted {
+			unknown = append(unknown, s)
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("%s not among the collected servers (%s)", strings.Join(unknown, ", "), strings.Join(cfg.Servers, ", "))
+	}
+	if len(servers) < 2 {
+		return fmt.Errorf("--servers needs at least 2 servers to compare")
+	}
+	log.Infof("Comparing %d of the %d collected server(s): %s", len(servers), len(cfg.Servers), strings.Join(servers, ", "))
+	cfg.Servers = servers
+	return nil
+}
+
+// scopedAnalysisOptions returns analysisOptions, only comparing the files
+// named by analyze --files and those below --dirs
+func scopedAnalysisOptions() (analyze.Options, error) {
+	opts := analysisOptions()
+	var err error
+	if opts.Files, err = scopePaths(filesStr); err != nil {
+		return opts, err
+	}
+	if opts.Within, err = scopePaths(dirsStr); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// scopePaths cleans the comma-separated paths of --files or --dirs
+func scopePaths(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var paths []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "/") && !config.IsHomePath(p) {
+			return nil, fmt.Errorf("invalid path %q: must be absolute or start with ~/", p)
+		}
+		if config.IsHomePath(p) {
+			p = "~" + path.Clean(strings.TrimPrefix(p, "~"))
+		} else {
+			p = path.Clean(p)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// checkFileScope rejects an analyze --files path that is one of cfg's
+// directories: --files only matches files, so it would compare nothing
+func checkFileScope(cfg *config.Config, opts analyze.Options) error {
+	for _, p := range opts.Files {
+		for _, dir := range cfg.Dirs {
+			if p == dir {
+				return fmt.Errorf("--files %s is a configured directory; use --dirs to compare the files below it", p)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brndnsvr/remote-diff-tool/internal/collect"
+	"github.com/brndnsvr/remote-diff-tool/internal/config"
+	"github.com/brndnsvr/remote-diff-tool/internal/keyring"
+	"github.com/brndnsvr/remote-diff-tool/internal/util"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// Where --sudo-password reads the sudo password from
+const (
+	sudoPasswordEnv     = "env"     // $SSHSUDOPASS
+	sudoPasswordPrompt  = "prompt"  // Asked once on the terminal
+	sudoPasswordKeyring = "keyring" // See keyring.Lookup; the account is the SSH user
+)
+
+// sudoPasswordEnvVar holds the password for --sudo-password env
+const sudoPasswordEnvVar = "SSHSUDOPASS"
+
+var (
+	sudoPasswordFrom string
+	sudoPassword     *string // Read once, so a prompt isn't repeated for every run of watch or serve
+)
+
+// applyBecome checks --become and puts the sudo password from --sudo-password into cfg
+func applyBecome(cfg *config.Config) error {
+	if err := util.ValidateBecome(collect.Become); err != nil {
+		return err
+	}
+	if sudoPasswordFrom == "" || replayDir != "" {
+		return nil // A replay answers without a password
+	}
+	if sudoPassword == nil {
+		password, err := readSudoPassword(sudoPasswordFrom, cfg.SSHConfig.Username)
+		if err != nil {
+			return err
+		}
+		sudoPassword = &password
+	}
+	cfg.SSHConfig.SudoPassword = *sudoPassword
+	return nil
+}
+
+// readSudoPassword reads the sudo password of user from source
+func readSudoPassword(source, user string) (string, error) {
+	var password string
+	switch source {
+	case sudoPasswordEnv:
+		password = os.Getenv(sudoPasswordEnvVar)
+		if password == "" {
+			return "", fmt.Errorf("--sudo-password env needs $%s", sudoPasswordEnvVar)
+		}
+	case sudoPasswordPrompt:
+		var err error
+		if password, err = promptSecret("--sudo-password", fmt.Sprintf("Sudo password for %s: ", user)); err != nil {
+			return "", err
+		}
+	case sudoPasswordKeyring:
+		var err error
+		if password, err = keyring.Lookup(user); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("invalid --sudo-password %q (expected %s, %s or %s)", source, sudoPasswordEnv, sudoPasswordPrompt, sudoPasswordKeyring)
+	}
+	if password == "" {
+		return "", fmt.Errorf("the sudo password from %s is empty", source)
+	}
+	if strings.ContainsAny(password, "\r\n") {
+		return "", fmt.Errorf("the sudo password from %s spans several lines", source)
+	}
+	return password, nil
+}
+
+// promptSecret asks for a secret on the terminal without echoing it
+func promptSecret(flag, prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("%s prompt needs a terminal; use env or keyring instead", flag)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	data, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read from the terminal")
+	}
+	return string(data), nil
+}